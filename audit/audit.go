@@ -0,0 +1,66 @@
+package audit
+
+import (
+	"time"
+)
+
+// Actions recorded in the audit trail
+const (
+	Connect     = "connect"
+	Publish     = "publish"
+	Subscribe   = "subscribe"
+	Will        = "will"
+	AddUser     = "adduser"
+	SetRights   = "setrights"
+	DeleteUser  = "deleteuser"
+	DisableUser = "disableuser"
+	EnableUser  = "enableuser"
+	Lockout     = "lockout"
+)
+
+// Decisions recorded in the audit trail. Allow and Deny are used for access
+// decisions, Success and Failure for changes to users.
+const (
+	Allow   = "allow"
+	Deny    = "deny"
+	Success = "success"
+	Failure = "failure"
+)
+
+// Event is a single authentication, authorization or user management decision
+type Event struct {
+	Time     time.Time `json:"time"`
+	ClientID string    `json:"clientid,omitempty"`
+	Username string    `json:"username,omitempty"`
+	Remote   string    `json:"remote,omitempty"`
+	Action   string    `json:"action"`
+	Topic    string    `json:"topic,omitempty"`
+	Decision string    `json:"decision"`
+	Reason   string    `json:"reason,omitempty"`
+}
+
+type Sink interface {
+	// Audit records an event. Implementations must be safe for concurrent use
+	Audit(e Event)
+}
+
+// Multi sends every event to each of the given sinks
+type Multi []Sink
+
+func (m Multi) Audit(e Event) {
+	for _, s := range m {
+		s.Audit(e)
+	}
+}
+
+// Record fills in the event time, if not set, and sends the event to the
+// sink. A nil sink is allowed, and discards the event.
+func Record(s Sink, e Event) {
+	if s == nil {
+		return
+	}
+	if e.Time.IsZero() {
+		e.Time = time.Now().UTC()
+	}
+	s.Audit(e)
+}
@@ -0,0 +1,115 @@
+package file
+
+import (
+	"encoding/json"
+	"github.com/trafero/tstack/audit"
+	"github.com/trafero/tstack/logging"
+	"os"
+	"strconv"
+	"sync"
+)
+
+var logger = logging.New("audit")
+
+// File writes audit events as JSON lines, rotating the file once it reaches
+// a maximum size. Rotated files are named <path>.1 (newest) to
+// <path>.<backups> (oldest).
+type File struct {
+	mutex   sync.Mutex
+	path    string
+	maxSize int64
+	backups int
+	file    *os.File
+	size    int64
+}
+
+// New opens (or creates) the audit file at path. Files are rotated when
+// they would exceed maxSize bytes, keeping the given number of backups. A
+// maxSize of zero disables rotation.
+func New(path string, maxSize int64, backups int) (f *File, err error) {
+	f = &File{
+		path:    path,
+		maxSize: maxSize,
+		backups: backups,
+	}
+	if err = f.open(); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+func (f *File) open() (err error) {
+	f.file, err = os.OpenFile(f.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return err
+	}
+	info, err := f.file.Stat()
+	if err != nil {
+		f.file.Close()
+		return err
+	}
+	f.size = info.Size()
+	return nil
+}
+
+// Audit writes the event as a single JSON line
+func (f *File) Audit(e audit.Event) {
+	line, err := json.Marshal(e)
+	if err != nil {
+		logger.Error("Could not encode audit event", "error", err)
+		return
+	}
+	line = append(line, '\n')
+
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	if f.maxSize > 0 && f.size > 0 && f.size+int64(len(line)) > f.maxSize {
+		if err := f.rotate(); err != nil {
+			logger.Error("Could not rotate audit file", "file", f.path, "error", err)
+		}
+	}
+	if f.file == nil {
+		if err := f.open(); err != nil {
+			logger.Error("Could not open audit file", "file", f.path, "error", err)
+			return
+		}
+	}
+	n, err := f.file.Write(line)
+	f.size += int64(n)
+	if err != nil {
+		logger.Error("Could not write audit event", "file", f.path, "error", err)
+	}
+}
+
+// rotate must be called with the mutex held
+func (f *File) rotate() error {
+	f.file.Close()
+	f.file = nil
+
+	if f.backups > 0 {
+		// Shift <path>.n to <path>.n+1, dropping the oldest
+		os.Remove(f.path + "." + strconv.Itoa(f.backups))
+		for i := f.backups - 1; i > 0; i-- {
+			os.Rename(f.path+"."+strconv.Itoa(i), f.path+"."+strconv.Itoa(i+1))
+		}
+		if err := os.Rename(f.path, f.path+".1"); err != nil {
+			return err
+		}
+	} else if err := os.Remove(f.path); err != nil {
+		return err
+	}
+	return f.open()
+}
+
+// Close closes the underlying file
+func (f *File) Close() error {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	if f.file == nil {
+		return nil
+	}
+	err := f.file.Close()
+	f.file = nil
+	return err
+}
@@ -0,0 +1,47 @@
+package file
+
+import (
+	"bufio"
+	"encoding/json"
+	"github.com/trafero/tstack/audit"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestRotate(t *testing.T) {
+	dir, err := ioutil.TempDir("", "audit")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "audit.log")
+
+	f, err := New(path, 200, 2)
+	if err != nil {
+		t.Fatal("Error opening audit file", err)
+	}
+	for i := 0; i < 10; i++ {
+		audit.Record(f, audit.Event{Username: "user", Action: audit.Connect, Decision: audit.Allow})
+	}
+	f.Close()
+
+	for _, p := range []string{path, path + ".1", path + ".2"} {
+		r, err := os.Open(p)
+		if err != nil {
+			t.Fatal("Expected rotated file", p)
+		}
+		scanner := bufio.NewScanner(r)
+		for scanner.Scan() {
+			var e audit.Event
+			if err := json.Unmarshal(scanner.Bytes(), &e); err != nil {
+				t.Error("Expected a JSON event per line", err)
+			}
+		}
+		r.Close()
+	}
+	if _, err := os.Stat(path + ".3"); !os.IsNotExist(err) {
+		t.Error("Expected only 2 backups")
+	}
+}
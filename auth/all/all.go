@@ -47,3 +47,19 @@ func (t *All) Rights(username string) (rights string) {
 func (t *All) UserExists(username string) bool {
 	return true
 }
+
+func (t *All) DeleteUser(username string) (err error) {
+	return nil
+}
+
+func (t *All) DisableUser(username string) (err error) {
+	return nil
+}
+
+func (t *All) EnableUser(username string) (err error) {
+	return nil
+}
+
+func (t *All) ListUsers(prefix string, after string, limit int) (users []auth.User, err error) {
+	return nil, nil
+}
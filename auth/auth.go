@@ -1,11 +1,20 @@
 package auth
 
+import (
+	"errors"
+	"time"
+)
+
+// Returned by back ends for users that don't exist
+var ErrUserNotFound = errors.New("User not found")
+
 // User struct uses typical user access naming conventions to try and make this
 // generic, however it can also fit the needs of devices
 type User struct {
 	Username string // Device name
 	Password string // Password hash
 	Rights   string // User rights - may be string reg ex for topics
+	Disabled bool   `json:",omitempty"` // Disabled users can't authenticate
 }
 
 type Auth interface {
@@ -26,4 +35,47 @@ type Auth interface {
 
 	// Check that a given username exists
 	UserExists(username string) bool
+
+	// DeleteUser removes a user
+	DeleteUser(username string) (err error)
+
+	// DisableUser stops a user authenticating, keeping their details
+	DisableUser(username string) (err error)
+
+	// EnableUser lets a disabled user authenticate again
+	EnableUser(username string) (err error)
+
+	// ListUsers returns up to limit users whose usernames start with prefix,
+	// in username order, starting after the username given in after. A
+	// limit of 0 returns all of them
+	ListUsers(prefix string, after string, limit int) (users []User, err error)
+}
+
+// Notifier is implemented by back ends that can tell when users are changed
+// elsewhere, e.g. by tuser, so that copies can be dropped at once
+type Notifier interface {
+	// WatchUsers calls changed with the username of each user changed, or
+	// with "" when changes may have been missed, until stop is closed
+	WatchUsers(stop <-chan struct{}, changed func(username string))
+}
+
+// Session is what a back end knows of a client from its credentials alone,
+// such as from a token. Clients whose credentials expire keep the rights
+// given here until then, as the back end may not know the user otherwise
+type Session struct {
+	Username string
+	Rights   string
+	Expires  time.Time // When the credentials expire. Zero if they don't
+}
+
+/*
+ * SessionAuthenticator is implemented by back ends whose credentials carry
+ * the user's details, such as tokens. The broker uses it instead of
+ * Authenticate and Rights, so that clients can be disconnected when their
+ * credentials expire
+ */
+type SessionAuthenticator interface {
+	// AuthenticateSession checks the credentials, returning the session
+	// they give. An empty username is taken from the credentials
+	AuthenticateSession(username string, password string) (s Session, ok bool)
 }
@@ -0,0 +1,124 @@
+// Package authtest provides an in-memory auth.Auth for tests
+package authtest
+
+import (
+	"github.com/trafero/tstack/auth"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// Auth keeps users and plain text passwords in memory
+type Auth struct {
+	mutex sync.Mutex
+	users map[string]auth.User
+}
+
+func New() *Auth {
+	return &Auth{users: make(map[string]auth.User)}
+}
+
+// NewUser returns an Auth with one user
+func NewUser(username string, password string, rights string) *Auth {
+	a := New()
+	a.AddOrUpdateUser(username, password)
+	a.SetRights(username, rights)
+	return a
+}
+
+func (a *Auth) User(username string) (u auth.User, err error) {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	u, ok := a.users[username]
+	if !ok {
+		return u, auth.ErrUserNotFound
+	}
+	return u, nil
+}
+
+func (a *Auth) Authenticate(username string, password string) bool {
+	u, err := a.User(username)
+	return err == nil && !u.Disabled && u.Password == password
+}
+
+func (a *Auth) AddOrUpdateUser(username string, password string) (err error) {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	u := a.users[username]
+	u.Username = username
+	u.Password = password
+	a.users[username] = u
+	return nil
+}
+
+func (a *Auth) SetRights(username string, rights string) (err error) {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	u, ok := a.users[username]
+	if !ok {
+		return auth.ErrUserNotFound
+	}
+	u.Rights = rights
+	a.users[username] = u
+	return nil
+}
+
+func (a *Auth) Rights(username string) (rights string) {
+	u, _ := a.User(username)
+	return u.Rights
+}
+
+func (a *Auth) UserExists(username string) bool {
+	_, err := a.User(username)
+	return err == nil
+}
+
+func (a *Auth) DeleteUser(username string) (err error) {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	if _, ok := a.users[username]; !ok {
+		return auth.ErrUserNotFound
+	}
+	delete(a.users, username)
+	return nil
+}
+
+func (a *Auth) DisableUser(username string) (err error) {
+	return a.setDisabled(username, true)
+}
+
+func (a *Auth) EnableUser(username string) (err error) {
+	return a.setDisabled(username, false)
+}
+
+func (a *Auth) setDisabled(username string, disabled bool) (err error) {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	u, ok := a.users[username]
+	if !ok {
+		return auth.ErrUserNotFound
+	}
+	u.Disabled = disabled
+	a.users[username] = u
+	return nil
+}
+
+func (a *Auth) ListUsers(prefix string, after string, limit int) (users []auth.User, err error) {
+	a.mutex.Lock()
+	var usernames []string
+	for username := range a.users {
+		if strings.HasPrefix(username, prefix) && username > after {
+			usernames = append(usernames, username)
+		}
+	}
+	a.mutex.Unlock()
+	sort.Strings(usernames)
+	if limit > 0 && len(usernames) > limit {
+		usernames = usernames[:limit]
+	}
+	for _, username := range usernames {
+		u, _ := a.User(username)
+		users = append(users, u)
+	}
+	return users, nil
+}
@@ -0,0 +1,285 @@
+/*
+ * Package cache keeps the results of another auth back end for a time, so
+ * that a storm of reconnects doesn't mean a storm of database lookups and
+ * bcrypt comparisons. Back ends that implement auth.Notifier, such as etcd,
+ * have changed users dropped from the cache at once.
+ */
+package cache
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"github.com/trafero/tstack/auth"
+	"github.com/trafero/tstack/logging"
+	"sync"
+	"time"
+)
+
+var logger = logging.New("auth")
+
+// How long results are kept, by default
+const DefaultTTL = time.Minute
+
+type entry struct {
+	user    auth.User
+	hasUser bool
+	rights  string
+	// Set if rights is known
+	hasRights bool
+	// Keyed hash of the last password to authenticate, or nil
+	password []byte
+	expires  time.Time
+}
+
+// Cache is an auth.Auth that keeps the results of another
+type Cache struct {
+	next auth.Auth
+	ttl  time.Duration
+	key  []byte // For hashing passwords, so they aren't held in memory
+
+	mutex   sync.Mutex
+	entries map[string]*entry // By username
+	gen     uint64            // Incremented by Invalidate
+	stop    chan struct{}     // Closed by Close
+	// Told of changes after they are dropped, by WatchUsers
+	watchers []watcher
+}
+
+// watcher is told of changes by Invalidate, until stop is closed
+type watcher struct {
+	stop    <-chan struct{}
+	changed func(username string)
+}
+
+/*
+ * New returns a Cache of next, keeping user records, rights and successful
+ * authentications for ttl. Failed authentications are not kept, so that new
+ * users and passwords work at once. If next is an auth.Notifier, changed
+ * users are dropped when it says so
+ */
+func New(next auth.Auth, ttl time.Duration) *Cache {
+	if ttl <= 0 {
+		ttl = DefaultTTL
+	}
+	c := &Cache{
+		next:    next,
+		ttl:     ttl,
+		key:     make([]byte, 32),
+		entries: make(map[string]*entry),
+		stop:    make(chan struct{}),
+	}
+	if _, err := rand.Read(c.key); err != nil {
+		logger.Fatal("Could not make cache key", "error", err)
+	}
+	if n, ok := next.(auth.Notifier); ok {
+		n.WatchUsers(c.stop, c.Invalidate)
+	}
+	go c.sweep()
+	return c
+}
+
+// Close stops watching for changes
+func (c *Cache) Close() {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	select {
+	case <-c.stop:
+	default:
+		close(c.stop)
+	}
+}
+
+/*
+ * Invalidate drops a user from the cache, or all users if username is "",
+ * then tells anything watching for changes with WatchUsers
+ */
+func (c *Cache) Invalidate(username string) {
+	c.mutex.Lock()
+	c.gen++
+	if username == "" {
+		c.entries = make(map[string]*entry)
+		logger.Debug("Cache cleared")
+	} else {
+		delete(c.entries, username)
+		logger.Debug("Cached user dropped", "username", username)
+	}
+	var watching []watcher
+	for _, w := range c.watchers {
+		select {
+		case <-w.stop:
+		default:
+			watching = append(watching, w)
+		}
+	}
+	c.watchers = watching
+	c.mutex.Unlock()
+	for _, w := range watching {
+		w.changed(username)
+	}
+}
+
+/*
+ * WatchUsers calls changed with the username of each user dropped from the
+ * cache, or "" if all are dropped, until stop is closed. Users are dropped
+ * first, so changed sees them as they are now
+ */
+func (c *Cache) WatchUsers(stop <-chan struct{}, changed func(username string)) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.watchers = append(c.watchers, watcher{stop: stop, changed: changed})
+}
+
+// sweep drops expired entries every ttl, until Close is called
+func (c *Cache) sweep() {
+	ticker := time.NewTicker(c.ttl)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-c.stop:
+			return
+		}
+		now := time.Now()
+		c.mutex.Lock()
+		for username, e := range c.entries {
+			if now.After(e.expires) {
+				delete(c.entries, username)
+			}
+		}
+		c.mutex.Unlock()
+	}
+}
+
+/*
+ * lookup returns a copy of the unexpired entry for a user, or an empty one,
+ * and the generation to give update with anything then read from the back
+ * end
+ */
+func (c *Cache) lookup(username string) (entry, uint64) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	e, ok := c.entries[username]
+	if !ok || time.Now().After(e.expires) {
+		return entry{}, c.gen
+	}
+	return *e, c.gen
+}
+
+/*
+ * update changes the entry for a user, starting a new one if there's no
+ * unexpired entry. Nothing is changed if Invalidate has been called since
+ * gen was returned by lookup, as what was read may already be out of date
+ */
+func (c *Cache) update(username string, gen uint64, f func(e *entry)) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if gen != c.gen {
+		return
+	}
+	e, ok := c.entries[username]
+	if !ok || time.Now().After(e.expires) {
+		e = &entry{expires: time.Now().Add(c.ttl)}
+		c.entries[username] = e
+	}
+	f(e)
+}
+
+func (c *Cache) hash(password string) []byte {
+	mac := hmac.New(sha256.New, c.key)
+	mac.Write([]byte(password))
+	return mac.Sum(nil)
+}
+
+// Returns user object for a given username
+func (c *Cache) User(username string) (u auth.User, err error) {
+	e, gen := c.lookup(username)
+	if e.hasUser {
+		return e.user, nil
+	}
+	u, err = c.next.User(username)
+	if err != nil {
+		return u, err
+	}
+	c.update(username, gen, func(e *entry) {
+		e.user, e.hasUser = u, true
+	})
+	return u, nil
+}
+
+// Authenticate checks the password against the last one to succeed, or
+// with the back end if there isn't one
+func (c *Cache) Authenticate(username string, password string) bool {
+	hash := c.hash(password)
+	e, gen := c.lookup(username)
+	if e.password != nil && hmac.Equal(e.password, hash) {
+		logger.Debug("Authenticated from cache", "username", username)
+		return true
+	}
+	if !c.next.Authenticate(username, password) {
+		return false
+	}
+	c.update(username, gen, func(e *entry) {
+		e.password = hash
+	})
+	return true
+}
+
+// AddOrUdpdateUser adds or updates a user's password in the back end
+func (c *Cache) AddOrUpdateUser(username string, password string) (err error) {
+	err = c.next.AddOrUpdateUser(username, password)
+	c.Invalidate(username)
+	return err
+}
+
+// SetRights sets user rights in the back end
+func (c *Cache) SetRights(username string, rights string) (err error) {
+	err = c.next.SetRights(username, rights)
+	c.Invalidate(username)
+	return err
+}
+
+// Rights returns a string of allowed access rights
+func (c *Cache) Rights(username string) (rights string) {
+	e, gen := c.lookup(username)
+	if e.hasRights {
+		return e.rights
+	}
+	rights = c.next.Rights(username)
+	c.update(username, gen, func(e *entry) {
+		e.rights, e.hasRights = rights, true
+	})
+	return rights
+}
+
+// UserExists returns true if the user exists and false for anything else
+func (c *Cache) UserExists(username string) bool {
+	_, err := c.User(username)
+	return err == nil
+}
+
+// DeleteUser removes a user from the back end
+func (c *Cache) DeleteUser(username string) (err error) {
+	err = c.next.DeleteUser(username)
+	c.Invalidate(username)
+	return err
+}
+
+// DisableUser stops a user authenticating
+func (c *Cache) DisableUser(username string) (err error) {
+	err = c.next.DisableUser(username)
+	c.Invalidate(username)
+	return err
+}
+
+// EnableUser lets a disabled user authenticate again
+func (c *Cache) EnableUser(username string) (err error) {
+	err = c.next.EnableUser(username)
+	c.Invalidate(username)
+	return err
+}
+
+// ListUsers lists users from the back end. Lists are not cached
+func (c *Cache) ListUsers(prefix string, after string, limit int) (users []auth.User, err error) {
+	return c.next.ListUsers(prefix, after, limit)
+}
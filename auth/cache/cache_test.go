@@ -0,0 +1,108 @@
+package cache
+
+import (
+	"github.com/trafero/tstack/auth/authtest"
+	"sync"
+	"testing"
+	"time"
+)
+
+// counted counts calls to an authtest.Auth, and tells of changes made with
+// change
+type counted struct {
+	*authtest.Auth
+	mutex   sync.Mutex
+	calls   int
+	changed func(username string)
+}
+
+func (a *counted) count() {
+	a.mutex.Lock()
+	a.calls++
+	a.mutex.Unlock()
+}
+
+func (a *counted) Calls() int {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	return a.calls
+}
+
+func (a *counted) Authenticate(username string, password string) bool {
+	a.count()
+	return a.Auth.Authenticate(username, password)
+}
+
+func (a *counted) Rights(username string) string {
+	a.count()
+	return a.Auth.Rights(username)
+}
+
+func (a *counted) WatchUsers(stop <-chan struct{}, changed func(username string)) {
+	a.changed = changed
+}
+
+// change sets a user's password and rights behind the cache's back
+func (a *counted) change(username string, password string, rights string) {
+	a.Auth.AddOrUpdateUser(username, password)
+	a.Auth.SetRights(username, rights)
+	a.changed(username)
+}
+
+func TestCache(t *testing.T) {
+	next := &counted{Auth: authtest.NewUser("device", "secret", "device/#")}
+	c := New(next, time.Hour)
+	defer c.Close()
+
+	for i := 0; i < 3; i++ {
+		if !c.Authenticate("device", "secret") {
+			t.Fatal("Expected device to authenticate")
+		}
+		if r := c.Rights("device"); r != "device/#" {
+			t.Fatalf("Expected rights device/#, got %s", r)
+		}
+	}
+	if calls := next.Calls(); calls != 2 {
+		t.Errorf("Expected 2 calls to the back end, got %d", calls)
+	}
+
+	// Failures aren't kept, and don't replace the cached password
+	if c.Authenticate("device", "wrong") || c.Authenticate("device", "wrong") {
+		t.Error("Expected wrong password to fail")
+	}
+	if calls := next.Calls(); calls != 4 {
+		t.Errorf("Expected 4 calls to the back end, got %d", calls)
+	}
+
+	// Changes made elsewhere drop the user
+	next.change("device", "new", "device/+/temperature")
+	if c.Authenticate("device", "secret") {
+		t.Error("Expected old password to fail after change")
+	}
+	if !c.Authenticate("device", "new") {
+		t.Error("Expected new password to authenticate after change")
+	}
+	if r := c.Rights("device"); r != "device/+/temperature" {
+		t.Errorf("Expected new rights after change, got %s", r)
+	}
+
+	// As do changes made through the cache
+	c.SetRights("device", "#")
+	if r := c.Rights("device"); r != "#" {
+		t.Errorf("Expected rights # after SetRights, got %s", r)
+	}
+}
+
+func TestCacheExpiry(t *testing.T) {
+	next := &counted{Auth: authtest.NewUser("device", "secret", "device/#")}
+	c := New(next, 50*time.Millisecond)
+	defer c.Close()
+
+	c.Authenticate("device", "secret")
+	c.Authenticate("device", "secret")
+	time.Sleep(100 * time.Millisecond)
+	c.Authenticate("device", "secret")
+	if calls := next.Calls(); calls != 2 {
+		t.Errorf("Expected 2 calls to the back end, got %d", calls)
+	}
+}
@@ -0,0 +1,233 @@
+/*
+ * Package chain puts several auth back ends together, such as devices in
+ * etcd, administrators in a file and services with tokens, in one broker.
+ * Users are looked up in the first back end that knows them, which alone
+ * checks their password and gives their rights. Users no back end knows may
+ * still connect with credentials that carry the user, such as tokens.
+ * Changes to users all go to one back end, the writer.
+ */
+package chain
+
+import (
+	"errors"
+	"github.com/trafero/tstack/auth"
+	"github.com/trafero/tstack/logging"
+	"sort"
+)
+
+var logger = logging.New("auth")
+
+var (
+	ErrUserNotFound = auth.ErrUserNotFound
+	ErrReadOnly     = errors.New("No back end is set for changing users")
+)
+
+// Chain is an auth.Auth made of others, tried in order
+type Chain struct {
+	backends []auth.Auth
+	writer   auth.Auth
+}
+
+/*
+ * New returns a Chain of backends, in the order they are tried. Changes to
+ * users go to writer, which should be one of backends, or are refused with
+ * ErrReadOnly if writer is nil
+ */
+func New(writer auth.Auth, backends ...auth.Auth) *Chain {
+	return &Chain{backends: backends, writer: writer}
+}
+
+/*
+ * owner returns the first back end that knows the user. Errors other than
+ * ErrUserNotFound stop the search, rather than fall through to a back end
+ * that might know another user of the same name
+ */
+func (c *Chain) owner(username string) (a auth.Auth, u auth.User, err error) {
+	for _, a := range c.backends {
+		u, err = a.User(username)
+		if err == ErrUserNotFound {
+			continue
+		}
+		if err != nil {
+			logger.Warn("Could not retrieve user", "username", username, "error", err)
+		}
+		return a, u, err
+	}
+	return nil, auth.User{Username: username}, ErrUserNotFound
+}
+
+// User returns the user from the first back end that knows them
+func (c *Chain) User(username string) (u auth.User, err error) {
+	_, u, err = c.owner(username)
+	return u, err
+}
+
+// Authenticate returns true if the back end that knows the user accepts the
+// password
+func (c *Chain) Authenticate(username string, password string) bool {
+	_, ok := c.AuthenticateSession(username, password)
+	return ok
+}
+
+/*
+ * AuthenticateSession checks the credentials with the first back end that
+ * knows the user, so that the session has the same rights as Rights gives.
+ * If no back end knows the user, each back end that is an
+ * auth.SessionAuthenticator is tried in turn, and the session of the first
+ * to accept the credentials is returned, unless it is for a user another
+ * back end knows
+ */
+func (c *Chain) AuthenticateSession(username string, password string) (s auth.Session, ok bool) {
+	if username != "" {
+		a, _, err := c.owner(username)
+		if err == nil {
+			return authenticate(a, username, password)
+		}
+		if err != ErrUserNotFound {
+			return s, false
+		}
+	}
+	for _, a := range c.backends {
+		sa, isSession := a.(auth.SessionAuthenticator)
+		if !isSession {
+			continue
+		}
+		if s, ok = sa.AuthenticateSession(username, password); !ok {
+			continue
+		}
+		if s.Username != username && s.Username != "" {
+			if _, _, err := c.owner(s.Username); err != ErrUserNotFound {
+				logger.Warn("Credentials are for a user known to another back end", "username", s.Username)
+				return auth.Session{}, false
+			}
+		}
+		return s, true
+	}
+	return auth.Session{}, false
+}
+
+// authenticate checks the credentials with one back end, returning the
+// session they give
+func authenticate(a auth.Auth, username string, password string) (s auth.Session, ok bool) {
+	if sa, isSession := a.(auth.SessionAuthenticator); isSession {
+		return sa.AuthenticateSession(username, password)
+	}
+	if !a.Authenticate(username, password) {
+		return s, false
+	}
+	return auth.Session{Username: username, Rights: a.Rights(username)}, true
+}
+
+// Rights returns the rights from the first back end that knows the user, or
+// an empty string if none do
+func (c *Chain) Rights(username string) (rights string) {
+	a, _, err := c.owner(username)
+	if err != nil {
+		return ""
+	}
+	return a.Rights(username)
+}
+
+// UserExists returns true if any back end knows the user
+func (c *Chain) UserExists(username string) bool {
+	_, _, err := c.owner(username)
+	return err == nil
+}
+
+/*
+ * WatchUsers tells changed of changes from every back end that is an
+ * auth.Notifier. A change to a user is only passed on from the back end that
+ * knows them, or if no back end does, so that a user of the same name in a
+ * later back end does not affect them
+ */
+func (c *Chain) WatchUsers(stop <-chan struct{}, changed func(username string)) {
+	for _, a := range c.backends {
+		n, ok := a.(auth.Notifier)
+		if !ok {
+			continue
+		}
+		notifier := a
+		n.WatchUsers(stop, func(username string) {
+			if username != "" {
+				if owner, _, err := c.owner(username); err == nil && owner != notifier {
+					logger.Debug("Ignoring change to user known to another back end", "username", username)
+					return
+				}
+			}
+			changed(username)
+		})
+	}
+}
+
+// AddOrUpdateUser adds or updates the user in the writer
+func (c *Chain) AddOrUpdateUser(username string, password string) (err error) {
+	if c.writer == nil {
+		return ErrReadOnly
+	}
+	return c.writer.AddOrUpdateUser(username, password)
+}
+
+// SetRights sets the user's rights in the writer
+func (c *Chain) SetRights(username string, rights string) (err error) {
+	if c.writer == nil {
+		return ErrReadOnly
+	}
+	return c.writer.SetRights(username, rights)
+}
+
+// DeleteUser removes the user from the writer
+func (c *Chain) DeleteUser(username string) (err error) {
+	if c.writer == nil {
+		return ErrReadOnly
+	}
+	return c.writer.DeleteUser(username)
+}
+
+// DisableUser disables the user in the writer
+func (c *Chain) DisableUser(username string) (err error) {
+	if c.writer == nil {
+		return ErrReadOnly
+	}
+	return c.writer.DisableUser(username)
+}
+
+// EnableUser enables the user in the writer
+func (c *Chain) EnableUser(username string) (err error) {
+	if c.writer == nil {
+		return ErrReadOnly
+	}
+	return c.writer.EnableUser(username)
+}
+
+/*
+ * ListUsers returns users from all back ends that can list them, sorted by
+ * username. A user in more than one back end is listed as the first knows
+ * them. If no back end can list users, the last error is returned
+ */
+func (c *Chain) ListUsers(prefix string, after string, limit int) (users []auth.User, err error) {
+	seen := make(map[string]bool)
+	listed := false
+	for _, a := range c.backends {
+		list, listErr := a.ListUsers(prefix, after, limit)
+		if listErr != nil {
+			logger.Debug("Could not list users", "error", listErr)
+			err = listErr
+			continue
+		}
+		listed = true
+		for _, u := range list {
+			if !seen[u.Username] {
+				seen[u.Username] = true
+				users = append(users, u)
+			}
+		}
+	}
+	if !listed {
+		return nil, err
+	}
+	sort.Slice(users, func(i, j int) bool { return users[i].Username < users[j].Username })
+	if limit > 0 && len(users) > limit {
+		users = users[:limit]
+	}
+	return users, nil
+}
@@ -0,0 +1,103 @@
+package chain
+
+import (
+	"github.com/trafero/tstack/auth"
+	"github.com/trafero/tstack/auth/authtest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// tokens accepts the password "token" for any user, with rights of their own
+type tokens struct {
+	*authtest.Auth
+}
+
+func (a tokens) AuthenticateSession(username string, password string) (s auth.Session, ok bool) {
+	if password != "token" {
+		return s, false
+	}
+	return auth.Session{Username: username, Rights: "services/#", Expires: time.Now().Add(time.Minute)}, true
+}
+
+// notifier tells of changes to its users when told to
+type notifier struct {
+	*authtest.Auth
+	changed func(username string)
+}
+
+func (n *notifier) WatchUsers(stop <-chan struct{}, changed func(username string)) {
+	n.changed = changed
+}
+
+func TestChain(t *testing.T) {
+	devices := authtest.NewUser("ABC-123", "secret", "ABC-123/#")
+	admins := authtest.NewUser("admin", "admin-secret", "#")
+	admins.AddOrUpdateUser("ABC-123", "other")
+	admins.SetRights("ABC-123", "#")
+	services := tokens{authtest.New()}
+	c := New(devices, devices, admins, services)
+
+	if !c.Authenticate("ABC-123", "secret") || !c.Authenticate("admin", "admin-secret") {
+		t.Error("Expected users of both back ends to authenticate")
+	}
+	if c.Authenticate("admin", "secret") {
+		t.Error("Expected wrong password to fail")
+	}
+	// Users are looked up in the first back end that knows them
+	if rights := c.Rights("ABC-123"); rights != "ABC-123/#" {
+		t.Errorf("Expected rights from the first back end, got %q", rights)
+	}
+	if rights := c.Rights("admin"); rights != "#" {
+		t.Errorf("Expected rights from the second back end, got %q", rights)
+	}
+	if _, err := c.User("XYZ-789"); err != ErrUserNotFound || c.UserExists("XYZ-789") {
+		t.Errorf("Expected unknown user not to be found, got %v", err)
+	}
+
+	// Only the back end that knows the user checks their password, so
+	// sessions have the rights Rights gives
+	if s, ok := c.AuthenticateSession("ABC-123", "secret"); !ok || s.Rights != "ABC-123/#" {
+		t.Errorf("Expected session with the first back end's rights, got %v, %v", s, ok)
+	}
+	if c.Authenticate("ABC-123", "other") || c.Authenticate("admin", "token") {
+		t.Error("Expected password of a later back end not to authenticate")
+	}
+	if s, ok := c.AuthenticateSession("billing", "token"); !ok || s.Rights != "services/#" || s.Expires.IsZero() {
+		t.Errorf("Expected session from the token back end, got %v, %v", s, ok)
+	}
+
+	// Changes go to the writer
+	if err := c.AddOrUpdateUser("XYZ-789", "secret"); err != nil || !devices.UserExists("XYZ-789") || admins.UserExists("XYZ-789") {
+		t.Errorf("Expected new user in the first back end only, got %v", err)
+	}
+	list, err := c.ListUsers("", "", 2)
+	if err != nil || len(list) != 2 || list[0].Username != "ABC-123" || list[0].Rights != "ABC-123/#" || list[1].Username != "XYZ-789" {
+		t.Errorf("Expected ABC-123 and XYZ-789 listed, got %v, %v", list, err)
+	}
+
+	if err := New(nil, devices).DeleteUser("ABC-123"); err != ErrReadOnly {
+		t.Errorf("Expected changes to be refused without a writer, got %v", err)
+	}
+}
+
+func TestWatchUsers(t *testing.T) {
+	devices := &notifier{Auth: authtest.NewUser("ABC-123", "secret", "ABC-123/#")}
+	admins := &notifier{Auth: authtest.NewUser("ABC-123", "other", "#")}
+	admins.AddOrUpdateUser("admin", "admin-secret")
+	c := New(devices, devices, admins)
+
+	var changed []string
+	c.WatchUsers(make(chan struct{}), func(username string) {
+		changed = append(changed, username)
+	})
+	// Changes are only passed on from the back end that knows the user
+	admins.changed("ABC-123")
+	devices.changed("ABC-123")
+	admins.changed("admin")
+	admins.changed("")
+	devices.changed("XYZ-789")
+	if strings.Join(changed, ",") != "ABC-123,admin,,XYZ-789" {
+		t.Errorf("Expected changes from the owning back ends, got %q", changed)
+	}
+}
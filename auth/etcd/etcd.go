@@ -3,13 +3,18 @@ package etcd
 import (
 	"encoding/json"
 	"github.com/coreos/etcd/client"
+	"github.com/trafero/tstack/audit"
 	"github.com/trafero/tstack/auth"
+	"github.com/trafero/tstack/logging"
 	"golang.org/x/crypto/bcrypt"
 	"golang.org/x/net/context"
-	"log"
+	"path"
+	"strings"
 	"time"
 )
 
+var logger = logging.New("auth")
+
 // String to represent no user rights
 const NO_RIGHTS = "^$"
 
@@ -18,6 +23,7 @@ type Etcd struct {
 	etcdConfig client.Config
 	etcdClient client.Client
 	etcdApi    client.KeysAPI
+	audit      audit.Sink // Audit trail of user changes. May be nil
 }
 
 // New returns a pointer to an Auth struct. Endpoints are an array of etcd
@@ -41,6 +47,11 @@ func New(endpoints []string) (a *Etcd, err error) {
 	return a, nil
 }
 
+// SetAudit sets the sink for recording user changes
+func (t *Etcd) SetAudit(s audit.Sink) {
+	t.audit = s
+}
+
 // Returns user object for a given username
 func (t *Etcd) User(username string) (u auth.User, err error) {
 	var resp *client.Response
@@ -56,8 +67,10 @@ func (t *Etcd) User(username string) (u auth.User, err error) {
 		"/user/"+username,
 		nil,
 	)
-	if err != nil {
-		log.Printf("Could not retrieve user %s from the database: %s", username, err)
+	if client.IsKeyNotFound(err) {
+		return u, auth.ErrUserNotFound
+	} else if err != nil {
+		logger.Warn("Could not retrieve user from the database", "username", username, "error", err)
 		return u, err
 	}
 
@@ -83,10 +96,10 @@ func (t *Etcd) setUser(u auth.User) (err error) {
 		nil,
 	)
 	if err != nil {
-		log.Printf("Error saving user %s: %s", u.Username, err)
+		logger.Error("Error saving user", "username", u.Username, "error", err)
 		return err
 	}
-	log.Printf("User %s saved", u.Username)
+	logger.Info("User saved", "username", u.Username)
 
 	return nil
 }
@@ -96,23 +109,27 @@ func (t *Etcd) Authenticate(username string, password string) bool {
 
 	u, err := t.User(username)
 	if err != nil {
-		log.Printf("Error retrtieving user: %s", err)
+		logger.Debug("Error retrieving user", "username", username, "error", err)
 		return false
 	}
 
 	// Password never set
 	if u.Password == "" {
-		log.Printf("No password set for user: %s", username)
+		logger.Warn("No password set for user", "username", username)
+		return false
+	}
+	if u.Disabled {
+		logger.Debug("User disabled", "username", username)
 		return false
 	}
 	// log.Printf("Got: %s", u.Password)
 
 	// Compare hash from ETCD with given password (not hashed)
 	if err := bcrypt.CompareHashAndPassword([]byte(u.Password), []byte(password)); err != nil {
-		log.Printf("Passwords do not match")
+		logger.Debug("Passwords do not match", "username", username)
 		return false
 	}
-	log.Printf("Passwords match for user %s", username)
+	logger.Debug("Passwords match", "username", username)
 	return true
 
 }
@@ -120,30 +137,33 @@ func (t *Etcd) Authenticate(username string, password string) bool {
 // AddOrUdpdateUser adds or updates a user's password, storing a hash of the
 // password in etcd under /passwd/<usename>
 func (t *Etcd) AddOrUpdateUser(username string, password string) (err error) {
-	log.Printf("Setting up user %s", username)
+	logger.Debug("Setting up user", "username", username)
 	var u auth.User
 	u, err = t.User(username)
 	u.Password = auth.Hash(password)
 	err = t.setUser(u)
+	t.record(audit.AddUser, username, "", err)
 	return err
 }
 
 // SetRights sets user rights
 func (t *Etcd) SetRights(username string, rights string) (err error) {
-	log.Printf("Setting up user rights for user %s", username)
+	logger.Debug("Setting up user rights", "username", username, "rights", rights)
 	var u auth.User
 	u, err = t.User(username)
 	if err != nil {
+		t.record(audit.SetRights, username, rights, err)
 		return err
 	}
 	u.Rights = rights
 	err = t.setUser(u)
+	t.record(audit.SetRights, username, rights, err)
 	return err
 }
 
 // Rights returns a string of allowed access rights
 func (t *Etcd) Rights(username string) (rights string) {
-	log.Printf("Getting user rights for user %s", username)
+	logger.Debug("Getting user rights", "username", username)
 	u, _ := t.User(username)
 	return u.Rights
 }
@@ -156,3 +176,124 @@ func (t *Etcd) UserExists(username string) bool {
 	}
 	return true
 }
+
+// DeleteUser removes a user from etcd
+func (t *Etcd) DeleteUser(username string) (err error) {
+	logger.Debug("Deleting user", "username", username)
+	_, err = t.etcdApi.Delete(context.Background(), "/user/"+username, nil)
+	if client.IsKeyNotFound(err) {
+		err = auth.ErrUserNotFound
+	} else if err != nil {
+		logger.Error("Error deleting user", "username", username, "error", err)
+	} else {
+		logger.Info("User deleted", "username", username)
+	}
+	t.record(audit.DeleteUser, username, "", err)
+	return err
+}
+
+// DisableUser stops a user authenticating, keeping their details
+func (t *Etcd) DisableUser(username string) (err error) {
+	err = t.setDisabled(username, true)
+	t.record(audit.DisableUser, username, "", err)
+	return err
+}
+
+// EnableUser lets a disabled user authenticate again
+func (t *Etcd) EnableUser(username string) (err error) {
+	err = t.setDisabled(username, false)
+	t.record(audit.EnableUser, username, "", err)
+	return err
+}
+
+func (t *Etcd) setDisabled(username string, disabled bool) (err error) {
+	u, err := t.User(username)
+	if err != nil {
+		return err
+	}
+	u.Disabled = disabled
+	return t.setUser(u)
+}
+
+/*
+ * ListUsers returns up to limit users whose usernames start with prefix,
+ * after the username given in after. The v2 API can't page through keys,
+ * so all users are read each time
+ */
+func (t *Etcd) ListUsers(prefix string, after string, limit int) (users []auth.User, err error) {
+	resp, err := t.etcdApi.Get(context.Background(), "/user", &client.GetOptions{Recursive: true, Sort: true})
+	if client.IsKeyNotFound(err) {
+		return nil, nil
+	} else if err != nil {
+		logger.Warn("Could not list users from the database", "error", err)
+		return nil, err
+	}
+	for _, node := range resp.Node.Nodes {
+		username := path.Base(node.Key)
+		if node.Dir || !strings.HasPrefix(username, prefix) || username <= after {
+			continue
+		}
+		u := auth.User{Username: username, Rights: NO_RIGHTS}
+		if err := json.Unmarshal([]byte(node.Value), &u); err != nil {
+			logger.Warn("Skipping unreadable user", "key", node.Key, "error", err)
+			continue
+		}
+		users = append(users, u)
+	}
+	if limit > 0 && len(users) > limit {
+		users = users[:limit]
+	}
+	return users, nil
+}
+
+/*
+ * WatchUsers calls changed with the username of each user changed in etcd,
+ * until stop is closed. If the watch fails, changed is called with "" and
+ * the watch started again
+ */
+func (t *Etcd) WatchUsers(stop <-chan struct{}, changed func(username string)) {
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		<-stop
+		cancel()
+	}()
+	go func() {
+		for {
+			w := t.etcdApi.Watcher("/user", &client.WatcherOptions{Recursive: true})
+			var err error
+			for {
+				var resp *client.Response
+				if resp, err = w.Next(ctx); err != nil {
+					break
+				}
+				changed(path.Base(resp.Node.Key))
+			}
+			if ctx.Err() != nil {
+				return
+			}
+			logger.Warn("Lost watch on users, watching again", "error", err)
+			changed("")
+			select {
+			case <-time.After(time.Second):
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+}
+
+// record adds a user change to the audit trail. For rights changes, the
+// topic is the new rights expression
+func (t *Etcd) record(action string, username string, topic string, err error) {
+	e := audit.Event{
+		Username: username,
+		Action:   action,
+		Topic:    topic,
+		Decision: audit.Success,
+	}
+	if err != nil {
+		e.Decision = audit.Failure
+		e.Reason = err.Error()
+	}
+	audit.Record(t.audit, e)
+}
@@ -0,0 +1,345 @@
+package etcdv3
+
+import (
+	"context"
+	"encoding/json"
+	"github.com/coreos/etcd/clientv3"
+	"github.com/trafero/tstack/audit"
+	"github.com/trafero/tstack/auth"
+	"github.com/trafero/tstack/logging"
+	"github.com/trafero/tstack/tls"
+	"golang.org/x/crypto/bcrypt"
+	"strings"
+	"time"
+)
+
+var logger = logging.New("auth")
+
+// String to represent no user rights
+const NO_RIGHTS = "^$"
+
+// Defaults for Config
+const (
+	DefaultPrefix         = "/user/"
+	DefaultDialTimeout    = 5 * time.Second
+	DefaultRequestTimeout = 2 * time.Second
+)
+
+var ErrUserNotFound = auth.ErrUserNotFound
+
+// Config is the etcd cluster to use. Empty or zero values take their
+// defaults
+type Config struct {
+	Endpoints      []string
+	Prefix         string        // Users are kept under <prefix><username> (default "/user/")
+	CaCertFile     string        // CA certificate for TLS. Optional
+	CertFile       string        // Client certificate for TLS. Optional
+	KeyFile        string        // Client key for TLS. Optional
+	Username       string        // For etcd authentication. Optional
+	Password       string        // For etcd authentication. Optional
+	DialTimeout    time.Duration // Time to wait to connect (default 5s)
+	RequestTimeout time.Duration // Time to wait for each request (default 2s)
+}
+
+/*
+ * Etcd is authentication with an etcd v3 back end. Users are stored as JSON,
+ * as with the v2 back end in auth/etcd, so they can be copied across with
+ * tetcdmigrate
+ */
+type Etcd struct {
+	client *clientv3.Client
+	config Config
+	audit  audit.Sink // Audit trail of user changes. May be nil
+}
+
+// New returns an Etcd using the given cluster. TLS is used if CaCertFile is
+// set, with a client certificate if CertFile and KeyFile are also set
+func New(c Config) (a *Etcd, err error) {
+	if c.Prefix == "" {
+		c.Prefix = DefaultPrefix
+	}
+	if c.DialTimeout == 0 {
+		c.DialTimeout = DefaultDialTimeout
+	}
+	if c.RequestTimeout == 0 {
+		c.RequestTimeout = DefaultRequestTimeout
+	}
+	cfg := clientv3.Config{
+		Endpoints:   c.Endpoints,
+		DialTimeout: c.DialTimeout,
+		Username:    c.Username,
+		Password:    c.Password,
+	}
+	if c.CaCertFile != "" && c.CertFile != "" {
+		cfg.TLS, err = tls.TLSConfig(c.CaCertFile, c.CertFile, c.KeyFile)
+	} else if c.CaCertFile != "" {
+		cfg.TLS, err = tls.TLSClientConfig(c.CaCertFile)
+	}
+	if err != nil {
+		return nil, err
+	}
+	client, err := clientv3.New(cfg)
+	if err != nil {
+		return nil, err
+	}
+	return &Etcd{client: client, config: c}, nil
+}
+
+// SetAudit sets the sink for recording user changes
+func (t *Etcd) SetAudit(s audit.Sink) {
+	t.audit = s
+}
+
+// Close closes the connection to etcd
+func (t *Etcd) Close() error {
+	return t.client.Close()
+}
+
+// Prefix returns the prefix users are kept under
+func (t *Etcd) Prefix() string {
+	return t.config.Prefix
+}
+
+// Returns user object for a given username
+func (t *Etcd) User(username string) (u auth.User, err error) {
+	u = auth.User{Username: username, Rights: NO_RIGHTS}
+
+	ctx, cancel := context.WithTimeout(context.Background(), t.config.RequestTimeout)
+	defer cancel()
+	resp, err := t.client.Get(ctx, t.config.Prefix+username)
+	if err != nil {
+		logger.Warn("Could not retrieve user from the database", "username", username, "error", err)
+		return u, err
+	}
+	if len(resp.Kvs) == 0 {
+		return u, ErrUserNotFound
+	}
+	err = json.Unmarshal(resp.Kvs[0].Value, &u)
+	return u, err
+}
+
+// Saves a user object
+func (t *Etcd) setUser(u auth.User) (err error) {
+	userInfo, err := json.Marshal(u)
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), t.config.RequestTimeout)
+	defer cancel()
+	if _, err = t.client.Put(ctx, t.config.Prefix+u.Username, string(userInfo)); err != nil {
+		logger.Error("Error saving user", "username", u.Username, "error", err)
+		return err
+	}
+	logger.Info("User saved", "username", u.Username)
+	return nil
+}
+
+// Authenticate checks the given password with the hashed version stored in etcd
+func (t *Etcd) Authenticate(username string, password string) bool {
+	u, err := t.User(username)
+	if err != nil {
+		logger.Debug("Error retrieving user", "username", username, "error", err)
+		return false
+	}
+	if u.Password == "" {
+		logger.Warn("No password set for user", "username", username)
+		return false
+	}
+	if u.Disabled {
+		logger.Debug("User disabled", "username", username)
+		return false
+	}
+	if err := bcrypt.CompareHashAndPassword([]byte(u.Password), []byte(password)); err != nil {
+		logger.Debug("Passwords do not match", "username", username)
+		return false
+	}
+	logger.Debug("Passwords match", "username", username)
+	return true
+}
+
+// AddOrUdpdateUser adds or updates a user's password, storing a hash of the
+// password in etcd
+func (t *Etcd) AddOrUpdateUser(username string, password string) (err error) {
+	logger.Debug("Setting up user", "username", username)
+	u, err := t.User(username)
+	if err != nil && err != ErrUserNotFound {
+		t.record(audit.AddUser, username, "", err)
+		return err
+	}
+	u.Password = auth.Hash(password)
+	err = t.setUser(u)
+	t.record(audit.AddUser, username, "", err)
+	return err
+}
+
+// SetRights sets user rights
+func (t *Etcd) SetRights(username string, rights string) (err error) {
+	logger.Debug("Setting up user rights", "username", username, "rights", rights)
+	u, err := t.User(username)
+	if err != nil {
+		t.record(audit.SetRights, username, rights, err)
+		return err
+	}
+	u.Rights = rights
+	err = t.setUser(u)
+	t.record(audit.SetRights, username, rights, err)
+	return err
+}
+
+// Rights returns a string of allowed access rights
+func (t *Etcd) Rights(username string) (rights string) {
+	logger.Debug("Getting user rights", "username", username)
+	u, _ := t.User(username)
+	return u.Rights
+}
+
+// UserExists returns true if the user exists and false for anything else
+func (t *Etcd) UserExists(username string) bool {
+	_, err := t.User(username)
+	return err == nil
+}
+
+// DeleteUser removes a user from etcd
+func (t *Etcd) DeleteUser(username string) (err error) {
+	logger.Debug("Deleting user", "username", username)
+	ctx, cancel := context.WithTimeout(context.Background(), t.config.RequestTimeout)
+	defer cancel()
+	resp, err := t.client.Delete(ctx, t.config.Prefix+username)
+	if err == nil && resp.Deleted == 0 {
+		err = ErrUserNotFound
+	} else if err != nil {
+		logger.Error("Error deleting user", "username", username, "error", err)
+	} else {
+		logger.Info("User deleted", "username", username)
+	}
+	t.record(audit.DeleteUser, username, "", err)
+	return err
+}
+
+// DisableUser stops a user authenticating, keeping their details
+func (t *Etcd) DisableUser(username string) (err error) {
+	err = t.setDisabled(username, true)
+	t.record(audit.DisableUser, username, "", err)
+	return err
+}
+
+// EnableUser lets a disabled user authenticate again
+func (t *Etcd) EnableUser(username string) (err error) {
+	err = t.setDisabled(username, false)
+	t.record(audit.EnableUser, username, "", err)
+	return err
+}
+
+func (t *Etcd) setDisabled(username string, disabled bool) (err error) {
+	u, err := t.User(username)
+	if err != nil {
+		return err
+	}
+	u.Disabled = disabled
+	return t.setUser(u)
+}
+
+// ListUsers returns up to limit users whose usernames start with prefix,
+// after the username given in after, reading only those from etcd
+func (t *Etcd) ListUsers(prefix string, after string, limit int) (users []auth.User, err error) {
+	start := t.config.Prefix + prefix
+	if after >= prefix {
+		// The smallest key after after
+		start = t.config.Prefix + after + "\x00"
+	}
+	opts := []clientv3.OpOption{
+		clientv3.WithRange(clientv3.GetPrefixRangeEnd(t.config.Prefix + prefix)),
+		clientv3.WithSort(clientv3.SortByKey, clientv3.SortAscend),
+	}
+	if limit > 0 {
+		opts = append(opts, clientv3.WithLimit(int64(limit)))
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), t.config.RequestTimeout)
+	defer cancel()
+	resp, err := t.client.Get(ctx, start, opts...)
+	if err != nil {
+		logger.Warn("Could not list users from the database", "error", err)
+		return nil, err
+	}
+	for _, kv := range resp.Kvs {
+		u := auth.User{Username: strings.TrimPrefix(string(kv.Key), t.config.Prefix), Rights: NO_RIGHTS}
+		if err := json.Unmarshal(kv.Value, &u); err != nil {
+			logger.Warn("Skipping unreadable user", "key", string(kv.Key), "error", err)
+			continue
+		}
+		users = append(users, u)
+	}
+	return users, nil
+}
+
+/*
+ * Import saves a user as is, with their password already hashed, for
+ * copying users from another back end. Existing users are only replaced if
+ * overwrite is set. Returns whether the user was saved
+ */
+func (t *Etcd) Import(u auth.User, overwrite bool) (saved bool, err error) {
+	if !overwrite {
+		if _, err := t.User(u.Username); err == nil {
+			return false, nil
+		} else if err != ErrUserNotFound {
+			return false, err
+		}
+	}
+	if err = t.setUser(u); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+/*
+ * WatchUsers calls changed with the username of each user changed in etcd,
+ * until stop is closed. If the watch fails, changed is called with "" and
+ * the watch started again
+ */
+func (t *Etcd) WatchUsers(stop <-chan struct{}, changed func(username string)) {
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		<-stop
+		cancel()
+	}()
+	go func() {
+		for {
+			for resp := range t.client.Watch(ctx, t.config.Prefix, clientv3.WithPrefix()) {
+				if err := resp.Err(); err != nil {
+					logger.Warn("Error watching users", "error", err)
+					changed("")
+					continue
+				}
+				for _, ev := range resp.Events {
+					changed(strings.TrimPrefix(string(ev.Kv.Key), t.config.Prefix))
+				}
+			}
+			if ctx.Err() != nil {
+				return
+			}
+			logger.Warn("Lost watch on users, watching again")
+			changed("")
+			select {
+			case <-time.After(time.Second):
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+}
+
+// record adds a user change to the audit trail. For rights changes, the
+// topic is the new rights expression
+func (t *Etcd) record(action string, username string, topic string, err error) {
+	e := audit.Event{
+		Username: username,
+		Action:   action,
+		Topic:    topic,
+		Decision: audit.Success,
+	}
+	if err != nil {
+		e.Decision = audit.Failure
+		e.Reason = err.Error()
+	}
+	audit.Record(t.audit, e)
+}
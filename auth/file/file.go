@@ -0,0 +1,420 @@
+/*
+ * Package file keeps users in files, for small deployments and tests.
+ *
+ * The users file has a line for each user of <username>:<bcrypt hash>, as
+ * made by "htpasswd -B". The ACL file has a line for each user of
+ * <username>:<rights>, where rights is a topic filter as used by tuser.
+ * Disabled users have "!" before their hash, as with locked accounts in
+ * /etc/shadow, so that no password matches. Blank lines and lines starting
+ * with # are ignored, and kept when the files are written.
+ */
+package file
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"github.com/trafero/tstack/audit"
+	"github.com/trafero/tstack/auth"
+	"github.com/trafero/tstack/logging"
+	"golang.org/x/crypto/bcrypt"
+	"io/ioutil"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+var logger = logging.New("auth")
+
+var (
+	ErrUserNotFound = auth.ErrUserNotFound
+	ErrBadUsername  = errors.New("Usernames cannot be empty or contain ':', '#' or white space")
+)
+
+// How often Watch checks the files for changes, by default
+const DefaultWatchInterval = 5 * time.Second
+
+// File is authentication with users and rights kept in files
+type File struct {
+	usersPath string
+	aclPath   string
+	audit     audit.Sink // Audit trail of user changes. May be nil
+
+	mutex    sync.RWMutex
+	users    map[string]string // Password hashes, by username
+	rights   map[string]string // Rights, by username
+	modified [2]time.Time      // Of the users and ACL files, when last read
+	stop     chan struct{}     // Closed by Close, to stop watching
+	watchers []watcher         // Told when the files are read again
+}
+
+// watcher is told of changes by Watch, until stop is closed
+type watcher struct {
+	stop    <-chan struct{}
+	changed func(username string)
+}
+
+/*
+ * New reads users from usersPath and their rights from aclPath. Either file
+ * may not exist yet, in which case it is created when a user is added or
+ * their rights set
+ */
+func New(usersPath string, aclPath string) (a *File, err error) {
+	a = &File{
+		usersPath: usersPath,
+		aclPath:   aclPath,
+		stop:      make(chan struct{}),
+	}
+	if err = a.load(); err != nil {
+		return nil, err
+	}
+	return a, nil
+}
+
+// SetAudit sets the sink for recording user changes
+func (a *File) SetAudit(s audit.Sink) {
+	a.audit = s
+}
+
+/*
+ * Watch reads the files again whenever they change, checking every
+ * interval, until Close is called. A file that can't be read is logged
+ * and the users already loaded are kept
+ */
+func (a *File) Watch(interval time.Duration) {
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+			case <-a.stop:
+				return
+			}
+			if !a.changed() {
+				continue
+			}
+			if err := a.load(); err != nil {
+				logger.Error("Could not reload users", "file", a.usersPath, "aclfile", a.aclPath, "error", err)
+				continue
+			}
+			logger.Info("Reloaded users", "file", a.usersPath, "aclfile", a.aclPath)
+			a.notify()
+		}
+	}()
+}
+
+// WatchUsers calls changed with "" whenever Watch reads the files again,
+// until stop is closed
+func (a *File) WatchUsers(stop <-chan struct{}, changed func(username string)) {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	a.watchers = append(a.watchers, watcher{stop: stop, changed: changed})
+}
+
+// notify tells watchers that any user may have changed
+func (a *File) notify() {
+	a.mutex.Lock()
+	var watching []watcher
+	for _, w := range a.watchers {
+		select {
+		case <-w.stop:
+		default:
+			watching = append(watching, w)
+		}
+	}
+	a.watchers = watching
+	a.mutex.Unlock()
+	for _, w := range watching {
+		w.changed("")
+	}
+}
+
+// Close stops watching the files
+func (a *File) Close() {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	select {
+	case <-a.stop:
+	default:
+		close(a.stop)
+	}
+}
+
+// changed reports whether either file has changed since last read
+func (a *File) changed() bool {
+	a.mutex.RLock()
+	defer a.mutex.RUnlock()
+	return modTime(a.usersPath) != a.modified[0] || modTime(a.aclPath) != a.modified[1]
+}
+
+// modTime returns when a file was modified, or the zero time if it doesn't
+// exist
+func modTime(path string) time.Time {
+	info, err := os.Stat(path)
+	if err != nil {
+		return time.Time{}
+	}
+	return info.ModTime()
+}
+
+// load reads both files, replacing the users held
+func (a *File) load() error {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	modified := [2]time.Time{modTime(a.usersPath), modTime(a.aclPath)}
+	users, err := readEntries(a.usersPath)
+	if err != nil {
+		return err
+	}
+	rights, err := readEntries(a.aclPath)
+	if err != nil {
+		return err
+	}
+	a.users, a.rights, a.modified = users, rights, modified
+	return nil
+}
+
+// readEntries reads <key>:<value> lines from a file. A missing file has
+// no entries
+func readEntries(path string) (entries map[string]string, err error) {
+	entries = make(map[string]string)
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return entries, nil
+	} else if err != nil {
+		return nil, err
+	}
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		parts := strings.SplitN(line, ":", 2)
+		if len(parts) != 2 {
+			logger.Warn("Ignoring malformed line", "file", path, "line", n)
+			continue
+		}
+		entries[parts[0]] = parts[1]
+	}
+	return entries, scanner.Err()
+}
+
+/*
+ * writeEntry sets the value of key in a file of <key>:<value> lines,
+ * keeping other lines as they are and adding the key at the end if new.
+ * The file is written then renamed, so that readers never see part of it
+ */
+func writeEntry(path string, key string, value string) error {
+	return rewriteEntry(path, key, &value)
+}
+
+// removeEntry removes key from a file of <key>:<value> lines, if it's there
+func removeEntry(path string, key string) error {
+	return rewriteEntry(path, key, nil)
+}
+
+// rewriteEntry sets the value of key, or removes it if value is nil
+func rewriteEntry(path string, key string, value *string) error {
+	data, err := ioutil.ReadFile(path)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	var buf bytes.Buffer
+	found := false
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for scanner.Scan() {
+		line := scanner.Text()
+		if strings.HasPrefix(strings.TrimSpace(line), key+":") {
+			found = true
+			if value == nil {
+				continue
+			}
+			line = key + ":" + *value
+		}
+		buf.WriteString(line + "\n")
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+	if !found && value != nil {
+		buf.WriteString(key + ":" + *value + "\n")
+	}
+	tmp := path + ".tmp"
+	if err := ioutil.WriteFile(tmp, buf.Bytes(), 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// Returns user object for a given username
+func (a *File) User(username string) (u auth.User, err error) {
+	a.mutex.RLock()
+	defer a.mutex.RUnlock()
+	hash, ok := a.users[username]
+	if !ok {
+		return u, ErrUserNotFound
+	}
+	return auth.User{
+		Username: username,
+		Password: strings.TrimPrefix(hash, "!"),
+		Rights:   a.rights[username],
+		Disabled: strings.HasPrefix(hash, "!"),
+	}, nil
+}
+
+// Authenticate checks the given password with the hashed version in the
+// users file
+func (a *File) Authenticate(username string, password string) bool {
+	u, err := a.User(username)
+	if err != nil {
+		logger.Debug("Error retrieving user", "username", username, "error", err)
+		return false
+	}
+	if u.Disabled {
+		logger.Debug("User disabled", "username", username)
+		return false
+	}
+	if err := bcrypt.CompareHashAndPassword([]byte(u.Password), []byte(password)); err != nil {
+		logger.Debug("Passwords do not match", "username", username)
+		return false
+	}
+	logger.Debug("Passwords match", "username", username)
+	return true
+}
+
+// AddOrUdpdateUser adds or updates a user's password, saving a hash of the
+// password in the users file. Disabled users stay disabled
+func (a *File) AddOrUpdateUser(username string, password string) (err error) {
+	hash := auth.Hash(password)
+	if u, err := a.User(username); err == nil && u.Disabled {
+		hash = "!" + hash
+	}
+	err = a.set(a.usersPath, username, hash)
+	a.record(audit.AddUser, username, "", err)
+	return err
+}
+
+// SetRights sets user rights in the ACL file
+func (a *File) SetRights(username string, rights string) (err error) {
+	if !a.UserExists(username) {
+		err = ErrUserNotFound
+	} else {
+		err = a.set(a.aclPath, username, rights)
+	}
+	a.record(audit.SetRights, username, rights, err)
+	return err
+}
+
+// set writes an entry to one of the files, and reads both again
+func (a *File) set(path string, username string, value string) error {
+	if username == "" || strings.ContainsAny(username, ": \t#") {
+		return ErrBadUsername
+	}
+	a.mutex.Lock()
+	err := writeEntry(path, username, value)
+	a.mutex.Unlock()
+	if err != nil {
+		logger.Error("Error saving user", "username", username, "file", path, "error", err)
+		return err
+	}
+	logger.Info("User saved", "username", username)
+	return a.load()
+}
+
+// DeleteUser removes a user from both files
+func (a *File) DeleteUser(username string) (err error) {
+	if !a.UserExists(username) {
+		err = ErrUserNotFound
+	} else {
+		a.mutex.Lock()
+		err = removeEntry(a.usersPath, username)
+		if err == nil {
+			err = removeEntry(a.aclPath, username)
+		}
+		a.mutex.Unlock()
+		if err == nil {
+			logger.Info("User deleted", "username", username)
+			err = a.load()
+		} else {
+			logger.Error("Error deleting user", "username", username, "error", err)
+		}
+	}
+	a.record(audit.DeleteUser, username, "", err)
+	return err
+}
+
+// DisableUser stops a user authenticating, by putting "!" before their hash
+func (a *File) DisableUser(username string) (err error) {
+	u, err := a.User(username)
+	if err == nil && !u.Disabled {
+		err = a.set(a.usersPath, username, "!"+u.Password)
+	}
+	a.record(audit.DisableUser, username, "", err)
+	return err
+}
+
+// EnableUser lets a disabled user authenticate again
+func (a *File) EnableUser(username string) (err error) {
+	u, err := a.User(username)
+	if err == nil && u.Disabled {
+		err = a.set(a.usersPath, username, u.Password)
+	}
+	a.record(audit.EnableUser, username, "", err)
+	return err
+}
+
+// ListUsers returns up to limit users whose usernames start with prefix,
+// after the username given in after
+func (a *File) ListUsers(prefix string, after string, limit int) (users []auth.User, err error) {
+	a.mutex.RLock()
+	var usernames []string
+	for username := range a.users {
+		if strings.HasPrefix(username, prefix) && username > after {
+			usernames = append(usernames, username)
+		}
+	}
+	a.mutex.RUnlock()
+	sort.Strings(usernames)
+	if limit > 0 && len(usernames) > limit {
+		usernames = usernames[:limit]
+	}
+	for _, username := range usernames {
+		if u, err := a.User(username); err == nil {
+			users = append(users, u)
+		}
+	}
+	return users, nil
+}
+
+// Rights returns a user's rights, or an empty string if they have none
+func (a *File) Rights(username string) (rights string) {
+	a.mutex.RLock()
+	defer a.mutex.RUnlock()
+	return a.rights[username]
+}
+
+// UserExists returns true if the user is in the users file
+func (a *File) UserExists(username string) bool {
+	_, err := a.User(username)
+	return err == nil
+}
+
+// record adds a user change to the audit trail. For rights changes, the
+// topic is the new rights expression
+func (a *File) record(action string, username string, topic string, err error) {
+	e := audit.Event{
+		Username: username,
+		Action:   action,
+		Topic:    topic,
+		Decision: audit.Success,
+	}
+	if err != nil {
+		e.Decision = audit.Failure
+		e.Reason = err.Error()
+	}
+	audit.Record(a.audit, e)
+}
@@ -0,0 +1,138 @@
+package file
+
+import (
+	"github.com/trafero/tstack/auth"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func tempFiles(t *testing.T) (dir string, users string, acl string) {
+	dir, err := ioutil.TempDir("", "authfile")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return dir, filepath.Join(dir, "users"), filepath.Join(dir, "acl")
+}
+
+func TestFile(t *testing.T) {
+	dir, users, acl := tempFiles(t)
+	defer os.RemoveAll(dir)
+
+	ioutil.WriteFile(users, []byte("# Devices\nABC-123:"+auth.Hash("secret")+"\n"), 0600)
+	ioutil.WriteFile(acl, []byte("ABC-123:ABC-123/#\n"), 0600)
+
+	a, err := New(users, acl)
+	if err != nil {
+		t.Fatal("Error reading files:", err)
+	}
+	if !a.Authenticate("ABC-123", "secret") {
+		t.Error("Expected ABC-123 to authenticate")
+	}
+	if a.Authenticate("ABC-123", "wrong") || a.Authenticate("XYZ-789", "secret") {
+		t.Error("Expected wrong password and unknown user to fail")
+	}
+	if rights := a.Rights("ABC-123"); rights != "ABC-123/#" {
+		t.Errorf("Expected rights ABC-123/#, got %q", rights)
+	}
+
+	// Writes are kept, along with comments
+	if err := a.AddOrUpdateUser("backend", "pass"); err != nil {
+		t.Fatal("Error adding user:", err)
+	}
+	if err := a.SetRights("backend", "#"); err != nil {
+		t.Fatal("Error setting rights:", err)
+	}
+	if err := a.SetRights("nobody", "#"); err != ErrUserNotFound {
+		t.Errorf("Expected user not found setting rights, got %v", err)
+	}
+	if err := a.AddOrUpdateUser("a:b", "pass"); err != ErrBadUsername {
+		t.Errorf("Expected bad username, got %v", err)
+	}
+	a, err = New(users, acl)
+	if err != nil {
+		t.Fatal("Error reading files:", err)
+	}
+	if !a.Authenticate("backend", "pass") || a.Rights("backend") != "#" || !a.Authenticate("ABC-123", "secret") {
+		t.Error("Expected users to be saved")
+	}
+	if data, _ := ioutil.ReadFile(users); !strings.HasPrefix(string(data), "# Devices\n") {
+		t.Errorf("Expected comment kept, got %q", data)
+	}
+}
+
+func TestWatch(t *testing.T) {
+	dir, users, acl := tempFiles(t)
+	defer os.RemoveAll(dir)
+
+	a, err := New(users, acl)
+	if err != nil {
+		t.Fatal("Error reading missing files:", err)
+	}
+	a.Watch(10 * time.Millisecond)
+	defer a.Close()
+
+	// Changed by another process, e.g. tuser
+	other, _ := New(users, acl)
+	other.AddOrUpdateUser("device", "secret")
+	other.SetRights("device", "device/#")
+
+	deadline := time.Now().Add(5 * time.Second)
+	for a.Rights("device") != "device/#" {
+		if time.Now().After(deadline) {
+			t.Fatal("Timed out waiting for reload")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if !a.Authenticate("device", "secret") {
+		t.Error("Expected reloaded user to authenticate")
+	}
+}
+
+func TestLifecycle(t *testing.T) {
+	dir, users, acl := tempFiles(t)
+	defer os.RemoveAll(dir)
+
+	a, _ := New(users, acl)
+	for _, username := range []string{"ABC-123", "ABC-456", "XYZ-789"} {
+		a.AddOrUpdateUser(username, "secret")
+		a.SetRights(username, username+"/#")
+	}
+
+	if err := a.DisableUser("ABC-123"); err != nil {
+		t.Fatal("Error disabling user:", err)
+	}
+	a.AddOrUpdateUser("ABC-123", "changed")
+	if u, _ := a.User("ABC-123"); !u.Disabled || a.Authenticate("ABC-123", "changed") {
+		t.Error("Expected disabled user to stay disabled, and not authenticate")
+	}
+	if err := a.EnableUser("ABC-123"); err != nil || !a.Authenticate("ABC-123", "changed") {
+		t.Errorf("Expected enabled user to authenticate, got %v", err)
+	}
+
+	if err := a.DeleteUser("ABC-456"); err != nil {
+		t.Fatal("Error deleting user:", err)
+	}
+	if err := a.DeleteUser("ABC-456"); err != ErrUserNotFound {
+		t.Errorf("Expected user not found deleting twice, got %v", err)
+	}
+	if data, _ := ioutil.ReadFile(acl); strings.Contains(string(data), "ABC-456") {
+		t.Errorf("Expected rights removed, got %q", data)
+	}
+
+	list, _ := a.ListUsers("ABC-", "", 0)
+	if len(list) != 1 || list[0].Username != "ABC-123" || list[0].Rights != "ABC-123/#" {
+		t.Errorf("Expected ABC-123 listed, got %v", list)
+	}
+	list, _ = a.ListUsers("", "", 1)
+	if len(list) != 1 || list[0].Username != "ABC-123" {
+		t.Errorf("Expected first page of ABC-123, got %v", list)
+	}
+	list, _ = a.ListUsers("", list[0].Username, 1)
+	if len(list) != 1 || list[0].Username != "XYZ-789" {
+		t.Errorf("Expected second page of XYZ-789, got %v", list)
+	}
+}
@@ -0,0 +1,227 @@
+/*
+ * Package http asks another service, such as an existing account service,
+ * about users over HTTP. Each endpoint is POSTed a JSON object, and answers
+ * with JSON:
+ *
+ *   authenticate: {"username": "ABC-123", "password": "secret"}
+ *     2xx if the password is right, anything else if not
+ *   rights:       {"username": "ABC-123"}
+ *     {"rights": "ABC-123/#"}, or 404 for no rights
+ *   user:         {"username": "ABC-123"}
+ *     {"username": "ABC-123", "rights": "ABC-123/#", "disabled": false},
+ *     or 404 if there is no such user
+ *
+ * Users are managed by the other service, so can't be changed here.
+ */
+package http
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"github.com/trafero/tstack/auth"
+	"github.com/trafero/tstack/logging"
+	"github.com/trafero/tstack/tls"
+	"gopkg.in/yaml.v2"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"time"
+)
+
+var logger = logging.New("auth")
+
+var (
+	ErrUserNotFound = auth.ErrUserNotFound
+	ErrReadOnly     = errors.New("Users are managed by the account service")
+)
+
+// How long to wait for each request, by default
+const DefaultTimeout = 5 * time.Second
+
+// Config is the service to use. Only AuthenticateURL and UserURL are needed
+type Config struct {
+	AuthenticateURL string
+	RightsURL       string // If empty, rights are read from UserURL
+	UserURL         string
+
+	Headers map[string]string // Added to each request, e.g. Authorization
+
+	CaCertFile string // CA certificate for TLS. Optional
+	CertFile   string // Client certificate for TLS. Optional
+	KeyFile    string // Client key for TLS. Optional
+
+	Timeout  time.Duration // For each request (default 5s)
+	CacheTTL time.Duration // How long tserve keeps results, with auth/cache (default 0, not kept)
+}
+
+// ReadConfig reads a Config from a YAML file, with lower case keys, e.g.
+// "authenticateurl: https://accounts/mqtt/authenticate"
+func ReadConfig(path string) (c Config, err error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return c, err
+	}
+	err = yaml.Unmarshal(data, &c)
+	return c, err
+}
+
+// HTTP is authentication by another service
+type HTTP struct {
+	client *http.Client
+	config Config
+}
+
+// New returns an HTTP using the service given in c. TLS is used if
+// CaCertFile is set, with a client certificate if CertFile and KeyFile are
+// also set
+func New(c Config) (a *HTTP, err error) {
+	if c.AuthenticateURL == "" || c.UserURL == "" {
+		return nil, errors.New("Authenticate and user URLs are needed")
+	}
+	if c.Timeout == 0 {
+		c.Timeout = DefaultTimeout
+	}
+	transport := &http.Transport{}
+	if c.CaCertFile != "" && c.CertFile != "" {
+		transport.TLSClientConfig, err = tls.TLSConfig(c.CaCertFile, c.CertFile, c.KeyFile)
+	} else if c.CaCertFile != "" {
+		transport.TLSClientConfig, err = tls.TLSClientConfig(c.CaCertFile)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &HTTP{
+		client: &http.Client{Transport: transport, Timeout: c.Timeout},
+		config: c,
+	}, nil
+}
+
+type request struct {
+	Username string `json:"username"`
+	Password string `json:"password,omitempty"`
+}
+
+type response struct {
+	Username string `json:"username"`
+	Rights   string `json:"rights"`
+	Disabled bool   `json:"disabled"`
+}
+
+/*
+ * post sends req to url, returning the status code and decoding a 2xx
+ * answer into resp, if not nil. Other answers are discarded
+ */
+func (a *HTTP) post(url string, req request, resp *response) (status int, err error) {
+	body, err := json.Marshal(req)
+	if err != nil {
+		return 0, err
+	}
+	r, err := http.NewRequest("POST", url, bytes.NewReader(body))
+	if err != nil {
+		return 0, err
+	}
+	r.Header.Set("Content-Type", "application/json")
+	for k, v := range a.config.Headers {
+		r.Header.Set(k, v)
+	}
+	res, err := a.client.Do(r)
+	if err != nil {
+		return 0, err
+	}
+	defer res.Body.Close()
+	if res.StatusCode/100 == 2 && resp != nil {
+		err = json.NewDecoder(res.Body).Decode(resp)
+	} else {
+		io.Copy(ioutil.Discard, res.Body)
+	}
+	return res.StatusCode, err
+}
+
+// Returns user object for a given username. The password hash is never known
+func (a *HTTP) User(username string) (u auth.User, err error) {
+	u = auth.User{Username: username}
+	var resp response
+	status, err := a.post(a.config.UserURL, request{Username: username}, &resp)
+	if err != nil {
+		logger.Warn("Could not retrieve user from the account service", "username", username, "error", err)
+		return u, err
+	}
+	switch {
+	case status == http.StatusNotFound:
+		return u, ErrUserNotFound
+	case status/100 != 2:
+		logger.Warn("Could not retrieve user from the account service", "username", username, "status", status)
+		return u, errors.New("Account service answered " + http.StatusText(status))
+	}
+	u.Rights, u.Disabled = resp.Rights, resp.Disabled
+	return u, nil
+}
+
+// Authenticate asks the account service to check the password
+func (a *HTTP) Authenticate(username string, password string) bool {
+	status, err := a.post(a.config.AuthenticateURL, request{Username: username, Password: password}, nil)
+	if err != nil {
+		logger.Warn("Could not authenticate with the account service", "username", username, "error", err)
+		return false
+	}
+	if status/100 != 2 {
+		logger.Debug("Account service refused user", "username", username, "status", status)
+		return false
+	}
+	logger.Debug("Account service accepted user", "username", username)
+	return true
+}
+
+// Rights returns a user's rights, or an empty string if they have none or
+// can't be read
+func (a *HTTP) Rights(username string) (rights string) {
+	if a.config.RightsURL == "" {
+		u, _ := a.User(username)
+		return u.Rights
+	}
+	var resp response
+	status, err := a.post(a.config.RightsURL, request{Username: username}, &resp)
+	if err != nil || (status/100 != 2 && status != http.StatusNotFound) {
+		logger.Warn("Could not retrieve user rights from the account service", "username", username, "status", status, "error", err)
+		return ""
+	}
+	return resp.Rights
+}
+
+// UserExists returns true if the user exists and false for anything else
+func (a *HTTP) UserExists(username string) bool {
+	_, err := a.User(username)
+	return err == nil
+}
+
+// AddOrUpdateUser returns ErrReadOnly, as users are managed by the account
+// service
+func (a *HTTP) AddOrUpdateUser(username string, password string) (err error) {
+	return ErrReadOnly
+}
+
+// SetRights returns ErrReadOnly
+func (a *HTTP) SetRights(username string, rights string) (err error) {
+	return ErrReadOnly
+}
+
+// DeleteUser returns ErrReadOnly
+func (a *HTTP) DeleteUser(username string) (err error) {
+	return ErrReadOnly
+}
+
+// DisableUser returns ErrReadOnly
+func (a *HTTP) DisableUser(username string) (err error) {
+	return ErrReadOnly
+}
+
+// EnableUser returns ErrReadOnly
+func (a *HTTP) EnableUser(username string) (err error) {
+	return ErrReadOnly
+}
+
+// ListUsers returns ErrReadOnly, as the account service can't be asked
+func (a *HTTP) ListUsers(prefix string, after string, limit int) (users []auth.User, err error) {
+	return nil, ErrReadOnly
+}
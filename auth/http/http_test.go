@@ -0,0 +1,99 @@
+package http
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// accounts stands in for an account service, with one user
+func accounts(t *testing.T) *httptest.Server {
+	mux := http.NewServeMux()
+	decode := func(w http.ResponseWriter, r *http.Request) (req request, ok bool) {
+		if r.Header.Get("Authorization") != "Bearer token" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return req, false
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			t.Error("Error decoding request:", err)
+		}
+		return req, true
+	}
+	mux.HandleFunc("/authenticate", func(w http.ResponseWriter, r *http.Request) {
+		if req, ok := decode(w, r); ok && (req.Username != "ABC-123" || req.Password != "secret") {
+			w.WriteHeader(http.StatusForbidden)
+		}
+	})
+	mux.HandleFunc("/user", func(w http.ResponseWriter, r *http.Request) {
+		req, ok := decode(w, r)
+		if !ok {
+			return
+		}
+		if req.Username != "ABC-123" {
+			http.NotFound(w, r)
+			return
+		}
+		w.Write([]byte(`{"username": "ABC-123", "rights": "ABC-123/#", "disabled": false}`))
+	})
+	mux.HandleFunc("/slow", func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(200 * time.Millisecond)
+	})
+	return httptest.NewServer(mux)
+}
+
+func TestHTTP(t *testing.T) {
+	server := accounts(t)
+	defer server.Close()
+	a, err := New(Config{
+		AuthenticateURL: server.URL + "/authenticate",
+		UserURL:         server.URL + "/user",
+		Headers:         map[string]string{"Authorization": "Bearer token"},
+	})
+	if err != nil {
+		t.Fatal("Error setting up:", err)
+	}
+
+	if !a.Authenticate("ABC-123", "secret") {
+		t.Error("Expected ABC-123 to authenticate")
+	}
+	if a.Authenticate("ABC-123", "wrong") || a.Authenticate("XYZ-789", "secret") {
+		t.Error("Expected wrong password and unknown user to fail")
+	}
+	if rights := a.Rights("ABC-123"); rights != "ABC-123/#" {
+		t.Errorf("Expected rights ABC-123/#, got %q", rights)
+	}
+	if _, err := a.User("XYZ-789"); err != ErrUserNotFound {
+		t.Errorf("Expected user not found, got %v", err)
+	}
+	if a.UserExists("XYZ-789") || !a.UserExists("ABC-123") {
+		t.Error("Expected only ABC-123 to exist")
+	}
+	if err := a.SetRights("ABC-123", "#"); err != ErrReadOnly {
+		t.Errorf("Expected users to be read only, got %v", err)
+	}
+
+	// Without the service's credentials, nothing is allowed
+	a.config.Headers = nil
+	if a.Authenticate("ABC-123", "secret") || a.UserExists("ABC-123") {
+		t.Error("Expected requests without credentials to fail")
+	}
+}
+
+func TestHTTPTimeout(t *testing.T) {
+	server := accounts(t)
+	defer server.Close()
+	a, _ := New(Config{
+		AuthenticateURL: server.URL + "/slow",
+		UserURL:         server.URL + "/slow",
+		Timeout:         50 * time.Millisecond,
+	})
+	start := time.Now()
+	if a.Authenticate("ABC-123", "secret") {
+		t.Error("Expected authentication to fail when the service is slow")
+	}
+	if elapsed := time.Since(start); elapsed > 150*time.Millisecond {
+		t.Errorf("Expected request to time out, took %v", elapsed)
+	}
+}
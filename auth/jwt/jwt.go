@@ -0,0 +1,274 @@
+/*
+ * Package jwt authenticates clients that give a JSON Web Token as their
+ * MQTT password. Tokens are checked against a key file, or a JWKS file of
+ * keys, and may be signed with HS256, RS256 or ES256. Tokens must have an
+ * expiry ("exp"), and may have an audience ("aud") and issuer ("iss") that
+ * must match the config.
+ *
+ * The username comes from a claim ("sub" by default), and must match the
+ * CONNECT username if one is given. Rights come from another claim
+ * ("rights" by default), or a template for tokens without it.
+ *
+ * Users are managed by whoever issues the tokens, so can't be changed or
+ * looked up here. The rights a client has come from its token alone.
+ */
+package jwt
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"github.com/trafero/tstack/auth"
+	"github.com/trafero/tstack/logging"
+	"gopkg.in/yaml.v2"
+	"io/ioutil"
+	"strings"
+	"time"
+)
+
+var logger = logging.New("auth")
+
+var (
+	ErrUserNotFound = auth.ErrUserNotFound
+	ErrReadOnly     = errors.New("Users are managed by the token issuer")
+	ErrBadToken     = errors.New("Malformed token")
+	ErrExpired      = errors.New("Token has expired")
+	ErrNotYetValid  = errors.New("Token is not valid yet")
+	ErrAudience     = errors.New("Token is for another audience")
+	ErrIssuer       = errors.New("Token is from another issuer")
+	ErrNoUsername   = errors.New("Token has no username")
+)
+
+const (
+	DefaultUsernameClaim = "sub"
+	DefaultRightsClaim   = "rights"
+)
+
+// Config is where the keys are, and what tokens must contain. One of KeyFile
+// or JWKSFile is needed
+type Config struct {
+	KeyFile  string // PEM public key or certificate, or an HMAC secret
+	JWKSFile string // JSON Web Key Set, such as from an identity provider
+
+	Audience string // If set, tokens' "aud" must include it
+	Issuer   string // If set, tokens' "iss" must be it
+
+	UsernameClaim string // Claim holding the username (default "sub")
+	RightsClaim   string // Claim holding the rights (default "rights")
+	DefaultRights string // Rights for tokens without the rights claim, e.g. "{username}/#"
+
+	Leeway time.Duration // Allowed clock difference with the issuer
+}
+
+// ReadConfig reads a Config from a YAML file, with lower case keys, e.g.
+// "jwksfile: /etc/tstack/jwks.json"
+func ReadConfig(path string) (c Config, err error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return c, err
+	}
+	err = yaml.Unmarshal(data, &c)
+	return c, err
+}
+
+// JWT is authentication by signed tokens
+type JWT struct {
+	config Config
+	keys   []*key
+}
+
+// New returns a JWT checking tokens with the keys given in c
+func New(c Config) (a *JWT, err error) {
+	if c.UsernameClaim == "" {
+		c.UsernameClaim = DefaultUsernameClaim
+	}
+	if c.RightsClaim == "" {
+		c.RightsClaim = DefaultRightsClaim
+	}
+	var keys []*key
+	switch {
+	case c.JWKSFile != "":
+		keys, err = readJWKSFile(c.JWKSFile)
+	case c.KeyFile != "":
+		keys, err = readKeyFile(c.KeyFile)
+	default:
+		return nil, errors.New("Key file or JWKS file is needed")
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &JWT{config: c, keys: keys}, nil
+}
+
+type header struct {
+	Alg string `json:"alg"`
+	Kid string `json:"kid"`
+}
+
+// parse checks a token's signature and claims, returning its session
+func (a *JWT) parse(token string) (s auth.Session, err error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return s, ErrBadToken
+	}
+	var h header
+	if err := decode(parts[0], &h); err != nil {
+		return s, err
+	}
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return s, ErrBadToken
+	}
+	if !a.verify(h, []byte(parts[0]+"."+parts[1]), signature) {
+		return s, ErrBadSignature
+	}
+	var claims map[string]interface{}
+	if err := decode(parts[1], &claims); err != nil {
+		return s, err
+	}
+	return a.session(claims)
+}
+
+// verify checks the signature with the keys for the token's algorithm, and
+// key ID if it has one. The algorithm must match the key, so that a public
+// key can't be used as an HMAC secret
+func (a *JWT) verify(h header, signed []byte, signature []byte) bool {
+	for _, k := range a.keys {
+		if k.alg != h.Alg || (h.Kid != "" && k.id != "" && k.id != h.Kid) {
+			continue
+		}
+		if k.verify(signed, signature) {
+			return true
+		}
+	}
+	return false
+}
+
+// session checks the claims, returning the session they give
+func (a *JWT) session(claims map[string]interface{}) (s auth.Session, err error) {
+	now := time.Now()
+	exp, ok := claims["exp"].(float64)
+	if !ok {
+		return s, ErrBadToken
+	}
+	s.Expires = time.Unix(int64(exp), 0).Add(a.config.Leeway)
+	if now.After(s.Expires) {
+		return s, ErrExpired
+	}
+	if nbf, ok := claims["nbf"].(float64); ok && now.Add(a.config.Leeway).Before(time.Unix(int64(nbf), 0)) {
+		return s, ErrNotYetValid
+	}
+	if a.config.Issuer != "" && claims["iss"] != a.config.Issuer {
+		return s, ErrIssuer
+	}
+	if a.config.Audience != "" && !hasAudience(claims["aud"], a.config.Audience) {
+		return s, ErrAudience
+	}
+	s.Username, _ = claims[a.config.UsernameClaim].(string)
+	if s.Username == "" {
+		return s, ErrNoUsername
+	}
+	if rights, ok := claims[a.config.RightsClaim].(string); ok {
+		s.Rights = rights
+	} else {
+		s.Rights = strings.Replace(a.config.DefaultRights, "{username}", s.Username, -1)
+	}
+	return s, nil
+}
+
+// hasAudience returns true if aud, a string or list of strings, includes
+// audience
+func hasAudience(aud interface{}, audience string) bool {
+	switch aud := aud.(type) {
+	case string:
+		return aud == audience
+	case []interface{}:
+		for _, a := range aud {
+			if a == audience {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// decode decodes a base64url encoded JSON part of a token into v
+func decode(part string, v interface{}) error {
+	data, err := base64.RawURLEncoding.DecodeString(part)
+	if err != nil {
+		return ErrBadToken
+	}
+	if err := json.Unmarshal(data, v); err != nil {
+		return ErrBadToken
+	}
+	return nil
+}
+
+/*
+ * AuthenticateSession checks the token given as the password. The username
+ * must be the token's, or empty to use the token's
+ */
+func (a *JWT) AuthenticateSession(username string, password string) (s auth.Session, ok bool) {
+	s, err := a.parse(password)
+	if err != nil {
+		logger.Debug("Token refused", "username", username, "error", err)
+		return s, false
+	}
+	if username != "" && username != s.Username {
+		logger.Debug("Token is for another user", "username", username, "token", s.Username)
+		return s, false
+	}
+	return s, true
+}
+
+// Authenticate checks the token given as the password
+func (a *JWT) Authenticate(username string, password string) bool {
+	_, ok := a.AuthenticateSession(username, password)
+	return ok
+}
+
+// Rights returns an empty string, as rights are only known from a token
+func (a *JWT) Rights(username string) (rights string) {
+	return ""
+}
+
+// User returns ErrUserNotFound, as users are only known from a token
+func (a *JWT) User(username string) (u auth.User, err error) {
+	return auth.User{Username: username}, ErrUserNotFound
+}
+
+// UserExists returns false, as users are only known from a token
+func (a *JWT) UserExists(username string) bool {
+	return false
+}
+
+// AddOrUpdateUser returns ErrReadOnly, as users are managed by the token
+// issuer
+func (a *JWT) AddOrUpdateUser(username string, password string) (err error) {
+	return ErrReadOnly
+}
+
+// SetRights returns ErrReadOnly
+func (a *JWT) SetRights(username string, rights string) (err error) {
+	return ErrReadOnly
+}
+
+// DeleteUser returns ErrReadOnly
+func (a *JWT) DeleteUser(username string) (err error) {
+	return ErrReadOnly
+}
+
+// DisableUser returns ErrReadOnly
+func (a *JWT) DisableUser(username string) (err error) {
+	return ErrReadOnly
+}
+
+// EnableUser returns ErrReadOnly
+func (a *JWT) EnableUser(username string) (err error) {
+	return ErrReadOnly
+}
+
+// ListUsers returns ErrReadOnly, as users aren't known until they connect
+func (a *JWT) ListUsers(prefix string, after string, limit int) (users []auth.User, err error) {
+	return nil, ErrReadOnly
+}
@@ -0,0 +1,172 @@
+package jwt
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+var b64 = base64.RawURLEncoding
+
+// sign returns a token of claims, signed with secret, an RSA key or a P-256
+// key
+func sign(t *testing.T, kid string, claims map[string]interface{}, signer interface{}) string {
+	h := header{Kid: kid}
+	switch signer.(type) {
+	case []byte:
+		h.Alg = "HS256"
+	case *rsa.PrivateKey:
+		h.Alg = "RS256"
+	case *ecdsa.PrivateKey:
+		h.Alg = "ES256"
+	}
+	hj, _ := json.Marshal(h)
+	cj, _ := json.Marshal(claims)
+	signed := b64.EncodeToString(hj) + "." + b64.EncodeToString(cj)
+	hash := sha256.Sum256([]byte(signed))
+	var signature []byte
+	var err error
+	switch key := signer.(type) {
+	case []byte:
+		mac := hmac.New(sha256.New, key)
+		mac.Write([]byte(signed))
+		signature = mac.Sum(nil)
+	case *rsa.PrivateKey:
+		signature, err = rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, hash[:])
+	case *ecdsa.PrivateKey:
+		var r, s *big.Int
+		r, s, err = ecdsa.Sign(rand.Reader, key, hash[:])
+		signature = make([]byte, 64)
+		if err == nil {
+			r.FillBytes(signature[:32])
+			s.FillBytes(signature[32:])
+		}
+	}
+	if err != nil {
+		t.Fatal("Error signing token:", err)
+	}
+	return signed + "." + b64.EncodeToString(signature)
+}
+
+func claims(sub string, ttl time.Duration) map[string]interface{} {
+	return map[string]interface{}{"sub": sub, "exp": time.Now().Add(ttl).Unix()}
+}
+
+func tempFile(t *testing.T, dir string, name string, data []byte) string {
+	path := filepath.Join(dir, name)
+	if err := ioutil.WriteFile(path, data, 0600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestHMAC(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "authjwt")
+	defer os.RemoveAll(dir)
+	secret := []byte("secret")
+	a, err := New(Config{
+		KeyFile:       tempFile(t, dir, "secret", []byte("secret\n")),
+		Audience:      "mqtt",
+		DefaultRights: "{username}/#",
+	})
+	if err != nil {
+		t.Fatal("Error setting up:", err)
+	}
+
+	c := claims("ABC-123", time.Minute)
+	c["aud"] = []string{"web", "mqtt"}
+	token := sign(t, "", c, secret)
+	s, ok := a.AuthenticateSession("", token)
+	if !ok || s.Username != "ABC-123" || s.Rights != "ABC-123/#" || s.Expires.Before(time.Now()) {
+		t.Errorf("Expected session for ABC-123, got %v, %v", s, ok)
+	}
+	if !a.Authenticate("ABC-123", token) || a.Authenticate("XYZ-789", token) {
+		t.Error("Expected token to authenticate only its own user")
+	}
+	// Rights are only known from the token
+	if rights := a.Rights("ABC-123"); rights != "" {
+		t.Errorf("Expected no rights without a token, got %q", rights)
+	}
+	if _, err := a.User("ABC-123"); err != ErrUserNotFound {
+		t.Errorf("Expected user not to be found without a token, got %v", err)
+	}
+
+	c["rights"] = "ABC-123/in/#"
+	if s, _ := a.AuthenticateSession("", sign(t, "", c, secret)); s.Rights != "ABC-123/in/#" {
+		t.Errorf("Expected rights from the token, got %q", s.Rights)
+	}
+
+	other := strings.Split(sign(t, "", claims("XYZ-789", time.Minute), secret), ".")
+	parts := strings.Split(token, ".")
+	refused := map[string]string{
+		"expired":         sign(t, "", claims("ABC-123", -time.Minute), secret),
+		"wrong audience":  sign(t, "", claims("ABC-123", time.Minute), secret),
+		"wrong secret":    sign(t, "", c, []byte("other")),
+		"no username":     sign(t, "", claims("", time.Minute), secret),
+		"not a token":     "secret",
+		"tampered claims": parts[0] + "." + other[1] + "." + parts[2],
+	}
+	for reason, token := range refused {
+		if a.Authenticate("", token) {
+			t.Errorf("Expected token to be refused: %s", reason)
+		}
+	}
+}
+
+func TestPublicKeys(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "authjwt")
+	defer os.RemoveAll(dir)
+	rsaKey, _ := rsa.GenerateKey(rand.Reader, 2048)
+	ecKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+
+	// A PEM public key
+	der, _ := x509.MarshalPKIXPublicKey(&rsaKey.PublicKey)
+	pemFile := tempFile(t, dir, "rsa.pem", pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der}))
+	a, err := New(Config{KeyFile: pemFile})
+	if err != nil {
+		t.Fatal("Error reading PEM key:", err)
+	}
+	if !a.Authenticate("ABC-123", sign(t, "", claims("ABC-123", time.Minute), rsaKey)) {
+		t.Error("Expected RS256 token to authenticate")
+	}
+	// The public key must not be usable as an HMAC secret
+	if a.Authenticate("ABC-123", sign(t, "", claims("ABC-123", time.Minute), pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der}))) {
+		t.Error("Expected HS256 token signed with the public key to be refused")
+	}
+
+	// A key set, chosen between by key ID
+	set := map[string]interface{}{"keys": []map[string]string{
+		{"kty": "RSA", "kid": "rsa", "n": b64.EncodeToString(rsaKey.N.Bytes()), "e": b64.EncodeToString(big.NewInt(int64(rsaKey.E)).Bytes())},
+		{"kty": "EC", "kid": "ec", "crv": "P-256", "x": b64.EncodeToString(ecKey.X.Bytes()), "y": b64.EncodeToString(ecKey.Y.Bytes())},
+		{"kty": "RSA", "kid": "enc", "use": "enc", "n": "AQAB", "e": "AQAB"},
+	}}
+	data, _ := json.Marshal(set)
+	a, err = New(Config{JWKSFile: tempFile(t, dir, "jwks.json", data)})
+	if err != nil {
+		t.Fatal("Error reading key set:", err)
+	}
+	if !a.Authenticate("ABC-123", sign(t, "rsa", claims("ABC-123", time.Minute), rsaKey)) {
+		t.Error("Expected RS256 token to authenticate")
+	}
+	if !a.Authenticate("ABC-123", sign(t, "ec", claims("ABC-123", time.Minute), ecKey)) {
+		t.Error("Expected ES256 token to authenticate")
+	}
+	if a.Authenticate("ABC-123", sign(t, "rsa", claims("ABC-123", time.Minute), ecKey)) {
+		t.Error("Expected token with the wrong key ID to be refused")
+	}
+}
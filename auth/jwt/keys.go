@@ -0,0 +1,194 @@
+package jwt
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"io/ioutil"
+	"math/big"
+	"strings"
+)
+
+var (
+	ErrNoKeys       = errors.New("No usable keys found")
+	ErrBadKey       = errors.New("Unsupported or malformed key")
+	ErrBadSignature = errors.New("Token signature does not match")
+)
+
+// key is a key to check signatures with, for one algorithm
+type key struct {
+	id  string // Key ID, to match the token's "kid", if any
+	alg string // HS256, RS256 or ES256
+	key interface{}
+}
+
+// verify checks the signature of a signed token's header and claims
+func (k *key) verify(signed []byte, signature []byte) bool {
+	hash := sha256.Sum256(signed)
+	switch pub := k.key.(type) {
+	case []byte:
+		mac := hmac.New(sha256.New, pub)
+		mac.Write(signed)
+		return hmac.Equal(mac.Sum(nil), signature)
+	case *rsa.PublicKey:
+		return rsa.VerifyPKCS1v15(pub, crypto.SHA256, hash[:], signature) == nil
+	case *ecdsa.PublicKey:
+		// Signatures are r and s, each 32 bytes for P-256
+		if len(signature) != 64 {
+			return false
+		}
+		r := new(big.Int).SetBytes(signature[:32])
+		s := new(big.Int).SetBytes(signature[32:])
+		return ecdsa.Verify(pub, hash[:], r, s)
+	}
+	return false
+}
+
+/*
+ * readKeyFile reads a PEM encoded RSA or P-256 public key, or certificate,
+ * for RS256 or ES256. Anything else is taken as an HS256 secret, less any
+ * trailing new line
+ */
+func readKeyFile(path string) (keys []*key, err error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(data)
+	if block == nil {
+		secret := strings.TrimRight(string(data), "\r\n")
+		if secret == "" {
+			return nil, ErrNoKeys
+		}
+		return []*key{{alg: "HS256", key: []byte(secret)}}, nil
+	}
+	var pub interface{}
+	switch block.Type {
+	case "PUBLIC KEY":
+		pub, err = x509.ParsePKIXPublicKey(block.Bytes)
+	case "RSA PUBLIC KEY":
+		pub, err = x509.ParsePKCS1PublicKey(block.Bytes)
+	case "CERTIFICATE":
+		var cert *x509.Certificate
+		if cert, err = x509.ParseCertificate(block.Bytes); err == nil {
+			pub = cert.PublicKey
+		}
+	default:
+		return nil, ErrBadKey
+	}
+	if err != nil {
+		return nil, err
+	}
+	k, err := publicKey(pub)
+	if err != nil {
+		return nil, err
+	}
+	return []*key{k}, nil
+}
+
+// publicKey returns a key for an RSA or P-256 public key
+func publicKey(pub interface{}) (*key, error) {
+	switch pub := pub.(type) {
+	case *rsa.PublicKey:
+		return &key{alg: "RS256", key: pub}, nil
+	case *ecdsa.PublicKey:
+		if pub.Curve != elliptic.P256() {
+			return nil, ErrBadKey
+		}
+		return &key{alg: "ES256", key: pub}, nil
+	}
+	return nil, ErrBadKey
+}
+
+// jwk is a JSON Web Key, as in RFC 7517, of the types supported
+type jwk struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Alg string `json:"alg"`
+	Use string `json:"use"`
+	N   string `json:"n"`   // RSA modulus
+	E   string `json:"e"`   // RSA exponent
+	Crv string `json:"crv"` // EC curve
+	X   string `json:"x"`   // EC point
+	Y   string `json:"y"`
+	K   string `json:"k"` // Symmetric key
+}
+
+/*
+ * readJWKSFile reads a JSON Web Key Set, as published by identity
+ * providers. Keys of unsupported types, or not for signing, are skipped
+ */
+func readJWKSFile(path string) (keys []*key, err error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var set struct {
+		Keys []jwk `json:"keys"`
+	}
+	if err := json.Unmarshal(data, &set); err != nil {
+		return nil, err
+	}
+	for _, j := range set.Keys {
+		if j.Use != "" && j.Use != "sig" {
+			continue
+		}
+		k, err := j.key()
+		if err != nil {
+			logger.Warn("Skipping key", "kid", j.Kid, "kty", j.Kty, "error", err)
+			continue
+		}
+		if j.Alg != "" && j.Alg != k.alg {
+			logger.Warn("Skipping key for unsupported algorithm", "kid", j.Kid, "alg", j.Alg)
+			continue
+		}
+		keys = append(keys, k)
+	}
+	if len(keys) == 0 {
+		return nil, ErrNoKeys
+	}
+	return keys, nil
+}
+
+func (j *jwk) key() (k *key, err error) {
+	b64 := base64.RawURLEncoding
+	switch j.Kty {
+	case "oct":
+		secret, err := b64.DecodeString(j.K)
+		if err != nil || len(secret) == 0 {
+			return nil, ErrBadKey
+		}
+		k = &key{alg: "HS256", key: secret}
+	case "RSA":
+		n, err1 := b64.DecodeString(j.N)
+		e, err2 := b64.DecodeString(j.E)
+		if err1 != nil || err2 != nil || len(e) > 4 {
+			return nil, ErrBadKey
+		}
+		exponent := int(new(big.Int).SetBytes(e).Int64())
+		k = &key{alg: "RS256", key: &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: exponent}}
+	case "EC":
+		x, err1 := b64.DecodeString(j.X)
+		y, err2 := b64.DecodeString(j.Y)
+		if j.Crv != "P-256" || err1 != nil || err2 != nil {
+			return nil, ErrBadKey
+		}
+		pub := &ecdsa.PublicKey{Curve: elliptic.P256(), X: new(big.Int).SetBytes(x), Y: new(big.Int).SetBytes(y)}
+		if !pub.Curve.IsOnCurve(pub.X, pub.Y) {
+			return nil, ErrBadKey
+		}
+		k = &key{alg: "ES256", key: pub}
+	default:
+		return nil, ErrBadKey
+	}
+	k.id = j.Kid
+	return k, nil
+}
@@ -0,0 +1,342 @@
+/*
+ * Package sql keeps users in a PostgreSQL or SQLite database. By default
+ * it uses this schema:
+ *
+ *   CREATE TABLE users (
+ *       username TEXT PRIMARY KEY,
+ *       password TEXT NOT NULL,                  -- bcrypt hash
+ *       rights   TEXT NOT NULL DEFAULT '',       -- topic filter, as used by tuser
+ *       disabled BOOLEAN NOT NULL DEFAULT FALSE
+ *   );
+ *
+ * Other schemas can be used by setting the queries in Config.
+ */
+package sql
+
+import (
+	"database/sql"
+	"github.com/trafero/tstack/audit"
+	"github.com/trafero/tstack/auth"
+	"github.com/trafero/tstack/logging"
+	"golang.org/x/crypto/bcrypt"
+	"gopkg.in/yaml.v2"
+	"io/ioutil"
+	"math"
+	"time"
+
+	_ "github.com/lib/pq"
+	_ "github.com/mattn/go-sqlite3"
+)
+
+var logger = logging.New("auth")
+
+var ErrUserNotFound = auth.ErrUserNotFound
+
+/*
+ * Default queries. Arguments are given in the order listed for each, as $1,
+ * $2..., which both PostgreSQL and SQLite accept as long as they appear in
+ * order in the query
+ */
+const (
+	// Given the username, returns the password hash and, optionally, whether
+	// the user is disabled
+	DefaultUserQuery = "SELECT password, disabled FROM users WHERE username = $1"
+	// Given the username, returns the rights. No rows is no rights
+	DefaultRightsQuery = "SELECT rights FROM users WHERE username = $1"
+	// Given the username and password hash, adds or updates the user
+	DefaultAddUserQuery = "INSERT INTO users (username, password) VALUES ($1, $2) ON CONFLICT (username) DO UPDATE SET password = excluded.password"
+	// Given the rights and username, sets the user's rights
+	DefaultSetRightsQuery = "UPDATE users SET rights = $1 WHERE username = $2"
+	// Given the username, removes the user
+	DefaultDeleteUserQuery = "DELETE FROM users WHERE username = $1"
+	// Given whether the user is disabled and the username, sets it
+	DefaultSetDisabledQuery = "UPDATE users SET disabled = $1 WHERE username = $2"
+	// Given a prefix, a username to start after and a limit, returns the
+	// username, rights and whether disabled of each user, in username order
+	DefaultListUsersQuery = "SELECT username, rights, disabled FROM users WHERE substr(username, 1, length($1)) = $1 AND username > $2 ORDER BY username LIMIT $3"
+)
+
+// Config is the database to use, and how to use it. Empty queries and zero
+// limits take their defaults
+type Config struct {
+	Driver string // "postgres" or "sqlite3"
+	DSN    string // e.g. "postgres://tstack:secret@db/tstack?sslmode=require" or "/var/lib/trafero/users.db"
+
+	UserQuery        string
+	RightsQuery      string
+	AddUserQuery     string
+	SetRightsQuery   string
+	DeleteUserQuery  string
+	SetDisabledQuery string
+	ListUsersQuery   string
+
+	MaxOpenConns    int           // Most connections open at once (default 10)
+	MaxIdleConns    int           // Most idle connections kept open (default 2)
+	ConnMaxLifetime time.Duration // Connections are closed after this long (default 1 hour)
+}
+
+// ReadConfig reads a Config from a YAML file, with lower case keys, e.g.
+// "driver: postgres"
+func ReadConfig(path string) (c Config, err error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return c, err
+	}
+	err = yaml.Unmarshal(data, &c)
+	return c, err
+}
+
+// SQL is authentication with users kept in a database
+type SQL struct {
+	db     *sql.DB
+	config Config
+	audit  audit.Sink // Audit trail of user changes. May be nil
+}
+
+// New opens the database given in c. Connections are made as needed, and
+// pooled
+func New(c Config) (a *SQL, err error) {
+	if c.UserQuery == "" {
+		c.UserQuery = DefaultUserQuery
+	}
+	if c.RightsQuery == "" {
+		c.RightsQuery = DefaultRightsQuery
+	}
+	if c.AddUserQuery == "" {
+		c.AddUserQuery = DefaultAddUserQuery
+	}
+	if c.SetRightsQuery == "" {
+		c.SetRightsQuery = DefaultSetRightsQuery
+	}
+	if c.DeleteUserQuery == "" {
+		c.DeleteUserQuery = DefaultDeleteUserQuery
+	}
+	if c.SetDisabledQuery == "" {
+		c.SetDisabledQuery = DefaultSetDisabledQuery
+	}
+	if c.ListUsersQuery == "" {
+		c.ListUsersQuery = DefaultListUsersQuery
+	}
+	if c.MaxOpenConns == 0 {
+		c.MaxOpenConns = 10
+	}
+	if c.MaxIdleConns == 0 {
+		c.MaxIdleConns = 2
+	}
+	if c.ConnMaxLifetime == 0 {
+		c.ConnMaxLifetime = time.Hour
+	}
+
+	db, err := sql.Open(c.Driver, c.DSN)
+	if err != nil {
+		return nil, err
+	}
+	db.SetMaxOpenConns(c.MaxOpenConns)
+	db.SetMaxIdleConns(c.MaxIdleConns)
+	db.SetConnMaxLifetime(c.ConnMaxLifetime)
+	if err = db.Ping(); err != nil {
+		db.Close()
+		return nil, err
+	}
+	return &SQL{db: db, config: c}, nil
+}
+
+// SetAudit sets the sink for recording user changes
+func (a *SQL) SetAudit(s audit.Sink) {
+	a.audit = s
+}
+
+// Close closes the database
+func (a *SQL) Close() error {
+	return a.db.Close()
+}
+
+// Returns user object for a given username
+func (a *SQL) User(username string) (u auth.User, err error) {
+	u = auth.User{Username: username}
+	err = a.user(&u)
+	if err == sql.ErrNoRows {
+		return u, ErrUserNotFound
+	} else if err != nil {
+		logger.Warn("Could not retrieve user from the database", "username", username, "error", err)
+		return u, err
+	}
+	u.Rights, err = a.rights(username)
+	return u, err
+}
+
+// user reads the password, and whether disabled if the query gives it
+func (a *SQL) user(u *auth.User) error {
+	rows, err := a.db.Query(a.config.UserQuery, u.Username)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	if !rows.Next() {
+		if err := rows.Err(); err != nil {
+			return err
+		}
+		return sql.ErrNoRows
+	}
+	columns, err := rows.Columns()
+	if err != nil {
+		return err
+	}
+	if len(columns) > 1 {
+		return rows.Scan(&u.Password, &u.Disabled)
+	}
+	return rows.Scan(&u.Password)
+}
+
+// Authenticate checks the given password with the hashed version in the
+// database
+func (a *SQL) Authenticate(username string, password string) bool {
+	u, err := a.User(username)
+	if err != nil {
+		logger.Debug("Error retrieving user", "username", username, "error", err)
+		return false
+	}
+	if u.Disabled {
+		logger.Debug("User disabled", "username", username)
+		return false
+	}
+	if err := bcrypt.CompareHashAndPassword([]byte(u.Password), []byte(password)); err != nil {
+		logger.Debug("Passwords do not match", "username", username)
+		return false
+	}
+	logger.Debug("Passwords match", "username", username)
+	return true
+}
+
+// AddOrUdpdateUser adds or updates a user's password, saving a hash of the
+// password
+func (a *SQL) AddOrUpdateUser(username string, password string) (err error) {
+	_, err = a.db.Exec(a.config.AddUserQuery, username, auth.Hash(password))
+	if err != nil {
+		logger.Error("Error saving user", "username", username, "error", err)
+	} else {
+		logger.Info("User saved", "username", username)
+	}
+	a.record(audit.AddUser, username, "", err)
+	return err
+}
+
+// SetRights sets user rights
+func (a *SQL) SetRights(username string, rights string) (err error) {
+	err = a.exec(a.config.SetRightsQuery, rights, username)
+	if err != nil {
+		logger.Error("Error saving user rights", "username", username, "error", err)
+	}
+	a.record(audit.SetRights, username, rights, err)
+	return err
+}
+
+// DeleteUser removes a user
+func (a *SQL) DeleteUser(username string) (err error) {
+	err = a.exec(a.config.DeleteUserQuery, username)
+	if err != nil && err != ErrUserNotFound {
+		logger.Error("Error deleting user", "username", username, "error", err)
+	} else if err == nil {
+		logger.Info("User deleted", "username", username)
+	}
+	a.record(audit.DeleteUser, username, "", err)
+	return err
+}
+
+// DisableUser stops a user authenticating, keeping their details
+func (a *SQL) DisableUser(username string) (err error) {
+	err = a.exec(a.config.SetDisabledQuery, true, username)
+	if err != nil && err != ErrUserNotFound {
+		logger.Error("Error disabling user", "username", username, "error", err)
+	}
+	a.record(audit.DisableUser, username, "", err)
+	return err
+}
+
+// EnableUser lets a disabled user authenticate again
+func (a *SQL) EnableUser(username string) (err error) {
+	err = a.exec(a.config.SetDisabledQuery, false, username)
+	if err != nil && err != ErrUserNotFound {
+		logger.Error("Error enabling user", "username", username, "error", err)
+	}
+	a.record(audit.EnableUser, username, "", err)
+	return err
+}
+
+// exec runs a query that changes a user, returning ErrUserNotFound if no
+// rows were changed
+func (a *SQL) exec(query string, args ...interface{}) error {
+	result, err := a.db.Exec(query, args...)
+	if err != nil {
+		return err
+	}
+	n, err := result.RowsAffected()
+	if err == nil && n == 0 {
+		err = ErrUserNotFound
+	}
+	return err
+}
+
+// ListUsers returns up to limit users whose usernames start with prefix,
+// after the username given in after. Passwords are not read
+func (a *SQL) ListUsers(prefix string, after string, limit int) (users []auth.User, err error) {
+	if limit <= 0 {
+		limit = math.MaxInt32
+	}
+	rows, err := a.db.Query(a.config.ListUsersQuery, prefix, after, limit)
+	if err != nil {
+		logger.Warn("Could not list users from the database", "error", err)
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var u auth.User
+		var rights sql.NullString
+		if err := rows.Scan(&u.Username, &rights, &u.Disabled); err != nil {
+			return nil, err
+		}
+		u.Rights = rights.String
+		users = append(users, u)
+	}
+	return users, rows.Err()
+}
+
+// Rights returns a user's rights, or an empty string if they have none
+func (a *SQL) Rights(username string) (rights string) {
+	rights, err := a.rights(username)
+	if err != nil {
+		logger.Warn("Could not retrieve user rights from the database", "username", username, "error", err)
+	}
+	return rights
+}
+
+func (a *SQL) rights(username string) (rights string, err error) {
+	var r sql.NullString
+	err = a.db.QueryRow(a.config.RightsQuery, username).Scan(&r)
+	if err == sql.ErrNoRows {
+		return "", nil
+	}
+	return r.String, err
+}
+
+// UserExists returns true if the user exists and false for anything else
+func (a *SQL) UserExists(username string) bool {
+	_, err := a.User(username)
+	return err == nil
+}
+
+// record adds a user change to the audit trail. For rights changes, the
+// topic is the new rights expression
+func (a *SQL) record(action string, username string, topic string, err error) {
+	e := audit.Event{
+		Username: username,
+		Action:   action,
+		Topic:    topic,
+		Decision: audit.Success,
+	}
+	if err != nil {
+		e.Decision = audit.Failure
+		e.Reason = err.Error()
+	}
+	audit.Record(a.audit, e)
+}
@@ -0,0 +1,125 @@
+package sql
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+const schema = `CREATE TABLE users (
+	username TEXT PRIMARY KEY,
+	password TEXT NOT NULL,
+	rights   TEXT NOT NULL DEFAULT '',
+	disabled BOOLEAN NOT NULL DEFAULT FALSE
+)`
+
+func testDB(t *testing.T, c Config) (a *SQL, cleanup func()) {
+	dir, err := ioutil.TempDir("", "authsql")
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.Driver = "sqlite3"
+	c.DSN = filepath.Join(dir, "users.db")
+	a, err = New(c)
+	if err != nil {
+		os.RemoveAll(dir)
+		t.Skip("SQLite not available:", err)
+	}
+	if _, err := a.db.Exec(schema); err != nil {
+		t.Fatal("Error creating schema:", err)
+	}
+	return a, func() {
+		a.Close()
+		os.RemoveAll(dir)
+	}
+}
+
+func TestSQL(t *testing.T) {
+	a, cleanup := testDB(t, Config{})
+	defer cleanup()
+
+	if a.UserExists("ABC-123") || a.Authenticate("ABC-123", "secret") {
+		t.Error("Expected unknown user not to exist")
+	}
+	if err := a.SetRights("ABC-123", "#"); err != ErrUserNotFound {
+		t.Errorf("Expected user not found setting rights, got %v", err)
+	}
+	if err := a.AddOrUpdateUser("ABC-123", "secret"); err != nil {
+		t.Fatal("Error adding user:", err)
+	}
+	if err := a.SetRights("ABC-123", "ABC-123/#"); err != nil {
+		t.Fatal("Error setting rights:", err)
+	}
+	if !a.Authenticate("ABC-123", "secret") || a.Authenticate("ABC-123", "wrong") {
+		t.Error("Expected only the right password to authenticate")
+	}
+	if rights := a.Rights("ABC-123"); rights != "ABC-123/#" {
+		t.Errorf("Expected rights ABC-123/#, got %q", rights)
+	}
+
+	// Updating the password keeps the rights
+	if err := a.AddOrUpdateUser("ABC-123", "changed"); err != nil {
+		t.Fatal("Error updating user:", err)
+	}
+	u, err := a.User("ABC-123")
+	if err != nil || u.Rights != "ABC-123/#" || !a.Authenticate("ABC-123", "changed") {
+		t.Errorf("Expected updated password and same rights, got %v, %v", u, err)
+	}
+}
+
+func TestQueries(t *testing.T) {
+	// Rights kept in a table of their own
+	a, cleanup := testDB(t, Config{
+		RightsQuery:    "SELECT filter FROM acl WHERE username = $1",
+		SetRightsQuery: "INSERT INTO acl (filter, username) VALUES ($1, $2)",
+	})
+	defer cleanup()
+	if _, err := a.db.Exec("CREATE TABLE acl (username TEXT PRIMARY KEY, filter TEXT)"); err != nil {
+		t.Fatal("Error creating schema:", err)
+	}
+	a.AddOrUpdateUser("ABC-123", "secret")
+	if rights := a.Rights("ABC-123"); rights != "" {
+		t.Errorf("Expected no rights, got %q", rights)
+	}
+	if err := a.SetRights("ABC-123", "ABC-123/#"); err != nil {
+		t.Fatal("Error setting rights:", err)
+	}
+	if rights := a.Rights("ABC-123"); rights != "ABC-123/#" {
+		t.Errorf("Expected rights ABC-123/#, got %q", rights)
+	}
+}
+
+func TestLifecycle(t *testing.T) {
+	a, cleanup := testDB(t, Config{})
+	defer cleanup()
+	for _, username := range []string{"ABC-123", "ABC-456", "XYZ-789"} {
+		a.AddOrUpdateUser(username, "secret")
+		a.SetRights(username, username+"/#")
+	}
+
+	if err := a.DisableUser("ABC-123"); err != nil {
+		t.Fatal("Error disabling user:", err)
+	}
+	if u, _ := a.User("ABC-123"); !u.Disabled || a.Authenticate("ABC-123", "secret") {
+		t.Error("Expected disabled user not to authenticate")
+	}
+	if err := a.EnableUser("ABC-123"); err != nil || !a.Authenticate("ABC-123", "secret") {
+		t.Errorf("Expected enabled user to authenticate, got %v", err)
+	}
+	if err := a.DeleteUser("ABC-456"); err != nil {
+		t.Fatal("Error deleting user:", err)
+	}
+	if err := a.DeleteUser("ABC-456"); err != ErrUserNotFound {
+		t.Errorf("Expected user not found deleting twice, got %v", err)
+	}
+
+	list, err := a.ListUsers("ABC-", "", 0)
+	if err != nil || len(list) != 1 || list[0].Username != "ABC-123" || list[0].Rights != "ABC-123/#" {
+		t.Errorf("Expected ABC-123 listed, got %v, %v", list, err)
+	}
+	list, _ = a.ListUsers("", "ABC-123", 1)
+	if len(list) != 1 || list[0].Username != "XYZ-789" {
+		t.Errorf("Expected second page of XYZ-789, got %v", list)
+	}
+}
@@ -1,16 +1,18 @@
 package auth
 
 import (
+	"github.com/trafero/tstack/logging"
 	"golang.org/x/crypto/bcrypt"
-	"log"
 )
 
+var logger = logging.New("auth")
+
 // hash returns a bcrypt "hash" of the given string
 func Hash(s string) (hashed string) {
 	hash, err := bcrypt.GenerateFromPassword([]byte(s), bcrypt.DefaultCost)
 	// TODO handle error
 	if err != nil {
-		log.Fatal(err)
+		logger.Fatal("Could not hash password", "error", err)
 	}
 	return string(hash)
 }
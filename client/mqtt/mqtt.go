@@ -1,83 +1,204 @@
 package mqtt
 
 import (
+	"context"
+	"errors"
 	paho "github.com/eclipse/paho.mqtt.golang"
 	"github.com/trafero/tstack/client/settings"
 	"github.com/trafero/tstack/tls"
+	"github.com/trafero/tstack/tstackutil"
 	"log"
+	"math/rand"
+	"sync"
 	"time"
 )
 
-const (
-	qos = 0
+var ErrClosed = errors.New("Client closed")
+
+var (
+	// Delay before the first attempt to connect again. Each attempt after
+	// that doubles the delay, up to MaxBackoff. Delays are randomised
+	// between half and all of their value, so that clients disconnected
+	// together don't all reconnect together
+	MinBackoff = time.Second
+	MaxBackoff = 2 * time.Minute
 )
 
 type Message struct {
-	Topic   string
-	Payload string
+	Topic     string
+	Payload   []byte
+	QoS       byte      // QoS the message was delivered at
+	Retained  bool      // Whether sent by the broker as a retained message on subscribing
+	Duplicate bool      // Whether possibly delivered before
+	Received  time.Time // When received by the client
+}
+
+// PayloadString returns the payload as a string
+func (msg Message) PayloadString() string {
+	return string(msg.Payload)
+}
+
+// State is the state of the connection to the broker
+type State int
+
+const (
+	Connecting     State = iota // Connecting for the first time
+	Connected                   // Connected
+	ConnectionLost              // The connection has been lost
+	Reconnecting                // Waiting to try connecting again, after a failed attempt
+	Closed                      // Closed with Close
+)
+
+func (s State) String() string {
+	switch s {
+	case Connecting:
+		return "connecting"
+	case Connected:
+		return "connected"
+	case ConnectionLost:
+		return "connection lost"
+	case Reconnecting:
+		return "reconnecting"
+	case Closed:
+		return "closed"
+	}
+	return "unknown"
 }
 
 type MQTT struct {
-	client  paho.Client
-	handler func(Message)
-	topics  []string // Topics subscribed to
+	// Updated atomically, so kept first for 64 bit alignment on 32 bit platforms
+	requestID uint64
+
+	client   paho.Client
+	clientid string
+	username string
+	qos      byte              // Default QoS
+	birth    *settings.Message // Published on connecting. May be nil
+	handler  func(Message)
+	topics   []route // Topics subscribed to, without their own handler
+	queue    *queue  // Publishes made while disconnected. May be nil
+
+	ctx    context.Context // Cancelled by Close, to stop reconnecting
+	cancel context.CancelFunc
+
+	mutex        sync.Mutex
+	state        State
+	stateHandler func(State, error)
+	deltaHandler DeltaHandler             // Set by HandleDelta. May be nil
+	publishes    sync.WaitGroup           // Publishes in progress, for Close to wait for
+	routes       []route                  // Subscriptions with their own handler, in order subscribed
+	requests     map[string]chan response // Requests awaiting a response, by response topic
+	responses    map[string]bool          // Response filters subscribed to
 }
 
+func newMQTT(s *settings.Settings) *MQTT {
+	ctx, cancel := context.WithCancel(context.Background())
+	return &MQTT{
+		clientid:  s.ClientId(),
+		username:  s.Username,
+		qos:       s.QoS,
+		birth:     s.Birth,
+		ctx:       ctx,
+		cancel:    cancel,
+		requests:  make(map[string]chan response),
+		responses: make(map[string]bool),
+	}
+}
+
+// New sets up a new session using TLS. It does not return until connected
 func New(s *settings.Settings) (m *MQTT, err error) {
+	return newWithContext(context.Background(), s, true)
+}
 
-	m = &MQTT{}
+// NewInsecure sets up a new session without TLS. It does not return until
+// connected
+func NewInsecure(s *settings.Settings) (m *MQTT, err error) {
+	return newWithContext(context.Background(), s, false)
+}
 
-	// Create paho MQTT Client
-	tlsconfig, err := tls.TLSClientConfig(s.CaCertFile)
+/*
+ * NewWithContext sets up a new session, using TLS if the broker URL is
+ * secure (e.g. ssl://). It returns once connected, or with the context's
+ * error if the context is done first. Once connected, the connection is
+ * made again whenever it is lost, until Close is called.
+ */
+func NewWithContext(ctx context.Context, s *settings.Settings) (m *MQTT, err error) {
+	secure, err := tstackutil.IsSecureUrl(s.Broker)
 	if err != nil {
 		return nil, err
 	}
-	tlsconfig.InsecureSkipVerify = !s.VerifyTls
-	opts := paho.NewClientOptions()
-	opts.SetClientID(s.ClientId())
-	opts.SetTLSConfig(tlsconfig)
-	opts.AddBroker(s.Broker)
-	opts.SetDefaultPublishHandler(m.controlMessageHandler)
-	opts.SetUsername(s.Username)
-	opts.SetPassword(s.Password)
-	opts.SetKeepAlive(30 * time.Second)
-	opts.SetConnectionLostHandler(m.connectionLostHandler)
-	c := paho.NewClient(opts)
-	m.client = c
-
-	m.connect()
-
-	return m, nil
+	return newWithContext(ctx, s, secure)
 }
 
-// NewInsecure sets up a new session without TLS
-func NewInsecure(s *settings.Settings) (m *MQTT, err error) {
+func newWithContext(ctx context.Context, s *settings.Settings, secure bool) (m *MQTT, err error) {
 
-	m = &MQTT{}
+	m = newMQTT(s)
+	if s.QueueFile != "" {
+		if m.queue, err = openQueue(s.QueueFile, s.QueueLimit); err != nil {
+			return nil, err
+		}
+	}
 
+	// Create paho MQTT Client
 	opts := paho.NewClientOptions()
+	if secure {
+		tlsconfig, err := tls.TLSClientConfig(s.CaCertFile)
+		if err != nil {
+			return nil, err
+		}
+		tlsconfig.InsecureSkipVerify = !s.VerifyTls
+		opts.SetTLSConfig(tlsconfig)
+	}
 	opts.SetClientID(s.ClientId())
 	opts.AddBroker(s.Broker)
 	opts.SetDefaultPublishHandler(m.controlMessageHandler)
 	opts.SetUsername(s.Username)
 	opts.SetPassword(s.Password)
 	opts.SetKeepAlive(30 * time.Second)
+	opts.SetConnectTimeout(30 * time.Second)
 	opts.SetConnectionLostHandler(m.connectionLostHandler)
-	c := paho.NewClient(opts)
-	m.client = c
+	opts.SetAutoReconnect(false) // connectionLostHandler reconnects
+	setWill(opts, s)
+	m.client = paho.NewClient(opts)
 
-	m.connect()
+	// Cancelling ctx only cancels connecting, not the session
+	stop := make(chan struct{})
+	defer close(stop)
+	connectCtx, cancel := context.WithCancel(m.ctx)
+	defer cancel()
+	go func() {
+		select {
+		case <-ctx.Done():
+			cancel()
+		case <-stop:
+		}
+	}()
 
+	if err = m.connect(connectCtx); err != nil {
+		m.cancel()
+		if m.queue != nil {
+			m.queue.close()
+		}
+		if ctx.Err() != nil {
+			err = ctx.Err()
+		}
+		return nil, err
+	}
 	return m, nil
 }
 
 func (m *MQTT) controlMessageHandler(client paho.Client, msg paho.Message) {
 	// log.Printf("Received topic: %s message: %s", msg.Topic(), msg.Payload())
-	if m.handler != nil {
-		message := Message{
-			Topic:   string(msg.Topic()),
-			Payload: string(msg.Payload()),
-		}
+	message := Message{
+		Topic:     msg.Topic(),
+		Payload:   msg.Payload(),
+		QoS:       msg.Qos(),
+		Retained:  msg.Retained(),
+		Duplicate: msg.Duplicate(),
+		Received:  time.Now(),
+	}
+	// Messages matching no SubscribeFunc filter go to the default handler
+	if !m.route(message) && m.handler != nil {
 		m.handler(message)
 	}
 }
@@ -86,10 +207,98 @@ func (m *MQTT) SetHandler(f func(Message)) {
 	m.handler = f
 }
 
-// sendMessage sends an MQTT message.
+/*
+ * SetStateHandler sets a function to be called each time the state of the
+ * connection changes, with the error that caused it, if any. The first
+ * connection is made before New returns, so State gives the state at the
+ * time the handler is set
+ */
+func (m *MQTT) SetStateHandler(f func(state State, err error)) {
+	m.mutex.Lock()
+	m.stateHandler = f
+	m.mutex.Unlock()
+}
+
+// State returns the current state of the connection
+func (m *MQTT) State() State {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	return m.state
+}
+
+func (m *MQTT) setState(state State, err error) {
+	m.mutex.Lock()
+	if m.state == Closed {
+		m.mutex.Unlock()
+		return
+	}
+	m.state = state
+	f := m.stateHandler
+	m.mutex.Unlock()
+	if f != nil {
+		f(state, err)
+	}
+}
+
+func setWill(opts *paho.ClientOptions, s *settings.Settings) {
+	if s.Will != nil {
+		opts.SetWill(s.Will.Topic, s.Will.Payload, s.Will.QoS, s.Will.Retain)
+	}
+}
+
+// PublishMessage sends an MQTT message at the default QoS, not retained
 func (m *MQTT) PublishMessage(topic string, payload string) error {
+	return m.Publish(topic, payload, m.qos, false)
+}
+
+// Publish sends an MQTT message with the given QoS and retain flag
+func (m *MQTT) Publish(topic string, payload string, qos byte, retain bool) error {
+	return m.PublishBytes(topic, []byte(payload), qos, retain)
+}
+
+/*
+ * PublishBytes sends an MQTT message with a binary payload, and the given
+ * QoS and retain flag. With a queue file set, messages published while
+ * disconnected, or while earlier ones are still queued, are queued to be
+ * sent in order once connected
+ */
+func (m *MQTT) PublishBytes(topic string, payload []byte, qos byte, retain bool) error {
+	if !m.startPublish() {
+		return ErrClosed
+	}
+	defer m.publishes.Done()
+
+	if m.queue != nil && (m.State() != Connected || m.queue.len() > 0) {
+		if err := m.queue.push(topic, payload, qos, retain); err != nil {
+			return err
+		}
+		if m.State() == Connected {
+			go m.flush()
+		}
+		return nil
+	}
+	err := m.publish(topic, payload, qos, retain)
+	if err != nil && m.queue != nil && !m.client.IsConnected() {
+		return m.queue.push(topic, payload, qos, retain)
+	}
+	return err
+}
+
+// startPublish reports whether a publish may go ahead, counting it as in
+// progress for Close if so
+func (m *MQTT) startPublish() bool {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	if m.state == Closed {
+		return false
+	}
+	m.publishes.Add(1)
+	return true
+}
+
+func (m *MQTT) publish(topic string, payload []byte, qos byte, retain bool) error {
 	// log.Printf("Sending topic %s and payload %s", topic, payload)
-	token := m.client.Publish(topic, qos, false, payload)
+	token := m.client.Publish(topic, qos, retain, payload)
 	if token.Error() != nil {
 		return token.Error()
 	}
@@ -97,42 +306,193 @@ func (m *MQTT) PublishMessage(topic string, payload string) error {
 	return token.Error()
 }
 
+// Subscribe subscribes to a topic at the default QoS, with messages going
+// to the handler set with SetHandler
 func (m *MQTT) Subscribe(topic string) {
+	m.SubscribeQoS(topic, m.qos)
+}
+
+// SubscribeQoS subscribes to a topic at the given QoS, with messages going
+// to the handler set with SetHandler
+func (m *MQTT) SubscribeQoS(topic string, qos byte) {
 	var token paho.Token
-	m.topics = append(m.topics, topic)
-	token = m.client.Subscribe(topic, byte(0), nil)
+	m.mutex.Lock()
+	m.topics = append(m.topics, route{filter: topic, qos: qos})
+	m.mutex.Unlock()
+	token = m.client.Subscribe(topic, qos, nil)
 	token.Wait()
 	if token.Error() != nil {
 		log.Printf("WARNING: %s\n", token.Error())
 	}
 }
 
+/*
+ * Close waits for publishes in progress to finish, or for the context to be
+ * done, then disconnects cleanly, so the broker discards the will. Returns
+ * the context's error if publishes were still in progress
+ */
+func (m *MQTT) Close(ctx context.Context) (err error) {
+	m.mutex.Lock()
+	if m.state == Closed {
+		m.mutex.Unlock()
+		return nil
+	}
+	m.state = Closed
+	f := m.stateHandler
+	m.mutex.Unlock()
+	m.cancel()
+
+	done := make(chan struct{})
+	go func() {
+		m.publishes.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-ctx.Done():
+		err = ctx.Err()
+	}
+	m.client.Disconnect(250)
+	if m.queue != nil {
+		m.queue.close()
+	}
+	if f != nil {
+		f(Closed, err)
+	}
+	return err
+}
+
 func (m *MQTT) connectionLostHandler(c paho.Client, err error) {
 	log.Printf("WARNING. Connection lost: %s\n", err)
+	m.setState(ConnectionLost, err)
+	go m.connect(m.ctx)
+}
+
+/*
+ * connect connects to the broker, trying again with exponential backoff
+ * until connected or the context is done. Subscriptions are renewed, and
+ * the birth message published, once connected
+ */
+func (m *MQTT) connect(ctx context.Context) (err error) {
 
-	m.connect()
+	log.Println("Attempting to connect")
 
-	// Re-subscribe to all the topics
-	for _, topic := range m.topics {
-		m.Subscribe(topic)
+	for attempt := 0; ; attempt++ {
+		if attempt > 0 {
+			delay := backoff(attempt)
+			log.Printf("Connection failure: %s. Trying again in %s", err, delay)
+			m.setState(Reconnecting, err)
+			select {
+			case <-time.After(delay):
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+		}
+		if err = m.connectOnce(ctx); err == nil {
+			break
+		}
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
 	}
+
+	log.Println("Connected")
+	m.setState(Connected, nil)
+	m.resubscribe()
+
+	// The birth message goes before any queued publishes
+	if m.birth != nil {
+		if err := m.publish(m.birth.Topic, []byte(m.birth.Payload), m.birth.QoS, m.birth.Retain); err != nil {
+			log.Printf("WARNING: Could not publish birth message: %s", err)
+		}
+	}
+	if m.queue != nil {
+		go m.flush()
+	}
+	go m.syncShadow()
+	return nil
 }
 
-func (m *MQTT) connect() {
+/*
+ * flush sends queued publishes in order while connected, taking each off
+ * the queue once sent. Anything left is sent after connecting again
+ */
+func (m *MQTT) flush() {
+	for m.queue.startFlush() {
+		sent := m.sendQueued()
+		m.queue.stopFlush()
+		// Publishes queued as the last was sent would otherwise wait for the
+		// next flush
+		if !sent || m.State() != Connected || m.queue.len() == 0 {
+			return
+		}
+	}
+}
 
-	log.Println("Attempting to connect")
+// sendQueued sends queued publishes until the queue is empty, returning
+// false if they could not all be sent
+func (m *MQTT) sendQueued() bool {
+	for m.State() == Connected {
+		msg, ok := m.queue.peek()
+		if !ok {
+			return true
+		}
+		if !m.startPublish() {
+			return false
+		}
+		err := m.publish(msg.Topic, msg.Payload, msg.QoS, msg.Retain)
+		m.publishes.Done()
+		if err != nil {
+			log.Printf("WARNING: Could not send queued publish: %s", err)
+			return false
+		}
+		m.queue.remove(msg.Seq)
+	}
+	return false
+}
 
-	for {
-		token := m.client.Connect()
-		if token.Error() != nil {
-			log.Printf("Connection failure: %s", token.Error())
+// connectOnce makes one attempt to connect, giving up if the context is done
+func (m *MQTT) connectOnce(ctx context.Context) error {
+	token := m.client.Connect()
+	for !token.WaitTimeout(100 * time.Millisecond) {
+		if ctx.Err() != nil {
+			// The attempt can't be stopped, so disconnect if it succeeds
+			go func() {
+				if token.Wait(); token.Error() == nil {
+					m.client.Disconnect(250)
+				}
+			}()
+			return ctx.Err()
 		}
+	}
+	if token.Error() != nil {
+		return token.Error()
+	}
+	if !m.client.IsConnected() {
+		return errors.New("Not connected")
+	}
+	return nil
+}
+
+// backoff returns the delay before the given attempt to connect again
+func backoff(attempt int) time.Duration {
+	d := MaxBackoff
+	if attempt < 32 && MinBackoff<<uint(attempt-1) < MaxBackoff {
+		d = MinBackoff << uint(attempt-1)
+	}
+	return d/2 + time.Duration(rand.Int63n(int64(d/2)+1))
+}
+
+// resubscribe renews all subscriptions after connecting again
+func (m *MQTT) resubscribe() {
+	m.mutex.Lock()
+	subscriptions := append(append([]route{}, m.topics...), m.routes...)
+	m.mutex.Unlock()
+	for _, r := range subscriptions {
+		token := m.client.Subscribe(r.filter, r.qos, nil)
 		token.Wait()
-		if m.client.IsConnected() {
-			log.Println("Connected")
-			break
+		if token.Error() != nil {
+			log.Printf("WARNING: %s\n", token.Error())
 		}
-		time.Sleep(5 * time.Second)
 	}
-
 }
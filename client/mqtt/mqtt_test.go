@@ -0,0 +1,157 @@
+package mqtt
+
+import (
+	"bytes"
+	"context"
+	"github.com/trafero/tstack/client/settings"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestWillAndBirth(t *testing.T) {
+	broker, conns := listenConns(t)
+
+	watcher := testClient(t, broker, "watcher")
+	<-conns
+	status := make(chan string, 10)
+	watcher.SubscribeFunc("device/status", 1, func(msg Message) { status <- msg.PayloadString() })
+
+	s := &settings.Settings{Username: "device", Broker: broker, QoS: 1}
+	s.SetStatus()
+	device, err := NewInsecure(s)
+	if err != nil {
+		t.Fatal("Error initiating mqtt client", err)
+	}
+	deviceConn := <-conns
+	expect := func(want string) {
+		select {
+		case got := <-status:
+			if got != want {
+				t.Errorf("Expected status %q, got %q", want, got)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("Timed out waiting for status %q", want)
+		}
+	}
+	expect("online")
+
+	// Retained, so new subscribers see it
+	late := testClient(t, broker, "late")
+	retained := make(chan string, 1)
+	late.SubscribeFunc("device/status", 0, func(msg Message) { retained <- msg.PayloadString() })
+	select {
+	case got := <-retained:
+		if got != "online" {
+			t.Errorf("Expected retained status online, got %q", got)
+		}
+	case <-time.After(5 * time.Second):
+		t.Error("Timed out waiting for retained status")
+	}
+
+	// Losing the connection sends the will. The client then reconnects,
+	// publishing its birth message again
+	deviceConn.Close()
+	expect("offline")
+	expect("online")
+
+	// No will after a clean disconnect
+	device.Close(context.Background())
+	select {
+	case got := <-status:
+		t.Errorf("Unexpected status %q after clean disconnect", got)
+	case <-time.After(200 * time.Millisecond):
+	}
+}
+
+func TestNewWithContextCancelled(t *testing.T) {
+	// Nothing listening
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal("Error setting up listener:", err)
+	}
+	broker := "tcp://" + l.Addr().String()
+	l.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	_, err = NewWithContext(ctx, &settings.Settings{Username: "device", Broker: broker})
+	if err != context.DeadlineExceeded {
+		t.Errorf("Expected deadline exceeded, got %v", err)
+	}
+	if time.Since(start) > 2*time.Second {
+		t.Error("Expected NewWithContext to return when the context was done")
+	}
+}
+
+func TestStateAndClose(t *testing.T) {
+	defer func(min time.Duration) { MinBackoff = min }(MinBackoff)
+	MinBackoff = 10 * time.Millisecond
+
+	broker, conns := listenConns(t)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	m, err := NewWithContext(ctx, &settings.Settings{Username: "device", Broker: broker})
+	if err != nil {
+		t.Fatal("Error initiating mqtt client", err)
+	}
+	if m.State() != Connected {
+		t.Errorf("Expected connected, got %s", m.State())
+	}
+	states := make(chan State, 10)
+	m.SetStateHandler(func(state State, err error) { states <- state })
+	expect := func(want State) {
+		select {
+		case got := <-states:
+			if got != want {
+				t.Errorf("Expected state %s, got %s", want, got)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("Timed out waiting for state %s", want)
+		}
+	}
+
+	(<-conns).Close()
+	expect(ConnectionLost)
+	expect(Connected)
+
+	if err := m.PublishMessage("device/a", "x"); err != nil {
+		t.Error("Error publishing after reconnecting:", err)
+	}
+	if err := m.Close(ctx); err != nil {
+		t.Error("Error closing:", err)
+	}
+	expect(Closed)
+	if err := m.PublishMessage("device/a", "x"); err != ErrClosed {
+		t.Errorf("Expected ErrClosed, got %v", err)
+	}
+}
+
+func TestBinaryPayload(t *testing.T) {
+	broker := listen(t)
+	device := testClient(t, broker, "device")
+	payload := []byte{0xa1, 0x00, 0xff, 0x19}
+	if err := device.PublishBytes("device/cbor", payload, 1, true); err != nil {
+		t.Fatal("Error publishing:", err)
+	}
+
+	// Subscribing after the publish, so sent as retained
+	received := make(chan Message, 1)
+	watcher := testClient(t, broker, "watcher")
+	watcher.SubscribeFunc("device/cbor", 1, func(msg Message) { received <- msg })
+	select {
+	case msg := <-received:
+		if !bytes.Equal(msg.Payload, payload) {
+			t.Errorf("Expected payload %x, got %x", payload, msg.Payload)
+		}
+		if msg.QoS != 1 || !msg.Retained || msg.Duplicate {
+			t.Errorf("Expected QoS 1, retained, not duplicate. Got %d, %t, %t", msg.QoS, msg.Retained, msg.Duplicate)
+		}
+		if time.Since(msg.Received) > 5*time.Second {
+			t.Errorf("Unexpected received time %s", msg.Received)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Timed out waiting for message")
+	}
+}
@@ -0,0 +1,260 @@
+package mqtt
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Publishes queued by default, before the oldest are dropped
+const DefaultQueueLimit = 10000
+
+// Records in the queue file beyond those needed for queued publishes,
+// before it is compacted
+const queueSlack = 1000
+
+// queued is a publish waiting for the client to connect
+type queued struct {
+	Seq     uint64 // Order queued in, from 1
+	Topic   string
+	Payload []byte
+	QoS     byte
+	Retain  bool
+	Time    time.Time // When queued
+}
+
+/*
+ * queueRecord is a line of the queue file. Files are append only, with a
+ * record for each publish queued or removed, and are compacted when mostly
+ * made up of removed publishes
+ */
+type queueRecord struct {
+	Add    *queued `json:",omitempty"`
+	Remove uint64  `json:",omitempty"`
+}
+
+// queue holds publishes in order while disconnected, in a file so that
+// they survive a restart
+type queue struct {
+	mutex    sync.Mutex
+	path     string
+	file     *os.File // Open for appending
+	records  int      // Records in the file
+	limit    int      // Most publishes queued
+	seq      uint64   // Of the last publish queued
+	messages []queued // Oldest first
+	flushing bool     // Whether queued publishes are being sent
+}
+
+/*
+ * openQueue reads publishes queued in path, by this or an earlier process,
+ * and uses path for queueing from now on. The oldest publishes are dropped
+ * when there are more than limit
+ */
+func openQueue(path string, limit int) (q *queue, err error) {
+	if limit <= 0 {
+		limit = DefaultQueueLimit
+	}
+	q = &queue{path: path, limit: limit}
+
+	msgs := make(map[uint64]queued)
+	f, err := os.Open(path)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	if err == nil {
+		decoder := json.NewDecoder(f)
+		for {
+			var r queueRecord
+			if err := decoder.Decode(&r); err == io.EOF {
+				break
+			} else if err != nil {
+				// A crash may leave a partial last record
+				log.Printf("WARNING: Could not read queue file %s: %s", path, err)
+				break
+			}
+			if r.Add != nil {
+				msgs[r.Add.Seq] = *r.Add
+			} else {
+				delete(msgs, r.Remove)
+			}
+		}
+		f.Close()
+	}
+	for _, msg := range msgs {
+		q.messages = append(q.messages, msg)
+		if msg.Seq > q.seq {
+			q.seq = msg.Seq
+		}
+	}
+	sort.Slice(q.messages, func(i, j int) bool { return q.messages[i].Seq < q.messages[j].Seq })
+	q.trim()
+
+	if err := q.compact(); err != nil {
+		return nil, err
+	}
+	if len(q.messages) > 0 {
+		log.Printf("Loaded %d queued publishes from %s", len(q.messages), path)
+	}
+	return q, nil
+}
+
+// push adds a publish to the end of the queue, dropping the oldest if full
+func (q *queue) push(topic string, payload []byte, qos byte, retain bool) error {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	q.seq++
+	msg := queued{
+		Seq:     q.seq,
+		Topic:   topic,
+		Payload: payload,
+		QoS:     qos,
+		Retain:  retain,
+		Time:    time.Now(),
+	}
+	// Queued before saving, so that compacting while saving keeps it
+	q.messages = append(q.messages, msg)
+	if err := q.save(queueRecord{Add: &msg}); err != nil {
+		q.messages = q.messages[:len(q.messages)-1]
+		return err
+	}
+	q.trim()
+	return nil
+}
+
+// trim drops the oldest publishes beyond the limit. Must be called with the
+// mutex held
+func (q *queue) trim() {
+	if len(q.messages) <= q.limit {
+		return
+	}
+	dropped := q.messages[:len(q.messages)-q.limit]
+	log.Printf("WARNING: Queue full, dropping %d oldest publishes", len(dropped))
+	// Dropped before saving, so that compacting while saving leaves them out
+	q.messages = append([]queued{}, q.messages[len(dropped):]...)
+	for _, msg := range dropped {
+		q.save(queueRecord{Remove: msg.Seq})
+	}
+}
+
+// peek returns the oldest publish, if any
+func (q *queue) peek() (msg queued, ok bool) {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	if len(q.messages) == 0 {
+		return msg, false
+	}
+	return q.messages[0], true
+}
+
+// remove takes a publish off the queue once sent. It may already have been
+// dropped
+func (q *queue) remove(seq uint64) {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	for i, msg := range q.messages {
+		if msg.Seq == seq {
+			q.messages = append(q.messages[:i], q.messages[i+1:]...)
+			q.save(queueRecord{Remove: seq})
+			return
+		}
+	}
+}
+
+func (q *queue) len() int {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	return len(q.messages)
+}
+
+/*
+ * startFlush reports whether the caller should send the queued publishes,
+ * so that only one goroutine sends them at once. The caller must call
+ * stopFlush when done
+ */
+func (q *queue) startFlush() bool {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	if q.flushing {
+		return false
+	}
+	q.flushing = true
+	return true
+}
+
+func (q *queue) stopFlush() {
+	q.mutex.Lock()
+	q.flushing = false
+	q.mutex.Unlock()
+}
+
+// save appends a record to the file. Must be called with the mutex held
+func (q *queue) save(r queueRecord) error {
+	if q.file == nil {
+		// Compacting failed earlier. Try again
+		if err := q.compact(); err != nil {
+			return err
+		}
+	}
+	data, err := json.Marshal(r)
+	if err != nil {
+		return err
+	}
+	if _, err := q.file.Write(append(data, '\n')); err != nil {
+		return err
+	}
+	q.records++
+	if q.records > 2*len(q.messages)+queueSlack {
+		if err := q.compact(); err != nil {
+			log.Printf("WARNING: Could not compact queue file %s: %s", q.path, err)
+		}
+	}
+	return nil
+}
+
+// compact rewrites the file with only the queued publishes, and opens it
+// for appending. Must be called with the mutex held
+func (q *queue) compact() error {
+	var buf bytes.Buffer
+	encoder := json.NewEncoder(&buf)
+	for i := range q.messages {
+		if err := encoder.Encode(queueRecord{Add: &q.messages[i]}); err != nil {
+			return err
+		}
+	}
+	// Write then rename so that a crash never leaves a partial file
+	tmp := q.path + ".tmp"
+	if err := ioutil.WriteFile(tmp, buf.Bytes(), 0600); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, q.path); err != nil {
+		return err
+	}
+	if q.file != nil {
+		q.file.Close()
+	}
+	f, err := os.OpenFile(q.path, os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		q.file = nil
+		return err
+	}
+	q.file = f
+	q.records = len(q.messages)
+	return nil
+}
+
+// close closes the file, leaving queued publishes in it for next time
+func (q *queue) close() {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	if q.file != nil {
+		q.file.Close()
+		q.file = nil
+	}
+}
@@ -0,0 +1,153 @@
+package mqtt
+
+import (
+	"context"
+	"github.com/trafero/tstack/client/settings"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestQueueFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "queue")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "queue")
+
+	q, err := openQueue(path, 3)
+	if err != nil {
+		t.Fatal("Error opening queue:", err)
+	}
+	for _, payload := range []string{"1", "2", "3", "4", "5"} {
+		if err := q.push("device/a", []byte(payload), 1, false); err != nil {
+			t.Fatal("Error queueing:", err)
+		}
+	}
+	expect := func(q *queue, want ...string) {
+		if q.len() != len(want) {
+			t.Fatalf("Expected %d queued, got %d", len(want), q.len())
+		}
+		for i, msg := range q.messages {
+			if string(msg.Payload) != want[i] {
+				t.Errorf("Expected %q at %d, got %q", want[i], i, msg.Payload)
+			}
+		}
+	}
+	// The oldest are dropped
+	expect(q, "3", "4", "5")
+
+	msg, _ := q.peek()
+	q.remove(msg.Seq)
+	q.close()
+
+	// Survives a restart, in order
+	q, err = openQueue(path, 3)
+	if err != nil {
+		t.Fatal("Error opening queue:", err)
+	}
+	expect(q, "4", "5")
+	q.push("device/a", []byte("6"), 1, false)
+	expect(q, "4", "5", "6")
+	q.close()
+}
+
+func TestQueueCompact(t *testing.T) {
+	dir, err := ioutil.TempDir("", "queue")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "queue")
+
+	// Each push beyond the limit adds two records, so the file is
+	// compacted while pushing
+	q, err := openQueue(path, 2)
+	if err != nil {
+		t.Fatal("Error opening queue:", err)
+	}
+	compacted := 0
+	for i := 1; i <= queueSlack; i++ {
+		records := q.records
+		if err := q.push("device/a", []byte(strconv.Itoa(i)), 1, false); err != nil {
+			t.Fatal("Error queueing:", err)
+		}
+		if q.records >= records {
+			continue
+		}
+		compacted++
+
+		// Nothing pushed or dropped around the compaction is lost
+		q.close()
+		q, err = openQueue(path, 2)
+		if err != nil {
+			t.Fatal("Error opening queue:", err)
+		}
+		if q.len() != 2 || string(q.messages[0].Payload) != strconv.Itoa(i-1) || string(q.messages[1].Payload) != strconv.Itoa(i) {
+			t.Fatalf("Expected %d and %d queued after compacting, got %d publishes", i-1, i, q.len())
+		}
+	}
+	q.close()
+	if compacted == 0 {
+		t.Error("Expected the queue file to be compacted")
+	}
+}
+
+func TestOfflinePublish(t *testing.T) {
+	dir, err := ioutil.TempDir("", "queue")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	broker, conns := listenConns(t)
+	watcher := testClient(t, broker, "watcher")
+	<-conns
+	received := make(chan string, 10)
+	watcher.SubscribeFunc("device/a", 1, func(msg Message) { received <- msg.PayloadString() })
+
+	s := &settings.Settings{
+		Username:  "device",
+		Broker:    broker,
+		QoS:       1,
+		QueueFile: filepath.Join(dir, "queue"),
+	}
+	device, err := NewInsecure(s)
+	if err != nil {
+		t.Fatal("Error initiating mqtt client", err)
+	}
+	deviceConn := <-conns
+
+	// Published while disconnected, before the client reconnects
+	published := make(chan error, 3)
+	device.SetStateHandler(func(state State, err error) {
+		if state == ConnectionLost {
+			for _, payload := range []string{"1", "2", "3"} {
+				published <- device.PublishMessage("device/a", payload)
+			}
+		}
+	})
+	deviceConn.Close()
+	for i := 0; i < 3; i++ {
+		if err := <-published; err != nil {
+			t.Error("Error publishing while disconnected:", err)
+		}
+	}
+
+	// Sent in order once connected again
+	for _, want := range []string{"1", "2", "3"} {
+		select {
+		case got := <-received:
+			if got != want {
+				t.Errorf("Expected %q, got %q", want, got)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("Timed out waiting for %q", want)
+		}
+	}
+	device.Close(context.Background())
+}
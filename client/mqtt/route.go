@@ -0,0 +1,103 @@
+package mqtt
+
+import (
+	"strings"
+)
+
+// route is a subscription, with its own handler if made with SubscribeFunc
+type route struct {
+	filter  string
+	qos     byte
+	handler func(Message)
+}
+
+/*
+ * SubscribeFunc subscribes to a topic filter, which may contain wildcards,
+ * with messages matching it going to handler rather than the handler set
+ * with SetHandler. A message matching several filters goes to each of their
+ * handlers. Subscribing to the same filter again replaces its handler. The
+ * subscription is renewed, with its handler, after reconnecting.
+ */
+func (m *MQTT) SubscribeFunc(filter string, qos byte, handler func(Message)) error {
+	m.mutex.Lock()
+	replaced := false
+	for i, r := range m.routes {
+		if r.filter == filter {
+			m.routes[i] = route{filter: filter, qos: qos, handler: handler}
+			replaced = true
+		}
+	}
+	if !replaced {
+		m.routes = append(m.routes, route{filter: filter, qos: qos, handler: handler})
+	}
+	m.mutex.Unlock()
+
+	token := m.client.Subscribe(filter, qos, nil)
+	token.Wait()
+	return token.Error()
+}
+
+// Unsubscribe removes subscriptions made with Subscribe or SubscribeFunc
+func (m *MQTT) Unsubscribe(filters ...string) error {
+	m.mutex.Lock()
+	for _, filter := range filters {
+		for i := 0; i < len(m.routes); i++ {
+			if m.routes[i].filter == filter {
+				m.routes = append(m.routes[:i], m.routes[i+1:]...)
+				i--
+			}
+		}
+		for i := 0; i < len(m.topics); i++ {
+			if m.topics[i].filter == filter {
+				m.topics = append(m.topics[:i], m.topics[i+1:]...)
+				i--
+			}
+		}
+		// Request subscribes again the next time it is needed
+		delete(m.responses, filter)
+	}
+	m.mutex.Unlock()
+
+	token := m.client.Unsubscribe(filters...)
+	token.Wait()
+	return token.Error()
+}
+
+// route passes a message to the handler of each filter it matches. Returns
+// false if there were none
+func (m *MQTT) route(msg Message) bool {
+	var handlers []func(Message)
+	m.mutex.Lock()
+	for _, r := range m.routes {
+		if matches(r.filter, msg.Topic) {
+			handlers = append(handlers, r.handler)
+		}
+	}
+	m.mutex.Unlock()
+	for _, h := range handlers {
+		h(msg)
+	}
+	return len(handlers) > 0
+}
+
+// matches reports whether a topic matches a topic filter
+func matches(filter string, topic string) bool {
+	// MQTT-4.7.2-1 topics begining with $ should not match on wildcard
+	if strings.HasPrefix(topic, "$") && (strings.HasPrefix(filter, "+") || strings.HasPrefix(filter, "#")) {
+		return false
+	}
+	f := strings.Split(filter, "/")
+	t := strings.Split(topic, "/")
+	for i, level := range f {
+		switch {
+		case level == "#":
+			// Also matches the parent level, e.g. "a/#" matches "a"
+			return true
+		case i >= len(t):
+			return false
+		case level != "+" && level != t[i]:
+			return false
+		}
+	}
+	return len(t) == len(f)
+}
@@ -0,0 +1,67 @@
+package mqtt
+
+import (
+	"testing"
+	"time"
+)
+
+func TestMatches(t *testing.T) {
+	cases := []struct {
+		filter string
+		topic  string
+		match  bool
+	}{
+		{"a/b", "a/b", true},
+		{"a/b", "a/c", false},
+		{"a/+", "a/b", true},
+		{"a/+", "a/b/c", false},
+		{"a/#", "a/b/c", true},
+		{"a/#", "a", true},
+		{"+/+/c", "a/b/c", true},
+		{"#", "a/b", true},
+		{"#", "$SYS/audit", false},
+		{"+/audit", "$SYS/audit", false},
+		{"$SYS/#", "$SYS/audit", true},
+		{"a/b/c", "a/b", false},
+	}
+	for _, c := range cases {
+		if got := matches(c.filter, c.topic); got != c.match {
+			t.Errorf("matches(%q, %q) = %v, expected %v", c.filter, c.topic, got, c.match)
+		}
+	}
+}
+
+func TestSubscribeFunc(t *testing.T) {
+	m := testClient(t, listen(t), "device")
+
+	received := make(chan string, 10)
+	m.SetHandler(func(msg Message) { received <- "default " + msg.Topic })
+	if err := m.SubscribeFunc("device/+/temperature", 0, func(msg Message) { received <- "temperature " + msg.Topic }); err != nil {
+		t.Fatal("Error subscribing:", err)
+	}
+	if err := m.SubscribeFunc("device/command", 0, func(msg Message) { received <- "command " + msg.Topic }); err != nil {
+		t.Fatal("Error subscribing:", err)
+	}
+	m.Subscribe("device/other")
+
+	expect := func(topic string, want string) {
+		m.PublishMessage(topic, "x")
+		select {
+		case got := <-received:
+			if got != want {
+				t.Errorf("Expected %q, got %q", want, got)
+			}
+		case <-time.After(5 * time.Second):
+			t.Errorf("Timed out waiting for %q", want)
+		}
+	}
+	expect("device/1/temperature", "temperature device/1/temperature")
+	expect("device/command", "command device/command")
+	expect("device/other", "default device/other")
+
+	if err := m.Unsubscribe("device/command"); err != nil {
+		t.Fatal("Error unsubscribing:", err)
+	}
+	m.PublishMessage("device/command", "x")
+	expect("device/2/temperature", "temperature device/2/temperature")
+}
@@ -0,0 +1,157 @@
+package mqtt
+
+import (
+	"context"
+	"errors"
+	"log"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+/*
+ * Requests and responses use a topic convention, as MQTT 3.1.1 has no
+ * response topic or correlation data properties. A request to <topic> is
+ * published to
+ *
+ *   <topic>/request/<requester>/<id>
+ *
+ * and answered on
+ *
+ *   <topic>/response/<requester>/<id>
+ *
+ * with "/error" appended if the handler failed. Everything stays under
+ * <topic>, so a device with rights to its own topics can answer requests
+ * sent to them.
+ */
+const (
+	requestLevel  = "request"
+	responseLevel = "response"
+	errorLevel    = "error"
+)
+
+var ErrMultiLevelWildcard = errors.New("Requests cannot be handled for topics containing #")
+
+// RequestTimeout applies to requests whose context has no deadline
+var RequestTimeout = 30 * time.Second
+
+// RequestHandler answers a request. If it returns an error, the error text
+// is sent back and returned by Request as a RequestError
+type RequestHandler func(req Message) (response string, err error)
+
+// RequestError is an error returned by the handler of a request
+type RequestError string
+
+func (e RequestError) Error() string {
+	return string(e)
+}
+
+type response struct {
+	msg Message
+	err error
+}
+
+/*
+ * Request publishes payload to topic as a request, and waits for the
+ * response. Any number of requests may be in flight at once
+ */
+func (m *MQTT) Request(ctx context.Context, topic string, payload string) (msg Message, err error) {
+	if _, ok := ctx.Deadline(); !ok {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, RequestTimeout)
+		defer cancel()
+	}
+
+	// Subscribe once to all responses for this topic
+	filter := topic + "/" + responseLevel + "/" + m.clientid + "/#"
+	m.mutex.Lock()
+	subscribed := m.responses[filter]
+	m.responses[filter] = true
+	m.mutex.Unlock()
+	if !subscribed {
+		if err = m.SubscribeFunc(filter, m.qos, m.responseHandler); err != nil {
+			m.mutex.Lock()
+			delete(m.responses, filter)
+			m.mutex.Unlock()
+			return msg, err
+		}
+	}
+
+	id := strconv.FormatUint(atomic.AddUint64(&m.requestID, 1), 10)
+	responseTopic := topic + "/" + responseLevel + "/" + m.clientid + "/" + id
+	ch := make(chan response, 1)
+	m.mutex.Lock()
+	m.requests[responseTopic] = ch
+	m.mutex.Unlock()
+	defer func() {
+		m.mutex.Lock()
+		delete(m.requests, responseTopic)
+		m.mutex.Unlock()
+	}()
+
+	err = m.PublishMessage(topic+"/"+requestLevel+"/"+m.clientid+"/"+id, payload)
+	if err != nil {
+		return msg, err
+	}
+
+	select {
+	case r := <-ch:
+		return r.msg, r.err
+	case <-ctx.Done():
+		return msg, ctx.Err()
+	}
+}
+
+// responseHandler passes a response to the request waiting for it
+func (m *MQTT) responseHandler(msg Message) {
+	r := response{msg: msg}
+	responseTopic := msg.Topic
+	if strings.HasSuffix(responseTopic, "/"+errorLevel) {
+		responseTopic = strings.TrimSuffix(responseTopic, "/"+errorLevel)
+		r.err = RequestError(r.msg.PayloadString())
+	}
+	m.mutex.Lock()
+	ch, ok := m.requests[responseTopic]
+	m.mutex.Unlock()
+	if ok {
+		select {
+		case ch <- r:
+		default:
+		}
+	}
+}
+
+/*
+ * HandleRequests answers requests sent to topic, which may contain the +
+ * wildcard, but not #. Each request is handled in its own goroutine
+ */
+func (m *MQTT) HandleRequests(topic string, f RequestHandler) error {
+	if strings.Contains(topic, "#") {
+		return ErrMultiLevelWildcard
+	}
+	return m.SubscribeFunc(topic+"/"+requestLevel+"/+/+", m.qos, func(req Message) {
+		go m.answer(req, f)
+	})
+}
+
+func (m *MQTT) answer(req Message, f RequestHandler) {
+	levels := strings.Split(req.Topic, "/")
+	n := len(levels)
+	if n < 4 || levels[n-3] != requestLevel {
+		log.Printf("WARNING: Malformed request topic %s", req.Topic)
+		return
+	}
+	responseTopic := strings.Join(levels[:n-3], "/") + "/" + responseLevel + "/" + levels[n-2] + "/" + levels[n-1]
+	// Handlers see the topic the request was sent to
+	req.Topic = strings.Join(levels[:n-3], "/")
+
+	payload, err := f(req)
+	if err != nil {
+		responseTopic += "/" + errorLevel
+		payload = err.Error()
+	}
+	if err := m.PublishMessage(responseTopic, payload); err != nil {
+		log.Printf("WARNING: Could not send response to %s: %s", responseTopic, err)
+	}
+}
@@ -0,0 +1,129 @@
+package mqtt
+
+import (
+	"context"
+	"errors"
+	authall "github.com/trafero/tstack/auth/all"
+	"github.com/trafero/tstack/client/settings"
+	"github.com/trafero/tstack/serve"
+	"net"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+)
+
+/*
+ * listen sets up a broker on a local port, returning its URL
+ */
+func listen(t *testing.T) string {
+	url, _ := listenConns(t)
+	return url
+}
+
+/*
+ * listenConns sets up a broker on a local port, returning its URL and the
+ * broker side of each connection, in the order they are accepted
+ */
+func listenConns(t *testing.T) (url string, conns chan net.Conn) {
+	a, _ := authall.New()
+	b := serve.NewBroker()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal("Error setting up listener:", err)
+	}
+	conns = make(chan net.Conn, 100)
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			select {
+			case conns <- c:
+			default:
+			}
+			go serve.NewClient(a, b, c).HandleConnection()
+		}
+	}()
+	return "tcp://" + l.Addr().String(), conns
+}
+
+func testClient(t *testing.T, broker string, username string) *MQTT {
+	m, err := NewInsecure(&settings.Settings{Username: username, Broker: broker})
+	if err != nil {
+		t.Fatal("Error initiating mqtt client", err)
+	}
+	return m
+}
+
+func TestRequest(t *testing.T) {
+	broker := listen(t)
+	device := testClient(t, broker, "device")
+	backend := testClient(t, broker, "backend")
+
+	err := device.HandleRequests("device/+", func(req Message) (string, error) {
+		if req.PayloadString() == "fail" {
+			return "", errors.New("failed")
+		}
+		return req.Topic + ":" + req.PayloadString(), nil
+	})
+	if err != nil {
+		t.Fatal("Error handling requests:", err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	// Concurrent requests each get their own response
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			payload := strconv.Itoa(i)
+			resp, err := backend.Request(ctx, "device/echo", payload)
+			if err != nil {
+				t.Error("Request failed:", err)
+			} else if resp.PayloadString() != "device/echo:"+payload {
+				t.Errorf("Expected response to %s, got %s", payload, resp.Payload)
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	_, err = backend.Request(ctx, "device/echo", "fail")
+	if _, ok := err.(RequestError); !ok || err.Error() != "failed" {
+		t.Errorf("Expected request error, got %v", err)
+	}
+
+	// Nobody answers
+	short, cancelShort := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancelShort()
+	if _, err = backend.Request(short, "nobody/echo", "x"); err != context.DeadlineExceeded {
+		t.Errorf("Expected timeout, got %v", err)
+	}
+}
+
+func TestRequestAfterUnsubscribe(t *testing.T) {
+	broker := listen(t)
+	device := testClient(t, broker, "device")
+	backend := testClient(t, broker, "backend")
+
+	if err := device.HandleRequests("device/#", nil); err != ErrMultiLevelWildcard {
+		t.Errorf("Expected ErrMultiLevelWildcard, got %v", err)
+	}
+	device.HandleRequests("device/echo", func(req Message) (string, error) {
+		return req.PayloadString(), nil
+	})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	for i := 0; i < 2; i++ {
+		if resp, err := backend.Request(ctx, "device/echo", "x"); err != nil || resp.PayloadString() != "x" {
+			t.Fatalf("Expected response x, got %q, %v", resp.Payload, err)
+		}
+		// The response filter is subscribed to again by the next request
+		backend.Unsubscribe("device/echo/" + responseLevel + "/" + backend.clientid + "/#")
+	}
+}
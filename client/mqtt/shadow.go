@@ -0,0 +1,116 @@
+package mqtt
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+)
+
+// Shadow is a device's state, as kept by the shadow service (tshadow)
+type Shadow struct {
+	Reported map[string]interface{} // State last reported by the device
+	Desired  map[string]interface{} // State the device should be in
+	Delta    map[string]interface{} // Desired values that differ from the reported ones
+	Version  int
+}
+
+// DeltaHandler is given desired values that differ from the reported ones
+type DeltaHandler func(delta map[string]interface{}, version int)
+
+/*
+ * ReportState publishes state as the device's reported state. Only the
+ * values given are changed, and a nil value removes a key from the shadow
+ */
+func (m *MQTT) ReportState(state map[string]interface{}) error {
+	return m.updateShadow(m.username, "reported", state)
+}
+
+/*
+ * SetDesiredState sets the state device id should be in, for back ends
+ * with rights to the device's topics. Only the values given are changed,
+ * and a nil value removes a key from the shadow
+ */
+func (m *MQTT) SetDesiredState(id string, state map[string]interface{}) error {
+	return m.updateShadow(id, "desired", state)
+}
+
+func (m *MQTT) updateShadow(id string, key string, state map[string]interface{}) error {
+	payload, err := json.Marshal(map[string]interface{}{
+		"state": map[string]interface{}{key: state},
+	})
+	if err != nil {
+		return err
+	}
+	return m.PublishBytes(id+"/shadow/update", payload, 1, false)
+}
+
+// GetShadow fetches the shadow of device id
+func (m *MQTT) GetShadow(ctx context.Context, id string) (s Shadow, err error) {
+	resp, err := m.Request(ctx, id+"/shadow/get", "")
+	if err != nil {
+		return s, err
+	}
+	var doc struct {
+		State struct {
+			Reported map[string]interface{}
+			Desired  map[string]interface{}
+			Delta    map[string]interface{}
+		}
+		Version int
+	}
+	if err := json.Unmarshal(resp.Payload, &doc); err != nil {
+		return s, err
+	}
+	return Shadow{
+		Reported: doc.State.Reported,
+		Desired:  doc.State.Desired,
+		Delta:    doc.State.Delta,
+		Version:  doc.Version,
+	}, nil
+}
+
+/*
+ * HandleDelta calls f each time the device's desired state changes to
+ * differ from its reported state. Deltas sent while the device was offline
+ * are missed, so the shadow is also fetched now and each time the client
+ * connects again, with f called if it has a delta
+ */
+func (m *MQTT) HandleDelta(f DeltaHandler) error {
+	m.mutex.Lock()
+	m.deltaHandler = f
+	m.mutex.Unlock()
+	err := m.SubscribeFunc(m.username+"/shadow/delta", 1, func(msg Message) {
+		var delta struct {
+			State   map[string]interface{}
+			Version int
+		}
+		if err := json.Unmarshal(msg.Payload, &delta); err != nil {
+			log.Printf("WARNING: Could not decode shadow delta: %s", err)
+			return
+		}
+		f(delta.State, delta.Version)
+	})
+	if err != nil {
+		return err
+	}
+	go m.syncShadow()
+	return nil
+}
+
+// syncShadow fetches the shadow, passing any delta to the delta handler
+func (m *MQTT) syncShadow() {
+	m.mutex.Lock()
+	f := m.deltaHandler
+	m.mutex.Unlock()
+	if f == nil {
+		return
+	}
+	s, err := m.GetShadow(m.ctx, m.username)
+	if err != nil {
+		log.Printf("WARNING: Could not fetch shadow: %s", err)
+		return
+	}
+	if len(s.Delta) > 0 {
+		f(s.Delta, s.Version)
+	}
+}
@@ -20,6 +20,30 @@ type Settings struct {
 	CaCertFile string
 	clientId   string
 	VerifyTls  bool
+	QoS        byte     // Default QoS for publishing and subscribing
+	Will       *Message // Published by the broker if the connection is lost. May be nil
+	Birth      *Message // Published each time the client connects. May be nil
+	QueueFile  string   // Publishes made while disconnected are queued in this file. Optional
+	QueueLimit int      // Most publishes queued, before the oldest are dropped (default 10000)
+}
+
+// Message is a will or birth message
+type Message struct {
+	Topic   string
+	Payload string
+	QoS     byte
+	Retain  bool
+}
+
+/*
+ * SetStatus sets a retained will of "offline", and birth message of
+ * "online", on <username>/status, so that subscribers always know whether
+ * the client is connected
+ */
+func (s *Settings) SetStatus() {
+	topic := s.Username + "/status"
+	s.Will = &Message{Topic: topic, Payload: "offline", QoS: 1, Retain: true}
+	s.Birth = &Message{Topic: topic, Payload: "online", QoS: 1, Retain: true}
 }
 
 func Read() (s *Settings, err error) {
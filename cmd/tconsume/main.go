@@ -9,8 +9,8 @@ import (
 	"github.com/trafero/tstack/consume/graphite"
 	"github.com/trafero/tstack/consume/influxdb"
 	"github.com/trafero/tstack/consume/stdout"
+	"github.com/trafero/tstack/logging"
 	"github.com/trafero/tstack/tstackutil"
-	"log"
 )
 
 var username, password, mqtturl, topic, ctype string
@@ -22,10 +22,16 @@ var influxport int
 var graphitehost string
 var graphiteport int
 
+var qos int
+
+var loglevel, logformat string
+
 var verifytls, useconfig bool
 
 var consumer consume.Consume
 
+var logger = logging.New("tconsume")
+
 const (
 	clientid = "consumer"
 )
@@ -35,6 +41,7 @@ func init() {
 	flag.StringVar(&password, "password", "", "Password for MQTT broker")
 	flag.StringVar(&mqtturl, "mqtturl", "tcp://localhost:1883", "URL for MQTT broker")
 	flag.StringVar(&topic, "topic", "", "Topic to subscribe to. Defaults to USERNAME/#")
+	flag.IntVar(&qos, "qos", -1, "QoS to subscribe at. One of 0, 1, 2. Defaults to the qos setting, or 0")
 
 	flag.StringVar(&influxhost, "influxhost", "localhost", "InfluxDB hostname")
 	flag.IntVar(&influxport, "influxport", 8086, "InfluxDB port")
@@ -48,6 +55,8 @@ func init() {
 
 	flag.BoolVar(&verifytls, "verifytls", true, "Verify MQTT certificate")
 	flag.BoolVar(&useconfig, "useconfig", false, "Use tstack configuration file")
+	flag.StringVar(&loglevel, "loglevel", "info", "Log level. One of debug, info, warn, error")
+	flag.StringVar(&logformat, "logformat", "logfmt", "Log format. One of logfmt, json")
 
 	flag.Parse()
 
@@ -59,12 +68,15 @@ func main() {
 	var secure bool // secure connection or not
 	var s *settings.Settings
 
+	err = logging.Configure(loglevel, logformat)
+	checkErr(err)
+
 	// Read settings into s
 	if useconfig {
 		s, err = settings.Read()
 		if err != nil {
 			flag.Usage()
-			log.Fatal(err)
+			logger.Fatal(err.Error())
 		}
 	} else {
 
@@ -79,13 +91,21 @@ func main() {
 
 	}
 
+	if qos > 2 {
+		flag.Usage()
+		logger.Fatal("Invalid QoS", "qos", qos)
+	}
+	if qos >= 0 {
+		s.QoS = byte(qos)
+	}
+
 	// Set topic to receive everything for that user, if it hasn'y been set
 	// already
 	if topic == "" {
 		topic = s.Username + `/#`
 	}
 
-	log.Printf("Using broker %s and topic %s.", s.Broker, topic)
+	logger.Info("Using broker", "broker", s.Broker, "topic", topic)
 
 	secure, err = tstackutil.IsSecureUrl(s.Broker)
 	checkErr(err)
@@ -112,7 +132,7 @@ func main() {
 
 	checkErr(err)
 
-	log.Printf("Connecting to broker %s", s.Broker)
+	logger.Info("Connecting to broker", "broker", s.Broker)
 	var m *mqtt.MQTT
 
 	if secure {
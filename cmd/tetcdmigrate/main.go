@@ -0,0 +1,117 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"github.com/coreos/etcd/client"
+	"github.com/trafero/tstack/auth"
+	"github.com/trafero/tstack/auth/etcdv3"
+	"github.com/trafero/tstack/logging"
+	"golang.org/x/net/context"
+	"path"
+	"strings"
+	"time"
+)
+
+var etcdhosts, etcdv3hosts, etcdprefix, etcdcafile, etcdcertfile, etcdkeyfile string
+var overwrite, dryrun bool
+var loglevel, logformat string
+
+var logger = logging.New("tetcdmigrate")
+
+func init() {
+	flag.StringVar(&etcdhosts, "etcdhosts", "", "list of etcd endpoints to copy users from, with the v2 API. e.g. 'http://etcd0:2379 http://etcd1:2379'")
+	flag.StringVar(&etcdv3hosts, "etcdv3hosts", "", "list of etcd endpoints to copy users to, with the v3 API. Defaults to etcdhosts")
+	flag.StringVar(&etcdprefix, "etcdprefix", etcdv3.DefaultPrefix, "Key prefix for users in etcd v3")
+	flag.StringVar(&etcdcafile, "etcdcafile", "", "CA certificate for TLS to etcd v3")
+	flag.StringVar(&etcdcertfile, "etcdcertfile", "", "Client certificate for TLS to etcd v3")
+	flag.StringVar(&etcdkeyfile, "etcdkeyfile", "", "Client key for TLS to etcd v3")
+	flag.BoolVar(&overwrite, "overwrite", false, "Replace users already in etcd v3")
+	flag.BoolVar(&dryrun, "dryrun", false, "List the users that would be copied, without copying them")
+	flag.StringVar(&loglevel, "loglevel", "info", "Log level. One of debug, info, warn, error")
+	flag.StringVar(&logformat, "logformat", "logfmt", "Log format. One of logfmt, json")
+	flag.Parse()
+}
+
+func main() {
+
+	checkErr(logging.Configure(loglevel, logformat))
+
+	if etcdhosts == "" {
+		flag.Usage()
+		logger.Fatal("Incorrect command line arguments")
+	}
+	if etcdv3hosts == "" {
+		etcdv3hosts = etcdhosts
+	}
+
+	users, err := v2Users(strings.Split(etcdhosts, " "))
+	checkErr(err)
+	logger.Info("Read users from etcd v2", "etcdhosts", etcdhosts, "users", len(users))
+
+	to, err := etcdv3.New(etcdv3.Config{
+		Endpoints:  strings.Split(etcdv3hosts, " "),
+		Prefix:     etcdprefix,
+		CaCertFile: etcdcafile,
+		CertFile:   etcdcertfile,
+		KeyFile:    etcdkeyfile,
+	})
+	checkErr(err)
+	defer to.Close()
+
+	copied, skipped := 0, 0
+	for _, u := range users {
+		if dryrun {
+			exists := to.UserExists(u.Username)
+			logger.Info("Would copy user", "username", u.Username, "exists", exists, "replace", exists && overwrite)
+			continue
+		}
+		saved, err := to.Import(u, overwrite)
+		checkErr(err)
+		if saved {
+			logger.Info("Copied user", "username", u.Username)
+			copied++
+		} else {
+			logger.Info("User already exists, skipping", "username", u.Username)
+			skipped++
+		}
+	}
+	if !dryrun {
+		logger.Info("Finished copying users", "copied", copied, "skipped", skipped)
+	}
+}
+
+// v2Users reads all users under /user with the etcd v2 API, as saved by
+// auth/etcd
+func v2Users(endpoints []string) (users []auth.User, err error) {
+	c, err := client.New(client.Config{
+		Endpoints:               endpoints,
+		Transport:               client.DefaultTransport,
+		HeaderTimeoutPerRequest: time.Second,
+	})
+	if err != nil {
+		return nil, err
+	}
+	resp, err := client.NewKeysAPI(c).Get(context.Background(), "/user", &client.GetOptions{Recursive: true})
+	if err != nil {
+		return nil, err
+	}
+	for _, node := range resp.Node.Nodes {
+		if node.Dir {
+			continue
+		}
+		u := auth.User{Username: path.Base(node.Key)}
+		if err := json.Unmarshal([]byte(node.Value), &u); err != nil {
+			logger.Warn("Skipping unreadable user", "key", node.Key, "error", err)
+			continue
+		}
+		users = append(users, u)
+	}
+	return users, nil
+}
+
+func checkErr(err error) {
+	if err != nil {
+		logger.Fatal(err.Error())
+	}
+}
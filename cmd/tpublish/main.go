@@ -1,15 +1,20 @@
 package main
 
 import (
+	"context"
 	"flag"
 	"github.com/trafero/tstack/client/mqtt"
 	"github.com/trafero/tstack/client/settings"
+	"github.com/trafero/tstack/logging"
 	"github.com/trafero/tstack/tstackutil"
-	"log"
 )
 
 var username, password, mqtturl, topic, payload, cacertfile string
-var verifytls, useconfig bool
+var loglevel, logformat string
+var verifytls, useconfig, retain bool
+var qos int
+
+var logger = logging.New("tpublish")
 
 const (
 	clientid = "tpublish"
@@ -21,9 +26,13 @@ func init() {
 	flag.StringVar(&mqtturl, "mqtturl", "tcp://localhost:1883", "URL for MQTT broker")
 	flag.StringVar(&topic, "topic", "", "Topic to publish to")
 	flag.StringVar(&payload, "payload", "", "Payload to publish")
+	flag.IntVar(&qos, "qos", -1, "QoS to publish at. One of 0, 1, 2. Defaults to the qos setting, or 0")
+	flag.BoolVar(&retain, "retain", false, "Ask the broker to retain the message")
 	flag.StringVar(&cacertfile, "cacrtfile", "/etc/trafero/ca.crt", "CA Cert file")
 	flag.BoolVar(&verifytls, "verifytls", true, "Verify MQTT certificate")
 	flag.BoolVar(&useconfig, "useconfig", true, "Use tstack configuration file")
+	flag.StringVar(&loglevel, "loglevel", "info", "Log level. One of debug, info, warn, error")
+	flag.StringVar(&logformat, "logformat", "logfmt", "Log format. One of logfmt, json")
 
 	flag.Parse()
 
@@ -35,12 +44,15 @@ func main() {
 	var secure bool // secure connection or not
 	var s *settings.Settings
 
+	err = logging.Configure(loglevel, logformat)
+	checkErr(err)
+
 	// Read settings into s
 	if useconfig {
 		s, err = settings.Read()
 		if err != nil {
 			flag.Usage()
-			log.Fatal(err)
+			logger.Fatal(err.Error())
 		}
 	} else {
 
@@ -55,19 +67,27 @@ func main() {
 
 	}
 
+	if qos > 2 {
+		flag.Usage()
+		logger.Fatal("Invalid QoS", "qos", qos)
+	}
+	if qos >= 0 {
+		s.QoS = byte(qos)
+	}
+
 	// Set topic to receive everything for that user, if it hasn'y been set
 	// already
 	if topic == "" {
 		flag.Usage()
-		log.Fatal("No topic")
+		logger.Fatal("No topic")
 	}
 
-	log.Printf("Publishing topic %s.", topic)
+	logger.Info("Publishing topic", "topic", topic)
 
 	secure, err = tstackutil.IsSecureUrl(s.Broker)
 	checkErr(err)
 
-	log.Printf("Connecting to broker %s", s.Broker)
+	logger.Info("Connecting to broker", "broker", s.Broker)
 	var m *mqtt.MQTT
 
 	if secure {
@@ -78,8 +98,9 @@ func main() {
 
 	checkErr(err)
 
-	err = m.PublishMessage(topic, payload)
+	err = m.Publish(topic, payload, s.QoS, retain)
 	checkErr(err)
+	m.Close(context.Background())
 }
 
 func checkErr(err error) {
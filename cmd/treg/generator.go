@@ -2,7 +2,6 @@ package main
 
 import (
 	"github.com/trafero/tstack/auth"
-	"log"
 	"math/rand"
 	"time"
 )
@@ -38,7 +37,7 @@ func NewId(authService auth.Auth) (string, error) {
 		}
 
 		// It does exist so round and round we go
-		log.Printf("ID %s was not as unique as we hoped. Trying another.\n", id)
+		logger.Info("ID was not as unique as we hoped. Trying another.", "id", id)
 
 		// Be kind to all the other services
 		time.Sleep(1000 * time.Millisecond)
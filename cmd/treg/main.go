@@ -3,39 +3,91 @@ package main
 import (
 	"encoding/json"
 	"flag"
-	"fmt"
 	"github.com/didip/tollbooth"
+	"github.com/trafero/tstack/audit"
+	auditfile "github.com/trafero/tstack/audit/file"
 	"github.com/trafero/tstack/auth"
 	"github.com/trafero/tstack/auth/etcd"
+	"github.com/trafero/tstack/auth/etcdv3"
+	sqlauth "github.com/trafero/tstack/auth/sql"
+	"github.com/trafero/tstack/logging"
 	"io/ioutil"
-	"log"
 	"net/http"
 	"strings"
 	"time"
 )
 
 var authService auth.Auth
-var mqtturl, regkey, etcdhosts, port, cacertfile string
+var mqtturl, regkey, etcdhosts, authsql, port, cacertfile string
+var loglevel, logformat string
+var auditpath string
+var etcdv3auth bool
+var etcdprefix, etcdcafile, etcdcertfile, etcdkeyfile string
+
+var logger = logging.New("treg")
+
+// userStore is an auth back end that can record user changes
+type userStore interface {
+	auth.Auth
+	SetAudit(audit.Sink)
+}
 
 func init() {
 	flag.StringVar(&regkey, "regkey", "", "Registration key")
 	flag.StringVar(&etcdhosts, "etcdhosts", "", "list of etcd endpoints. e.g. 'http://etcd0:2379 http://etcd1:2379'")
+	flag.BoolVar(&etcdv3auth, "etcdv3", false, "Use the etcd v3 API for etcdhosts")
+	flag.StringVar(&etcdprefix, "etcdprefix", etcdv3.DefaultPrefix, "Key prefix for users, with etcdv3")
+	flag.StringVar(&etcdcafile, "etcdcafile", "", "CA certificate for TLS to etcd, with etcdv3")
+	flag.StringVar(&etcdcertfile, "etcdcertfile", "", "Client certificate for TLS to etcd, with etcdv3")
+	flag.StringVar(&etcdkeyfile, "etcdkeyfile", "", "Client key for TLS to etcd, with etcdv3")
+	flag.StringVar(&authsql, "authsql", "", "SQL database config file (YAML), to use instead of etcd")
 	flag.StringVar(&mqtturl, "mqtturl", "tcp://localhost:1883", "URL for MQTT broker")
 	flag.StringVar(&port, "port", "8000", "Port to listen on")
 	flag.StringVar(&cacertfile, "cacertfile", "", "CA certificate location")
+	flag.StringVar(&auditpath, "auditfile", "", "Audit log file for user changes")
+	flag.StringVar(&loglevel, "loglevel", "info", "Log level. One of debug, info, warn, error")
+	flag.StringVar(&logformat, "logformat", "logfmt", "Log format. One of logfmt, json")
 	flag.Parse()
 }
 
 func main() {
 	var err error
-	if etcdhosts == "" || regkey == "" {
+
+	err = logging.Configure(loglevel, logformat)
+	checkErr(err)
+
+	if (etcdhosts == "" && authsql == "") || regkey == "" {
 		flag.Usage()
-		log.Fatal("Incorrect command line arguments")
+		logger.Fatal("Incorrect command line arguments")
 	}
-	authService, err = etcd.New(strings.Split(etcdhosts, " "))
-	checkErr(err)
+	var service userStore
+	if authsql != "" {
+		config, err := sqlauth.ReadConfig(authsql)
+		checkErr(err)
+		service, err = sqlauth.New(config)
+		checkErr(err)
+	} else if etcdv3auth {
+		service, err = etcdv3.New(etcdv3.Config{
+			Endpoints:  strings.Split(etcdhosts, " "),
+			Prefix:     etcdprefix,
+			CaCertFile: etcdcafile,
+			CertFile:   etcdcertfile,
+			KeyFile:    etcdkeyfile,
+		})
+		checkErr(err)
+	} else {
+		service, err = etcd.New(strings.Split(etcdhosts, " "))
+		checkErr(err)
+	}
+	if auditpath != "" {
+		f, err := auditfile.New(auditpath, 0, 0)
+		checkErr(err)
+		defer f.Close()
+		service.SetAudit(f)
+	}
+	authService = service
 
-	log.Printf("Listening for registration requests on port %s", port)
+	logger.Info("Listening for registration requests", "port", port)
 
 	http.Handle(
 		"/register.json",
@@ -63,14 +115,14 @@ func register(w http.ResponseWriter, r *http.Request) {
 	err := decoder.Decode(&req_data)
 	if err != nil {
 		w.WriteHeader(http.StatusBadRequest)
-		log.Println("Bad registration request: ", err)
+		logger.Warn("Bad registration request", "remote", r.RemoteAddr, "error", err)
 		return
 	}
 
 	// Check registration key
 	if req_data.RegistrationKey != regkey {
 		w.WriteHeader(http.StatusUnauthorized)
-		log.Println("Unauthorized request key: ", req_data.RegistrationKey)
+		logger.Warn("Unauthorized request key", "remote", r.RemoteAddr, "regkey", req_data.RegistrationKey)
 		return
 	}
 
@@ -86,6 +138,8 @@ func register(w http.ResponseWriter, r *http.Request) {
 	err = authService.SetRights(id, id+`/#`)
 	checkErr(err)
 
+	logger.Info("Registered device", "username", id, "remote", r.RemoteAddr)
+
 	// Read TLS certs into struct for output
 	ca := ""
 	if cacertfile != "" {
@@ -112,8 +166,7 @@ func register(w http.ResponseWriter, r *http.Request) {
 }
 
 func LogRequest(r *http.Request) {
-	url := fmt.Sprintf("%v %v %v", r.Method, r.URL, r.Proto)
-	log.Printf("%s\n", url)
+	logger.Info("Request", "method", r.Method, "url", r.URL, "proto", r.Proto, "remote", r.RemoteAddr)
 }
 
 func checkErr(err error) {
@@ -3,8 +3,8 @@ package main
 import (
 	"flag"
 	"github.com/trafero/tstack/client/settings"
+	"github.com/trafero/tstack/logging"
 	"io/ioutil"
-	"log"
 	"os"
 )
 
@@ -15,12 +15,20 @@ const (
 )
 
 var regservice, regkey string
-var verifytls bool
+var loglevel, logformat string
+var verifytls, status bool
+var qos int
+
+var logger = logging.New("tregister")
 
 func init() {
 	flag.StringVar(&regservice, "regservice", "", "Registration service (e.g. http://localhost:8000/register.json)")
 	flag.StringVar(&regkey, "regkey", "", "Registration key")
 	flag.BoolVar(&verifytls, "verifytls", true, "Verify MQTT server TLS certificate name")
+	flag.IntVar(&qos, "qos", 0, "Default QoS for publishing and subscribing. One of 0, 1, 2")
+	flag.BoolVar(&status, "status", false, "Publish online/offline status to USERNAME/status")
+	flag.StringVar(&loglevel, "loglevel", "info", "Log level. One of debug, info, warn, error")
+	flag.StringVar(&logformat, "logformat", "logfmt", "Log format. One of logfmt, json")
 	flag.Parse()
 }
 
@@ -29,28 +37,31 @@ func main() {
 	var err error
 	var s *settings.Settings
 
-	if regservice == "" || regkey == "" {
+	if err = logging.Configure(loglevel, logformat); err != nil {
+		logger.Fatal(err.Error())
+	}
+
+	if regservice == "" || regkey == "" || qos < 0 || qos > 2 {
 		flag.Usage()
-		log.Fatal(err)
+		logger.Fatal("Incorrect command line arguments")
 	}
 
 	// Ensure configuration directory is present
 	if _, err = os.Stat(settingsDirectory); os.IsNotExist(err) {
 		if err = os.MkdirAll(settingsDirectory, os.ModePerm); err != nil {
-			log.Fatal(err)
+			logger.Fatal(err.Error())
 		}
 	}
 
 	if _, err := os.Stat(settingsFile); !os.IsNotExist(err) {
-		log.Fatal("ERROR: Settings file \"" + settingsFile + "\" already exists")
+		logger.Fatal("Settings file already exists", "file", settingsFile)
 	}
 
 	if s, err = registerDevice(); err != nil {
-		log.Fatal(err)
+		logger.Fatal(err.Error())
 	}
 
-	log.Printf("Device name %s", s.Username)
-	log.Printf("Using broker %s", s.Broker)
+	logger.Info("Registered device", "username", s.Username, "broker", s.Broker)
 
 }
 
@@ -59,6 +70,7 @@ func registerDevice() (s *settings.Settings, err error) {
 	s = &settings.Settings{
 		VerifyTls:  verifytls,
 		CaCertFile: cacertfile,
+		QoS:        byte(qos),
 	}
 
 	reply, err := Register(regservice, regkey)
@@ -72,6 +84,9 @@ func registerDevice() (s *settings.Settings, err error) {
 	s.Username = reply.Name
 	s.Password = reply.Password
 	s.Broker = reply.Broker
+	if status {
+		s.SetStatus()
+	}
 
 	// Write settings to file
 	err = settings.Write(s)
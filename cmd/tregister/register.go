@@ -4,7 +4,6 @@ import (
 	"bytes"
 	"encoding/json"
 	"github.com/trafero/tstack/tstackutil"
-	"log"
 	"net/http"
 	"strings"
 	"time"
@@ -25,7 +24,7 @@ func Register(registrationService string, registrationKey string) (reply Reply,
 	var resp *http.Response
 	reply = Reply{}
 
-	log.Printf("Connecting to registration service %s", registrationService)
+	logger.Info("Connecting to registration service", "url", registrationService)
 	tstackutil.WaitForUrl(registrationService)
 
 	post := Post{
@@ -44,19 +43,19 @@ func Register(registrationService string, registrationKey string) (reply Reply,
 		if err == nil {
 			break
 		}
-		log.Printf("Error from registration service%s\n", err)
+		logger.Warn("Error from registration service", "error", err)
 		time.Sleep(time.Second)
 	}
 
 	defer resp.Body.Close()
 	if !strings.HasPrefix(resp.Status, "200") {
-		log.Printf("Got a response code of %s. Hoping for a 200", resp.Status)
+		logger.Warn("Got an unexpected response code. Hoping for a 200", "status", resp.Status)
 	}
 	err = json.NewDecoder(resp.Body).Decode(&reply)
 	if err != nil {
 		return reply, err
 	}
-	log.Println("Registered a device name of", reply.Name)
+	logger.Info("Registered a device name", "username", reply.Name)
 
 	return reply, nil
 
@@ -3,22 +3,66 @@ package main
 import (
 	nettls "crypto/tls"
 	"flag"
+	"github.com/trafero/tstack/audit"
+	auditfile "github.com/trafero/tstack/audit/file"
 	"github.com/trafero/tstack/auth"
 	authall "github.com/trafero/tstack/auth/all"
+	authcache "github.com/trafero/tstack/auth/cache"
+	chainauth "github.com/trafero/tstack/auth/chain"
 	etcdauth "github.com/trafero/tstack/auth/etcd"
+	"github.com/trafero/tstack/auth/etcdv3"
+	fileauth "github.com/trafero/tstack/auth/file"
+	httpauth "github.com/trafero/tstack/auth/http"
+	jwtauth "github.com/trafero/tstack/auth/jwt"
+	sqlauth "github.com/trafero/tstack/auth/sql"
+	"github.com/trafero/tstack/coap"
+	"github.com/trafero/tstack/logging"
+	"github.com/trafero/tstack/mqttsn"
 	"github.com/trafero/tstack/serve"
 	"github.com/trafero/tstack/tls"
 	"github.com/trafero/tstack/tstackutil"
-	"log"
 	"net"
 	"strings"
+	"time"
 
 	"net/http"
 	_ "net/http/pprof"
 )
 
 var addr, addrTls, etcdhosts, certfile, keyfile, cafile string
+var loglevel, logformat string
 var authentication bool
+var authfile, aclfile string
+var authsql string
+var authhttp string
+var authjwt string
+var authchain, authwrite string
+var authcachettl time.Duration
+var disconnectchanged bool
+var lockoutfailures, lockoutsourcefailures int
+var lockouttime, lockoutdelay, lockoutmaxdelay time.Duration
+var lockoutallow string
+var etcdv3auth bool
+var etcdprefix, etcdcafile, etcdcertfile, etcdkeyfile string
+
+var auditpath string
+var auditmaxsize int64
+var auditbackups int
+var auditsys bool
+
+var delaystore string
+var delaylimit int
+var expiry string
+var rewrite string
+
+var addrHttp, addrHttps string
+
+var addrCoap string
+
+var addrSn, sntopics, snusername, snpassword string
+var snid int
+
+var logger = logging.New("tserve")
 
 var broker *serve.Broker
 var authenticator auth.Auth
@@ -28,34 +72,103 @@ func init() {
 	flag.StringVar(&addr, "addr", "", "Unencrypted listen address. e.g. 0.0.0.0:1883")
 	flag.StringVar(&addrTls, "addrTls", "", "Encrypted listen address. eg. 0.0.0.0:8883")
 	flag.StringVar(&etcdhosts, "etcdhosts", "", "list of etcd endpoints. e.g. 'http://etcd0:2379 http://etcd1:2379'")
+	flag.BoolVar(&etcdv3auth, "etcdv3", false, "Use the etcd v3 API for etcdhosts")
+	flag.StringVar(&etcdprefix, "etcdprefix", etcdv3.DefaultPrefix, "Key prefix for users, with etcdv3")
+	flag.StringVar(&etcdcafile, "etcdcafile", "", "CA certificate for TLS to etcd, with etcdv3")
+	flag.StringVar(&etcdcertfile, "etcdcertfile", "", "Client certificate for TLS to etcd, with etcdv3")
+	flag.StringVar(&etcdkeyfile, "etcdkeyfile", "", "Client key for TLS to etcd, with etcdv3")
 	flag.StringVar(&certfile, "certfile", "/certs/mqtt.crt", "TLS certificate file")
 	flag.StringVar(&keyfile, "keyfile", "/certs/mqtt.key", "TLS key file")
 	flag.StringVar(&cafile, "cafile", "/certs/ca.crt", "CA certificate")
 	flag.BoolVar(&authentication, "authentication", true, "Use authentication")
+	flag.StringVar(&authfile, "authfile", "", "Users file, of username:bcrypt hash lines, to use instead of etcd")
+	flag.StringVar(&aclfile, "aclfile", "", "Access rights file, of username:rights lines, for authfile. Defaults to AUTHFILE.acl")
+	flag.StringVar(&authsql, "authsql", "", "SQL database config file (YAML), to use instead of etcd")
+	flag.StringVar(&authhttp, "authhttp", "", "HTTP account service config file (YAML), to use instead of etcd")
+	flag.StringVar(&authjwt, "authjwt", "", "JWT config file (YAML), to take JSON Web Tokens as passwords instead of using etcd")
+	flag.StringVar(&authchain, "authchain", "", "Back ends to try in order, of file, sql, http, jwt and etcd, each set up by its own options. e.g. 'etcd,file,jwt'")
+	flag.StringVar(&authwrite, "authwrite", "", "Back end of authchain that user changes go to, or none. Defaults to the first")
+	flag.DurationVar(&authcachettl, "authcache", 0, "Time to keep users and successful logins from etcd, authsql or authhttp. e.g. 1m. 0 to not keep them")
+	flag.BoolVar(&disconnectchanged, "disconnectchanged", false, "Disconnect clients whose user is removed, disabled or password changed")
+	flag.IntVar(&lockoutfailures, "lockoutfailures", 0, "Failed logins for a username before it is locked out. 0 for no limit")
+	flag.IntVar(&lockoutsourcefailures, "lockoutsourcefailures", 20, "Failed logins from an address before it is locked out. 0 for no limit")
+	flag.DurationVar(&lockouttime, "lockouttime", 15*time.Minute, "How long usernames and addresses are locked out for")
+	flag.DurationVar(&lockoutdelay, "lockoutdelay", time.Second, "Time after a failed login that logins are refused, doubled with each failure")
+	flag.DurationVar(&lockoutmaxdelay, "lockoutmaxdelay", 30*time.Second, "Longest time logins are refused after failures. 0 for no wait")
+	flag.StringVar(&lockoutallow, "lockoutallow", "", "Addresses and networks never delayed or locked out. e.g. '10.0.0.0/8,192.168.1.5'")
+	flag.StringVar(&auditpath, "auditfile", "", "Audit log file for authentication and authorization decisions")
+	flag.Int64Var(&auditmaxsize, "auditmaxsize", 100, "Size in MB at which the audit log file is rotated")
+	flag.IntVar(&auditbackups, "auditbackups", 5, "Number of rotated audit log files to keep")
+	flag.BoolVar(&auditsys, "auditsys", false, "Publish audit events to the "+serve.AuditTopic+" topic")
+	flag.StringVar(&delaystore, "delaystore", "", "File to persist delayed messages in")
+	flag.IntVar(&delaylimit, "delaylimit", serve.DefaultDelayedLimit, "Most delayed messages pending at once")
+	flag.StringVar(&expiry, "expiry", "", "Message time to live by topic filter. e.g. '+/command/#=10m,sensors/#=24h'")
+	flag.StringVar(&rewrite, "rewrite", "", "Topic rewrite rules. e.g. 'sensors/+/t=$1/temperature'")
+	flag.StringVar(&addrHttp, "addrHttp", "", "Unencrypted HTTP publish/subscribe listen address. e.g. 0.0.0.0:8080")
+	flag.StringVar(&addrHttps, "addrHttps", "", "Encrypted HTTP publish/subscribe listen address. e.g. 0.0.0.0:8443")
+	flag.StringVar(&addrCoap, "addrCoap", "", "CoAP (UDP) listen address. e.g. 0.0.0.0:5683")
+	flag.StringVar(&addrSn, "addrSn", "", "MQTT-SN (UDP) listen address. e.g. 0.0.0.0:1884")
+	flag.IntVar(&snid, "snid", 1, "MQTT-SN gateway ID")
+	flag.StringVar(&sntopics, "sntopics", "", "MQTT-SN predefined topic IDs. e.g. '1=ABC-123/temperature'")
+	flag.StringVar(&snusername, "snusername", "", "Username for MQTT-SN QoS -1 publishes")
+	flag.StringVar(&snpassword, "snpassword", "", "Password for MQTT-SN QoS -1 publishes")
+	flag.StringVar(&loglevel, "loglevel", "info", "Log level. One of debug, info, warn, error")
+	flag.StringVar(&logformat, "logformat", "logfmt", "Log format. One of logfmt, json")
 	flag.Parse()
 }
 
 func main() {
 
-	// For pprof profiler (at http://localhost:8070/debug/pprof/ )
-	go http.ListenAndServe("localhost:8070", nil) // For pprof
-
 	var err error
 
-	if addr == "" && addrTls == "" {
+	err = logging.Configure(loglevel, logformat)
+	checkErr(err)
+
+	// For pprof profiler (at http://localhost:8070/debug/pprof/ ) and
+	// changing the log level at runtime (at http://localhost:8070/debug/loglevel )
+	http.Handle("/debug/loglevel", logging.LevelHandler())
+	go http.ListenAndServe("localhost:8070", nil)
+
+	if addr == "" && addrTls == "" && addrSn == "" && addrHttp == "" && addrHttps == "" && addrCoap == "" {
 		flag.Usage()
-		log.Fatal("addr and addrTls cannot both be missing")
+		logger.Fatal("addr, addrTls, addrSn, addrHttp, addrHttps and addrCoap cannot all be missing")
 	}
 
-	if authentication {
+	if authentication && authchain != "" {
+		// Several back ends, tried in order
+		var backends []auth.Auth
+		var writer auth.Auth
+		names := strings.Split(authchain, ",")
+		if authwrite == "" {
+			authwrite = strings.TrimSpace(names[0])
+		}
+		for _, name := range names {
+			name = strings.TrimSpace(name)
+			a := backend(name)
+			if name == authwrite {
+				writer = a
+			}
+			backends = append(backends, a)
+		}
+		if writer == nil && authwrite != "none" {
+			logger.Fatal("authwrite is not one of authchain", "authwrite", authwrite)
+		}
+		logger.Info("Using chained back ends", "authchain", authchain, "authwrite", authwrite)
+		authenticator = chainauth.New(writer, backends...)
+	} else if authentication && authfile != "" {
+		authenticator = backend("file")
+	} else if authentication && authsql != "" {
+		authenticator = backend("sql")
+	} else if authentication && authhttp != "" {
+		authenticator = backend("http")
+	} else if authentication && authjwt != "" {
+		authenticator = backend("jwt")
+	} else if authentication {
 		if etcdhosts == "" {
 			flag.Usage()
-			log.Fatal("etcdhosts argument missing")
+			logger.Fatal("etcdhosts, authfile, authsql, authhttp, authjwt or authchain argument missing")
 		}
-		// Authentication using ETCD
-		log.Printf("Using etcd hosts: %s", etcdhosts)
-		authenticator, err = etcdauth.New(strings.Split(etcdhosts, " "))
-		checkErr(err)
+		authenticator = backend("etcd")
 	} else {
 		// Authentication using dummy authenticator which allows all and gives
 		// everyone '#' rights (not access to topics starting with $)
@@ -65,9 +178,65 @@ func main() {
 	// MQTT broker back end
 	broker = serve.NewBroker()
 
+	// Changes to users, e.g. with tuser, apply to connected clients
+	broker.SetDisconnectChanged(disconnectchanged)
+	if n, ok := authenticator.(auth.Notifier); ok {
+		n.WatchUsers(make(chan struct{}), broker.UserChanged)
+	}
+
+	// Topic rewriting
+	rewriteRules, err := serve.ParseRewriteRules(rewrite)
+	checkErr(err)
+	broker.SetRewrites(rewriteRules)
+
+	// Message expiry, with counts of expired messages at http://localhost:8070/expiry
+	expiryRules, err := serve.ParseExpiryRules(expiry)
+	checkErr(err)
+	broker.SetExpiry(expiryRules)
+	http.Handle("/expiry", serve.ExpiryHandler(broker))
+
+	// Password guessing limits, with counts of failures at http://localhost:8070/lockout
+	allow, err := serve.ParseAllowList(lockoutallow)
+	checkErr(err)
+	broker.SetLockout(serve.Lockout{
+		MaxFailures:       lockoutfailures,
+		MaxSourceFailures: lockoutsourcefailures,
+		LockoutTime:       lockouttime,
+		Delay:             lockoutdelay,
+		MaxDelay:          lockoutmaxdelay,
+		Allow:             allow,
+	})
+	http.Handle("/lockout", serve.LockoutHandler(broker))
+
+	// Delayed messages, listed and cancelled at http://localhost:8070/delayed
+	broker.SetDelayedLimit(delaylimit)
+	if delaystore != "" {
+		logger.Info("Persisting delayed messages", "file", delaystore)
+		err = broker.SetDelayedStore(delaystore)
+		checkErr(err)
+	}
+	http.Handle("/delayed", serve.DelayedHandler(broker))
+
+	// Audit trail
+	var sinks audit.Multi
+	if auditpath != "" {
+		logger.Info("Writing audit log", "file", auditpath)
+		f, err := auditfile.New(auditpath, auditmaxsize*1024*1024, auditbackups)
+		checkErr(err)
+		defer f.Close()
+		sinks = append(sinks, f)
+	}
+	if auditsys {
+		logger.Info("Publishing audit events", "topic", serve.AuditTopic)
+		sinks = append(sinks, serve.NewSysAudit(broker))
+	}
+	if len(sinks) > 0 {
+		broker.SetAudit(sinks)
+	}
+
 	// Unencrypted MQTT server
 	if addr != "" {
-		log.Printf("Running MQTT server on %s", addr)
+		logger.Info("Running MQTT server", "addr", addr)
 		l, err := net.Listen("tcp", addr)
 		checkErr(err)
 		go handleServer(l)
@@ -82,7 +251,7 @@ func main() {
 		tstackutil.WaitForFile(certfile)
 		tstackutil.WaitForFile(keyfile)
 
-		log.Printf("Running encypted MQTT server on %s", addrTls)
+		logger.Info("Running encrypted MQTT server", "addr", addrTls)
 		tlsconfig, err := tls.TLSConfig(cafile, certfile, keyfile)
 		checkErr(err)
 		l, err := nettls.Listen("tcp", addrTls, tlsconfig)
@@ -91,6 +260,67 @@ func main() {
 		defer l.Close()
 	}
 
+	// HTTP publish/subscribe gateway
+	httpGateway := serve.NewHTTPGateway(authenticator, broker)
+	if addrHttp != "" {
+		logger.Info("Running HTTP gateway", "addr", addrHttp)
+		l, err := net.Listen("tcp", addrHttp)
+		checkErr(err)
+		go func() {
+			checkErr(http.Serve(l, httpGateway))
+		}()
+		defer l.Close()
+	}
+	if addrHttps != "" {
+		tstackutil.WaitForFile(cafile)
+		tstackutil.WaitForFile(certfile)
+		tstackutil.WaitForFile(keyfile)
+
+		logger.Info("Running encrypted HTTP gateway", "addr", addrHttps)
+		tlsconfig, err := tls.TLSConfig(cafile, certfile, keyfile)
+		checkErr(err)
+		l, err := nettls.Listen("tcp", addrHttps, tlsconfig)
+		checkErr(err)
+		go func() {
+			checkErr(http.Serve(l, httpGateway))
+		}()
+		defer l.Close()
+	}
+
+	// CoAP gateway, with each CoAP client connected to the broker in process
+	if addrCoap != "" {
+		gateway := coap.New(func(remote net.Addr) (net.Conn, error) {
+			return serve.Pipe(authenticator, broker, remote), nil
+		})
+		logger.Info("Running CoAP gateway", "addr", addrCoap)
+		conn, err := net.ListenPacket("udp", addrCoap)
+		checkErr(err)
+		go func() {
+			checkErr(gateway.Serve(conn))
+		}()
+		defer conn.Close()
+	}
+
+	// MQTT-SN gateway, with each MQTT-SN client connected to the broker in
+	// process
+	if addrSn != "" {
+		topics, err := mqttsn.ParsePredefinedTopics(sntopics)
+		checkErr(err)
+		gateway := mqttsn.New(byte(snid), func(remote net.Addr) (net.Conn, error) {
+			return serve.Pipe(authenticator, broker, remote), nil
+		})
+		gateway.SetPredefinedTopics(topics)
+		gateway.SetAnonymous(snusername, snpassword)
+
+		logger.Info("Running MQTT-SN gateway", "addr", addrSn)
+		conn, err := net.ListenPacket("udp", addrSn)
+		checkErr(err)
+		go func() {
+			checkErr(gateway.Serve(conn))
+		}()
+		defer conn.Close()
+	}
+
 	// Wait forever
 	select {}
 
@@ -106,8 +336,78 @@ func handleServer(l net.Listener) {
 	}
 }
 
+/*
+ * backend opens the auth back end of the given name, one of file, sql, http,
+ * jwt or etcd, from its options. etcd, sql and http are cached if
+ * -authcache is set
+ */
+func backend(name string) (a auth.Auth) {
+	var err error
+	cachettl := authcachettl
+	switch name {
+	case "file":
+		// Authentication using users and rights files, reloaded when changed
+		if aclfile == "" {
+			aclfile = authfile + ".acl"
+		}
+		logger.Info("Using auth files", "authfile", authfile, "aclfile", aclfile)
+		fileAuth, err := fileauth.New(authfile, aclfile)
+		checkErr(err)
+		fileAuth.Watch(fileauth.DefaultWatchInterval)
+		return fileAuth
+	case "sql":
+		// Authentication using a PostgreSQL or SQLite database
+		config, err := sqlauth.ReadConfig(authsql)
+		checkErr(err)
+		logger.Info("Using SQL database", "driver", config.Driver)
+		a, err = sqlauth.New(config)
+		checkErr(err)
+	case "http":
+		// Authentication by another service, over HTTP
+		config, err := httpauth.ReadConfig(authhttp)
+		checkErr(err)
+		logger.Info("Using HTTP account service", "url", config.AuthenticateURL)
+		a, err = httpauth.New(config)
+		checkErr(err)
+		if cachettl == 0 {
+			cachettl = config.CacheTTL
+		}
+	case "jwt":
+		// Authentication by signed tokens, given as the password. Tokens
+		// carry the user with them, so are never worth caching
+		config, err := jwtauth.ReadConfig(authjwt)
+		checkErr(err)
+		logger.Info("Using JWT tokens", "keyfile", config.KeyFile, "jwksfile", config.JWKSFile)
+		a, err = jwtauth.New(config)
+		checkErr(err)
+		return a
+	case "etcd":
+		// Authentication using ETCD
+		logger.Info("Using etcd hosts", "etcdhosts", etcdhosts, "v3", etcdv3auth)
+		if etcdv3auth {
+			a, err = etcdv3.New(etcdv3.Config{
+				Endpoints:  strings.Split(etcdhosts, " "),
+				Prefix:     etcdprefix,
+				CaCertFile: etcdcafile,
+				CertFile:   etcdcertfile,
+				KeyFile:    etcdkeyfile,
+			})
+		} else {
+			a, err = etcdauth.New(strings.Split(etcdhosts, " "))
+		}
+		checkErr(err)
+	default:
+		logger.Fatal("Unknown auth back end", "name", name)
+	}
+	if cachettl > 0 {
+		logger.Info("Caching users", "backend", name, "ttl", cachettl)
+		a = authcache.New(a, cachettl)
+	}
+	return a
+}
+
 func checkErr(err error) {
 	if err != nil {
-		log.Fatal(err)
+		logger.Fatal(err.Error())
 	}
 }
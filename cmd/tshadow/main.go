@@ -0,0 +1,98 @@
+package main
+
+import (
+	"flag"
+	"github.com/trafero/tstack/client/mqtt"
+	"github.com/trafero/tstack/client/settings"
+	"github.com/trafero/tstack/logging"
+	"github.com/trafero/tstack/shadow"
+	"github.com/trafero/tstack/shadow/etcd"
+	"github.com/trafero/tstack/tstackutil"
+	"strings"
+)
+
+var username, password, mqtturl, cacertfile, etcdhosts string
+var loglevel, logformat string
+var verifytls, useconfig bool
+
+var logger = logging.New("tshadow")
+
+func init() {
+	flag.StringVar(&username, "username", "", "Username for MQTT broker. Needs rights to the shadow topics of all devices")
+	flag.StringVar(&password, "password", "", "Password for MQTT broker")
+	flag.StringVar(&mqtturl, "mqtturl", "tcp://localhost:1883", "URL for MQTT broker")
+	flag.StringVar(&cacertfile, "cacrtfile", "/etc/trafero/ca.crt", "CA Cert file")
+	flag.StringVar(&etcdhosts, "etcdhosts", "", "list of etcd endpoints. e.g. 'http://etcd0:2379 http://etcd1:2379'")
+	flag.BoolVar(&verifytls, "verifytls", true, "Verify MQTT certificate")
+	flag.BoolVar(&useconfig, "useconfig", false, "Use tstack configuration file")
+	flag.StringVar(&loglevel, "loglevel", "info", "Log level. One of debug, info, warn, error")
+	flag.StringVar(&logformat, "logformat", "logfmt", "Log format. One of logfmt, json")
+
+	flag.Parse()
+}
+
+func main() {
+
+	var err error
+	var secure bool // secure connection or not
+	var s *settings.Settings
+
+	err = logging.Configure(loglevel, logformat)
+	checkErr(err)
+
+	if etcdhosts == "" {
+		flag.Usage()
+		logger.Fatal("Incorrect command line arguments")
+	}
+
+	// Read settings into s
+	if useconfig {
+		s, err = settings.Read()
+		if err != nil {
+			flag.Usage()
+			logger.Fatal(err.Error())
+		}
+	} else {
+
+		s = &settings.Settings{
+			Username: username,
+			Password: password,
+			Broker:   mqtturl,
+			// Only used for TLS
+			CaCertFile: cacertfile,
+			VerifyTls:  verifytls,
+		}
+
+	}
+	// Updates and answers are all at QoS 1
+	s.QoS = 1
+
+	store, err := etcd.New(strings.Split(etcdhosts, " "))
+	checkErr(err)
+
+	secure, err = tstackutil.IsSecureUrl(s.Broker)
+	checkErr(err)
+
+	logger.Info("Connecting to broker", "broker", s.Broker)
+	var m *mqtt.MQTT
+
+	if secure {
+		m, err = mqtt.New(s)
+	} else {
+		m, err = mqtt.NewInsecure(s)
+	}
+	checkErr(err)
+
+	err = shadow.New(m, store).Start()
+	checkErr(err)
+	logger.Info("Keeping device shadows")
+
+	// Go to forever land
+	select {}
+}
+
+func checkErr(err error) {
+	if err != nil {
+		panic(err)
+	}
+}
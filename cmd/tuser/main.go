@@ -1,44 +1,233 @@
 package main
 
 import (
+	"encoding/json"
 	"flag"
+	"fmt"
+	"github.com/trafero/tstack/audit"
+	auditfile "github.com/trafero/tstack/audit/file"
+	"github.com/trafero/tstack/auth"
 	etcdauth "github.com/trafero/tstack/auth/etcd"
-	"log"
+	"github.com/trafero/tstack/auth/etcdv3"
+	fileauth "github.com/trafero/tstack/auth/file"
+	sqlauth "github.com/trafero/tstack/auth/sql"
+	"github.com/trafero/tstack/logging"
+	"os"
 	"strings"
 )
 
-var etcdhosts, username, password, rights string
+var etcdhosts, authfile, aclfile, authsql, username, password, rights string
+var loglevel, logformat string
+var auditpath string
+var etcdv3auth bool
+var etcdprefix, etcdcafile, etcdcertfile, etcdkeyfile string
+var prefix, after string
+var limit int
+
+var logger = logging.New("tuser")
+
+// userStore is an auth back end that can record user changes
+type userStore interface {
+	auth.Auth
+	SetAudit(audit.Sink)
+}
+
+// userInfo is a user as output, without their password hash
+type userInfo struct {
+	Username string `json:"username"`
+	Rights   string `json:"rights"`
+	Disabled bool   `json:"disabled"`
+}
+
+// userList is a page of users as output. Next is given to -after for the
+// next page, and is empty on the last page
+type userList struct {
+	Users []userInfo `json:"users"`
+	Next  string     `json:"next,omitempty"`
+}
+
+const commands = `
+Commands:
+  add      Add a user, or change their password, with -username, -password and optionally -rights
+  passwd   Change a user's password, with -username and -password
+  rights   Set a user's rights, with -username and -rights
+  delete   Remove a user, with -username
+  disable  Stop a user connecting, keeping their details, with -username
+  enable   Let a disabled user connect again, with -username
+  show     Show a user, with -username
+  list     List users, optionally with -prefix, -after and -limit
+
+Users are written to standard output as JSON. Without a command, add is
+used if -username, -password and -rights are all given.
+`
 
 func init() {
 	flag.StringVar(&etcdhosts, "etcdhosts", "", "list of etcd endpoints. e.g. 'http://etcd0:2379 http://etcd1:2379'")
-	flag.StringVar(&username, "username", "", "Username for new user")
-	flag.StringVar(&password, "password", "", "Password for new user")
+	flag.BoolVar(&etcdv3auth, "etcdv3", false, "Use the etcd v3 API for etcdhosts")
+	flag.StringVar(&etcdprefix, "etcdprefix", etcdv3.DefaultPrefix, "Key prefix for users, with etcdv3")
+	flag.StringVar(&etcdcafile, "etcdcafile", "", "CA certificate for TLS to etcd, with etcdv3")
+	flag.StringVar(&etcdcertfile, "etcdcertfile", "", "Client certificate for TLS to etcd, with etcdv3")
+	flag.StringVar(&etcdkeyfile, "etcdkeyfile", "", "Client key for TLS to etcd, with etcdv3")
+	flag.StringVar(&authfile, "authfile", "", "Users file, of username:bcrypt hash lines, to use instead of etcd")
+	flag.StringVar(&aclfile, "aclfile", "", "Access rights file, of username:rights lines, for authfile. Defaults to AUTHFILE.acl")
+	flag.StringVar(&authsql, "authsql", "", "SQL database config file (YAML), to use instead of etcd")
+	flag.StringVar(&username, "username", "", "Username of user")
+	flag.StringVar(&password, "password", "", "Password for user")
 	flag.StringVar(&rights, "rights", "", "Access rights as topic expression")
+	flag.StringVar(&prefix, "prefix", "", "List only usernames starting with this")
+	flag.StringVar(&after, "after", "", "List usernames after this one, as given by next from the last page")
+	flag.IntVar(&limit, "limit", 100, "Most users to list at once. 0 for all")
+	flag.StringVar(&auditpath, "auditfile", "", "Audit log file for user changes")
+	flag.StringVar(&loglevel, "loglevel", "info", "Log level. One of debug, info, warn, error")
+	flag.StringVar(&logformat, "logformat", "logfmt", "Log format. One of logfmt, json")
+	flag.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: %s [options] command [options]\n\nOptions:\n", os.Args[0])
+		flag.PrintDefaults()
+		fmt.Fprint(os.Stderr, commands)
+	}
 	flag.Parse()
 }
 
 func main() {
 
-	if etcdhosts == "" || username == "" || password == "" || rights == "" {
-		flag.Usage()
-		log.Fatal("Incorrect command line arguments")
+	checkErr(logging.Configure(loglevel, logformat))
+
+	// Options may come after the command too
+	command := flag.Arg(0)
+	if flag.NArg() > 0 {
+		checkErr(flag.CommandLine.Parse(flag.Args()[1:]))
+	}
+	if command == "" && username != "" && password != "" && rights != "" {
+		command = "add"
+	}
+
+	if etcdhosts == "" && authfile == "" && authsql == "" {
+		usage("etcdhosts, authfile or authsql argument missing")
+	}
+	switch command {
+	case "add", "passwd":
+		if username == "" || password == "" {
+			usage("username and password arguments needed")
+		}
+	case "rights":
+		if username == "" || rights == "" {
+			usage("username and rights arguments needed")
+		}
+	case "delete", "disable", "enable", "show":
+		if username == "" {
+			usage("username argument needed")
+		}
+	case "list":
+	default:
+		usage("Unknown or missing command")
 	}
 
-	log.Printf("Setting up user %s", username)
-	log.Printf("ETCD hosts %s", etcdhosts)
+	a := open()
 
-	a, err := etcdauth.New(strings.Split(etcdhosts, " "))
+	if auditpath != "" {
+		f, err := auditfile.New(auditpath, 0, 0)
+		checkErr(err)
+		defer f.Close()
+		a.SetAudit(f)
+	}
+
+	switch command {
+	case "add":
+		checkErr(a.AddOrUpdateUser(username, password))
+		if rights != "" {
+			checkErr(a.SetRights(username, rights))
+		}
+		show(a)
+	case "passwd":
+		if !a.UserExists(username) {
+			checkErr(auth.ErrUserNotFound)
+		}
+		checkErr(a.AddOrUpdateUser(username, password))
+		show(a)
+	case "rights":
+		checkErr(a.SetRights(username, rights))
+		show(a)
+	case "delete":
+		checkErr(a.DeleteUser(username))
+		output(map[string]interface{}{"username": username, "deleted": true})
+	case "disable":
+		checkErr(a.DisableUser(username))
+		show(a)
+	case "enable":
+		checkErr(a.EnableUser(username))
+		show(a)
+	case "show":
+		show(a)
+	case "list":
+		list(a)
+	}
+}
+
+// open returns the back end given by the options
+func open() userStore {
+	var a userStore
+	var err error
+	if authfile != "" {
+		if aclfile == "" {
+			aclfile = authfile + ".acl"
+		}
+		logger.Debug("Using auth files", "authfile", authfile, "aclfile", aclfile)
+		a, err = fileauth.New(authfile, aclfile)
+	} else if authsql != "" {
+		var config sqlauth.Config
+		config, err = sqlauth.ReadConfig(authsql)
+		checkErr(err)
+		logger.Debug("Using SQL database", "driver", config.Driver)
+		a, err = sqlauth.New(config)
+	} else if etcdv3auth {
+		logger.Debug("Using etcd hosts", "etcdhosts", etcdhosts, "v3", true)
+		a, err = etcdv3.New(etcdv3.Config{
+			Endpoints:  strings.Split(etcdhosts, " "),
+			Prefix:     etcdprefix,
+			CaCertFile: etcdcafile,
+			CertFile:   etcdcertfile,
+			KeyFile:    etcdkeyfile,
+		})
+	} else {
+		logger.Debug("Using etcd hosts", "etcdhosts", etcdhosts)
+		a, err = etcdauth.New(strings.Split(etcdhosts, " "))
+	}
 	checkErr(err)
+	return a
+}
 
-	err = a.AddOrUpdateUser(username, password)
+// show outputs the user given by -username
+func show(a auth.Auth) {
+	u, err := a.User(username)
 	checkErr(err)
+	output(userInfo{Username: u.Username, Rights: u.Rights, Disabled: u.Disabled})
+}
 
-	err = a.SetRights(username, rights)
+// list outputs a page of users
+func list(a auth.Auth) {
+	users, err := a.ListUsers(prefix, after, limit)
 	checkErr(err)
+	l := userList{Users: []userInfo{}}
+	for _, u := range users {
+		l.Users = append(l.Users, userInfo{Username: u.Username, Rights: u.Rights, Disabled: u.Disabled})
+	}
+	if limit > 0 && len(users) == limit {
+		l.Next = users[len(users)-1].Username
+	}
+	output(l)
+}
+
+func output(v interface{}) {
+	checkErr(json.NewEncoder(os.Stdout).Encode(v))
+}
+
+func usage(message string) {
+	flag.Usage()
+	logger.Fatal(message)
 }
 
 func checkErr(err error) {
 	if err != nil {
-		log.Fatal(err)
+		logger.Fatal(err.Error())
 	}
 }
@@ -0,0 +1,386 @@
+package coap
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"github.com/trafero/tstack/logging"
+	"math/rand"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+var logger = logging.New("coap")
+
+// Path prefix of the publish/subscribe resources, e.g. coap://host/ps/<topic>
+const PathPrefix = "ps"
+
+var (
+	// How long responses to confirmable requests are kept, to answer
+	// retransmissions without publishing twice (EXCHANGE_LIFETIME, sec. 4.8.2)
+	exchangeLifetime = 247 * time.Second
+	// Publish sessions unused for this long are closed
+	sessionIdle = 5 * time.Minute
+	// Notifications are sent confirmable at least this often, to find
+	// observers that have gone away (RFC 7641 sec. 4.5)
+	confirmInterval = time.Minute
+	// Retransmission of confirmable notifications (sec. 4.8)
+	ackTimeout     = 2 * time.Second
+	maxRetransmits = 4
+)
+
+// Dialer opens an MQTT 3.1.1 connection to the broker on behalf of the CoAP
+// client at remote (e.g. serve.Pipe)
+type Dialer func(remote net.Addr) (net.Conn, error)
+
+// Gateway maps CoAP requests on /ps/<topic> to MQTT sessions on a broker.
+// PUT and POST publish, and GET with Observe subscribes. Credentials are
+// given as Uri-Query options u=<username> and p=<password>, and each
+// request is made with the user's own MQTT session, so the broker applies
+// the user's rights.
+type Gateway struct {
+	dial Dialer
+	conn net.PacketConn
+
+	mutex      sync.Mutex
+	messageID  uint16
+	publishers map[string]*session  // By remote address, username and password
+	observers  map[string]*observer // By remote address and token
+	acks       map[string]chan bool // Confirmable notifications awaiting ACK, by remote address and message ID
+	exchanges  map[string]*exchange // Recent confirmable requests, by remote address and message ID
+}
+
+// exchange is a confirmable request, with its response once sent
+type exchange struct {
+	response []byte
+	expires  time.Time
+}
+
+func New(dial Dialer) *Gateway {
+	return &Gateway{
+		dial:       dial,
+		messageID:  uint16(rand.Intn(0x10000)),
+		publishers: make(map[string]*session),
+		observers:  make(map[string]*observer),
+		acks:       make(map[string]chan bool),
+		exchanges:  make(map[string]*exchange),
+	}
+}
+
+// Serve reads CoAP datagrams from conn until it is closed
+func (g *Gateway) Serve(conn net.PacketConn) error {
+	g.conn = conn
+	go g.cleanRound()
+
+	buf := make([]byte, 65536)
+	for {
+		n, addr, err := conn.ReadFrom(buf)
+		if err != nil {
+			g.closeAll()
+			return err
+		}
+		m, err := Decode(buf[:n])
+		if err != nil {
+			logger.Debug("Could not decode datagram", "remote", addr, "error", err)
+			continue
+		}
+		g.handle(addr, m)
+	}
+}
+
+func (g *Gateway) send(addr net.Addr, m *Message) []byte {
+	b := m.Encode()
+	if _, err := g.conn.WriteTo(b, addr); err != nil {
+		logger.Debug("Could not send datagram", "remote", addr, "error", err)
+	}
+	return b
+}
+
+func (g *Gateway) nextMessageID() uint16 {
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+	g.messageID++
+	return g.messageID
+}
+
+func messageKey(addr net.Addr, id uint16) string {
+	return addr.String() + " " + strconv.Itoa(int(id))
+}
+
+func (g *Gateway) handle(addr net.Addr, m *Message) {
+	switch {
+	case m.Type == Acknowledgement || m.Type == Reset:
+		g.mutex.Lock()
+		ack, ok := g.acks[messageKey(addr, m.MessageID)]
+		g.mutex.Unlock()
+		if ok {
+			select {
+			case ack <- m.Type == Acknowledgement:
+			default:
+			}
+		}
+		if m.Type == Reset {
+			g.reset(addr, m.MessageID)
+		}
+	case m.Code == Empty:
+		// CoAP ping (sec. 4.3)
+		if m.Type == Confirmable {
+			g.send(addr, &Message{Type: Reset, MessageID: m.MessageID})
+		}
+	case m.IsRequest():
+		if m.Type == Confirmable {
+			key := messageKey(addr, m.MessageID)
+			g.mutex.Lock()
+			e, duplicate := g.exchanges[key]
+			var response []byte
+			if duplicate {
+				response = e.response
+			} else {
+				g.exchanges[key] = &exchange{expires: time.Now().Add(exchangeLifetime)}
+			}
+			g.mutex.Unlock()
+			if duplicate {
+				// Repeat the response, if there is one yet
+				if response != nil {
+					g.conn.WriteTo(response, addr)
+				}
+				return
+			}
+		}
+		go g.request(addr, m)
+	default:
+		// Responses are not expected by the gateway
+		if m.Type == Confirmable {
+			g.send(addr, &Message{Type: Reset, MessageID: m.MessageID})
+		}
+	}
+}
+
+/*
+ * respond answers a request, piggybacked on the ACK for confirmable
+ * requests (sec. 5.2.1)
+ */
+func (g *Gateway) respond(addr net.Addr, req *Message, resp *Message) {
+	resp.Token = req.Token
+	if req.Type == Confirmable {
+		resp.Type = Acknowledgement
+		resp.MessageID = req.MessageID
+	} else {
+		resp.Type = NonConfirmable
+		resp.MessageID = g.nextMessageID()
+	}
+	b := g.send(addr, resp)
+	if req.Type == Confirmable {
+		g.mutex.Lock()
+		if e, ok := g.exchanges[messageKey(addr, req.MessageID)]; ok {
+			e.response = b
+		}
+		g.mutex.Unlock()
+	}
+}
+
+func (g *Gateway) respondCode(addr net.Addr, req *Message, code byte, diagnostic string) {
+	g.respond(addr, req, &Message{Code: code, Payload: []byte(diagnostic)})
+}
+
+func (g *Gateway) request(addr net.Addr, m *Message) {
+	path := m.Path()
+	if len(path) < 2 || path[0] != PathPrefix {
+		g.respondCode(addr, m, NotFound, "")
+		return
+	}
+	topic := strings.Join(path[1:], "/")
+	query := m.Query()
+	username, password := query["u"], query["p"]
+
+	switch m.Code {
+	case PUT, POST:
+		g.publish(addr, m, topic, username, password, query["retain"])
+	case GET:
+		observe, ok := m.Observe()
+		switch {
+		case !ok:
+			g.respondCode(addr, m, BadRequest, "Observe option required")
+		case observe == 0:
+			qos, err := strconv.Atoi(query["qos"])
+			if query["qos"] == "" {
+				qos, err = 0, nil
+			}
+			if err != nil || qos < 0 || qos > 2 {
+				g.respondCode(addr, m, BadRequest, "Invalid qos")
+				return
+			}
+			g.observe(addr, m, topic, byte(qos), username, password)
+		default:
+			g.cancel(addr, m.Token)
+			g.respond(addr, m, &Message{Code: Content})
+		}
+	default:
+		g.respondCode(addr, m, MethodNotAllowed, "")
+	}
+}
+
+func (g *Gateway) publish(addr net.Addr, m *Message, topic string, username string, password string, retain string) {
+	if strings.ContainsAny(topic, "+#") {
+		g.respondCode(addr, m, BadRequest, "Wildcards cannot be published to")
+		return
+	}
+	retained := false
+	if retain != "" {
+		var err error
+		if retained, err = strconv.ParseBool(retain); err != nil {
+			g.respondCode(addr, m, BadRequest, "Invalid retain")
+			return
+		}
+	}
+
+	s, err := g.publisher(addr, username, password)
+	if err == errNotAuthorized {
+		logger.Warn("CoAP client could not be authenticated", "remote", addr, "username", username)
+		g.respondCode(addr, m, Unauthorized, "")
+		return
+	} else if err != nil {
+		logger.Error("Could not connect CoAP client", "remote", addr, "username", username, "error", err)
+		g.respondCode(addr, m, InternalServerError, "")
+		return
+	}
+
+	switch err = s.publish(topic, m.Payload, retained); err {
+	case nil:
+		logger.Debug("Delivering CoAP message", "remote", addr, "username", username, "topic", topic)
+		g.respondCode(addr, m, Changed, "")
+	case errNotAuthorized:
+		logger.Warn("CoAP client not authorized to publish to topic", "remote", addr, "username", username, "topic", topic)
+		g.removePublisher(s)
+		g.respondCode(addr, m, Forbidden, "")
+	case errTimeout:
+		g.respondCode(addr, m, GatewayTimeout, "")
+	default:
+		g.removePublisher(s)
+		g.respondCode(addr, m, InternalServerError, "")
+	}
+}
+
+/*
+ * publisherKey identifies a publish session. The password is part of it, so
+ * that a session is only reused by requests with the credentials it was
+ * made with, as source addresses are easily spoofed
+ */
+func publisherKey(addr net.Addr, username string, password string) string {
+	h := sha256.Sum256([]byte(password))
+	return addr.String() + " " + username + " " + hex.EncodeToString(h[:])
+}
+
+// publisher returns the client's session for publishing, connecting if needed
+func (g *Gateway) publisher(addr net.Addr, username string, password string) (s *session, err error) {
+	key := publisherKey(addr, username, password)
+	g.mutex.Lock()
+	s, ok := g.publishers[key]
+	g.mutex.Unlock()
+	if ok {
+		select {
+		case <-s.Done:
+		default:
+			return s, nil
+		}
+	}
+
+	if s, err = connect(g.dial, addr, username, password); err != nil {
+		return nil, err
+	}
+	s.key = key
+	g.mutex.Lock()
+	if existing, ok := g.publishers[key]; ok {
+		existing.close()
+	}
+	g.publishers[key] = s
+	g.mutex.Unlock()
+	return s, nil
+}
+
+func (g *Gateway) removePublisher(s *session) {
+	g.mutex.Lock()
+	if g.publishers[s.key] == s {
+		delete(g.publishers, s.key)
+	}
+	g.mutex.Unlock()
+	s.close()
+}
+
+/*
+ * confirm sends a confirmable message, retransmitting it until it is
+ * acknowledged. Returns false if it was reset or never acknowledged
+ */
+func (g *Gateway) confirm(addr net.Addr, m *Message) bool {
+	key := messageKey(addr, m.MessageID)
+	ack := make(chan bool, 1)
+	g.mutex.Lock()
+	g.acks[key] = ack
+	g.mutex.Unlock()
+	defer func() {
+		g.mutex.Lock()
+		delete(g.acks, key)
+		g.mutex.Unlock()
+	}()
+
+	// Initial timeout is randomised between ACK_TIMEOUT and 1.5 times
+	// ACK_TIMEOUT, and doubled for each retransmission (sec. 4.2)
+	timeout := ackTimeout + time.Duration(rand.Int63n(int64(ackTimeout/2)))
+	b := m.Encode()
+	for i := 0; i <= maxRetransmits; i++ {
+		g.conn.WriteTo(b, addr)
+		select {
+		case ok := <-ack:
+			return ok
+		case <-time.After(timeout):
+			timeout *= 2
+		}
+	}
+	return false
+}
+
+// cleanRound closes idle publish sessions and forgets old exchanges
+func (g *Gateway) cleanRound() {
+	for now := range time.Tick(30 * time.Second) {
+		var idle []*session
+		g.mutex.Lock()
+		for key, e := range g.exchanges {
+			if now.After(e.expires) {
+				delete(g.exchanges, key)
+			}
+		}
+		for key, s := range g.publishers {
+			if s.idle(now.Add(-sessionIdle)) {
+				delete(g.publishers, key)
+				idle = append(idle, s)
+			}
+		}
+		g.mutex.Unlock()
+		for _, s := range idle {
+			s.close()
+		}
+	}
+}
+
+func (g *Gateway) closeAll() {
+	g.mutex.Lock()
+	var sessions []*session
+	for key, s := range g.publishers {
+		sessions = append(sessions, s)
+		delete(g.publishers, key)
+	}
+	for key, o := range g.observers {
+		sessions = append(sessions, o.session)
+		delete(g.observers, key)
+	}
+	g.mutex.Unlock()
+	for _, s := range sessions {
+		s.close()
+	}
+}
+
+func observerKey(addr net.Addr, token []byte) string {
+	return addr.String() + " " + hex.EncodeToString(token)
+}
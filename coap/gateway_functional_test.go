@@ -0,0 +1,192 @@
+package coap
+
+import (
+	"github.com/trafero/tstack/auth/authtest"
+	"github.com/trafero/tstack/serve"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+/*
+ * listen starts a gateway on a local UDP port, connected to an in-process
+ * broker
+ */
+func listen(t *testing.T) net.Addr {
+	a := authtest.NewUser("username", "password", "allowed/#")
+	b := serve.NewBroker()
+	g := New(func(remote net.Addr) (net.Conn, error) {
+		return serve.Pipe(a, b, remote), nil
+	})
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal("Error setting up listener:", err)
+	}
+	go g.Serve(conn)
+	return conn.LocalAddr()
+}
+
+type testClient struct {
+	t         *testing.T
+	conn      net.Conn
+	messageID uint16
+}
+
+func (c *testClient) request(msgType byte, code byte, path string, query string, payload string) *Message {
+	c.messageID++
+	m := &Message{Type: msgType, Code: code, MessageID: c.messageID, Token: []byte{byte(c.messageID)}, Payload: []byte(payload)}
+	for _, p := range strings.Split(path, "/") {
+		m.AddOption(OptionURIPath, []byte(p))
+	}
+	for _, q := range strings.Split(query, "&") {
+		m.AddOption(OptionURIQuery, []byte(q))
+	}
+	return m
+}
+
+func (c *testClient) send(m *Message) {
+	if _, err := c.conn.Write(m.Encode()); err != nil {
+		c.t.Fatal("Error sending:", err)
+	}
+}
+
+func (c *testClient) receive() *Message {
+	buf := make([]byte, 1024)
+	c.conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	n, err := c.conn.Read(buf)
+	if err != nil {
+		c.t.Fatal("Waiting for response:", err)
+	}
+	m, err := Decode(buf[:n])
+	if err != nil {
+		c.t.Fatal("Error decoding:", err)
+	}
+	return m
+}
+
+func (c *testClient) expect(req *Message, code byte) *Message {
+	c.send(req)
+	resp := c.receive()
+	if resp.Code != code {
+		c.t.Fatalf("Expected code %#x, got %#x %s", code, resp.Code, resp.Payload)
+	}
+	if req.Type == Confirmable && (resp.Type != Acknowledgement || resp.MessageID != req.MessageID) {
+		c.t.Errorf("Expected piggybacked response, got type %d message ID %d", resp.Type, resp.MessageID)
+	}
+	return resp
+}
+
+func TestGateway(t *testing.T) {
+	addr := listen(t)
+	conn, err := net.Dial("udp", addr.String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	c := &testClient{t: t, conn: conn}
+
+	creds := "u=username&p=password"
+	c.expect(c.request(Confirmable, PUT, "ps/allowed/a", "u=username&p=wrong", "x"), Unauthorized)
+	c.expect(c.request(Confirmable, PUT, "ps/denied/a", creds, "x"), Forbidden)
+	c.expect(c.request(Confirmable, PUT, "other/a", creds, "x"), NotFound)
+	c.expect(c.request(Confirmable, GET, "ps/allowed/a", creds, ""), BadRequest)
+
+	// Retained message, then observe it and a new message
+	c.expect(c.request(Confirmable, PUT, "ps/allowed/a", creds+"&retain=true", "retained"), Changed)
+	time.Sleep(50 * time.Millisecond)
+
+	observe := c.request(Confirmable, GET, "ps/allowed/+", creds, "")
+	observe.AddUintOption(OptionObserve, 0)
+	resp := c.expect(observe, Content)
+	if _, ok := resp.Observe(); !ok {
+		t.Fatal("Expected Observe option in response")
+	}
+
+	notification := c.receive()
+	if string(notification.Payload) != "retained" || string(notification.Token) != string(observe.Token) {
+		t.Errorf("Unexpected notification %+v", notification)
+	}
+
+	// The response and notification may arrive in either order
+	publish := c.request(NonConfirmable, POST, "ps/allowed/b", creds, "hello")
+	c.send(publish)
+	for i := 0; i < 2; i++ {
+		m := c.receive()
+		if string(m.Token) == string(publish.Token) {
+			if m.Code != Changed {
+				t.Errorf("Expected Changed, got %#x", m.Code)
+			}
+		} else {
+			notification = m
+		}
+	}
+	if string(notification.Payload) != "hello" {
+		t.Errorf("Unexpected notification %q", notification.Payload)
+	}
+	var location []string
+	for _, o := range notification.Options {
+		if o.Number == OptionLocationPath {
+			location = append(location, string(o.Value))
+		}
+	}
+	if strings.Join(location, "/") != "allowed/b" {
+		t.Errorf("Expected topic allowed/b in Location-Path, got %v", location)
+	}
+
+	// Deregister
+	cancel := c.request(Confirmable, GET, "ps/allowed/+", creds, "")
+	cancel.Token = observe.Token
+	cancel.AddUintOption(OptionObserve, 1)
+	c.expect(cancel, Content)
+}
+
+func TestPublisherCredentials(t *testing.T) {
+	addr := listen(t)
+	conn, err := net.Dial("udp", addr.String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	c := &testClient{t: t, conn: conn}
+
+	// The session made for the first request is not reused with another
+	// password
+	c.expect(c.request(Confirmable, PUT, "ps/allowed/a", "u=username&p=password", "x"), Changed)
+	c.expect(c.request(Confirmable, PUT, "ps/allowed/a", "u=username&p=wrong", "x"), Unauthorized)
+	c.expect(c.request(Confirmable, PUT, "ps/allowed/a", "u=username&p=password", "x"), Changed)
+}
+
+func TestObserveAgain(t *testing.T) {
+	addr := listen(t)
+	conn, err := net.Dial("udp", addr.String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	c := &testClient{t: t, conn: conn}
+	creds := "u=username&p=password"
+
+	// Registering again with the same token replaces the observation,
+	// rather than ending it (RFC 7641 sec. 4.1)
+	observe := c.request(Confirmable, GET, "ps/allowed/a", creds, "")
+	observe.AddUintOption(OptionObserve, 0)
+	c.expect(observe, Content)
+	again := c.request(Confirmable, GET, "ps/allowed/a", creds, "")
+	again.Token = observe.Token
+	again.AddUintOption(OptionObserve, 0)
+	c.expect(again, Content)
+	time.Sleep(50 * time.Millisecond)
+
+	publish := c.request(NonConfirmable, POST, "ps/allowed/a", creds, "hello")
+	c.send(publish)
+	var notification *Message
+	for i := 0; i < 2; i++ {
+		if m := c.receive(); string(m.Token) == string(observe.Token) {
+			notification = m
+		}
+	}
+	if notification == nil || string(notification.Payload) != "hello" {
+		t.Errorf("Expected notification after registering again, got %+v", notification)
+	}
+}
@@ -0,0 +1,242 @@
+package coap
+
+import (
+	"encoding/binary"
+	"errors"
+	"sort"
+	"strings"
+)
+
+// Message types (RFC 7252 sec. 3)
+const (
+	Confirmable     byte = 0
+	NonConfirmable  byte = 1
+	Acknowledgement byte = 2
+	Reset           byte = 3
+)
+
+// Method and response codes, as class << 5 | detail (sec. 12.1)
+const (
+	Empty  byte = 0x00
+	GET    byte = 0x01
+	POST   byte = 0x02
+	PUT    byte = 0x03
+	DELETE byte = 0x04
+
+	Created             byte = 0x41 // 2.01
+	Deleted             byte = 0x42 // 2.02
+	Changed             byte = 0x44 // 2.04
+	Content             byte = 0x45 // 2.05
+	BadRequest          byte = 0x80 // 4.00
+	Unauthorized        byte = 0x81 // 4.01
+	Forbidden           byte = 0x83 // 4.03
+	NotFound            byte = 0x84 // 4.04
+	MethodNotAllowed    byte = 0x85 // 4.05
+	InternalServerError byte = 0xA0 // 5.00
+	ServiceUnavailable  byte = 0xA3 // 5.03
+	GatewayTimeout      byte = 0xA4 // 5.04
+)
+
+// Option numbers (sec. 5.10, RFC 7641)
+const (
+	OptionObserve       uint16 = 6
+	OptionLocationPath  uint16 = 8
+	OptionURIPath       uint16 = 11
+	OptionContentFormat uint16 = 12
+	OptionURIQuery      uint16 = 15
+)
+
+const version = 1
+
+var ErrMalformed = errors.New("Malformed CoAP message")
+
+type Option struct {
+	Number uint16
+	Value  []byte
+}
+
+// Message is a CoAP request or response
+type Message struct {
+	Type      byte
+	Code      byte
+	MessageID uint16
+	Token     []byte
+	Options   []Option
+	Payload   []byte
+}
+
+// IsRequest reports whether the message carries a method code
+func (m *Message) IsRequest() bool {
+	return m.Code >= GET && m.Code < 0x20
+}
+
+// Option returns the first value of an option
+func (m *Message) Option(number uint16) (value []byte, ok bool) {
+	for _, o := range m.Options {
+		if o.Number == number {
+			return o.Value, true
+		}
+	}
+	return nil, false
+}
+
+// AddOption appends an option. Repeated options keep the order they are
+// added in
+func (m *Message) AddOption(number uint16, value []byte) {
+	m.Options = append(m.Options, Option{Number: number, Value: value})
+}
+
+// AddUintOption appends an option holding an unsigned integer
+func (m *Message) AddUintOption(number uint16, v uint32) {
+	var b []byte
+	for ; v > 0; v >>= 8 {
+		b = append([]byte{byte(v)}, b...)
+	}
+	m.AddOption(number, b)
+}
+
+// Observe returns the value of the Observe option, if present
+func (m *Message) Observe() (v uint32, ok bool) {
+	b, ok := m.Option(OptionObserve)
+	if !ok {
+		return 0, false
+	}
+	for _, c := range b {
+		v = v<<8 | uint32(c)
+	}
+	return v, true
+}
+
+// Path returns the Uri-Path segments
+func (m *Message) Path() (path []string) {
+	for _, o := range m.Options {
+		if o.Number == OptionURIPath {
+			path = append(path, string(o.Value))
+		}
+	}
+	return path
+}
+
+// Query returns the Uri-Query options, each in the form "key=value"
+func (m *Message) Query() map[string]string {
+	query := make(map[string]string)
+	for _, o := range m.Options {
+		if o.Number == OptionURIQuery {
+			parts := strings.SplitN(string(o.Value), "=", 2)
+			if len(parts) == 2 {
+				query[parts[0]] = parts[1]
+			} else {
+				query[parts[0]] = ""
+			}
+		}
+	}
+	return query
+}
+
+// Encode returns the message as a datagram
+func (m *Message) Encode() []byte {
+	b := []byte{version<<6 | m.Type<<4 | byte(len(m.Token)), m.Code}
+	b = append(b, byte(m.MessageID>>8), byte(m.MessageID))
+	b = append(b, m.Token...)
+
+	// Options are encoded in order of number, as deltas (sec. 3.1)
+	options := append([]Option{}, m.Options...)
+	sort.SliceStable(options, func(i, j int) bool { return options[i].Number < options[j].Number })
+	var last uint16
+	for _, o := range options {
+		delta, dext := extended(int(o.Number - last))
+		length, lext := extended(len(o.Value))
+		b = append(b, delta<<4|length)
+		b = append(b, dext...)
+		b = append(b, lext...)
+		b = append(b, o.Value...)
+		last = o.Number
+	}
+
+	if len(m.Payload) > 0 {
+		b = append(b, 0xFF)
+		b = append(b, m.Payload...)
+	}
+	return b
+}
+
+// extended returns the 4 bit nibble and extended bytes for an option delta
+// or length
+func extended(v int) (nibble byte, ext []byte) {
+	switch {
+	case v < 13:
+		return byte(v), nil
+	case v < 269:
+		return 13, []byte{byte(v - 13)}
+	default:
+		v -= 269
+		return 14, []byte{byte(v >> 8), byte(v)}
+	}
+}
+
+// Decode reads a message from a datagram
+func Decode(datagram []byte) (m *Message, err error) {
+	if len(datagram) < 4 || datagram[0]>>6 != version {
+		return nil, ErrMalformed
+	}
+	tkl := int(datagram[0] & 0x0F)
+	if tkl > 8 || len(datagram) < 4+tkl {
+		return nil, ErrMalformed
+	}
+	m = &Message{
+		Type:      datagram[0] >> 4 & 0x03,
+		Code:      datagram[1],
+		MessageID: binary.BigEndian.Uint16(datagram[2:4]),
+	}
+	if tkl > 0 {
+		m.Token = append([]byte{}, datagram[4:4+tkl]...)
+	}
+
+	b := datagram[4+tkl:]
+	var number int
+	for len(b) > 0 {
+		if b[0] == 0xFF {
+			if len(b) == 1 {
+				return nil, ErrMalformed
+			}
+			m.Payload = append([]byte{}, b[1:]...)
+			break
+		}
+		delta, length := int(b[0]>>4), int(b[0]&0x0F)
+		b = b[1:]
+		if delta, b, err = readExtended(delta, b); err != nil {
+			return nil, err
+		}
+		if length, b, err = readExtended(length, b); err != nil {
+			return nil, err
+		}
+		if len(b) < length {
+			return nil, ErrMalformed
+		}
+		number += delta
+		if number > 0xFFFF {
+			return nil, ErrMalformed
+		}
+		m.AddOption(uint16(number), append([]byte{}, b[:length]...))
+		b = b[length:]
+	}
+	return m, nil
+}
+
+func readExtended(nibble int, b []byte) (v int, rest []byte, err error) {
+	switch nibble {
+	case 13:
+		if len(b) < 1 {
+			return 0, nil, ErrMalformed
+		}
+		return int(b[0]) + 13, b[1:], nil
+	case 14:
+		if len(b) < 2 {
+			return 0, nil, ErrMalformed
+		}
+		return int(binary.BigEndian.Uint16(b)) + 269, b[2:], nil
+	case 15:
+		return 0, nil, ErrMalformed
+	}
+	return nibble, b, nil
+}
@@ -0,0 +1,71 @@
+package coap
+
+import (
+	"bytes"
+	"reflect"
+	"testing"
+)
+
+func TestMessageRoundTrip(t *testing.T) {
+	m := &Message{
+		Type:      Confirmable,
+		Code:      PUT,
+		MessageID: 0x1234,
+		Token:     []byte{1, 2, 3, 4},
+		Payload:   []byte("21.5"),
+	}
+	m.AddOption(OptionURIPath, []byte("ps"))
+	m.AddOption(OptionURIPath, []byte("ABC-123"))
+	m.AddOption(OptionURIPath, []byte("temperature"))
+	m.AddOption(OptionURIQuery, []byte("u=ABC-123"))
+	m.AddOption(OptionURIQuery, bytes.Repeat([]byte("p"), 300))
+	m.AddUintOption(OptionObserve, 0)
+
+	got, err := Decode(m.Encode())
+	if err != nil {
+		t.Fatal("Could not decode message:", err)
+	}
+	if got.Type != m.Type || got.Code != m.Code || got.MessageID != m.MessageID ||
+		!bytes.Equal(got.Token, m.Token) || !bytes.Equal(got.Payload, m.Payload) {
+		t.Errorf("Decoded %+v, expected %+v", got, m)
+	}
+	if path := got.Path(); !reflect.DeepEqual(path, []string{"ps", "ABC-123", "temperature"}) {
+		t.Errorf("Unexpected path %v", path)
+	}
+	if q := got.Query(); q["u"] != "ABC-123" || len(q) != 2 {
+		t.Errorf("Unexpected query %v", q)
+	}
+	if v, ok := got.Observe(); !ok || v != 0 {
+		t.Errorf("Expected Observe 0, got %d %v", v, ok)
+	}
+}
+
+func TestUintOption(t *testing.T) {
+	for _, v := range []uint32{0, 1, 255, 256, 0xFFFFFF} {
+		m := &Message{}
+		m.AddUintOption(OptionObserve, v)
+		got, err := Decode(m.Encode())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if o, _ := got.Observe(); o != v {
+			t.Errorf("Expected %d, got %d", v, o)
+		}
+	}
+}
+
+func TestDecodeMalformed(t *testing.T) {
+	for _, b := range [][]byte{
+		{},
+		{0x40, 0x01, 0x00},             // Short header
+		{0x80, 0x01, 0x00, 0x01},       // Version 2
+		{0x49, 0x01, 0x00, 0x01},       // Token length 9
+		{0x40, 0x01, 0x00, 0x01, 0xFF}, // Payload marker without payload
+		{0x40, 0x01, 0x00, 0x01, 0xB3}, // Option longer than message
+		{0x40, 0x01, 0x00, 0x01, 0xF0}, // Reserved option delta
+	} {
+		if _, err := Decode(b); err == nil {
+			t.Errorf("Expected % x to be malformed", b)
+		}
+	}
+}
@@ -0,0 +1,197 @@
+package coap
+
+import (
+	"github.com/gomqtt/packet"
+	"net"
+	"strings"
+	"sync"
+	"time"
+)
+
+// observer is a CoAP client observing a topic filter (RFC 7641), with the
+// MQTT session subscribed on its behalf
+type observer struct {
+	gateway  *Gateway
+	addr     net.Addr
+	token    []byte
+	filter   string
+	username string
+	session  *session
+
+	mutex         sync.Mutex
+	sequence      uint32    // Observe option value, 24 bits
+	lastMessageID uint16    // Of the most recent notification, for matching a Reset
+	lastConfirmed time.Time // When a notification was last acknowledged
+}
+
+func (g *Gateway) observe(addr net.Addr, m *Message, filter string, qos byte, username string, password string) {
+	s, err := connect(g.dial, addr, username, password)
+	if err == errNotAuthorized {
+		logger.Warn("CoAP client could not be authenticated", "remote", addr, "username", username)
+		g.respondCode(addr, m, Unauthorized, "")
+		return
+	} else if err != nil {
+		logger.Error("Could not connect CoAP client", "remote", addr, "username", username, "error", err)
+		g.respondCode(addr, m, InternalServerError, "")
+		return
+	}
+
+	pending, err := s.subscribe(filter, qos)
+	if err != nil {
+		s.close()
+		if err == errNotAuthorized {
+			logger.Warn("CoAP client not authorized to observe topic", "remote", addr, "username", username, "topic", filter)
+			g.respondCode(addr, m, Forbidden, "")
+		} else {
+			g.respondCode(addr, m, GatewayTimeout, "")
+		}
+		return
+	}
+
+	o := &observer{
+		gateway:       g,
+		addr:          addr,
+		token:         m.Token,
+		filter:        filter,
+		username:      username,
+		session:       s,
+		lastConfirmed: time.Now(),
+	}
+	// Registering again with the same token replaces the observation
+	// (RFC 7641 sec. 4.1)
+	key := observerKey(addr, m.Token)
+	g.mutex.Lock()
+	existing := g.observers[key]
+	g.observers[key] = o
+	g.mutex.Unlock()
+	if existing != nil {
+		existing.session.close()
+	}
+
+	resp := &Message{Code: Content}
+	resp.AddUintOption(OptionObserve, o.next())
+	g.respond(addr, m, resp)
+	logger.Info("CoAP client observing topic", "remote", addr, "username", username, "topic", filter)
+
+	go o.run(pending)
+}
+
+// cancel ends an observation, at the client's request
+func (g *Gateway) cancel(addr net.Addr, token []byte) {
+	g.mutex.Lock()
+	o := g.observers[observerKey(addr, token)]
+	g.mutex.Unlock()
+	if o != nil {
+		g.removeObserver(o)
+	}
+}
+
+/*
+ * removeObserver ends an observation. An observer that has been replaced,
+ * by the client registering again with the same token, only has its
+ * session closed, leaving the new observation in place
+ */
+func (g *Gateway) removeObserver(o *observer) {
+	key := observerKey(o.addr, o.token)
+	g.mutex.Lock()
+	current := g.observers[key] == o
+	if current {
+		delete(g.observers, key)
+	}
+	g.mutex.Unlock()
+	if current {
+		logger.Info("CoAP client stopped observing topic", "remote", o.addr, "username", o.username, "topic", o.filter)
+	}
+	o.session.close()
+}
+
+// reset ends the observation a rejected notification belonged to
+func (g *Gateway) reset(addr net.Addr, messageID uint16) {
+	g.mutex.Lock()
+	var found *observer
+	for _, o := range g.observers {
+		if o.addr.String() == addr.String() && o.lastNotification() == messageID {
+			found = o
+			break
+		}
+	}
+	g.mutex.Unlock()
+	if found != nil {
+		g.removeObserver(found)
+	}
+}
+
+func (o *observer) next() uint32 {
+	o.mutex.Lock()
+	defer o.mutex.Unlock()
+	o.sequence = (o.sequence + 1) & 0xFFFFFF
+	return o.sequence
+}
+
+func (o *observer) lastNotification() uint16 {
+	o.mutex.Lock()
+	defer o.mutex.Unlock()
+	return o.lastMessageID
+}
+
+// run sends a notification for each message, until the session ends
+func (o *observer) run(pending []*packet.Message) {
+	for _, msg := range pending {
+		if !o.notify(msg) {
+			o.gateway.removeObserver(o)
+			return
+		}
+	}
+	for {
+		select {
+		case msg := <-o.session.Messages:
+			if !o.notify(msg) {
+				o.gateway.removeObserver(o)
+				return
+			}
+		case <-o.session.Done:
+			o.gateway.removeObserver(o)
+			return
+		}
+	}
+}
+
+/*
+ * notify sends a message to the observer. The topic is given as
+ * Location-Path options when observing a wildcard filter. Returns false if
+ * a confirmable notification was not acknowledged
+ */
+func (o *observer) notify(msg *packet.Message) bool {
+	m := &Message{
+		Type:      NonConfirmable,
+		Code:      Content,
+		MessageID: o.gateway.nextMessageID(),
+		Token:     o.token,
+		Payload:   msg.Payload,
+	}
+	m.AddUintOption(OptionObserve, o.next())
+	if strings.ContainsAny(o.filter, "+#") {
+		for _, level := range strings.Split(msg.Topic, "/") {
+			m.AddOption(OptionLocationPath, []byte(level))
+		}
+	}
+
+	o.mutex.Lock()
+	o.lastMessageID = m.MessageID
+	confirm := time.Since(o.lastConfirmed) > confirmInterval
+	o.mutex.Unlock()
+
+	if !confirm {
+		o.gateway.send(o.addr, m)
+		return true
+	}
+	m.Type = Confirmable
+	if !o.gateway.confirm(o.addr, m) {
+		logger.Info("CoAP observer did not acknowledge notification", "remote", o.addr, "username", o.username, "topic", o.filter)
+		return false
+	}
+	o.mutex.Lock()
+	o.lastConfirmed = time.Now()
+	o.mutex.Unlock()
+	return true
+}
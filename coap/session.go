@@ -0,0 +1,103 @@
+package coap
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"github.com/gomqtt/packet"
+	"github.com/trafero/tstack/serve"
+	"net"
+	"sync"
+	"time"
+)
+
+// Time to wait for the broker to answer
+var brokerTimeout = 5 * time.Second
+
+var (
+	errNotAuthorized = errors.New("Not authorized")
+	errTimeout       = serve.ErrTimeout
+)
+
+// session is an MQTT connection to the broker, made with a CoAP client's
+// credentials
+type session struct {
+	*serve.GatewayClient
+	key string // In Gateway.publishers, if publishing
+
+	mutex    sync.Mutex
+	lastUsed time.Time
+}
+
+/*
+ * connect opens a clean MQTT session with a random client ID. Returns
+ * errNotAuthorized if the broker refuses the credentials
+ */
+func connect(dial Dialer, remote net.Addr, username string, password string) (s *session, err error) {
+	conn, err := dial(remote)
+	if err != nil {
+		return nil, err
+	}
+	id := make([]byte, 8)
+	rand.Read(id)
+	connect := packet.NewConnectPacket()
+	connect.ClientID = "coap-" + hex.EncodeToString(id)
+	connect.Username = username
+	connect.Password = password
+	connect.CleanSession = true
+	upstream, err := serve.Connect(conn, connect, brokerTimeout)
+	if err == serve.ErrRefused {
+		return nil, errNotAuthorized
+	} else if err != nil {
+		return nil, err
+	}
+	return &session{
+		GatewayClient: serve.NewGatewayClient(upstream),
+		lastUsed:      time.Now(),
+	}, nil
+}
+
+/*
+ * publish sends a message at QoS 1 and waits for the broker to acknowledge
+ * it. The broker closes the connection instead if the user does not have
+ * rights to the topic, so errNotAuthorized is returned
+ */
+func (s *session) publish(topic string, payload []byte, retain bool) error {
+	s.mutex.Lock()
+	s.lastUsed = time.Now()
+	s.mutex.Unlock()
+	err := s.Publish(packet.Message{
+		Topic:   topic,
+		Payload: payload,
+		QOS:     packet.QOSAtLeastOnce,
+		Retain:  retain,
+	}, brokerTimeout)
+	if err == serve.ErrClosed {
+		return errNotAuthorized
+	}
+	return err
+}
+
+/*
+ * subscribe subscribes to a filter, returning any messages that arrive
+ * before the SUBACK (i.e. retained messages)
+ */
+func (s *session) subscribe(filter string, qos byte) (pending []*packet.Message, err error) {
+	codes, pending, err := s.Subscribe([]packet.Subscription{{Topic: filter, QOS: qos}}, brokerTimeout)
+	if err == serve.ErrClosed || (err == nil && (len(codes) == 0 || codes[0] == packet.QOSFailure)) {
+		return nil, errNotAuthorized
+	}
+	return pending, err
+}
+
+// idle reports whether the session has not published since the given time
+func (s *session) idle(since time.Time) bool {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.lastUsed.Before(since)
+}
+
+// close disconnects from the broker. It is safe to call more than once
+func (s *session) close() {
+	s.Close()
+}
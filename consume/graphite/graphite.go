@@ -3,9 +3,12 @@ package graphite
 import (
 	"github.com/marpaia/graphite-golang"
 	"github.com/trafero/tstack/client/mqtt"
+	"github.com/trafero/tstack/logging"
 	"github.com/trafero/tstack/tstackutil"
 )
 
+var logger = logging.New("consume")
+
 type Graphite struct {
 	graphitehost string
 	graphiteport int
@@ -34,6 +37,6 @@ func New(
 }
 
 func (c *Graphite) ControlMessageHandler(msg mqtt.Message) {
-	// log.Printf("Received topic: %s message: %s", msg.Topic, msg.Payload)
-	c.graphite.SimpleSend(msg.Topic, msg.Payload)
+	logger.Debug("Received message", "topic", msg.Topic, "payload", msg.PayloadString())
+	c.graphite.SimpleSend(msg.Topic, msg.PayloadString())
 }
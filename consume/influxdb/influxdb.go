@@ -5,12 +5,14 @@ import (
 	influx "github.com/influxdata/influxdb/client/v2"
 	_ "github.com/lib/pq"
 	"github.com/trafero/tstack/client/mqtt"
-	"log"
+	"github.com/trafero/tstack/logging"
 	"strconv"
 	"strings"
 	"time"
 )
 
+var logger = logging.New("consume")
+
 type Influxdb struct {
 	influxhost     string
 	influxport     int
@@ -39,14 +41,14 @@ func New(
 }
 
 func (c *Influxdb) ControlMessageHandler(msg mqtt.Message) {
-	// log.Printf("Received topic: %s message: %s\n", msg.Topic, msg.Payload)
-	err := c.sendToInfluxdb(msg.Topic, string(msg.Payload))
+	logger.Debug("Received message", "topic", msg.Topic, "payload", msg.PayloadString())
+	err := c.sendToInfluxdb(msg.Topic, msg.PayloadString(), msg.Received)
 	if err != nil {
-		log.Printf("ERROR: %s", err)
+		logger.Error("Could not write to InfluxDB", "topic", msg.Topic, "error", err)
 	}
 }
 
-func (c *Influxdb) sendToInfluxdb(topic string, payload string) (err error) {
+func (c *Influxdb) sendToInfluxdb(topic string, payload string, received time.Time) (err error) {
 	// Create a new point batch
 	bp, err := influx.NewBatchPoints(influx.BatchPointsConfig{
 		Database:  c.influxdatabase,
@@ -69,7 +71,7 @@ func (c *Influxdb) sendToInfluxdb(topic string, payload string) (err error) {
 	// Add payload as a database field
 	fields["payload"] = payload
 
-	pt, err := influx.NewPoint("reading", nil, fields, time.Now())
+	pt, err := influx.NewPoint("reading", nil, fields, received)
 	if err != nil {
 		return err
 	}
@@ -1,11 +1,15 @@
 package stdout
 
 import (
+	"encoding/base64"
 	"fmt"
 	"github.com/trafero/tstack/client/mqtt"
-	"time"
+	"github.com/trafero/tstack/logging"
+	"unicode/utf8"
 )
 
+var logger = logging.New("consume")
+
 type Stdout struct{}
 
 func New() (c *Stdout, err error) {
@@ -13,7 +17,16 @@ func New() (c *Stdout, err error) {
 	return c, nil
 }
 
+/*
+ * ControlMessageHandler prints the time received, topic and payload as CSV.
+ * Payloads that aren't UTF-8 text, such as CBOR or protobuf, are printed
+ * base64 encoded
+ */
 func (c *Stdout) ControlMessageHandler(msg mqtt.Message) {
-	// log.Printf("Received topic: %s message: %s\n", msg.Topic, msg.Payload)
-	fmt.Printf("\"%s\",\"%s\",\"%s\"\n", time.Now().Format("02/01/2006 15:04:05"), msg.Topic, string(msg.Payload))
+	payload := msg.PayloadString()
+	if !utf8.Valid(msg.Payload) {
+		payload = base64.StdEncoding.EncodeToString(msg.Payload)
+	}
+	logger.Debug("Received message", "topic", msg.Topic, "payload", payload)
+	fmt.Printf("\"%s\",\"%s\",\"%s\"\n", msg.Received.Format("02/01/2006 15:04:05"), msg.Topic, payload)
 }
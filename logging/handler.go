@@ -0,0 +1,69 @@
+package logging
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+)
+
+// Configure sets the global level and format from command line style
+// strings, e.g. "debug" and "json"
+func Configure(level string, format string) error {
+	l, err := ParseLevel(level)
+	if err != nil {
+		return err
+	}
+	f, err := ParseFormat(format)
+	if err != nil {
+		return err
+	}
+	SetLevel(l)
+	SetFormat(f)
+	return nil
+}
+
+// LevelHandler allows the log level to be read and changed at runtime.
+//
+// GET returns the current levels. PUT or POST with a "level" parameter sets
+// the level, for a single component if a "component" parameter is also
+// given. e.g.
+//
+//	curl -X PUT 'http://localhost:8070/debug/loglevel?level=debug&component=auth'
+func LevelHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodGet:
+		case http.MethodPut, http.MethodPost:
+			l, err := ParseLevel(r.FormValue("level"))
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			if component := r.FormValue("component"); component != "" {
+				SetComponentLevel(component, l)
+			} else {
+				SetLevel(l)
+			}
+		default:
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		level, components := GetLevel()
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		fmt.Fprintf(w, "level=%s\n", level)
+		for _, c := range componentNames(components) {
+			fmt.Fprintf(w, "%s=%s\n", c, components[c])
+		}
+	})
+}
+
+// componentNames returns the sorted component override names
+func componentNames(components map[string]Level) []string {
+	names := make([]string, 0, len(components))
+	for c := range components {
+		names = append(names, c)
+	}
+	sort.Strings(names)
+	return names
+}
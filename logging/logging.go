@@ -0,0 +1,251 @@
+package logging
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Level is the severity of a log line
+type Level int32
+
+const (
+	DebugLevel Level = iota
+	InfoLevel
+	WarnLevel
+	ErrorLevel
+)
+
+var levelNames = map[Level]string{
+	DebugLevel: "debug",
+	InfoLevel:  "info",
+	WarnLevel:  "warn",
+	ErrorLevel: "error",
+}
+
+func (l Level) String() string {
+	if name, ok := levelNames[l]; ok {
+		return name
+	}
+	return "level(" + strconv.Itoa(int(l)) + ")"
+}
+
+// ParseLevel returns the level for one of debug, info, warn or error
+func ParseLevel(s string) (Level, error) {
+	for l, name := range levelNames {
+		if strings.EqualFold(s, name) {
+			return l, nil
+		}
+	}
+	return InfoLevel, errors.New("Unknown log level " + s)
+}
+
+// Format is the encoding used for each log line
+type Format int
+
+const (
+	LogfmtFormat Format = iota
+	JSONFormat
+)
+
+// ParseFormat returns the format for one of logfmt or json
+func ParseFormat(s string) (Format, error) {
+	switch strings.ToLower(s) {
+	case "logfmt":
+		return LogfmtFormat, nil
+	case "json":
+		return JSONFormat, nil
+	default:
+		return LogfmtFormat, errors.New("Unknown log format " + s)
+	}
+}
+
+// Shared configuration for all loggers. Levels may be changed at runtime,
+// either for every component or for a single named component
+var config = struct {
+	sync.RWMutex
+	out        io.Writer
+	format     Format
+	level      Level
+	components map[string]Level
+}{
+	out:        os.Stderr,
+	format:     LogfmtFormat,
+	level:      InfoLevel,
+	components: make(map[string]Level),
+}
+
+// Serialises writes so that lines from concurrent goroutines are not mixed
+var writeMutex sync.Mutex
+
+// SetOutput sets the destination for all log lines
+func SetOutput(w io.Writer) {
+	config.Lock()
+	config.out = w
+	config.Unlock()
+}
+
+// SetFormat sets the encoding for all log lines
+func SetFormat(f Format) {
+	config.Lock()
+	config.format = f
+	config.Unlock()
+}
+
+// SetLevel sets the minimum level logged by all components. Any component
+// level overrides are cleared.
+func SetLevel(l Level) {
+	config.Lock()
+	config.level = l
+	config.components = make(map[string]Level)
+	config.Unlock()
+}
+
+// SetComponentLevel sets the minimum level for a single component,
+// overriding the global level
+func SetComponentLevel(component string, l Level) {
+	config.Lock()
+	config.components[component] = l
+	config.Unlock()
+}
+
+// GetLevel returns the global level and any component overrides
+func GetLevel() (level Level, components map[string]Level) {
+	config.RLock()
+	defer config.RUnlock()
+	components = make(map[string]Level, len(config.components))
+	for c, l := range config.components {
+		components[c] = l
+	}
+	return config.level, components
+}
+
+// Logger writes structured log lines for a single component, with a set of
+// key/value pairs attached to every line
+type Logger struct {
+	component string
+	fields    []interface{}
+}
+
+// New returns a logger for the named component (e.g. broker, auth)
+func New(component string) *Logger {
+	return &Logger{component: component}
+}
+
+// With returns a copy of the logger with the given key/value pairs attached
+// to every line it writes
+func (l *Logger) With(keyvals ...interface{}) *Logger {
+	fields := make([]interface{}, 0, len(l.fields)+len(keyvals))
+	fields = append(fields, l.fields...)
+	fields = append(fields, keyvals...)
+	return &Logger{component: l.component, fields: fields}
+}
+
+func (l *Logger) Debug(msg string, keyvals ...interface{}) { l.log(DebugLevel, msg, keyvals) }
+func (l *Logger) Info(msg string, keyvals ...interface{})  { l.log(InfoLevel, msg, keyvals) }
+func (l *Logger) Warn(msg string, keyvals ...interface{})  { l.log(WarnLevel, msg, keyvals) }
+func (l *Logger) Error(msg string, keyvals ...interface{}) { l.log(ErrorLevel, msg, keyvals) }
+
+// Fatal logs at error level and exits
+func (l *Logger) Fatal(msg string, keyvals ...interface{}) {
+	l.log(ErrorLevel, msg, keyvals)
+	os.Exit(1)
+}
+
+// Enabled reports whether lines at the given level are currently written
+func (l *Logger) Enabled(level Level) bool {
+	config.RLock()
+	defer config.RUnlock()
+	return level >= l.minLevel()
+}
+
+// minLevel must be called with the config lock held
+func (l *Logger) minLevel() Level {
+	if cl, ok := config.components[l.component]; ok {
+		return cl
+	}
+	return config.level
+}
+
+func (l *Logger) log(level Level, msg string, keyvals []interface{}) {
+	config.RLock()
+	min, format, out := l.minLevel(), config.format, config.out
+	config.RUnlock()
+	if level < min {
+		return
+	}
+
+	// Fixed keys first, then logger fields, then call fields
+	keys := []string{"time", "level", "component", "msg"}
+	values := []interface{}{time.Now().UTC().Format(time.RFC3339Nano), level.String(), l.component, msg}
+	all := append(append([]interface{}{}, l.fields...), keyvals...)
+	for i := 0; i < len(all); i += 2 {
+		key := fmt.Sprint(all[i])
+		var value interface{} = "MISSING"
+		if i+1 < len(all) {
+			value = all[i+1]
+		}
+		switch v := value.(type) {
+		case error:
+			value = v.Error()
+		case fmt.Stringer:
+			value = v.String()
+		}
+		keys = append(keys, key)
+		values = append(values, value)
+	}
+
+	var line []byte
+	if format == JSONFormat {
+		line = encodeJSON(keys, values)
+	} else {
+		line = encodeLogfmt(keys, values)
+	}
+	writeMutex.Lock()
+	out.Write(line)
+	writeMutex.Unlock()
+}
+
+func encodeLogfmt(keys []string, values []interface{}) []byte {
+	var b strings.Builder
+	for i, key := range keys {
+		if i > 0 {
+			b.WriteByte(' ')
+		}
+		b.WriteString(key)
+		b.WriteByte('=')
+		s := fmt.Sprint(values[i])
+		if s == "" || strings.ContainsAny(s, " =\"\t\r\n") {
+			s = strconv.Quote(s)
+		}
+		b.WriteString(s)
+	}
+	b.WriteByte('\n')
+	return []byte(b.String())
+}
+
+func encodeJSON(keys []string, values []interface{}) []byte {
+	var b strings.Builder
+	b.WriteByte('{')
+	for i, key := range keys {
+		if i > 0 {
+			b.WriteByte(',')
+		}
+		k, _ := json.Marshal(key)
+		v, err := json.Marshal(values[i])
+		if err != nil {
+			v, _ = json.Marshal(fmt.Sprint(values[i]))
+		}
+		b.Write(k)
+		b.WriteByte(':')
+		b.Write(v)
+	}
+	b.WriteString("}\n")
+	return []byte(b.String())
+}
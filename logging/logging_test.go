@@ -0,0 +1,69 @@
+package logging
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"strings"
+	"testing"
+)
+
+func TestLogfmt(t *testing.T) {
+	var buf bytes.Buffer
+	SetOutput(&buf)
+	SetFormat(LogfmtFormat)
+	SetLevel(InfoLevel)
+
+	l := New("test").With("clientid", "abc")
+	l.Info("Client connected", "username", "user one")
+	line := buf.String()
+
+	for _, want := range []string{
+		"level=info",
+		"component=test",
+		`msg="Client connected"`,
+		"clientid=abc",
+		`username="user one"`,
+	} {
+		if !strings.Contains(line, want) {
+			t.Errorf("Expected %s in %s", want, line)
+		}
+	}
+}
+
+func TestJSON(t *testing.T) {
+	var buf bytes.Buffer
+	SetOutput(&buf)
+	SetFormat(JSONFormat)
+	SetLevel(InfoLevel)
+	defer SetFormat(LogfmtFormat)
+
+	New("test").Warn("Failed", "error", errors.New("boom"))
+
+	var line map[string]interface{}
+	if err := json.Unmarshal(buf.Bytes(), &line); err != nil {
+		t.Fatal("Expected valid JSON", err)
+	}
+	if line["level"] != "warn" || line["error"] != "boom" {
+		t.Error("Unexpected JSON line", buf.String())
+	}
+}
+
+func TestLevels(t *testing.T) {
+	var buf bytes.Buffer
+	SetOutput(&buf)
+	SetLevel(WarnLevel)
+
+	New("test").Info("Hidden")
+	if buf.Len() != 0 {
+		t.Error("Expected info line to be dropped at warn level")
+	}
+
+	SetComponentLevel("test", DebugLevel)
+	New("test").Debug("Shown")
+	New("other").Info("Hidden")
+	if strings.Count(buf.String(), "\n") != 1 {
+		t.Error("Expected only the component override to apply", buf.String())
+	}
+	SetLevel(InfoLevel)
+}
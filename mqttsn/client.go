@@ -0,0 +1,560 @@
+package mqttsn
+
+import (
+	"errors"
+	"github.com/gomqtt/packet"
+	"github.com/trafero/tstack/logging"
+	"github.com/trafero/tstack/serve"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Client states (sec. 6.14)
+const (
+	stateConnecting = iota // Waiting for will topic and message, or the broker
+	stateActive
+	stateAsleep
+	stateClosed
+)
+
+const (
+	// Messages held for a sleeping client. The oldest are dropped first
+	maxBuffered = 100
+	// Time to wait for a client to acknowledge a gateway REGISTER
+	registerTimeout = 5 * time.Second
+	// Time to wait for the broker to accept a connection
+	connectTimeout = 10 * time.Second
+)
+
+// client is an MQTT-SN client and its MQTT session on the broker
+type client struct {
+	gateway  *Gateway
+	addr     net.Addr
+	clientid string
+	mqttID   string // MQTT client ID on the broker
+	username string
+	password string
+	clean    bool
+	will     *packet.Message
+	log      *logging.Logger
+
+	mutex    sync.Mutex
+	state    int
+	started  time.Time     // When the CONNECT was received
+	duration time.Duration // Keepalive when active, sleep duration when asleep
+	lastSeen time.Time
+	topics   map[uint16]string // Registered topic IDs
+	ids      map[string]uint16
+	nextID   uint16
+	msgID    uint16                  // For gateway REGISTER messages
+	pubacks  map[uint16]uint16       // Message ID -> topic ID, for PUBACK
+	subacks  map[uint16]uint16       // Message ID -> topic ID, for SUBACK
+	buffer   []*packet.PublishPacket // Held while asleep
+	regacks  chan *Packet            // REGACK replies to gateway REGISTER
+	upstream *serve.Session          // MQTT connection to the broker
+}
+
+/*
+ * newClient creates a client from a CONNECT. The client ID may be given as
+ * [<name>@]<username>:<password>, as MQTT-SN 1.2 has no other way of
+ * passing credentials. The MQTT client ID is the MQTT-SN client ID without
+ * the password, prefixed with "mqttsn-", so that devices sharing a username
+ * have their own sessions when they are given names.
+ */
+func newClient(g *Gateway, addr net.Addr, p *Packet) *client {
+	id, password := p.ClientID, ""
+	if i := strings.Index(p.ClientID, ":"); i >= 0 {
+		id, password = p.ClientID[:i], p.ClientID[i+1:]
+	}
+	username := id
+	if i := strings.LastIndex(id, "@"); i >= 0 {
+		username = id[i+1:]
+	}
+	now := time.Now()
+	return &client{
+		gateway:  g,
+		addr:     addr,
+		clientid: p.ClientID,
+		mqttID:   "mqttsn-" + id,
+		username: username,
+		password: password,
+		clean:    p.CleanSession(),
+		log:      logger.With("remote", addr, "username", username),
+		state:    stateConnecting,
+		duration: time.Duration(p.Duration) * time.Second,
+		started:  now,
+		lastSeen: now,
+		topics:   make(map[uint16]string),
+		ids:      make(map[string]uint16),
+		pubacks:  make(map[uint16]uint16),
+		subacks:  make(map[uint16]uint16),
+		regacks:  make(chan *Packet, 1),
+	}
+}
+
+// newAnonymousClient creates the gateway's own session for QoS -1 publishes
+func newAnonymousClient(g *Gateway, addr net.Addr) *client {
+	return &client{
+		gateway:  g,
+		addr:     addr,
+		mqttID:   "mqttsn-gateway-" + strconv.Itoa(int(g.id)),
+		username: g.username,
+		password: g.password,
+		clean:    true,
+		log:      logger.With("username", g.username),
+		state:    stateActive,
+	}
+}
+
+// start asks for the will, if there is one, before connecting to the broker
+func (c *client) start(p *Packet) {
+	if p.Will() {
+		c.gateway.send(c.addr, &Packet{Type: WILLTOPICREQ})
+		return
+	}
+	go c.connect()
+}
+
+// resume handles a CONNECT from a client that is already connected or
+// asleep. Returns false if the session cannot be resumed
+func (c *client) resume(p *Packet) bool {
+	c.mutex.Lock()
+	if c.state != stateActive && c.state != stateAsleep {
+		c.mutex.Unlock()
+		return false
+	}
+	c.state = stateActive
+	c.duration = time.Duration(p.Duration) * time.Second
+	c.lastSeen = time.Now()
+	buffered := c.buffer
+	c.buffer = nil
+	c.mutex.Unlock()
+
+	c.gateway.send(c.addr, &Packet{Type: CONNACK, ReturnCode: Accepted})
+	for _, pkt := range buffered {
+		c.sendPublish(pkt)
+	}
+	return true
+}
+
+func (c *client) connect() {
+	if err := c.connectUpstream(); err != nil {
+		c.log.Warn("MQTT-SN client could not connect", "error", err)
+		c.gateway.send(c.addr, &Packet{Type: CONNACK, ReturnCode: RejectedNotSupport})
+		c.close(false)
+		return
+	}
+	c.mutex.Lock()
+	if c.state == stateConnecting {
+		c.state = stateActive
+	}
+	c.mutex.Unlock()
+	c.log.Info("MQTT-SN client connected")
+	c.gateway.send(c.addr, &Packet{Type: CONNACK, ReturnCode: Accepted})
+}
+
+// connectUpstream opens the MQTT session on the broker
+func (c *client) connectUpstream() error {
+	conn, err := c.gateway.dial(c.addr)
+	if err != nil {
+		return err
+	}
+	connect := packet.NewConnectPacket()
+	connect.ClientID = c.mqttID
+	connect.Username = c.username
+	connect.Password = c.password
+	connect.CleanSession = c.clean
+	connect.Will = c.will
+	// The gateway checks keepalives, as the broker would disconnect
+	// sleeping clients
+	connect.KeepAlive = 0
+
+	upstream, err := serve.Connect(conn, connect, connectTimeout)
+	if err != nil {
+		return err
+	}
+	c.mutex.Lock()
+	if c.state == stateClosed {
+		// Timed out while the broker was connecting
+		c.mutex.Unlock()
+		upstream.Close(true)
+		return errors.New("Client closed while connecting")
+	}
+	c.upstream = upstream
+	c.mutex.Unlock()
+	go c.readUpstream(upstream)
+	return nil
+}
+
+func (c *client) writeUpstream(p packet.Packet) error {
+	c.mutex.Lock()
+	upstream := c.upstream
+	c.mutex.Unlock()
+	if upstream == nil {
+		return errors.New("Not connected to broker")
+	}
+	return upstream.Write(p)
+}
+
+// close ends the client's session. With disconnect set, the broker is told
+// the client disconnected cleanly, so any will is discarded
+func (c *client) close(disconnect bool) {
+	c.mutex.Lock()
+	if c.state == stateClosed {
+		c.mutex.Unlock()
+		return
+	}
+	c.state = stateClosed
+	upstream := c.upstream
+	c.mutex.Unlock()
+
+	if upstream != nil {
+		upstream.Close(disconnect)
+	}
+	c.gateway.remove(c)
+}
+
+func (c *client) isClosed() bool {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.state == stateClosed
+}
+
+/*
+ * expired reports whether the client has been silent for too long, or is
+ * taking too long to connect, whatever its keepalive
+ */
+func (c *client) expired(now time.Time) bool {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if c.state == stateConnecting {
+		return now.Sub(c.started) > connectTimeout
+	}
+	if c.duration == 0 || c.state == stateClosed {
+		return false
+	}
+	return now.Sub(c.lastSeen) > c.duration*3/2
+}
+
+// handle processes a message from the MQTT-SN client
+func (c *client) handle(p *Packet) {
+	c.mutex.Lock()
+	c.lastSeen = time.Now()
+	state := c.state
+	c.mutex.Unlock()
+
+	if state == stateConnecting {
+		c.handleWill(p)
+		return
+	}
+
+	switch p.Type {
+	case REGISTER:
+		id := c.register(p.TopicName)
+		c.gateway.send(c.addr, &Packet{Type: REGACK, TopicID: id, MsgID: p.MsgID, ReturnCode: Accepted})
+	case REGACK:
+		select {
+		case c.regacks <- p:
+		default:
+		}
+	case PUBLISH:
+		c.publish(p)
+	case PUBACK:
+		c.writeUpstream(&packet.PubackPacket{PacketID: p.MsgID})
+	case PUBREC:
+		c.writeUpstream(&packet.PubrecPacket{PacketID: p.MsgID})
+	case PUBREL:
+		c.writeUpstream(&packet.PubrelPacket{PacketID: p.MsgID})
+	case PUBCOMP:
+		c.writeUpstream(&packet.PubcompPacket{PacketID: p.MsgID})
+	case SUBSCRIBE:
+		c.subscribe(p)
+	case UNSUBSCRIBE:
+		topic := c.topicName(p)
+		if topic == "" {
+			c.gateway.send(c.addr, &Packet{Type: UNSUBACK, MsgID: p.MsgID})
+			return
+		}
+		c.writeUpstream(&packet.UnsubscribePacket{PacketID: p.MsgID, Topics: []string{topic}})
+	case PINGREQ:
+		c.ping(p)
+	case DISCONNECT:
+		c.disconnect(p)
+	case WILLTOPICUPD:
+		c.gateway.send(c.addr, &Packet{Type: WILLTOPICRESP, ReturnCode: RejectedNotSupport})
+	case WILLMSGUPD:
+		c.gateway.send(c.addr, &Packet{Type: WILLMSGRESP, ReturnCode: RejectedNotSupport})
+	default:
+		c.log.Debug("Unexpected MQTT-SN message", "type", p.Type)
+	}
+}
+
+// handleWill collects the will topic and message before connecting
+func (c *client) handleWill(p *Packet) {
+	switch p.Type {
+	case WILLTOPIC:
+		if p.TopicName == "" {
+			// Empty will topic means no will
+			go c.connect()
+			return
+		}
+		c.mutex.Lock()
+		qos := p.QOS()
+		if qos < 0 {
+			qos = 0
+		}
+		c.will = &packet.Message{Topic: p.TopicName, QOS: byte(qos), Retain: p.Retain()}
+		c.mutex.Unlock()
+		c.gateway.send(c.addr, &Packet{Type: WILLMSGREQ})
+	case WILLMSG:
+		c.mutex.Lock()
+		if c.will == nil {
+			c.mutex.Unlock()
+			return
+		}
+		c.will.Payload = p.Data
+		c.mutex.Unlock()
+		go c.connect()
+	default:
+		c.log.Debug("Unexpected MQTT-SN message while connecting", "type", p.Type)
+	}
+}
+
+// register returns the topic ID for a topic name, assigning a new one if
+// needed
+func (c *client) register(topic string) uint16 {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if id, ok := c.ids[topic]; ok {
+		return id
+	}
+	c.nextID++
+	// Skip IDs used by predefined topics, and 0x0000 and 0xFFFF (reserved)
+	for c.nextID == 0 || c.nextID == 0xFFFF || c.gateway.predefined[c.nextID] != "" {
+		c.nextID++
+	}
+	c.topics[c.nextID] = topic
+	c.ids[topic] = c.nextID
+	return c.nextID
+}
+
+// topicName resolves the topic of a PUBLISH, SUBSCRIBE or UNSUBSCRIBE
+func (c *client) topicName(p *Packet) string {
+	switch p.TopicIDType() {
+	case TopicPredefined:
+		return c.gateway.predefined[p.TopicID]
+	case TopicShort:
+		return shortTopic(p.TopicID)
+	}
+	if p.Type == PUBLISH {
+		c.mutex.Lock()
+		defer c.mutex.Unlock()
+		return c.topics[p.TopicID]
+	}
+	return p.TopicName
+}
+
+func (c *client) publish(p *Packet) {
+	topic := c.topicName(p)
+	if topic == "" {
+		c.gateway.send(c.addr, &Packet{Type: PUBACK, TopicID: p.TopicID, MsgID: p.MsgID, ReturnCode: RejectedTopicID})
+		return
+	}
+	if p.QOS() == 1 {
+		c.mutex.Lock()
+		c.pubacks[p.MsgID] = p.TopicID
+		c.mutex.Unlock()
+	}
+	c.writeUpstream(&packet.PublishPacket{
+		Message: packet.Message{
+			Topic:   topic,
+			Payload: p.Data,
+			QOS:     byte(p.QOS()),
+			Retain:  p.Retain(),
+		},
+		Dup:      p.Dup(),
+		PacketID: p.MsgID,
+	})
+}
+
+func (c *client) subscribe(p *Packet) {
+	topic := c.topicName(p)
+	if topic == "" {
+		c.gateway.send(c.addr, &Packet{Type: SUBACK, MsgID: p.MsgID, ReturnCode: RejectedTopicID})
+		return
+	}
+	// Topic names without wildcards are registered, and their ID returned
+	var id uint16
+	switch {
+	case p.TopicIDType() == TopicPredefined:
+		id = p.TopicID
+	case p.TopicIDType() == TopicNormal && !strings.ContainsAny(topic, "+#") && len(topic) != 2:
+		id = c.register(topic)
+	}
+	c.mutex.Lock()
+	c.subacks[p.MsgID] = id
+	c.mutex.Unlock()
+
+	qos := p.QOS()
+	if qos < 0 {
+		qos = 0
+	}
+	c.writeUpstream(&packet.SubscribePacket{
+		PacketID:      p.MsgID,
+		Subscriptions: []packet.Subscription{{Topic: topic, QOS: byte(qos)}},
+	})
+}
+
+func (c *client) ping(p *Packet) {
+	// A sleeping client wakes up to collect its messages (sec. 6.14)
+	var buffered []*packet.PublishPacket
+	if p.ClientID != "" {
+		c.mutex.Lock()
+		if c.state == stateAsleep {
+			buffered = c.buffer
+			c.buffer = nil
+		}
+		c.mutex.Unlock()
+	}
+	for _, pkt := range buffered {
+		c.sendPublish(pkt)
+	}
+	c.gateway.send(c.addr, &Packet{Type: PINGRESP})
+}
+
+func (c *client) disconnect(p *Packet) {
+	if p.Duration > 0 {
+		c.mutex.Lock()
+		c.state = stateAsleep
+		c.duration = time.Duration(p.Duration) * time.Second
+		c.mutex.Unlock()
+		c.log.Debug("MQTT-SN client asleep", "duration", p.Duration)
+		c.gateway.send(c.addr, &Packet{Type: DISCONNECT})
+		return
+	}
+	c.log.Info("MQTT-SN client disconnected")
+	c.gateway.send(c.addr, &Packet{Type: DISCONNECT})
+	c.close(true)
+}
+
+// readUpstream translates messages from the broker for the MQTT-SN client
+func (c *client) readUpstream(upstream *serve.Session) {
+	for {
+		pkt, err := upstream.Read()
+		if err != nil {
+			if !c.isClosed() {
+				c.log.Info("Broker closed MQTT-SN client connection", "error", err)
+				// The gateway's own connection has no MQTT-SN client
+				if c.clientid != "" {
+					c.gateway.send(c.addr, &Packet{Type: DISCONNECT})
+				}
+				c.close(false)
+			}
+			return
+		}
+		switch pkt := pkt.(type) {
+		case *packet.PublishPacket:
+			c.mutex.Lock()
+			if c.state == stateAsleep {
+				if len(c.buffer) >= maxBuffered {
+					c.buffer = c.buffer[1:]
+				}
+				c.buffer = append(c.buffer, pkt)
+				c.mutex.Unlock()
+				continue
+			}
+			c.mutex.Unlock()
+			c.sendPublish(pkt)
+		case *packet.PubackPacket:
+			c.mutex.Lock()
+			id := c.pubacks[pkt.PacketID]
+			delete(c.pubacks, pkt.PacketID)
+			c.mutex.Unlock()
+			c.gateway.send(c.addr, &Packet{Type: PUBACK, TopicID: id, MsgID: pkt.PacketID, ReturnCode: Accepted})
+		case *packet.PubrecPacket:
+			c.gateway.send(c.addr, &Packet{Type: PUBREC, MsgID: pkt.PacketID})
+		case *packet.PubrelPacket:
+			c.gateway.send(c.addr, &Packet{Type: PUBREL, MsgID: pkt.PacketID})
+		case *packet.PubcompPacket:
+			c.gateway.send(c.addr, &Packet{Type: PUBCOMP, MsgID: pkt.PacketID})
+		case *packet.SubackPacket:
+			c.mutex.Lock()
+			id := c.subacks[pkt.PacketID]
+			delete(c.subacks, pkt.PacketID)
+			c.mutex.Unlock()
+			suback := &Packet{Type: SUBACK, TopicID: id, MsgID: pkt.PacketID, ReturnCode: Accepted}
+			if len(pkt.ReturnCodes) == 0 || pkt.ReturnCodes[0] == packet.QOSFailure {
+				suback.ReturnCode = RejectedNotSupport
+			} else {
+				suback.SetQOS(int(pkt.ReturnCodes[0]))
+			}
+			c.gateway.send(c.addr, suback)
+		case *packet.UnsubackPacket:
+			c.gateway.send(c.addr, &Packet{Type: UNSUBACK, MsgID: pkt.PacketID})
+		}
+	}
+}
+
+/*
+ * sendPublish forwards a message from the broker, registering its topic
+ * with the client first if the client does not know its ID
+ */
+func (c *client) sendPublish(pkt *packet.PublishPacket) {
+	topic := pkt.Message.Topic
+	p := &Packet{Type: PUBLISH, MsgID: pkt.PacketID, Data: pkt.Message.Payload}
+	p.SetQOS(int(pkt.Message.QOS))
+	if pkt.Message.Retain {
+		p.Flags |= flagRetain
+	}
+	if pkt.Dup {
+		p.Flags |= flagDup
+	}
+
+	c.mutex.Lock()
+	id, registered := c.ids[topic]
+	c.mutex.Unlock()
+
+	if predefined, ok := c.gateway.predefIDs[topic]; ok {
+		p.SetTopicIDType(TopicPredefined)
+		p.TopicID = predefined
+	} else if registered {
+		p.TopicID = id
+	} else if len(topic) == 2 {
+		p.SetTopicIDType(TopicShort)
+		p.TopicID = shortTopicID(topic)
+	} else {
+		id = c.register(topic)
+		c.mutex.Lock()
+		c.msgID++
+		msgID := c.msgID
+		c.mutex.Unlock()
+		c.gateway.send(c.addr, &Packet{Type: REGISTER, TopicID: id, MsgID: msgID, TopicName: topic})
+		if !c.waitRegack(msgID) {
+			c.log.Warn("MQTT-SN client did not register topic", "topic", topic)
+			c.mutex.Lock()
+			delete(c.ids, topic)
+			delete(c.topics, id)
+			c.mutex.Unlock()
+			return
+		}
+		p.TopicID = id
+	}
+	c.gateway.send(c.addr, p)
+}
+
+func (c *client) waitRegack(msgID uint16) bool {
+	timeout := time.After(registerTimeout)
+	for {
+		select {
+		case p := <-c.regacks:
+			if p.MsgID == msgID {
+				return p.ReturnCode == Accepted
+			}
+		case <-timeout:
+			return false
+		}
+	}
+}
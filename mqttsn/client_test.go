@@ -0,0 +1,39 @@
+package mqttsn
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+func TestNewClient(t *testing.T) {
+	g := New(1, nil)
+	addr := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 1884}
+	for _, test := range []struct {
+		clientID, mqttID, username, password string
+	}{
+		{"ABC-123:secret", "mqttsn-ABC-123", "ABC-123", "secret"},
+		{"sensor1@ABC-123:secret", "mqttsn-sensor1@ABC-123", "ABC-123", "secret"},
+		{"ABC-123:pass:word", "mqttsn-ABC-123", "ABC-123", "pass:word"},
+		{"ABC-123", "mqttsn-ABC-123", "ABC-123", ""},
+	} {
+		c := newClient(g, addr, &Packet{Type: CONNECT, ClientID: test.clientID})
+		if c.mqttID != test.mqttID || c.username != test.username || c.password != test.password {
+			t.Errorf("%s: expected %s %s %s, got %s %s %s", test.clientID,
+				test.mqttID, test.username, test.password, c.mqttID, c.username, c.password)
+		}
+	}
+}
+
+func TestConnectingExpires(t *testing.T) {
+	g := New(1, nil)
+	addr := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 1884}
+	// No keepalive, and waiting for a will that never comes
+	c := newClient(g, addr, &Packet{Type: CONNECT, Flags: flagWill, ClientID: "ABC-123:secret"})
+	if c.expired(time.Now()) {
+		t.Error("Expected new client not to have expired")
+	}
+	if !c.expired(time.Now().Add(connectTimeout + time.Second)) {
+		t.Error("Expected client still connecting to expire")
+	}
+}
@@ -0,0 +1,277 @@
+package mqttsn
+
+import (
+	"errors"
+	"github.com/gomqtt/packet"
+	"github.com/trafero/tstack/logging"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+var logger = logging.New("mqttsn")
+
+// Dialer opens an MQTT 3.1.1 connection to the broker on behalf of the
+// MQTT-SN client at remote (e.g. serve.Pipe)
+type Dialer func(remote net.Addr) (net.Conn, error)
+
+// Gateway translates MQTT-SN 1.2 over UDP into MQTT sessions on a broker.
+// Each MQTT-SN client gets its own MQTT connection, so authentication and
+// access rights are applied by the broker exactly as for MQTT clients.
+type Gateway struct {
+	id         byte
+	dial       Dialer
+	conn       net.PacketConn
+	predefined map[uint16]string // Predefined topic IDs, shared by all clients
+	predefIDs  map[string]uint16
+
+	// Credentials for QoS -1 publishes, which are sent without a connection
+	username   string
+	password   string
+	anon       *client
+	connecting bool // Guarded by mutex. Set while anon is connecting
+
+	mutex   sync.Mutex
+	clients map[string]*client // Mapped by remote address
+}
+
+// New returns a gateway with the given gateway ID, connecting clients to
+// the broker with dial
+func New(id byte, dial Dialer) *Gateway {
+	return &Gateway{
+		id:         id,
+		dial:       dial,
+		predefined: make(map[uint16]string),
+		predefIDs:  make(map[string]uint16),
+		clients:    make(map[string]*client),
+	}
+}
+
+// SetPredefinedTopics sets topic IDs that clients may use without
+// registering them
+func (g *Gateway) SetPredefinedTopics(topics map[uint16]string) {
+	g.predefined = topics
+	g.predefIDs = make(map[string]uint16)
+	for id, topic := range topics {
+		g.predefIDs[topic] = id
+	}
+}
+
+// SetAnonymous sets the broker credentials used for QoS -1 publishes. If not
+// set, QoS -1 publishes are dropped
+func (g *Gateway) SetAnonymous(username string, password string) {
+	g.username = username
+	g.password = password
+}
+
+/*
+ * ParsePredefinedTopics reads topic IDs in the form "id=topic,id=topic",
+ * e.g. "1=ABC-123/temperature,2=ABC-123/humidity"
+ */
+func ParsePredefinedTopics(s string) (topics map[uint16]string, err error) {
+	topics = make(map[uint16]string)
+	if s == "" {
+		return topics, nil
+	}
+	for _, t := range strings.Split(s, ",") {
+		parts := strings.SplitN(t, "=", 2)
+		if len(parts) != 2 || parts[1] == "" {
+			return nil, errors.New("Predefined topic must be in the form id=topic: " + t)
+		}
+		id, err := strconv.ParseUint(parts[0], 10, 16)
+		if err != nil || id == 0 || id == 0xFFFF {
+			return nil, errors.New("Invalid predefined topic ID: " + t)
+		}
+		topics[uint16(id)] = parts[1]
+	}
+	return topics, nil
+}
+
+// Serve reads MQTT-SN datagrams from conn until it is closed
+func (g *Gateway) Serve(conn net.PacketConn) error {
+	g.conn = conn
+	go g.keepaliveRound()
+
+	buf := make([]byte, 65536)
+	for {
+		n, addr, err := conn.ReadFrom(buf)
+		if err != nil {
+			g.closeAll()
+			return err
+		}
+		p, err := Decode(buf[:n])
+		if err != nil {
+			logger.Debug("Could not decode datagram", "remote", addr, "error", err)
+			continue
+		}
+		g.handle(addr, p)
+	}
+}
+
+func (g *Gateway) send(addr net.Addr, p *Packet) {
+	if _, err := g.conn.WriteTo(p.Encode(), addr); err != nil {
+		logger.Debug("Could not send datagram", "remote", addr, "error", err)
+	}
+}
+
+func (g *Gateway) handle(addr net.Addr, p *Packet) {
+	switch p.Type {
+	case SEARCHGW:
+		g.send(addr, &Packet{Type: GWINFO, GatewayID: g.id})
+		return
+	case CONNECT:
+		g.connect(addr, p)
+		return
+	case PUBLISH:
+		if p.QOS() == -1 {
+			g.publishAnonymous(addr, p)
+			return
+		}
+	}
+
+	g.mutex.Lock()
+	c, ok := g.clients[addr.String()]
+	g.mutex.Unlock()
+	if !ok {
+		logger.Debug("Message from unknown client", "remote", addr, "type", p.Type)
+		if p.Type != DISCONNECT {
+			g.send(addr, &Packet{Type: DISCONNECT})
+		}
+		return
+	}
+	c.handle(p)
+}
+
+func (g *Gateway) connect(addr net.Addr, p *Packet) {
+	g.mutex.Lock()
+	existing, ok := g.clients[addr.String()]
+	g.mutex.Unlock()
+
+	// A sleeping or active client connecting again, without a new will,
+	// carries on with the same session
+	if ok && existing.clientid == p.ClientID && !p.Will() && existing.resume(p) {
+		return
+	}
+	if ok {
+		existing.close(false)
+	}
+
+	c := newClient(g, addr, p)
+	g.mutex.Lock()
+	g.clients[addr.String()] = c
+	g.mutex.Unlock()
+	c.start(p)
+}
+
+func (g *Gateway) remove(c *client) {
+	g.mutex.Lock()
+	if g.clients[c.addr.String()] == c {
+		delete(g.clients, c.addr.String())
+	}
+	g.mutex.Unlock()
+}
+
+func (g *Gateway) closeAll() {
+	g.mutex.Lock()
+	clients := make([]*client, 0, len(g.clients))
+	for _, c := range g.clients {
+		clients = append(clients, c)
+	}
+	g.mutex.Unlock()
+	for _, c := range clients {
+		c.close(false)
+	}
+}
+
+/*
+ * publishAnonymous sends a QoS -1 publish to the broker, using the gateway's
+ * own connection. Only predefined and short topic IDs can be used
+ */
+func (g *Gateway) publishAnonymous(addr net.Addr, p *Packet) {
+	var topic string
+	switch p.TopicIDType() {
+	case TopicPredefined:
+		topic = g.predefined[p.TopicID]
+	case TopicShort:
+		topic = shortTopic(p.TopicID)
+	}
+	if topic == "" {
+		logger.Debug("QoS -1 publish to unknown topic", "remote", addr, "topicid", p.TopicID)
+		return
+	}
+	if g.username == "" {
+		logger.Warn("QoS -1 publish dropped, no gateway credentials set", "remote", addr, "topic", topic)
+		return
+	}
+
+	// Connecting may wait on the broker, so is done away from the read loop,
+	// with publishes dropped until it is done
+	g.mutex.Lock()
+	anon := g.anon
+	if anon == nil || anon.isClosed() {
+		if !g.connecting {
+			g.connecting = true
+			go g.connectAnonymous()
+		}
+		g.mutex.Unlock()
+		logger.Debug("QoS -1 publish dropped while connecting gateway to broker", "remote", addr, "topic", topic)
+		return
+	}
+	g.mutex.Unlock()
+
+	anon.writeUpstream(&packet.PublishPacket{
+		Message: packet.Message{
+			Topic:   topic,
+			Payload: p.Data,
+			QOS:     packet.QOSAtMostOnce,
+			Retain:  p.Retain(),
+		},
+	})
+}
+
+// connectAnonymous opens the gateway's own session for QoS -1 publishes
+func (g *Gateway) connectAnonymous() {
+	anon := newAnonymousClient(g, g.conn.LocalAddr())
+	err := anon.connectUpstream()
+	if err != nil {
+		logger.Error("Could not connect gateway to broker", "error", err)
+	}
+	g.mutex.Lock()
+	if err == nil {
+		g.anon = anon
+	}
+	g.connecting = false
+	g.mutex.Unlock()
+}
+
+// keepaliveRound drops clients that have not been heard from within 1.5
+// times their keepalive or sleep duration (sec. 6.14)
+func (g *Gateway) keepaliveRound() {
+	for now := range time.Tick(time.Second) {
+		g.mutex.Lock()
+		var lost []*client
+		for _, c := range g.clients {
+			if c.expired(now) {
+				lost = append(lost, c)
+			}
+		}
+		g.mutex.Unlock()
+		for _, c := range lost {
+			c.log.Info("MQTT-SN client lost")
+			// Closing without DISCONNECT has the broker send any will
+			c.close(false)
+		}
+	}
+}
+
+// shortTopic returns the two character topic name held in a topic ID
+func shortTopic(id uint16) string {
+	return string([]byte{byte(id >> 8), byte(id)})
+}
+
+// shortTopicID returns the topic ID for a two character topic name
+func shortTopicID(topic string) uint16 {
+	return uint16(topic[0])<<8 | uint16(topic[1])
+}
@@ -0,0 +1,139 @@
+package mqttsn
+
+import (
+	authall "github.com/trafero/tstack/auth/all"
+	"github.com/trafero/tstack/serve"
+	"net"
+	"testing"
+	"time"
+)
+
+/*
+ * listen starts a gateway on a local UDP port, connected to an in-process
+ * broker
+ */
+func listen(t *testing.T) net.Addr {
+	a, _ := authall.New()
+	b := serve.NewBroker()
+	g := New(1, func(remote net.Addr) (net.Conn, error) {
+		return serve.Pipe(a, b, remote), nil
+	})
+	g.SetPredefinedTopics(map[uint16]string{1: "predefined/topic"})
+
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal("Error setting up listener:", err)
+	}
+	go g.Serve(conn)
+	return conn.LocalAddr()
+}
+
+type testClient struct {
+	t    *testing.T
+	conn net.Conn
+}
+
+func (c *testClient) send(p *Packet) {
+	if _, err := c.conn.Write(p.Encode()); err != nil {
+		c.t.Fatal("Error sending:", err)
+	}
+}
+
+func (c *testClient) expect(msgType byte) *Packet {
+	buf := make([]byte, 1024)
+	c.conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	n, err := c.conn.Read(buf)
+	if err != nil {
+		c.t.Fatalf("Waiting for %#x: %s", msgType, err)
+	}
+	p, err := Decode(buf[:n])
+	if err != nil {
+		c.t.Fatal("Error decoding:", err)
+	}
+	if p.Type != msgType {
+		c.t.Fatalf("Expected %#x, got %#x", msgType, p.Type)
+	}
+	return p
+}
+
+func TestGateway(t *testing.T) {
+	addr := listen(t)
+	conn, err := net.Dial("udp", addr.String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	c := &testClient{t: t, conn: conn}
+
+	c.send(&Packet{Type: SEARCHGW})
+	if p := c.expect(GWINFO); p.GatewayID != 1 {
+		t.Errorf("Expected gateway ID 1, got %d", p.GatewayID)
+	}
+
+	c.send(&Packet{Type: CONNECT, Flags: flagCleanSession, Duration: 30, ClientID: "username:password"})
+	if p := c.expect(CONNACK); p.ReturnCode != Accepted {
+		t.Fatalf("Connection refused with %d", p.ReturnCode)
+	}
+
+	// Subscribe by name, and to a predefined topic
+	c.send(&Packet{Type: SUBSCRIBE, MsgID: 1, TopicName: "a/b"})
+	suback := c.expect(SUBACK)
+	if suback.ReturnCode != Accepted || suback.TopicID == 0 {
+		t.Fatalf("Unexpected SUBACK %+v", suback)
+	}
+	c.send(&Packet{Type: SUBSCRIBE, Flags: TopicPredefined, MsgID: 2, TopicID: 1})
+	c.expect(SUBACK)
+
+	// Publish to the registered topic, at QoS 1
+	c.send(&Packet{Type: REGISTER, MsgID: 3, TopicName: "a/b"})
+	regack := c.expect(REGACK)
+	if regack.TopicID != suback.TopicID {
+		t.Errorf("Expected topic ID %d, got %d", suback.TopicID, regack.TopicID)
+	}
+	publish := &Packet{Type: PUBLISH, TopicID: regack.TopicID, MsgID: 4, Data: []byte("payload")}
+	publish.SetQOS(1)
+	c.send(publish)
+
+	// PUBACK and the message, in either order
+	var got *Packet
+	for i := 0; i < 2; i++ {
+		buf := make([]byte, 1024)
+		conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+		n, err := conn.Read(buf)
+		if err != nil {
+			t.Fatal("Waiting for PUBACK and PUBLISH:", err)
+		}
+		p, _ := Decode(buf[:n])
+		switch {
+		case p.Type == PUBACK && p.ReturnCode != Accepted:
+			t.Errorf("Publish rejected with %d", p.ReturnCode)
+		case p.Type == PUBLISH:
+			got = p
+		}
+	}
+	if got == nil || string(got.Data) != "payload" || got.TopicID != regack.TopicID {
+		t.Fatalf("Unexpected message %+v", got)
+	}
+	if got.QOS() == 1 {
+		c.send(&Packet{Type: PUBACK, TopicID: got.TopicID, MsgID: got.MsgID})
+	}
+
+	// Predefined topic
+	publish = &Packet{Type: PUBLISH, Flags: TopicPredefined, TopicID: 1, Data: []byte("predefined")}
+	c.send(publish)
+	if p := c.expect(PUBLISH); p.TopicIDType() != TopicPredefined || string(p.Data) != "predefined" {
+		t.Errorf("Unexpected message %+v", p)
+	}
+
+	// Unknown topic ID
+	c.send(&Packet{Type: PUBLISH, TopicID: 999, MsgID: 5})
+	if p := c.expect(PUBACK); p.ReturnCode != RejectedTopicID {
+		t.Errorf("Expected topic ID rejection, got %d", p.ReturnCode)
+	}
+
+	c.send(&Packet{Type: PINGREQ})
+	c.expect(PINGRESP)
+
+	c.send(&Packet{Type: DISCONNECT})
+	c.expect(DISCONNECT)
+}
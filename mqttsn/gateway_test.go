@@ -0,0 +1,46 @@
+package mqttsn
+
+import (
+	"errors"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestPublishAnonymousConnecting(t *testing.T) {
+	var dials int32
+	release := make(chan struct{})
+	g := New(1, func(remote net.Addr) (net.Conn, error) {
+		atomic.AddInt32(&dials, 1)
+		<-release
+		return nil, errors.New("Broker unavailable")
+	})
+	g.SetAnonymous("gateway", "secret")
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal("Error setting up listener:", err)
+	}
+	defer conn.Close()
+	g.conn = conn
+
+	// Publishes return at once, and are dropped, while the broker is slow
+	p := &Packet{Type: PUBLISH, TopicID: shortTopicID("ab"), Data: []byte("1")}
+	p.SetQOS(-1)
+	p.Flags |= TopicShort
+	g.publishAnonymous(conn.LocalAddr(), p)
+	g.publishAnonymous(conn.LocalAddr(), p)
+	time.Sleep(50 * time.Millisecond)
+	if n := atomic.LoadInt32(&dials); n != 1 {
+		t.Errorf("Expected one connection attempt, got %d", n)
+	}
+
+	close(release)
+	time.Sleep(50 * time.Millisecond)
+	g.mutex.Lock()
+	connecting, anon := g.connecting, g.anon
+	g.mutex.Unlock()
+	if connecting || anon != nil {
+		t.Error("Expected failed connection to be cleared")
+	}
+}
@@ -0,0 +1,310 @@
+package mqttsn
+
+import (
+	"encoding/binary"
+	"errors"
+)
+
+// Message types (MQTT-SN 1.2 sec. 5.2.2)
+const (
+	ADVERTISE     byte = 0x00
+	SEARCHGW      byte = 0x01
+	GWINFO        byte = 0x02
+	CONNECT       byte = 0x04
+	CONNACK       byte = 0x05
+	WILLTOPICREQ  byte = 0x06
+	WILLTOPIC     byte = 0x07
+	WILLMSGREQ    byte = 0x08
+	WILLMSG       byte = 0x09
+	REGISTER      byte = 0x0A
+	REGACK        byte = 0x0B
+	PUBLISH       byte = 0x0C
+	PUBACK        byte = 0x0D
+	PUBCOMP       byte = 0x0E
+	PUBREC        byte = 0x0F
+	PUBREL        byte = 0x10
+	SUBSCRIBE     byte = 0x12
+	SUBACK        byte = 0x13
+	UNSUBSCRIBE   byte = 0x14
+	UNSUBACK      byte = 0x15
+	PINGREQ       byte = 0x16
+	PINGRESP      byte = 0x17
+	DISCONNECT    byte = 0x18
+	WILLTOPICUPD  byte = 0x1A
+	WILLTOPICRESP byte = 0x1B
+	WILLMSGUPD    byte = 0x1C
+	WILLMSGRESP   byte = 0x1D
+)
+
+// Return codes (sec. 5.3.10)
+const (
+	Accepted           byte = 0x00
+	RejectedCongestion byte = 0x01
+	RejectedTopicID    byte = 0x02
+	RejectedNotSupport byte = 0x03
+)
+
+// Topic ID types (sec. 5.3.4)
+const (
+	TopicNormal     byte = 0x00 // Registered topic ID, or a topic name in SUBSCRIBE
+	TopicPredefined byte = 0x01
+	TopicShort      byte = 0x02
+)
+
+// Flags (sec. 5.3.4)
+const (
+	flagDup          byte = 0x80
+	flagQOS          byte = 0x60
+	flagRetain       byte = 0x10
+	flagWill         byte = 0x08
+	flagCleanSession byte = 0x04
+	flagTopicIDType  byte = 0x03
+)
+
+const protocolID = 0x01
+
+var ErrMalformed = errors.New("Malformed MQTT-SN packet")
+
+// Packet holds any MQTT-SN message. Only the fields used by the message
+// Type are encoded
+type Packet struct {
+	Type       byte
+	Flags      byte
+	GatewayID  byte
+	Radius     byte
+	Duration   uint16
+	ClientID   string
+	TopicID    uint16
+	MsgID      uint16
+	ReturnCode byte
+	TopicName  string
+	Data       []byte
+}
+
+func (p *Packet) Dup() bool          { return p.Flags&flagDup != 0 }
+func (p *Packet) Retain() bool       { return p.Flags&flagRetain != 0 }
+func (p *Packet) Will() bool         { return p.Flags&flagWill != 0 }
+func (p *Packet) CleanSession() bool { return p.Flags&flagCleanSession != 0 }
+func (p *Packet) TopicIDType() byte  { return p.Flags & flagTopicIDType }
+
+// QOS returns 0, 1, 2 or -1 for publishing without a connection
+func (p *Packet) QOS() int {
+	q := int(p.Flags&flagQOS) >> 5
+	if q == 3 {
+		return -1
+	}
+	return q
+}
+
+// SetQOS sets the QoS flag to 0, 1, 2 or -1
+func (p *Packet) SetQOS(qos int) {
+	q := byte(qos)
+	if qos < 0 {
+		q = 3
+	}
+	p.Flags = p.Flags&^flagQOS | q<<5&flagQOS
+}
+
+// SetTopicIDType sets the topic ID type flag
+func (p *Packet) SetTopicIDType(t byte) {
+	p.Flags = p.Flags&^flagTopicIDType | t&flagTopicIDType
+}
+
+// hasTopicName reports whether a SUBSCRIBE or UNSUBSCRIBE carries a topic
+// name, rather than a two byte topic ID
+func (p *Packet) hasTopicName() bool {
+	return p.TopicIDType() == TopicNormal
+}
+
+// Encode returns the packet as a datagram
+func (p *Packet) Encode() []byte {
+	var b []byte
+	switch p.Type {
+	case ADVERTISE:
+		b = append(b, p.GatewayID)
+		b = u16(b, p.Duration)
+	case SEARCHGW:
+		b = append(b, p.Radius)
+	case GWINFO:
+		b = append(b, p.GatewayID)
+	case CONNECT:
+		b = append(b, p.Flags, protocolID)
+		b = u16(b, p.Duration)
+		b = append(b, p.ClientID...)
+	case CONNACK, WILLTOPICRESP, WILLMSGRESP:
+		b = append(b, p.ReturnCode)
+	case WILLTOPIC, WILLTOPICUPD:
+		if p.TopicName != "" {
+			b = append(b, p.Flags)
+			b = append(b, p.TopicName...)
+		}
+	case WILLMSG, WILLMSGUPD:
+		b = append(b, p.Data...)
+	case REGISTER:
+		b = u16(b, p.TopicID)
+		b = u16(b, p.MsgID)
+		b = append(b, p.TopicName...)
+	case REGACK, PUBACK:
+		b = u16(b, p.TopicID)
+		b = u16(b, p.MsgID)
+		b = append(b, p.ReturnCode)
+	case PUBLISH:
+		b = append(b, p.Flags)
+		b = u16(b, p.TopicID)
+		b = u16(b, p.MsgID)
+		b = append(b, p.Data...)
+	case PUBCOMP, PUBREC, PUBREL, UNSUBACK:
+		b = u16(b, p.MsgID)
+	case SUBSCRIBE, UNSUBSCRIBE:
+		b = append(b, p.Flags)
+		b = u16(b, p.MsgID)
+		if p.hasTopicName() {
+			b = append(b, p.TopicName...)
+		} else {
+			b = u16(b, p.TopicID)
+		}
+	case SUBACK:
+		b = append(b, p.Flags)
+		b = u16(b, p.TopicID)
+		b = u16(b, p.MsgID)
+		b = append(b, p.ReturnCode)
+	case PINGREQ:
+		b = append(b, p.ClientID...)
+	case DISCONNECT:
+		if p.Duration > 0 {
+			b = u16(b, p.Duration)
+		}
+	}
+
+	// Length includes itself and the message type. Three byte length for
+	// messages of 256 bytes or more (sec. 5.2.1)
+	if len(b)+2 < 256 {
+		return append([]byte{byte(len(b) + 2), p.Type}, b...)
+	}
+	header := u16([]byte{0x01}, uint16(len(b)+4))
+	return append(append(header, p.Type), b...)
+}
+
+// Decode reads a packet from a datagram
+func Decode(datagram []byte) (p *Packet, err error) {
+	var length int
+	var b []byte
+	switch {
+	case len(datagram) >= 2 && datagram[0] != 0x01:
+		length = int(datagram[0])
+		b = datagram[1:]
+	case len(datagram) >= 4 && datagram[0] == 0x01:
+		length = int(binary.BigEndian.Uint16(datagram[1:3]))
+		b = datagram[3:]
+	default:
+		return nil, ErrMalformed
+	}
+	if length != len(datagram) {
+		return nil, ErrMalformed
+	}
+
+	p = &Packet{Type: b[0]}
+	r := &reader{b: b[1:]}
+	switch p.Type {
+	case ADVERTISE:
+		p.GatewayID = r.byte()
+		p.Duration = r.u16()
+	case SEARCHGW:
+		p.Radius = r.byte()
+	case GWINFO:
+		p.GatewayID = r.byte()
+		r.rest() // Gateway address, only sent by clients
+	case CONNECT:
+		p.Flags = r.byte()
+		if r.byte() != protocolID {
+			r.err = ErrMalformed
+		}
+		p.Duration = r.u16()
+		p.ClientID = string(r.rest())
+	case CONNACK, WILLTOPICRESP, WILLMSGRESP:
+		p.ReturnCode = r.byte()
+	case WILLTOPICREQ, WILLMSGREQ, PINGRESP:
+	case WILLTOPIC, WILLTOPICUPD:
+		if len(r.b) > 0 {
+			p.Flags = r.byte()
+			p.TopicName = string(r.rest())
+		}
+	case WILLMSG, WILLMSGUPD:
+		p.Data = r.rest()
+	case REGISTER:
+		p.TopicID = r.u16()
+		p.MsgID = r.u16()
+		p.TopicName = string(r.rest())
+	case REGACK, PUBACK:
+		p.TopicID = r.u16()
+		p.MsgID = r.u16()
+		p.ReturnCode = r.byte()
+	case PUBLISH:
+		p.Flags = r.byte()
+		p.TopicID = r.u16()
+		p.MsgID = r.u16()
+		p.Data = r.rest()
+	case PUBCOMP, PUBREC, PUBREL, UNSUBACK:
+		p.MsgID = r.u16()
+	case SUBSCRIBE, UNSUBSCRIBE:
+		p.Flags = r.byte()
+		p.MsgID = r.u16()
+		if p.hasTopicName() {
+			p.TopicName = string(r.rest())
+		} else {
+			p.TopicID = r.u16()
+		}
+	case SUBACK:
+		p.Flags = r.byte()
+		p.TopicID = r.u16()
+		p.MsgID = r.u16()
+		p.ReturnCode = r.byte()
+	case PINGREQ:
+		p.ClientID = string(r.rest())
+	case DISCONNECT:
+		if len(r.b) > 0 {
+			p.Duration = r.u16()
+		}
+	default:
+		return nil, errors.New("Unsupported MQTT-SN message type")
+	}
+	if r.err != nil {
+		return nil, r.err
+	}
+	return p, nil
+}
+
+func u16(b []byte, v uint16) []byte {
+	return append(b, byte(v>>8), byte(v))
+}
+
+type reader struct {
+	b   []byte
+	err error
+}
+
+func (r *reader) byte() byte {
+	if len(r.b) < 1 {
+		r.err = ErrMalformed
+		return 0
+	}
+	v := r.b[0]
+	r.b = r.b[1:]
+	return v
+}
+
+func (r *reader) u16() uint16 {
+	if len(r.b) < 2 {
+		r.err = ErrMalformed
+		return 0
+	}
+	v := binary.BigEndian.Uint16(r.b)
+	r.b = r.b[2:]
+	return v
+}
+
+func (r *reader) rest() []byte {
+	v := append([]byte{}, r.b...)
+	r.b = nil
+	return v
+}
@@ -0,0 +1,88 @@
+package mqttsn
+
+import (
+	"bytes"
+	"reflect"
+	"testing"
+)
+
+func TestPacketRoundTrip(t *testing.T) {
+	packets := []*Packet{
+		{Type: SEARCHGW, Radius: 1},
+		{Type: GWINFO, GatewayID: 7},
+		{Type: CONNECT, Flags: flagCleanSession | flagWill, Duration: 60, ClientID: "user:pass"},
+		{Type: CONNACK, ReturnCode: RejectedCongestion},
+		{Type: WILLTOPIC, Flags: flagRetain, TopicName: "will/topic"},
+		{Type: WILLMSG, Data: []byte("gone")},
+		{Type: REGISTER, TopicID: 1, MsgID: 2, TopicName: "a/b"},
+		{Type: REGACK, TopicID: 1, MsgID: 2, ReturnCode: Accepted},
+		{Type: PUBLISH, Flags: flagDup | TopicPredefined, TopicID: 3, MsgID: 4, Data: []byte("payload")},
+		{Type: PUBREL, MsgID: 5},
+		{Type: SUBSCRIBE, MsgID: 6, TopicName: "a/+"},
+		{Type: SUBSCRIBE, Flags: TopicShort, MsgID: 6, TopicID: shortTopicID("ab")},
+		{Type: SUBACK, TopicID: 1, MsgID: 6, ReturnCode: Accepted},
+		{Type: PINGREQ, ClientID: "user:pass"},
+		{Type: DISCONNECT, Duration: 300},
+		{Type: DISCONNECT},
+	}
+	for _, p := range packets {
+		got, err := Decode(p.Encode())
+		if err != nil {
+			t.Errorf("Could not decode type %#x: %s", p.Type, err)
+			continue
+		}
+		if len(p.Data) == 0 {
+			got.Data = nil
+		}
+		if !reflect.DeepEqual(got, p) {
+			t.Errorf("Type %#x decoded as %+v, expected %+v", p.Type, got, p)
+		}
+	}
+}
+
+func TestLongPacket(t *testing.T) {
+	p := &Packet{Type: PUBLISH, TopicID: 1, Data: bytes.Repeat([]byte("x"), 300)}
+	b := p.Encode()
+	if b[0] != 0x01 || int(b[1])<<8|int(b[2]) != len(b) {
+		t.Errorf("Expected three byte length header, got % x", b[:3])
+	}
+	got, err := Decode(b)
+	if err != nil || !bytes.Equal(got.Data, p.Data) {
+		t.Errorf("Could not decode long packet: %v", err)
+	}
+}
+
+func TestDecodeMalformed(t *testing.T) {
+	for _, b := range [][]byte{
+		{},
+		{0x05, PUBLISH},
+		{0x04, REGACK, 0x00, 0x01},
+		{0x03, CONNECT, 0x00},
+	} {
+		if _, err := Decode(b); err == nil {
+			t.Errorf("Expected % x to be malformed", b)
+		}
+	}
+}
+
+func TestQOS(t *testing.T) {
+	p := &Packet{Flags: flagRetain}
+	for _, q := range []int{-1, 0, 1, 2} {
+		p.SetQOS(q)
+		if p.QOS() != q || !p.Retain() {
+			t.Errorf("Set QoS %d, got %d", q, p.QOS())
+		}
+	}
+}
+
+func TestParsePredefinedTopics(t *testing.T) {
+	topics, err := ParsePredefinedTopics("1=a/b,20=c")
+	if err != nil || topics[1] != "a/b" || topics[20] != "c" {
+		t.Errorf("Unexpected topics %v, %v", topics, err)
+	}
+	for _, s := range []string{"a/b", "0=a", "x=a", "1="} {
+		if _, err := ParsePredefinedTopics(s); err == nil {
+			t.Errorf("Expected error for %q", s)
+		}
+	}
+}
@@ -0,0 +1,67 @@
+package serve
+
+import (
+	"encoding/json"
+	"github.com/gomqtt/packet"
+	"github.com/trafero/tstack/audit"
+	"sync/atomic"
+)
+
+// AuditTopic is the topic that audit events are published to by SysAudit.
+// Subscribers need rights that explicitly cover it (e.g. "$SYS/#"), as "#"
+// does not match topics starting with $ [MQTT-4.7.2-1]
+const AuditTopic = "$SYS/audit"
+
+// Audit events waiting to be published. Events beyond this are dropped
+const auditQueue = 1000
+
+// SysAudit publishes audit events as JSON messages on AuditTopic. Events are
+// queued, so auditing never holds up the client the decision was made for,
+// and dropped if the queue is full.
+type SysAudit struct {
+	// Updated atomically, so kept first for 64 bit alignment on 32 bit platforms
+	dropped uint64
+
+	broker *Broker
+	queue  chan *packet.Message
+}
+
+func NewSysAudit(b *Broker) *SysAudit {
+	s := &SysAudit{
+		broker: b,
+		queue:  make(chan *packet.Message, auditQueue),
+	}
+	go s.publishRound()
+	return s
+}
+
+func (s *SysAudit) Audit(e audit.Event) {
+	payload, err := json.Marshal(e)
+	if err != nil {
+		logger.Error("Could not encode audit event", "error", err)
+		return
+	}
+	select {
+	case s.queue <- &packet.Message{
+		Topic:   AuditTopic,
+		Payload: payload,
+		QOS:     packet.QOSAtMostOnce,
+	}:
+	default:
+		// Log the first of each thousand, rather than adding to a flood
+		if n := atomic.AddUint64(&s.dropped, 1); n%auditQueue == 1 {
+			logger.Warn("Audit queue full, dropping events", "dropped", n)
+		}
+	}
+}
+
+// Dropped returns the number of events dropped because the queue was full
+func (s *SysAudit) Dropped() uint64 {
+	return atomic.LoadUint64(&s.dropped)
+}
+
+func (s *SysAudit) publishRound() {
+	for msg := range s.queue {
+		s.broker.deliverChan <- msg
+	}
+}
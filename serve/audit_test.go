@@ -0,0 +1,30 @@
+package serve
+
+import (
+	"github.com/gomqtt/packet"
+	"github.com/trafero/tstack/audit"
+	"testing"
+	"time"
+)
+
+func TestSysAuditNeverBlocks(t *testing.T) {
+	// Nothing reads from the broker's delivery channel
+	b := &Broker{deliverChan: make(chan *packet.Message)}
+	s := NewSysAudit(b)
+
+	done := make(chan struct{})
+	go func() {
+		for i := 0; i < 2*auditQueue; i++ {
+			s.Audit(audit.Event{Username: "username", Action: audit.Publish, Decision: audit.Deny})
+		}
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Audit blocked")
+	}
+	if s.Dropped() == 0 {
+		t.Error("Expected events to be dropped")
+	}
+}
@@ -2,26 +2,77 @@ package serve
 
 import (
 	"github.com/gomqtt/packet"
+	"github.com/trafero/tstack/audit"
+	"github.com/trafero/tstack/logging"
 	"sync"
+	"time"
 )
 
+var logger = logging.New("broker")
+
 type Broker struct {
+	// Updated atomically, so kept first for 64 bit alignment on 32 bit platforms
+	expiredRetained uint64
+	expiredInFlight uint64
+
 	sync.RWMutex
-	clients     map[string]*client         // Map by clientid
-	retained    map[string]*packet.Message // Map by topic
-	deliverChan chan *packet.Message       // Place to send message for delierfy
+	clients     map[string]*client   // Map by clientid
+	retained    map[string]*expiring // Map by topic
+	deliverChan chan *packet.Message // Place to send message for delierfy
+	audit       audit.Sink           // Audit trail of access decisions. May be nil
+	delayed     *delayed             // Messages published with a delay
+	expiry      []ExpiryRule         // Time to live for messages, by topic
+	rewrites    []*RewriteRule       // Topic rewrite rules, in order
+	// Disconnect clients whose user is removed or password changed
+	disconnectChanged bool
+	lockout           *lockout // Limits password guessing. May be nil
 }
 
 func NewBroker() *Broker {
 	b := &Broker{
 		clients:     make(map[string]*client),
-		retained:    make(map[string]*packet.Message),
+		retained:    make(map[string]*expiring),
 		deliverChan: make(chan *packet.Message, 10),
 	}
+	b.delayed = newDelayed(b)
 	go b.deliveryRound()
+	go b.expireRound()
 	return b
 }
 
+// SetAudit sets the sink for authentication and authorization decisions
+func (b *Broker) SetAudit(s audit.Sink) {
+	b.audit = s
+}
+
+/*
+ * SetDisconnectChanged sets whether clients are disconnected when their user
+ * is removed or disabled, or their password changed, as told by UserChanged.
+ * Otherwise they only lose the rights they no longer have
+ */
+func (b *Broker) SetDisconnectChanged(disconnect bool) {
+	b.disconnectChanged = disconnect
+}
+
+/*
+ * UserChanged applies a change to a user, such as new rights, to their
+ * connected clients, or to all clients if username is "". It is given to
+ * auth.Notifier.WatchUsers
+ */
+func (b *Broker) UserChanged(username string) {
+	var changed []*client
+	b.RLock()
+	for _, c := range b.clients {
+		if username == "" || c.username == username {
+			changed = append(changed, c)
+		}
+	}
+	b.RUnlock()
+	for _, c := range changed {
+		c.userChanged(b.disconnectChanged)
+	}
+}
+
 func (b *Broker) AddClient(c *client) {
 
 	b.RLock()
@@ -30,9 +81,14 @@ func (b *Broker) AddClient(c *client) {
 		// clientid already exists
 		c.inboundInTransit = existingClient.inboundInTransit
 		c.outboundInTransit = existingClient.outboundInTransit
+		c.transitMutex = existingClient.transitMutex
 		c.subscriptions = existingClient.subscriptions
+		c.rewrites = existingClient.rewrites
+		c.log.Debug("Resuming existing session", "subscriptions", len(c.subscriptions))
 	}
 	b.RUnlock()
+	// Rights may have changed since the session's subscriptions were made
+	c.revoke()
 	b.Lock()
 	b.clients[c.clientid] = c
 	b.Unlock()
@@ -44,16 +100,32 @@ func (b *Broker) RemoveClient(c *client) {
 	b.Unlock()
 }
 
+/*
+ * publish accepts a message from a client, holding it back if it was
+ * published to a $delayed or $scheduled topic
+ */
+func (b *Broker) publish(msg *packet.Message) {
+	if due, topic, ok := parseDelayed(msg.Topic, time.Now()); ok {
+		if !b.delayed.schedule(msg, due, topic) {
+			logger.Warn("Too many delayed messages, dropping message", "topic", msg.Topic)
+		}
+		return
+	}
+	b.deliverChan <- msg
+}
+
 func (b *Broker) deliveryRound() {
 	for {
 		msg := <-b.deliverChan
+		// Expiry is set on receipt, by the broker's own topic
+		expires := b.expires(msg.Topic, time.Now())
 		if msg.Retain {
 			b.Lock()
 			if len(msg.Payload) == 0 {
 				// MQTT-3.3.1-10
 				delete(b.retained, msg.Topic)
 			} else {
-				b.retained[msg.Topic] = msg
+				b.retained[msg.Topic] = &expiring{Message: *msg, expires: expires}
 			}
 			b.Unlock()
 		}
@@ -62,7 +134,7 @@ func (b *Broker) deliveryRound() {
 
 		b.RLock()
 		for _, c := range b.clients {
-			go checkDeliverToClient(c, allMatchers, msg)
+			go checkDeliverToClient(c, allMatchers, msg, expires)
 		}
 		b.RUnlock()
 	}
@@ -72,14 +144,15 @@ func (b *Broker) deliveryRound() {
  * Deliver given message to the given client if one of the topic matchers
  * matches one of the clients subscriptions
  */
-func checkDeliverToClient(c *client, allMatchers []string, msg *packet.Message) {
+func checkDeliverToClient(c *client, allMatchers []string, msg *packet.Message, expires time.Time) {
 	for _, matcher := range allMatchers {
 		c.mutex.Lock()
 		if sub, ok := c.subscriptions[matcher]; ok {
 			// Re-package the message with the correct QOS (matching the subscription) and retain
 			// Retain to false for all normal subscriptions (MQTT-3.3.1-9)
 			m := repackage(msg, sub.QOS, false)
-			c.deliveryChannel <- m
+			m.Topic = c.clientTopic(matcher, m.Topic)
+			c.deliveryChannel <- &expiring{Message: *m, expires: expires}
 		}
 		c.mutex.Unlock()
 	}
@@ -4,6 +4,7 @@ import (
 	"github.com/gomqtt/packet"
 	"math"
 	"strings"
+	"time"
 )
 
 func matches(matcher string, topic string) bool {
@@ -34,7 +35,7 @@ func allTopics(topic string) []string {
 	// answers at the end
 	if strings.HasPrefix(topics[0], "$") {
 		systemTopic = topics[0]
-		topics = topics[1 : len(topics)-1]
+		topics = topics[1:]
 	}
 
 	numTopics := len(topics)
@@ -90,6 +91,16 @@ func addIntopicWilds(topics []string) (ret [][]string) {
 	return ret
 }
 
+/*
+ * accessTopic returns the topic that rights are checked against when
+ * publishing to the given topic. This is the target topic for delayed
+ * messages
+ */
+func accessTopic(topic string) string {
+	_, target, _ := parseDelayed(topic, time.Time{})
+	return target
+}
+
 /*
  * re-packages a message with the given QOS and retail flag.
  */
@@ -71,6 +71,12 @@ func TestMatcher(t *testing.T) {
 	if !matches("one/+/three", "one/$two/three") {
 		t.Error("Wildcard should match on $ if not at the start")
 	}
+	if !matches("$SYS/audit", "$SYS/audit") {
+		t.Error("Expected matching $ topic and rights to validate")
+	}
+	if !matches("$SYS/#", "$SYS/audit") {
+		t.Error("Expected $ topic to match with wildcard after the first level")
+	}
 
 }
 
@@ -2,11 +2,14 @@ package serve
 
 import (
 	"github.com/gomqtt/packet"
+	"github.com/trafero/tstack/audit"
 	"github.com/trafero/tstack/auth"
+	"github.com/trafero/tstack/logging"
 	"io"
-	"log"
 	"net"
+	"strconv"
 	"sync"
+	"sync/atomic"
 	"time"
 	"unsafe"
 )
@@ -19,19 +22,25 @@ type client struct {
 	processedConnect bool
 	clientid         string
 	username         string
-	rights           string
+	password         string      // Password hash on connecting, if the broker disconnects on changes
+	rights           string      // Guarded by mutex once connected, as it changes with the user
+	expires          time.Time   // When the credentials, and the rights they carry, expire. Zero if they don't
+	expiry           *time.Timer // Disconnects the client when its credentials expire, if they do
 	will             *packet.Message
 	keepalive        uint16
 	encoder          *packet.Encoder
 	// decoder               *packet.Decoder
 	subscriptions         map[string]packet.Subscription // Mapped by topic
+	rewrites              map[string]*RewriteRule        // Rules that rewrote subscriptions, mapped by rewritten topic
 	mutex                 *sync.Mutex
 	connectionMutex       *sync.Mutex
 	packetIDCounter       uint16
 	inboundInTransit      map[uint16]packet.Message // QOS 2 messages to be received (and passeed to broker)
-	outboundInTransit     map[uint16]packet.Message // QOS 2 messages to be sent
+	outboundInTransit     map[uint16]expiring       // QOS 1 and 2 messages sent, or queued while offline, and not yet acknowledged
+	transitMutex          *sync.Mutex               // Guards outboundInTransit
 	internalClientCounter int                       // For internal client ids (MQTT-3.1.3-6)
-	deliveryChannel       chan *packet.Message
+	deliveryChannel       chan *expiring
+	log                   *logging.Logger // Carries remote address, and clientid and username once known
 }
 
 func NewClient(a auth.Auth, b *Broker, c net.Conn) *client {
@@ -43,11 +52,14 @@ func NewClient(a auth.Auth, b *Broker, c net.Conn) *client {
 		mutex:             &sync.Mutex{},
 		connectionMutex:   &sync.Mutex{},
 		inboundInTransit:  make(map[uint16]packet.Message),
-		outboundInTransit: make(map[uint16]packet.Message),
+		outboundInTransit: make(map[uint16]expiring),
+		transitMutex:      &sync.Mutex{},
 		subscriptions:     make(map[string]packet.Subscription),
+		rewrites:          make(map[string]*RewriteRule),
 		packetIDCounter:   0,
 		keepalive:         0, // in seconds
-		deliveryChannel:   make(chan *packet.Message),
+		deliveryChannel:   make(chan *expiring),
+		log:               logger.With("remote", c.RemoteAddr()),
 	}
 }
 
@@ -56,6 +68,11 @@ func (c *client) HandleConnection() {
 	var pkt packet.Packet
 
 	defer c.conn.Close()
+	defer func() {
+		if c.expiry != nil {
+			c.expiry.Stop()
+		}
+	}()
 
 	go c.delivery()
 
@@ -65,7 +82,9 @@ func (c *client) HandleConnection() {
 		pkt, err = decoder.Read()
 		if err != nil {
 			if err == io.EOF {
-				log.Println("Connection disconnected")
+				c.log.Info("Connection disconnected")
+			} else {
+				c.log.Debug("Connection read error", "error", err)
 			}
 			c.conn.Close()
 			break
@@ -76,7 +95,7 @@ func (c *client) HandleConnection() {
 
 		switch pkt := pkt.(type) {
 		default:
-			log.Println("Unknown MQTT packet received")
+			c.log.Warn("Unknown MQTT packet received")
 			c.conn.Close()
 		case *packet.ConnectPacket:
 			c.processConnect(pkt)
@@ -102,8 +121,11 @@ func (c *client) HandleConnection() {
 	}
 	// Send out with last will. Last will set to nill if never set or
 	// client send disconnect
-	if c.will != nil {
-		c.broker.deliverChan <- c.will
+	c.mutex.Lock()
+	will := c.will
+	c.mutex.Unlock()
+	if will != nil {
+		c.broker.publish(will)
 	}
 
 	// Remove the client from the list
@@ -117,28 +139,41 @@ func (c *client) HandleConnection() {
  */
 func (c *client) processConnect(pkt *packet.ConnectPacket) {
 	if c.processedConnect {
-		log.Println("Connect packet received for a second time on same connection")
+		c.log.Warn("Connect packet received for a second time on same connection")
+		c.recordConnect(pkt, audit.Deny, "second connect")
 		// No acknowledgement, just disconnect
 		c.conn.Close()
+		return
 	}
 	c.processedConnect = true
 	if pkt.Version != 4 {
 		c.writeConnack(packet.ErrInvalidProtocolVersion)
-		log.Println("Unsupported MQTT version")
+		c.log.Warn("Unsupported MQTT version", "version", pkt.Version)
+		c.recordConnect(pkt, audit.Deny, "unsupported protocol version")
 		c.conn.Close()
 		return
 	}
 
-	if c.auth.Authenticate(pkt.Username, pkt.Password) == false {
+	if !c.checkLockout(pkt) {
+		return
+	}
+	session, ok := authenticate(c.auth, pkt.Username, pkt.Password)
+	if !ok {
+		// Counted before refusing, so that the next attempt sees it
+		c.broker.failedLockout(pkt.Username, c.conn.RemoteAddr())
 		c.writeConnack(packet.ErrNotAuthorized)
-		log.Printf("User %s could not be authenticated", pkt.Username)
+		c.log.Warn("User could not be authenticated", "username", pkt.Username)
+		c.recordConnect(pkt, audit.Deny, "not authenticated")
 		c.conn.Close()
 		return
 	}
+	c.broker.succeededLockout(pkt.Username)
 
 	// MQTT-3.1.3-8
 	if pkt.ClientID == "" && pkt.CleanSession == false {
 		c.writeConnack(packet.ErrIdentifierRejected)
+		c.log.Warn("Empty client ID without clean session", "username", pkt.Username)
+		c.recordConnect(pkt, audit.Deny, "identifier rejected")
 		c.conn.Close()
 		return
 	}
@@ -152,11 +187,21 @@ func (c *client) processConnect(pkt *packet.ConnectPacket) {
 	c.clientid = pkt.ClientID
 
 	c.cleanSession = pkt.CleanSession
-	c.username = pkt.Username
-	c.rights = c.auth.Rights(c.username)
+	c.username = session.Username
+	c.rights = session.Rights
+	c.expires = session.Expires
+	if c.broker.disconnectChanged && c.expires.IsZero() {
+		u, _ := c.auth.User(c.username)
+		c.password = u.Password
+	}
+	c.log = c.log.With("clientid", c.clientid, "username", c.username)
 
-	if pkt.Will != nil && !matches(c.rights, pkt.Will.Topic) {
-		log.Println("Client not authorized to write this will")
+	if pkt.Will != nil {
+		pkt.Will.Topic = c.rewrite(pkt.Will.Topic)
+	}
+	if pkt.Will != nil && !matches(c.rights, accessTopic(pkt.Will.Topic)) {
+		c.log.Warn("Client not authorized to write this will", "topic", pkt.Will.Topic)
+		c.record(audit.Will, pkt.Will.Topic, audit.Deny, "not authorized")
 	} else {
 		c.will = pkt.Will // May be nil but that is ok
 	}
@@ -164,6 +209,63 @@ func (c *client) processConnect(pkt *packet.ConnectPacket) {
 	c.setReadDeadline()
 	c.broker.AddClient(c)
 	c.writeConnack(packet.ConnectionAccepted)
+	c.log.Info("Client connected", "cleansession", c.cleanSession, "keepalive", c.keepalive)
+	c.record(audit.Connect, "", audit.Allow, "")
+	if !c.expires.IsZero() {
+		c.expiry = time.AfterFunc(time.Until(c.expires), c.expired)
+	}
+}
+
+/*
+ * checkLockout refuses the CONNECT if its username or address is locked out,
+ * or failed too recently, without checking the password, returning false
+ */
+func (c *client) checkLockout(pkt *packet.ConnectPacket) bool {
+	locked, wait := c.broker.checkLockout(pkt.Username, c.conn.RemoteAddr())
+	switch {
+	case locked:
+		c.writeConnack(packet.ErrNotAuthorized)
+		c.log.Warn("User or address locked out", "username", pkt.Username)
+		c.recordConnect(pkt, audit.Deny, "locked out")
+		c.conn.Close()
+		return false
+	case wait > 0:
+		c.writeConnack(packet.ErrNotAuthorized)
+		c.log.Warn("Too soon after failed attempts", "username", pkt.Username, "wait", wait)
+		c.recordConnect(pkt, audit.Deny, "too soon after failure")
+		// Refused at once, so that gateways waiting on the CONNACK aren't
+		// held up, but kept open until the wait is over, so that clients
+		// that reconnect when closed are slowed down
+		time.AfterFunc(wait, func() { c.conn.Close() })
+		return false
+	}
+	return true
+}
+
+/*
+ * authenticate checks a client's credentials, returning the session they
+ * give. Back ends that are SessionAuthenticators may take the username from
+ * the credentials, and give when they expire
+ */
+func authenticate(a auth.Auth, username string, password string) (s auth.Session, ok bool) {
+	if sa, isSession := a.(auth.SessionAuthenticator); isSession {
+		s, ok = sa.AuthenticateSession(username, password)
+		if ok && s.Username == "" {
+			s.Username = username
+		}
+		return s, ok
+	}
+	if !a.Authenticate(username, password) {
+		return s, false
+	}
+	return auth.Session{Username: username, Rights: a.Rights(username)}, true
+}
+
+// expired disconnects the client once its credentials have expired
+func (c *client) expired() {
+	c.log.Warn("Credentials expired, disconnecting")
+	c.record(audit.Connect, "", audit.Deny, "credentials expired")
+	c.conn.Close()
 }
 
 /*
@@ -176,8 +278,25 @@ func (c *client) writeConnack(code packet.ConnackCode) {
 	c.sendPacket(connack)
 
 	// Now we are connected, check if there's any unfinished business
-	// Unfinished packets
+	// Unfinished packets, dropping any that have expired
+	now := time.Now()
+	resend := make(map[uint16]packet.Message)
+	var expired uint64
+	c.transitMutex.Lock()
 	for packetID, msg := range c.outboundInTransit {
+		if msg.expired(now) {
+			delete(c.outboundInTransit, packetID)
+			expired++
+			continue
+		}
+		resend[packetID] = msg.Message
+	}
+	c.transitMutex.Unlock()
+	if expired > 0 {
+		total := atomic.AddUint64(&c.broker.expiredInFlight, expired)
+		c.log.Info("Dropped expired in-flight messages", "count", expired, "total", total)
+	}
+	for packetID, msg := range resend {
 		c.resend(packetID, &msg)
 	}
 }
@@ -186,9 +305,11 @@ func (c *client) writeConnack(code packet.ConnackCode) {
  * PUBLISH – Publish message (3.3)
  */
 func (c *client) processPublish(pkt *packet.PublishPacket) {
-	if !matches(c.rights, pkt.Message.Topic) {
+	pkt.Message.Topic = c.rewrite(pkt.Message.Topic)
+	if !c.allowed(accessTopic(pkt.Message.Topic)) {
 		// TODO send code back?
-		log.Printf("Not authorized to publish to topic %s", pkt.Message.Topic)
+		c.log.Warn("Not authorized to publish to topic", "topic", pkt.Message.Topic)
+		c.record(audit.Publish, pkt.Message.Topic, audit.Deny, "not authorized")
 		// Give them a hint
 		c.conn.Close()
 	} else {
@@ -198,12 +319,12 @@ func (c *client) processPublish(pkt *packet.PublishPacket) {
 
 		case packet.QOSAtMostOnce:
 			// QOS 0
-			// log.Printf("Delivering topic %s", pkt.Message.Topic)
-			c.broker.deliverChan <- &pkt.Message
+			c.log.Debug("Delivering message", "topic", pkt.Message.Topic)
+			c.broker.publish(&pkt.Message)
 
 		case packet.QOSAtLeastOnce:
 			// QOS 1
-			c.broker.deliverChan <- &pkt.Message
+			c.broker.publish(&pkt.Message)
 			p := packet.NewPubackPacket()
 			p.PacketID = pkt.PacketID
 			c.sendPacket(p)
@@ -220,7 +341,7 @@ func (c *client) processPublish(pkt *packet.PublishPacket) {
 
 		default:
 			// Unknown QOS
-			log.Printf("Unknown QOS level")
+			c.log.Warn("Unknown QOS level", "qos", pkt.Message.QOS)
 			c.conn.Close()
 		}
 	}
@@ -230,7 +351,9 @@ func (c *client) processPublish(pkt *packet.PublishPacket) {
  *  PUBACK – Publish acknowledgement (3.4)
  */
 func (c *client) processPuback(pkt *packet.PubackPacket) {
+	c.transitMutex.Lock()
 	delete(c.outboundInTransit, pkt.PacketID)
+	c.transitMutex.Unlock()
 }
 
 /*
@@ -238,8 +361,11 @@ func (c *client) processPuback(pkt *packet.PubackPacket) {
  */
 func (c *client) processPubrec(pkt *packet.PubrecPacket) {
 	// Only send resonse if we have the message
-	if _, ok := c.outboundInTransit[pkt.PacketID]; !ok {
-		log.Println("Pubrec for a message that I do not have")
+	c.transitMutex.Lock()
+	_, ok := c.outboundInTransit[pkt.PacketID]
+	c.transitMutex.Unlock()
+	if !ok {
+		c.log.Warn("Pubrec for a message that I do not have", "packetid", pkt.PacketID)
 		c.conn.Close()
 		return
 	}
@@ -256,7 +382,7 @@ func (c *client) processPubrel(pkt *packet.PubrelPacket) {
 
 	if unsafe.Sizeof(msg) != 0 {
 		// msg is not an empty stuct
-		c.broker.deliverChan <- &msg
+		c.broker.publish(&msg)
 		delete(c.inboundInTransit, pkt.PacketID)
 		p := packet.NewPubcompPacket()
 		p.PacketID = pkt.PacketID
@@ -268,7 +394,9 @@ func (c *client) processPubrel(pkt *packet.PubrelPacket) {
  * PUBCOMP – Publish complete (QoS 2 publish received, part 3) (3.7)
  */
 func (c *client) processComp(pkt *packet.PubcompPacket) {
+	c.transitMutex.Lock()
 	delete(c.outboundInTransit, pkt.PacketID)
+	c.transitMutex.Unlock()
 }
 
 /*
@@ -279,13 +407,29 @@ func (c *client) processSubscribe(pkt *packet.SubscribePacket) {
 	suback.PacketID = pkt.PacketID
 
 	for _, s := range pkt.Subscriptions {
-		if !matches(c.rights, s.Topic) {
-			log.Printf("Not authorized to subscribe to topic %s", s.Topic)
+		var rule *RewriteRule
+		if topic, r := c.broker.rewrite(s.Topic); r != nil {
+			c.log.Debug("Rewrote subscription", "from", s.Topic, "to", topic)
+			s.Topic, rule = topic, r
+		}
+		// Checked and added together, so that rights changing in between
+		// can't leave an unauthorized subscription
+		c.mutex.Lock()
+		allowed := matches(c.rights, s.Topic)
+		if allowed {
+			c.subscriptions[s.Topic] = s
+			if rule != nil {
+				c.rewrites[s.Topic] = rule
+			} else {
+				delete(c.rewrites, s.Topic)
+			}
+		}
+		c.mutex.Unlock()
+		if !allowed {
+			c.log.Warn("Not authorized to subscribe to topic", "topic", s.Topic)
+			c.record(audit.Subscribe, s.Topic, audit.Deny, "not authorized")
 			suback.ReturnCodes = append(suback.ReturnCodes, 0x80) // sec 3.9.3 of spec
 		} else {
-			c.mutex.Lock()
-			c.subscriptions[s.Topic] = s
-			c.mutex.Unlock()
 			suback.ReturnCodes = append(suback.ReturnCodes, s.QOS)
 			// Send any retained messages for this subscription
 			c.sendRetained(s.Topic, s.QOS)
@@ -300,7 +444,9 @@ func (c *client) processSubscribe(pkt *packet.SubscribePacket) {
 func (c *client) processUnsubscribe(pkt *packet.UnsubscribePacket) {
 	c.mutex.Lock()
 	for _, t := range pkt.Topics {
+		t, _ = c.broker.rewrite(t)
 		delete(c.subscriptions, t)
+		delete(c.rewrites, t)
 	}
 	c.mutex.Unlock()
 	p := packet.NewUnsubackPacket()
@@ -321,31 +467,127 @@ func (c *client) processPing(pkt *packet.PingreqPacket) {
  */
 func (c *client) processDisconnect(pkt *packet.DisconnectPacket) {
 	//discard Will
+	c.mutex.Lock()
 	c.will = nil
+	c.mutex.Unlock()
 	// Close connection if the client has not already done so
 	c.conn.Close()
 }
 
+// allowed reports whether the client's rights cover the given topic
+func (c *client) allowed(topic string) bool {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return matches(c.rights, topic)
+}
+
+/*
+ * userChanged reads the client's user again after a change to it, e.g. by
+ * tuser. Subscriptions and wills the new rights don't cover are dropped,
+ * and removed or disabled users have no rights. With disconnect set, the
+ * client is disconnected if the user was removed or disabled, or their
+ * password changed. If the user can't be read, nothing changes. Clients
+ * whose rights came with credentials that expire, such as tokens, keep them
+ * until then, as the back end may not know the user otherwise
+ */
+func (c *client) userChanged(disconnect bool) {
+	if !c.expires.IsZero() {
+		return
+	}
+	u, err := c.auth.User(c.username)
+	rights := ""
+	if err == auth.ErrUserNotFound || (err == nil && u.Disabled) {
+		if disconnect {
+			c.log.Warn("User removed or disabled, disconnecting")
+			c.record(audit.Connect, "", audit.Deny, "user removed or disabled")
+			c.conn.Close()
+			return
+		}
+	} else if err != nil {
+		c.log.Warn("Could not read changed user, keeping rights", "error", err)
+		return
+	} else {
+		if disconnect && c.password != "" && u.Password != c.password {
+			c.log.Warn("Password changed, disconnecting")
+			c.record(audit.Connect, "", audit.Deny, "password changed")
+			c.conn.Close()
+			return
+		}
+		rights = c.auth.Rights(c.username)
+	}
+	c.mutex.Lock()
+	changed := rights != c.rights
+	c.rights = rights
+	c.mutex.Unlock()
+	if changed {
+		c.log.Info("Rights changed", "rights", rights)
+		c.revoke()
+	}
+}
+
+/*
+ * revoke drops any subscriptions and will that the client's rights no
+ * longer cover
+ */
+func (c *client) revoke() {
+	var dropped []string
+	c.mutex.Lock()
+	for topic := range c.subscriptions {
+		if !matches(c.rights, topic) {
+			delete(c.subscriptions, topic)
+			delete(c.rewrites, topic)
+			dropped = append(dropped, topic)
+		}
+	}
+	will := c.will
+	if will != nil && !matches(c.rights, accessTopic(will.Topic)) {
+		c.will = nil
+	} else {
+		will = nil
+	}
+	c.mutex.Unlock()
+
+	for _, topic := range dropped {
+		c.log.Warn("Subscription no longer authorized, dropped", "topic", topic)
+		c.record(audit.Subscribe, topic, audit.Deny, "rights revoked")
+	}
+	if will != nil {
+		c.log.Warn("Will no longer authorized, dropped", "topic", will.Topic)
+		c.record(audit.Will, will.Topic, audit.Deny, "rights revoked")
+	}
+}
+
 /*
  *  Wait for new messages on the deliverChan and send them to the client
  */
 func (c *client) delivery() {
 	for {
 		msg := <-c.deliveryChannel
+		// The message may have expired while queued for the client
+		if msg.expired(time.Now()) {
+			total := atomic.AddUint64(&c.broker.expiredInFlight, 1)
+			c.log.Debug("Dropped expired message", "topic", msg.Topic, "total", total)
+			continue
+		}
 		p := packet.NewPublishPacket()
-		p.Message = *msg
+		p.Message = msg.Message
 		p.Dup = false
 		// Sec. 2.3.1
 		if msg.QOS > 0 {
 			p.PacketID = c.newPacketID()
-			c.outboundInTransit[p.PacketID] = p.Message
+			c.transitMutex.Lock()
+			c.outboundInTransit[p.PacketID] = expiring{
+				Message: p.Message,
+				expires: msg.expires,
+			}
+			c.transitMutex.Unlock()
 		}
 		c.sendPacket(p)
 	}
 }
 
 func (c *client) resend(packetID uint16, msg *packet.Message) {
-	log.Printf("Re-sending message %d", packetID)
+	c.log.Debug("Re-sending message", "packetid", packetID)
 	p := packet.NewPublishPacket()
 	p.Message = *msg
 	p.Dup = true
@@ -356,19 +598,53 @@ func (c *client) resend(packetID uint16, msg *packet.Message) {
 func (c *client) sendRetained(topic string, qos uint8) {
 
 	// Retained messages [MQTT-3.3.1-6]
+	now := time.Now()
+	var msgs []*expiring
+	c.broker.RLock()
 	for t, msg := range c.broker.retained {
-		if matches(topic, t) {
+		if matches(topic, t) && !msg.expired(now) {
 			// Retain flag set to 1 [MQTT-3.3.1-8]
-			m := repackage(msg, qos, true)
-			c.deliveryChannel <- m
+			msgs = append(msgs, &expiring{Message: *repackage(&msg.Message, qos, true), expires: msg.expires})
+		}
+	}
+	c.broker.RUnlock()
+	c.mutex.Lock()
+	for _, m := range msgs {
+		m.Topic = c.clientTopic(topic, m.Topic)
+	}
+	c.mutex.Unlock()
+	for _, m := range msgs {
+		c.deliveryChannel <- m
+	}
+}
+
+// rewrite applies the broker's rewrite rules to a published topic
+func (c *client) rewrite(topic string) string {
+	rewritten, r := c.broker.rewrite(topic)
+	if r != nil {
+		c.log.Debug("Rewrote topic", "from", topic, "to", rewritten)
+	}
+	return rewritten
+}
+
+/*
+ * clientTopic maps the topic of a message delivered for the given
+ * subscription back to the client's own topic naming, if the subscription
+ * was rewritten by a reversible rule. Must be called with the mutex held
+ */
+func (c *client) clientTopic(subscription string, topic string) string {
+	if r := c.rewrites[subscription]; r != nil && r.inverse != nil {
+		if original, ok := r.inverse.apply(topic); ok {
+			return original
 		}
 	}
+	return topic
 }
 
 func (c *client) setReadDeadline() {
 	if c.keepalive > 0 {
 		if err := c.conn.SetReadDeadline(time.Now().Add(time.Duration(c.keepalive) * time.Second)); err != nil {
-			log.Printf("Error setting read deadline on network connection", err)
+			c.log.Error("Error setting read deadline on network connection", "error", err)
 		}
 	}
 }
@@ -383,7 +659,7 @@ func (c *client) sendPacket(p packet.Packet) {
 
 func (c *client) newInternalClientID() string {
 	c.internalClientCounter++
-	return "internalClient" + string(c.internalClientCounter)
+	return "internalClient" + strconv.Itoa(c.internalClientCounter)
 
 }
 
@@ -391,3 +667,29 @@ func (c *client) newPacketID() uint16 {
 	c.packetIDCounter++
 	return c.packetIDCounter
 }
+
+// record adds an access decision for this client to the broker's audit trail
+func (c *client) record(action string, topic string, decision string, reason string) {
+	audit.Record(c.broker.audit, audit.Event{
+		ClientID: c.clientid,
+		Username: c.username,
+		Remote:   c.conn.RemoteAddr().String(),
+		Action:   action,
+		Topic:    topic,
+		Decision: decision,
+		Reason:   reason,
+	})
+}
+
+// recordConnect audits a rejected CONNECT, before the client's identity has
+// been accepted
+func (c *client) recordConnect(pkt *packet.ConnectPacket, decision string, reason string) {
+	audit.Record(c.broker.audit, audit.Event{
+		ClientID: pkt.ClientID,
+		Username: pkt.Username,
+		Remote:   c.conn.RemoteAddr().String(),
+		Action:   audit.Connect,
+		Decision: decision,
+		Reason:   reason,
+	})
+}
@@ -43,13 +43,13 @@ func listen(t *testing.T) {
 	t.Log("Listening for MQTT connections")
 	l, err := net.Listen("tcp", thost)
 	if err != nil {
-		t.Error("Error settinng up listener: %s", err)
+		t.Error("Error settinng up listener:", err)
 	}
 	defer l.Close()
 	for {
 		c, err := l.Accept()
 		if err != nil {
-			t.Error("Error accepting connection: %s", err)
+			t.Error("Error accepting connection:", err)
 		}
 
 		client := NewClient(a, b, c)
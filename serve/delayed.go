@@ -0,0 +1,352 @@
+package serve
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"github.com/gomqtt/packet"
+	"io"
+	"io/ioutil"
+	"math"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Topic prefixes for delayed publishing. A message published to
+// $delayed/<seconds>/<topic> is delivered to <topic> after the given number
+// of seconds, and one published to $scheduled/<unix time>/<topic> is
+// delivered at the given time.
+const (
+	DelayedPrefix   = "$delayed/"
+	ScheduledPrefix = "$scheduled/"
+)
+
+// DelayedMessage is a message waiting to be delivered
+type DelayedMessage struct {
+	ID      string
+	Due     time.Time
+	Topic   string
+	Payload []byte
+	QOS     byte
+	Retain  bool
+}
+
+type delayedEntry struct {
+	msg   DelayedMessage
+	timer *time.Timer
+}
+
+// Pending delayed messages allowed by default, across all clients
+const DefaultDelayedLimit = 10000
+
+// Records in the store beyond those needed for pending messages, before it
+// is compacted
+const delayedSlack = 1000
+
+/*
+ * delayedRecord is a line of the store. Stores are append only, with a
+ * record for each message added or removed, and are compacted when mostly
+ * made up of removed messages
+ */
+type delayedRecord struct {
+	Add    *DelayedMessage `json:",omitempty"`
+	Remove string          `json:",omitempty"`
+}
+
+// delayed holds messages until they are due, optionally persisting them to
+// a file so that they survive a restart
+type delayed struct {
+	mutex   sync.Mutex
+	broker  *Broker
+	limit   int      // Most messages pending at once
+	path    string   // Empty for no persistence
+	file    *os.File // Store, open for appending
+	records int      // Records in the store
+	entries map[string]*delayedEntry
+}
+
+func newDelayed(b *Broker) *delayed {
+	return &delayed{
+		broker:  b,
+		limit:   DefaultDelayedLimit,
+		entries: make(map[string]*delayedEntry),
+	}
+}
+
+/*
+ * parseDelayed splits a $delayed or $scheduled topic into the time the
+ * message is due and the topic it should be delivered to
+ */
+func parseDelayed(topic string, now time.Time) (due time.Time, target string, ok bool) {
+	var prefix string
+	switch {
+	case strings.HasPrefix(topic, DelayedPrefix):
+		prefix = DelayedPrefix
+	case strings.HasPrefix(topic, ScheduledPrefix):
+		prefix = ScheduledPrefix
+	default:
+		return due, topic, false
+	}
+	parts := strings.SplitN(strings.TrimPrefix(topic, prefix), "/", 2)
+	if len(parts) != 2 || parts[1] == "" {
+		return due, topic, false
+	}
+	n, err := strconv.ParseInt(parts[0], 10, 64)
+	if err != nil || n < 0 {
+		return due, topic, false
+	}
+	if prefix == DelayedPrefix {
+		// Larger delays would overflow time.Duration
+		if n > math.MaxInt64/int64(time.Second) {
+			return due, topic, false
+		}
+		due = now.Add(time.Duration(n) * time.Second)
+	} else {
+		due = time.Unix(n, 0)
+	}
+	return due, parts[1], true
+}
+
+// load reads persisted messages from path and uses path for persistence
+// from now on. Messages that became due while the broker was down are
+// delivered straight away.
+func (d *delayed) load(path string) error {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	msgs := make(map[string]DelayedMessage)
+	f, err := os.Open(path)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if err == nil {
+		decoder := json.NewDecoder(f)
+		for {
+			var r delayedRecord
+			if err := decoder.Decode(&r); err == io.EOF {
+				break
+			} else if err != nil {
+				// A crash may leave a partial last record
+				logger.Warn("Could not read delayed messages", "file", path, "error", err)
+				break
+			}
+			if r.Add != nil {
+				msgs[r.Add.ID] = *r.Add
+			} else {
+				delete(msgs, r.Remove)
+			}
+		}
+		f.Close()
+	}
+
+	d.path = path
+	for _, m := range msgs {
+		d.add(m)
+	}
+	if err := d.compact(); err != nil {
+		return err
+	}
+	logger.Info("Loaded delayed messages", "file", path, "count", len(msgs))
+	return nil
+}
+
+/*
+ * schedule holds a message until it is due. Returns false if the limit of
+ * pending messages has been reached
+ */
+func (d *delayed) schedule(msg *packet.Message, due time.Time, topic string) bool {
+	m := DelayedMessage{
+		ID:      newDelayedID(),
+		Due:     due,
+		Topic:   topic,
+		Payload: msg.Payload,
+		QOS:     msg.QOS,
+		Retain:  msg.Retain,
+	}
+	d.mutex.Lock()
+	if len(d.entries) >= d.limit {
+		d.mutex.Unlock()
+		return false
+	}
+	d.add(m)
+	d.save(delayedRecord{Add: &m})
+	d.mutex.Unlock()
+	logger.Debug("Scheduled delayed message", "id", m.ID, "topic", topic, "due", due)
+	return true
+}
+
+// add must be called with the mutex held
+func (d *delayed) add(m DelayedMessage) {
+	wait := m.Due.Sub(time.Now())
+	if wait < 0 {
+		wait = 0
+	}
+	d.entries[m.ID] = &delayedEntry{
+		msg:   m,
+		timer: time.AfterFunc(wait, func() { d.fire(m.ID) }),
+	}
+}
+
+func (d *delayed) fire(id string) {
+	d.mutex.Lock()
+	e, ok := d.entries[id]
+	if ok {
+		delete(d.entries, id)
+		d.save(delayedRecord{Remove: id})
+	}
+	d.mutex.Unlock()
+	if !ok {
+		// Cancelled
+		return
+	}
+	logger.Debug("Delivering delayed message", "id", id, "topic", e.msg.Topic)
+	d.broker.deliverChan <- &packet.Message{
+		Topic:   e.msg.Topic,
+		Payload: e.msg.Payload,
+		QOS:     e.msg.QOS,
+		Retain:  e.msg.Retain,
+	}
+}
+
+func (d *delayed) cancel(id string) bool {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	e, ok := d.entries[id]
+	if !ok {
+		return false
+	}
+	e.timer.Stop()
+	delete(d.entries, id)
+	d.save(delayedRecord{Remove: id})
+	return true
+}
+
+// list returns pending messages, soonest first
+func (d *delayed) list() []DelayedMessage {
+	d.mutex.Lock()
+	msgs := make([]DelayedMessage, 0, len(d.entries))
+	for _, e := range d.entries {
+		msgs = append(msgs, e.msg)
+	}
+	d.mutex.Unlock()
+	sort.Slice(msgs, func(i, j int) bool { return msgs[i].Due.Before(msgs[j].Due) })
+	return msgs
+}
+
+/*
+ * save appends a record to the store, if there is one, compacting it once
+ * most of its records are no longer needed. Must be called with the mutex
+ * held
+ */
+func (d *delayed) save(r delayedRecord) {
+	if d.file == nil {
+		return
+	}
+	data, err := json.Marshal(r)
+	if err != nil {
+		logger.Error("Could not encode delayed message", "error", err)
+		return
+	}
+	if _, err := d.file.Write(append(data, '\n')); err != nil {
+		logger.Error("Could not save delayed message", "file", d.path, "error", err)
+		return
+	}
+	d.records++
+	if d.records > 2*len(d.entries)+delayedSlack {
+		if err := d.compact(); err != nil {
+			logger.Error("Could not compact delayed messages", "file", d.path, "error", err)
+		}
+	}
+}
+
+// compact rewrites the store with only the pending messages, and opens it
+// for appending. Must be called with the mutex held
+func (d *delayed) compact() error {
+	var buf bytes.Buffer
+	encoder := json.NewEncoder(&buf)
+	for _, e := range d.entries {
+		msg := e.msg
+		if err := encoder.Encode(delayedRecord{Add: &msg}); err != nil {
+			return err
+		}
+	}
+	// Write then rename so that a crash never leaves a partial file
+	tmp := d.path + ".tmp"
+	if err := ioutil.WriteFile(tmp, buf.Bytes(), 0600); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, d.path); err != nil {
+		return err
+	}
+	if d.file != nil {
+		d.file.Close()
+	}
+	f, err := os.OpenFile(d.path, os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		d.file = nil
+		return err
+	}
+	d.file = f
+	d.records = len(d.entries)
+	return nil
+}
+
+func newDelayedID() string {
+	b := make([]byte, 8)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// SetDelayedLimit sets the most delayed messages that may be pending at
+// once. Further delayed messages are dropped
+func (b *Broker) SetDelayedLimit(limit int) {
+	b.delayed.mutex.Lock()
+	b.delayed.limit = limit
+	b.delayed.mutex.Unlock()
+}
+
+// SetDelayedStore loads any delayed messages saved in the given file, and
+// saves delayed messages there from now on
+func (b *Broker) SetDelayedStore(path string) error {
+	return b.delayed.load(path)
+}
+
+// DelayedMessages lists the messages waiting to be delivered
+func (b *Broker) DelayedMessages() []DelayedMessage {
+	return b.delayed.list()
+}
+
+// CancelDelayed removes a delayed message before it is delivered. Returns
+// false if there is no such message
+func (b *Broker) CancelDelayed(id string) bool {
+	return b.delayed.cancel(id)
+}
+
+// DelayedHandler lists delayed messages as JSON (GET) and cancels them
+// (DELETE with an "id" parameter), e.g.
+//
+//	curl http://localhost:8070/delayed
+//	curl -X DELETE 'http://localhost:8070/delayed?id=0123456789abcdef'
+func DelayedHandler(b *Broker) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodGet:
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(b.DelayedMessages())
+		case http.MethodDelete:
+			if !b.CancelDelayed(r.FormValue("id")) {
+				http.Error(w, "No such delayed message", http.StatusNotFound)
+				return
+			}
+			w.WriteHeader(http.StatusNoContent)
+		default:
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		}
+	})
+}
@@ -0,0 +1,127 @@
+package serve
+
+import (
+	"github.com/gomqtt/packet"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestParseDelayed(t *testing.T) {
+	now := time.Unix(1000, 0)
+
+	due, topic, ok := parseDelayed("$delayed/60/ABC-123/valve", now)
+	if !ok || topic != "ABC-123/valve" || !due.Equal(now.Add(time.Minute)) {
+		t.Error("Expected delayed topic to parse, got", due, topic, ok)
+	}
+	due, topic, ok = parseDelayed("$scheduled/2000/ABC-123/valve", now)
+	if !ok || topic != "ABC-123/valve" || !due.Equal(time.Unix(2000, 0)) {
+		t.Error("Expected scheduled topic to parse, got", due, topic, ok)
+	}
+
+	for _, bad := range []string{"ABC-123/valve", "$delayed/abc/topic", "$delayed/60", "$delayed/60/", "$delayed/-1/topic", "$delayed/9223372036854775807/topic"} {
+		if _, topic, ok := parseDelayed(bad, now); ok || topic != bad {
+			t.Error("Expected topic not to be delayed", bad)
+		}
+	}
+
+	if accessTopic("$delayed/60/ABC-123/valve") != "ABC-123/valve" {
+		t.Error("Expected rights to be checked against the target topic")
+	}
+}
+
+func TestDelayedDelivery(t *testing.T) {
+	b := &Broker{deliverChan: make(chan *packet.Message, 1)}
+	b.delayed = newDelayed(b)
+
+	b.publish(&packet.Message{Topic: "$delayed/0/one/two", Payload: []byte("payload")})
+	select {
+	case msg := <-b.deliverChan:
+		if msg.Topic != "one/two" || string(msg.Payload) != "payload" {
+			t.Error("Unexpected delayed message", msg)
+		}
+	case <-time.After(time.Second):
+		t.Error("Expected delayed message to be delivered")
+	}
+}
+
+func TestDelayedStore(t *testing.T) {
+	dir, err := ioutil.TempDir("", "delayed")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "delayed.json")
+
+	b := &Broker{deliverChan: make(chan *packet.Message, 1)}
+	b.delayed = newDelayed(b)
+	if err := b.SetDelayedStore(path); err != nil {
+		t.Fatal("Error loading empty store", err)
+	}
+	b.publish(&packet.Message{Topic: "$delayed/3600/one/two", Payload: []byte("payload")})
+
+	// A new broker picks up the saved message
+	b2 := &Broker{deliverChan: make(chan *packet.Message, 1)}
+	b2.delayed = newDelayed(b2)
+	if err := b2.SetDelayedStore(path); err != nil {
+		t.Fatal("Error loading store", err)
+	}
+	msgs := b2.DelayedMessages()
+	if len(msgs) != 1 || msgs[0].Topic != "one/two" {
+		t.Fatal("Expected one saved delayed message, got", msgs)
+	}
+	if !b2.CancelDelayed(msgs[0].ID) || len(b2.DelayedMessages()) != 0 {
+		t.Error("Expected delayed message to be cancelled")
+	}
+	b.CancelDelayed(msgs[0].ID)
+}
+
+func TestDelayedLimit(t *testing.T) {
+	b := &Broker{deliverChan: make(chan *packet.Message, 1)}
+	b.delayed = newDelayed(b)
+	b.SetDelayedLimit(2)
+	for i := 0; i < 3; i++ {
+		b.publish(&packet.Message{Topic: "$delayed/3600/one/two", Payload: []byte("payload")})
+	}
+	if n := len(b.DelayedMessages()); n != 2 {
+		t.Errorf("Expected 2 delayed messages, got %d", n)
+	}
+}
+
+func TestDelayedStoreCompacts(t *testing.T) {
+	dir, err := ioutil.TempDir("", "delayed")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "delayed.json")
+
+	b := &Broker{deliverChan: make(chan *packet.Message, 1)}
+	b.delayed = newDelayed(b)
+	if err := b.SetDelayedStore(path); err != nil {
+		t.Fatal("Error loading empty store", err)
+	}
+	b.publish(&packet.Message{Topic: "$delayed/3600/kept", Payload: []byte("payload")})
+	for i := 0; i < delayedSlack; i++ {
+		b.publish(&packet.Message{Topic: "$delayed/3600/cancelled", Payload: []byte("payload")})
+		for _, m := range b.DelayedMessages() {
+			if m.Topic == "cancelled" {
+				b.CancelDelayed(m.ID)
+			}
+		}
+	}
+	if b.delayed.records > 2+delayedSlack {
+		t.Errorf("Expected store to be compacted, has %d records", b.delayed.records)
+	}
+
+	b2 := &Broker{deliverChan: make(chan *packet.Message, 1)}
+	b2.delayed = newDelayed(b2)
+	if err := b2.SetDelayedStore(path); err != nil {
+		t.Fatal("Error loading store", err)
+	}
+	if msgs := b2.DelayedMessages(); len(msgs) != 1 || msgs[0].Topic != "kept" {
+		t.Error("Expected only the kept message after loading, got", msgs)
+	}
+}
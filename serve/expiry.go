@@ -0,0 +1,125 @@
+package serve
+
+import (
+	"encoding/json"
+	"errors"
+	"github.com/gomqtt/packet"
+	"net/http"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// How often expired retained messages are removed
+const expiryInterval = 10 * time.Second
+
+// ExpiryRule gives messages published to topics matching Filter a time to
+// live. Rules are checked in order and the first match applies
+type ExpiryRule struct {
+	Filter string
+	TTL    time.Duration
+}
+
+// ExpiryCounts are the number of messages dropped because they expired
+type ExpiryCounts struct {
+	Retained uint64 // Retained messages removed
+	InFlight uint64 // Queued or in-flight messages not (re-)sent
+}
+
+// expiring is a message with the time after which it must not be delivered
+type expiring struct {
+	packet.Message
+	expires time.Time // Zero for never
+}
+
+func (e *expiring) expired(now time.Time) bool {
+	return !e.expires.IsZero() && now.After(e.expires)
+}
+
+/*
+ * ParseExpiryRules reads rules in the form "filter=duration,filter=duration",
+ * e.g. "+/command/#=10m,sensors/#=24h"
+ */
+func ParseExpiryRules(s string) (rules []ExpiryRule, err error) {
+	if s == "" {
+		return rules, nil
+	}
+	for _, r := range strings.Split(s, ",") {
+		parts := strings.SplitN(r, "=", 2)
+		if len(parts) != 2 || parts[0] == "" {
+			return nil, errors.New("Expiry rule must be in the form filter=duration: " + r)
+		}
+		ttl, err := time.ParseDuration(parts[1])
+		if err != nil {
+			return nil, err
+		}
+		if ttl <= 0 {
+			return nil, errors.New("Expiry duration must be positive: " + r)
+		}
+		rules = append(rules, ExpiryRule{Filter: parts[0], TTL: ttl})
+	}
+	return rules, nil
+}
+
+// SetExpiry sets the time to live rules for messages
+func (b *Broker) SetExpiry(rules []ExpiryRule) {
+	b.Lock()
+	b.expiry = rules
+	b.Unlock()
+}
+
+/*
+ * expires returns the time after which a message on the given topic,
+ * received now, expires. Zero if the message never expires
+ */
+func (b *Broker) expires(topic string, now time.Time) time.Time {
+	b.RLock()
+	defer b.RUnlock()
+	for _, r := range b.expiry {
+		if matches(r.Filter, topic) {
+			return now.Add(r.TTL)
+		}
+	}
+	return time.Time{}
+}
+
+// ExpiryCounts returns the number of messages that have expired
+func (b *Broker) ExpiryCounts() ExpiryCounts {
+	return ExpiryCounts{
+		Retained: atomic.LoadUint64(&b.expiredRetained),
+		InFlight: atomic.LoadUint64(&b.expiredInFlight),
+	}
+}
+
+func (b *Broker) expireRound() {
+	for now := range time.Tick(expiryInterval) {
+		b.expireRetained(now)
+	}
+}
+
+// expireRetained removes retained messages that expired before now
+func (b *Broker) expireRetained(now time.Time) {
+	var n uint64
+	b.Lock()
+	for topic, msg := range b.retained {
+		if msg.expired(now) {
+			delete(b.retained, topic)
+			n++
+		}
+	}
+	b.Unlock()
+	if n > 0 {
+		total := atomic.AddUint64(&b.expiredRetained, n)
+		logger.Info("Removed expired retained messages", "count", n, "total", total)
+	}
+}
+
+// ExpiryHandler reports the number of expired messages as JSON, e.g.
+//
+//	curl http://localhost:8070/expiry
+func ExpiryHandler(b *Broker) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(b.ExpiryCounts())
+	})
+}
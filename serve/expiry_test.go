@@ -0,0 +1,78 @@
+package serve
+
+import (
+	"github.com/gomqtt/packet"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestParseExpiryRules(t *testing.T) {
+	rules, err := ParseExpiryRules("+/command/#=10m,sensors/#=24h")
+	if err != nil {
+		t.Fatal("Error parsing expiry rules", err)
+	}
+	if len(rules) != 2 || rules[0].Filter != "+/command/#" || rules[1].TTL != 24*time.Hour {
+		t.Error("Unexpected expiry rules", rules)
+	}
+
+	for _, bad := range []string{"sensors/#", "=10m", "sensors/#=soon", "sensors/#=-1s"} {
+		if _, err := ParseExpiryRules(bad); err == nil {
+			t.Error("Expected error parsing expiry rule", bad)
+		}
+	}
+}
+
+func TestExpireRetained(t *testing.T) {
+	now := time.Now()
+	b := &Broker{retained: make(map[string]*expiring)}
+	b.SetExpiry([]ExpiryRule{
+		{Filter: "ABC-123/command/#", TTL: time.Minute},
+	})
+
+	if !b.expires("ABC-123/temperature", now).IsZero() {
+		t.Error("Expected no expiry for topic without a rule")
+	}
+	expires := b.expires("ABC-123/command/valve", now)
+	if !expires.Equal(now.Add(time.Minute)) {
+		t.Error("Expected expiry from matching rule, got", expires)
+	}
+
+	b.retained["ABC-123/command/valve"] = &expiring{Message: packet.Message{Topic: "ABC-123/command/valve"}, expires: expires}
+	b.retained["ABC-123/temperature"] = &expiring{Message: packet.Message{Topic: "ABC-123/temperature"}}
+
+	b.expireRetained(now)
+	if len(b.retained) != 2 {
+		t.Error("Expected no retained messages to expire yet")
+	}
+	b.expireRetained(now.Add(2 * time.Minute))
+	if _, ok := b.retained["ABC-123/command/valve"]; ok || len(b.retained) != 1 {
+		t.Error("Expected expired retained message to be removed")
+	}
+	if b.ExpiryCounts().Retained != 1 {
+		t.Error("Expected expired retained message to be counted")
+	}
+}
+
+func TestDeliveryExpiry(t *testing.T) {
+	rules, _ := ParseRewriteRules("sensors/+/t=$1/temperature")
+	b := &Broker{}
+	b.SetExpiry([]ExpiryRule{{Filter: "+/temperature", TTL: time.Minute}})
+	c := &client{
+		broker:          b,
+		mutex:           &sync.Mutex{},
+		subscriptions:   map[string]packet.Subscription{"+/temperature": {Topic: "+/temperature", QOS: 1}},
+		rewrites:        map[string]*RewriteRule{"+/temperature": rules[0]},
+		deliveryChannel: make(chan *expiring, 1),
+	}
+
+	// The expiry set on receipt is kept, although the client sees the
+	// topic it subscribed with
+	expires := time.Now().Add(time.Minute)
+	msg := &packet.Message{Topic: "ABC-123/temperature", QOS: 1}
+	checkDeliverToClient(c, allTopics(msg.Topic), msg, expires)
+	got := <-c.deliveryChannel
+	if got.Topic != "sensors/ABC-123/t" || !got.expires.Equal(expires) {
+		t.Errorf("Expected sensors/ABC-123/t expiring at %v, got %s at %v", expires, got.Topic, got.expires)
+	}
+}
@@ -0,0 +1,325 @@
+package serve
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/gomqtt/packet"
+	"github.com/trafero/tstack/audit"
+	"github.com/trafero/tstack/auth"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Largest payload accepted over HTTP, the MQTT maximum remaining length
+const maxHTTPPayload = 268435455
+
+// How often an idle event stream is sent a comment, to keep proxies from
+// closing it and to notice clients that have gone away
+var sseKeepalive = 30 * time.Second
+
+// HTTPGateway lets clients that cannot speak MQTT publish and subscribe over
+// HTTP. Requests use basic authentication with the same usernames,
+// passwords and rights as MQTT clients.
+//
+//	POST /topics/{topic}?qos=1&retain=true   Publish the request body
+//	GET  /topics/{topic}                     Fetch the retained message
+//	GET  /subscribe?filter={filter}          Stream messages as Server-Sent Events
+type HTTPGateway struct {
+	auth   auth.Auth
+	broker *Broker
+}
+
+func NewHTTPGateway(a auth.Auth, b *Broker) *HTTPGateway {
+	return &HTTPGateway{auth: a, broker: b}
+}
+
+// httpEvent is the data of a Server-Sent Event
+type httpEvent struct {
+	Topic    string `json:"topic"`
+	Payload  string `json:"payload"`
+	Encoding string `json:"encoding,omitempty"` // "base64" if requested
+	QOS      byte   `json:"qos"`
+	Retain   bool   `json:"retain"`
+}
+
+func (g *HTTPGateway) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	username, password, ok := r.BasicAuth()
+	var session auth.Session
+	if ok {
+		// Limited as CONNECTs are, by the address the request came from
+		remote := remoteAddr(r)
+		if locked, wait := g.broker.checkLockout(username, remote); locked || wait > 0 {
+			reason := "locked out"
+			if !locked {
+				reason = "too soon after failure"
+			}
+			logger.Warn("HTTP user refused after failed attempts", "remote", r.RemoteAddr, "username", username, "reason", reason)
+			g.record(r, username, audit.Connect, "", audit.Deny, reason)
+			w.Header().Set("Retry-After", strconv.Itoa(int((wait+time.Second-1)/time.Second)))
+			http.Error(w, "Too many failed attempts", http.StatusTooManyRequests)
+			return
+		}
+		if session, ok = authenticate(g.auth, username, password); ok {
+			g.broker.succeededLockout(username)
+		} else {
+			g.broker.failedLockout(username, remote)
+		}
+	}
+	if !ok {
+		logger.Warn("HTTP user could not be authenticated", "remote", r.RemoteAddr, "username", username)
+		g.record(r, username, audit.Connect, "", audit.Deny, "not authenticated")
+		w.Header().Set("WWW-Authenticate", `Basic realm="tstack"`)
+		http.Error(w, "Not authenticated", http.StatusUnauthorized)
+		return
+	}
+
+	switch {
+	case strings.HasPrefix(r.URL.Path, "/topics/"):
+		topic := strings.TrimPrefix(r.URL.Path, "/topics/")
+		switch r.Method {
+		case "POST", "PUT":
+			g.publish(w, r, session, topic)
+		case "GET":
+			g.retained(w, r, session, topic)
+		default:
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		}
+	case r.URL.Path == "/subscribe":
+		if r.Method != "GET" {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		g.subscribe(w, r, session.Username, password)
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func (g *HTTPGateway) publish(w http.ResponseWriter, r *http.Request, s auth.Session, topic string) {
+	if topic == "" || strings.ContainsAny(topic, "+#") {
+		http.Error(w, "Invalid topic", http.StatusBadRequest)
+		return
+	}
+	qos, err := parseQOS(r.URL.Query().Get("qos"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	retain := false
+	if s := r.URL.Query().Get("retain"); s != "" {
+		if retain, err = strconv.ParseBool(s); err != nil {
+			http.Error(w, "Invalid retain", http.StatusBadRequest)
+			return
+		}
+	}
+
+	topic, _ = g.broker.rewrite(topic)
+	if !matches(s.Rights, accessTopic(topic)) {
+		logger.Warn("HTTP user not authorized to publish to topic", "remote", r.RemoteAddr, "username", s.Username, "topic", topic)
+		g.record(r, s.Username, audit.Publish, topic, audit.Deny, "not authorized")
+		http.Error(w, "Not authorized", http.StatusForbidden)
+		return
+	}
+
+	payload, err := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, maxHTTPPayload))
+	if err != nil {
+		http.Error(w, "Could not read payload", http.StatusBadRequest)
+		return
+	}
+	logger.Debug("Delivering HTTP message", "remote", r.RemoteAddr, "username", s.Username, "topic", topic)
+	g.broker.publish(&packet.Message{
+		Topic:   topic,
+		Payload: payload,
+		QOS:     qos,
+		Retain:  retain,
+	})
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (g *HTTPGateway) retained(w http.ResponseWriter, r *http.Request, s auth.Session, topic string) {
+	topic, _ = g.broker.rewrite(topic)
+	if !matches(s.Rights, topic) {
+		logger.Warn("HTTP user not authorized to read topic", "remote", r.RemoteAddr, "username", s.Username, "topic", topic)
+		g.record(r, s.Username, audit.Subscribe, topic, audit.Deny, "not authorized")
+		http.Error(w, "Not authorized", http.StatusForbidden)
+		return
+	}
+
+	g.broker.RLock()
+	msg, ok := g.broker.retained[topic]
+	g.broker.RUnlock()
+	if !ok || msg.expired(time.Now()) {
+		http.NotFound(w, r)
+		return
+	}
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Header().Set("X-MQTT-QoS", strconv.Itoa(int(msg.QOS)))
+	w.Write(msg.Payload)
+}
+
+/*
+ * subscribe streams messages matching the filter(s) as Server-Sent Events.
+ * The stream is an MQTT session on the broker, connected with the user's
+ * own credentials, so rights and topic rewriting apply as for any client
+ */
+func (g *HTTPGateway) subscribe(w http.ResponseWriter, r *http.Request, username string, password string) {
+	filters := r.URL.Query()["filter"]
+	if len(filters) == 0 {
+		http.Error(w, "filter is required", http.StatusBadRequest)
+		return
+	}
+	qos, err := parseQOS(r.URL.Query().Get("qos"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	encoding := r.URL.Query().Get("encoding")
+	if encoding != "" && encoding != "base64" {
+		http.Error(w, "Invalid encoding", http.StatusBadRequest)
+		return
+	}
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "Streaming not supported", http.StatusInternalServerError)
+		return
+	}
+
+	s, err := g.connect(r, username, password)
+	if err != nil {
+		logger.Warn("Could not connect HTTP subscriber", "remote", r.RemoteAddr, "username", username, "error", err)
+		http.Error(w, "Could not connect to broker", http.StatusInternalServerError)
+		return
+	}
+	defer s.Close()
+
+	// Messages may arrive before the SUBACK, from retained messages
+	var subscriptions []packet.Subscription
+	for _, f := range filters {
+		subscriptions = append(subscriptions, packet.Subscription{Topic: f, QOS: qos})
+	}
+	codes, pending, err := s.Subscribe(subscriptions, 10*time.Second)
+	switch err {
+	case nil:
+	case ErrTimeout:
+		http.Error(w, "Timed out subscribing", http.StatusGatewayTimeout)
+		return
+	default:
+		http.Error(w, "Disconnected by broker", http.StatusInternalServerError)
+		return
+	}
+	for i, code := range codes {
+		if code == packet.QOSFailure && i < len(filters) {
+			http.Error(w, "Not authorized to subscribe to "+filters[i], http.StatusForbidden)
+			return
+		}
+	}
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+	logger.Info("HTTP subscriber connected", "remote", r.RemoteAddr, "username", username, "filters", strings.Join(filters, " "))
+
+	send := func(msg *packet.Message) error {
+		e := httpEvent{Topic: msg.Topic, Payload: string(msg.Payload), QOS: msg.QOS, Retain: msg.Retain}
+		if encoding == "base64" {
+			e.Payload = base64.StdEncoding.EncodeToString(msg.Payload)
+			e.Encoding = encoding
+		}
+		data, err := json.Marshal(e)
+		if err != nil {
+			return err
+		}
+		if _, err := fmt.Fprintf(w, "event: message\ndata: %s\n\n", data); err != nil {
+			return err
+		}
+		flusher.Flush()
+		return nil
+	}
+	for _, msg := range pending {
+		if send(msg) != nil {
+			return
+		}
+	}
+
+	keepalive := time.NewTicker(sseKeepalive)
+	defer keepalive.Stop()
+	for {
+		select {
+		case msg := <-s.Messages:
+			if send(msg) != nil {
+				return
+			}
+		case <-keepalive.C:
+			if _, err := fmt.Fprint(w, ": keepalive\n\n"); err != nil {
+				return
+			}
+			flusher.Flush()
+		case <-s.Done:
+			return
+		case <-r.Context().Done():
+			logger.Info("HTTP subscriber disconnected", "remote", r.RemoteAddr, "username", username)
+			return
+		}
+	}
+}
+
+// record adds an access decision for an HTTP request to the audit trail
+func (g *HTTPGateway) record(r *http.Request, username string, action string, topic string, decision string, reason string) {
+	audit.Record(g.broker.audit, audit.Event{
+		Username: username,
+		Remote:   r.RemoteAddr,
+		Action:   action,
+		Topic:    topic,
+		Decision: decision,
+		Reason:   reason,
+	})
+}
+
+// remoteAddr returns the address a request came from
+func remoteAddr(r *http.Request) net.Addr {
+	remote, err := net.ResolveTCPAddr("tcp", r.RemoteAddr)
+	if err != nil {
+		return &net.TCPAddr{}
+	}
+	return remote
+}
+
+// connect opens the MQTT session behind an event stream
+func (g *HTTPGateway) connect(r *http.Request, username string, password string) (c *GatewayClient, err error) {
+
+	// Each stream has its own client ID, so streams don't take over each
+	// other's sessions
+	id := make([]byte, 8)
+	rand.Read(id)
+	connect := packet.NewConnectPacket()
+	connect.ClientID = "http-" + hex.EncodeToString(id)
+	connect.Username = username
+	connect.Password = password
+	connect.CleanSession = true
+	s, err := Connect(Pipe(g.auth, g.broker, remoteAddr(r)), connect, 10*time.Second)
+	if err != nil {
+		return nil, err
+	}
+	return NewGatewayClient(s), nil
+}
+
+// parseQOS reads a QoS query parameter, defaulting to 0
+func parseQOS(s string) (qos byte, err error) {
+	if s == "" {
+		return packet.QOSAtMostOnce, nil
+	}
+	q, err := strconv.Atoi(s)
+	if err != nil || q < 0 || q > 2 {
+		return 0, errors.New("Invalid qos " + s)
+	}
+	return byte(q), nil
+}
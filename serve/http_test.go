@@ -0,0 +1,145 @@
+package serve
+
+import (
+	"bufio"
+	"encoding/json"
+	"github.com/trafero/tstack/auth/authtest"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func httpRequest(t *testing.T, method string, url string, body string, password string) *http.Response {
+	req, _ := http.NewRequest(method, url, strings.NewReader(body))
+	req.SetBasicAuth("username", password)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal("Error making request:", err)
+	}
+	return resp
+}
+
+func TestHTTPPublishRetained(t *testing.T) {
+	server := httptest.NewServer(NewHTTPGateway(authtest.NewUser("username", "password", "allowed/#"), NewBroker()))
+	defer server.Close()
+
+	resp := httpRequest(t, "POST", server.URL+"/topics/allowed/a", "payload", "wrong")
+	if resp.StatusCode != http.StatusUnauthorized {
+		t.Errorf("Expected 401 for wrong password, got %d", resp.StatusCode)
+	}
+	resp = httpRequest(t, "POST", server.URL+"/topics/denied/a", "payload", "password")
+	if resp.StatusCode != http.StatusForbidden {
+		t.Errorf("Expected 403 for topic without rights, got %d", resp.StatusCode)
+	}
+	resp = httpRequest(t, "POST", server.URL+"/topics/allowed/a?qos=3", "payload", "password")
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("Expected 400 for invalid qos, got %d", resp.StatusCode)
+	}
+	resp = httpRequest(t, "POST", server.URL+"/topics/allowed/a?qos=1&retain=true", "payload", "password")
+	if resp.StatusCode != http.StatusNoContent {
+		t.Fatalf("Expected 204 for publish, got %d", resp.StatusCode)
+	}
+
+	// The retained message is stored by the broker's delivery round
+	var body []byte
+	for i := 0; i < 50; i++ {
+		resp = httpRequest(t, "GET", server.URL+"/topics/allowed/a", "", "password")
+		body, _ = ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		if resp.StatusCode == http.StatusOK {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if string(body) != "payload" {
+		t.Errorf("Expected retained payload, got %d %q", resp.StatusCode, body)
+	}
+	resp = httpRequest(t, "GET", server.URL+"/topics/allowed/none", "", "password")
+	if resp.StatusCode != http.StatusNotFound {
+		t.Errorf("Expected 404 without retained message, got %d", resp.StatusCode)
+	}
+}
+
+func TestHTTPSession(t *testing.T) {
+	a := &tokenAuth{Auth: authtest.NewUser("device", "secret", "#"), ttl: time.Minute}
+	server := httptest.NewServer(NewHTTPGateway(a, NewBroker()))
+	defer server.Close()
+
+	// Rights come from the token, not the user
+	resp := httpRequest(t, "POST", server.URL+"/topics/device/a", "payload", "token")
+	if resp.StatusCode != http.StatusNoContent {
+		t.Errorf("Expected 204 for publish with token, got %d", resp.StatusCode)
+	}
+	resp = httpRequest(t, "POST", server.URL+"/topics/other/a", "payload", "token")
+	if resp.StatusCode != http.StatusForbidden {
+		t.Errorf("Expected 403 for topic outside the token's rights, got %d", resp.StatusCode)
+	}
+}
+
+func TestHTTPLockout(t *testing.T) {
+	b := NewBroker()
+	b.SetLockout(Lockout{MaxFailures: 1, LockoutTime: time.Minute})
+	server := httptest.NewServer(NewHTTPGateway(authtest.NewUser("username", "password", "allowed/#"), b))
+	defer server.Close()
+
+	resp := httpRequest(t, "POST", server.URL+"/topics/allowed/a", "payload", "wrong")
+	if resp.StatusCode != http.StatusUnauthorized {
+		t.Errorf("Expected 401 for wrong password, got %d", resp.StatusCode)
+	}
+	resp = httpRequest(t, "POST", server.URL+"/topics/allowed/a", "payload", "password")
+	if resp.StatusCode != http.StatusTooManyRequests || resp.Header.Get("Retry-After") != "60" {
+		t.Errorf("Expected 429 for locked out user, got %d, retry after %q", resp.StatusCode, resp.Header.Get("Retry-After"))
+	}
+	if counts := b.LockoutCounts(); counts.Failures != 1 || counts.Refused != 1 {
+		t.Errorf("Expected HTTP attempts to be counted, got %+v", counts)
+	}
+}
+
+func TestHTTPSubscribe(t *testing.T) {
+	server := httptest.NewServer(NewHTTPGateway(authtest.NewUser("username", "password", "allowed/#"), NewBroker()))
+	defer server.Close()
+
+	resp := httpRequest(t, "GET", server.URL+"/subscribe?filter=denied/%23", "", "password")
+	if resp.StatusCode != http.StatusForbidden {
+		t.Errorf("Expected 403 for filter without rights, got %d", resp.StatusCode)
+	}
+
+	stream := httpRequest(t, "GET", server.URL+"/subscribe?filter=allowed/%2B", "", "password")
+	defer stream.Body.Close()
+	if stream.StatusCode != http.StatusOK {
+		t.Fatalf("Expected 200 for subscribe, got %d", stream.StatusCode)
+	}
+	if ct := stream.Header.Get("Content-Type"); ct != "text/event-stream" {
+		t.Errorf("Expected event stream, got %s", ct)
+	}
+
+	resp = httpRequest(t, "POST", server.URL+"/topics/allowed/b", "hello", "password")
+	if resp.StatusCode != http.StatusNoContent {
+		t.Fatalf("Expected 204 for publish, got %d", resp.StatusCode)
+	}
+
+	events := make(chan string)
+	go func() {
+		scanner := bufio.NewScanner(stream.Body)
+		for scanner.Scan() {
+			if line := scanner.Text(); strings.HasPrefix(line, "data: ") {
+				events <- strings.TrimPrefix(line, "data: ")
+			}
+		}
+	}()
+	select {
+	case data := <-events:
+		var e httpEvent
+		if err := json.Unmarshal([]byte(data), &e); err != nil {
+			t.Fatal("Could not decode event:", err)
+		}
+		if e.Topic != "allowed/b" || e.Payload != "hello" {
+			t.Errorf("Unexpected event %+v", e)
+		}
+	case <-time.After(5 * time.Second):
+		t.Error("Timed out waiting for event")
+	}
+}
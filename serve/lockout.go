@@ -0,0 +1,331 @@
+package serve
+
+import (
+	"encoding/json"
+	"errors"
+	"github.com/trafero/tstack/audit"
+	"net"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Most usernames and addresses tracked, before those without recent
+// failures are forgotten
+const maxTracked = 100000
+
+/*
+ * Lockout limits how often passwords can be guessed on CONNECT and by the
+ * HTTP gateway, whatever the auth back end. After each failure, attempts for
+ * the same username or from the same address are refused without checking
+ * the password for Delay, twice as long each time up to MaxDelay. After
+ * MaxFailures for a username, or MaxSourceFailures from an address, they are
+ * refused until LockoutTime has passed. Failures are forgotten after
+ * LockoutTime without any
+ */
+type Lockout struct {
+	MaxFailures       int           // Failures for a username before it is locked out. 0 for no limit
+	MaxSourceFailures int           // Failures from an address before it is locked out. 0 for no limit
+	LockoutTime       time.Duration // How long lockouts last
+	Delay             time.Duration // Wait after a failure before another attempt
+	MaxDelay          time.Duration // Longest wait after failures. 0 for no wait
+	Allow             []*net.IPNet  // Addresses never delayed or locked out
+}
+
+// LockoutCounts are the number of failed and refused CONNECTs, and the
+// usernames and addresses locked out now
+type LockoutCounts struct {
+	Failures uint64   `json:"failures"` // Passwords refused
+	Refused  uint64   `json:"refused"`  // Attempts refused while locked out, or too soon after a failure
+	Lockouts uint64   `json:"lockouts"` // Lockouts started
+	Users    []string `json:"users"`    // Usernames locked out now
+	Sources  []string `json:"sources"`  // Addresses locked out now
+}
+
+// failures are the recent failures for a username or address
+type failures struct {
+	count  int
+	last   time.Time
+	locked time.Time // Locked out until
+}
+
+// lockout tracks failures for a broker
+type lockout struct {
+	Lockout
+	mutex   sync.Mutex
+	users   map[string]*failures
+	sources map[string]*failures
+	counts  LockoutCounts
+}
+
+func newLockout(l Lockout) *lockout {
+	return &lockout{
+		Lockout: l,
+		users:   make(map[string]*failures),
+		sources: make(map[string]*failures),
+	}
+}
+
+/*
+ * ParseAllowList reads addresses and networks in the form
+ * "10.0.0.0/8,192.168.1.5", for Lockout.Allow
+ */
+func ParseAllowList(s string) (allow []*net.IPNet, err error) {
+	if s == "" {
+		return allow, nil
+	}
+	for _, a := range strings.Split(s, ",") {
+		a = strings.TrimSpace(a)
+		if !strings.Contains(a, "/") {
+			ip := net.ParseIP(a)
+			if ip == nil {
+				return nil, errors.New("Not an address or network: " + a)
+			}
+			bits := 8 * len(ip.To16())
+			if ip.To4() != nil {
+				ip, bits = ip.To4(), 32
+			}
+			allow = append(allow, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, network, err := net.ParseCIDR(a)
+		if err != nil {
+			return nil, err
+		}
+		allow = append(allow, network)
+	}
+	return allow, nil
+}
+
+// SetLockout limits password guessing on CONNECT, as set in l
+func (b *Broker) SetLockout(l Lockout) {
+	b.lockout = newLockout(l)
+}
+
+// LockoutCounts returns the number of failed and refused CONNECTs. They are
+// all zero without SetLockout
+func (b *Broker) LockoutCounts() LockoutCounts {
+	if b.lockout == nil {
+		return LockoutCounts{Users: []string{}, Sources: []string{}}
+	}
+	return b.lockout.report(time.Now())
+}
+
+// LockoutHandler reports the number of failed CONNECTs, and who is locked
+// out, as JSON, e.g.
+//
+//	curl http://localhost:8070/lockout
+func LockoutHandler(b *Broker) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(b.LockoutCounts())
+	})
+}
+
+/*
+ * checkLockout returns whether an attempt for username from remote is locked
+ * out, and how long until another attempt may be made. Attempts that are
+ * locked out, or have a wait, are refused without checking the password
+ */
+func (b *Broker) checkLockout(username string, remote net.Addr) (locked bool, wait time.Duration) {
+	if b.lockout == nil {
+		return false, 0
+	}
+	return b.lockout.check(username, sourceIP(remote), time.Now())
+}
+
+// failedLockout counts a failed attempt, recording any lockout it starts
+func (b *Broker) failedLockout(username string, remote net.Addr) {
+	if b.lockout == nil {
+		return
+	}
+	userLocked, sourceLocked := b.lockout.failed(username, sourceIP(remote), time.Now())
+	if userLocked {
+		logger.Warn("Too many failed attempts, username locked out", "username", username, "duration", b.lockout.LockoutTime)
+		b.recordLockout(username, "", "too many failures for username")
+	}
+	if sourceLocked {
+		logger.Warn("Too many failed attempts, address locked out", "remote", remote, "duration", b.lockout.LockoutTime)
+		b.recordLockout("", remote.String(), "too many failures from address")
+	}
+}
+
+// succeededLockout forgets the failures of username after a successful
+// attempt
+func (b *Broker) succeededLockout(username string) {
+	if b.lockout != nil {
+		b.lockout.succeeded(username)
+	}
+}
+
+// recordLockout audits the start of a lockout of a username or address
+func (b *Broker) recordLockout(username string, remote string, reason string) {
+	audit.Record(b.audit, audit.Event{
+		Username: username,
+		Remote:   remote,
+		Action:   audit.Lockout,
+		Decision: audit.Deny,
+		Reason:   reason,
+	})
+}
+
+// sourceIP returns the address of a client, or "" if it has none
+func sourceIP(addr net.Addr) string {
+	var ip net.IP
+	switch a := addr.(type) {
+	case *net.TCPAddr:
+		ip = a.IP
+	case *net.UDPAddr:
+		ip = a.IP
+	case *net.IPAddr:
+		ip = a.IP
+	}
+	if ip == nil {
+		return ""
+	}
+	return ip.String()
+}
+
+// allowed returns true if source is on the allow list
+func (l *lockout) allowed(source string) bool {
+	ip := net.ParseIP(source)
+	for _, network := range l.Allow {
+		if ip != nil && network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// get returns the unexpired failures for key, or nil if there are none
+func (l *lockout) get(m map[string]*failures, key string, now time.Time) *failures {
+	f := m[key]
+	if f != nil && now.Sub(f.last) > l.LockoutTime && now.After(f.locked) {
+		delete(m, key)
+		return nil
+	}
+	return f
+}
+
+/*
+ * check returns whether an attempt for username from source is locked out,
+ * and how long until another attempt may be made. An attempt that is not
+ * locked out, but has a wait, is too soon after a failure. Empty usernames
+ * and sources aren't tracked
+ */
+func (l *lockout) check(username string, source string, now time.Time) (locked bool, wait time.Duration) {
+	if l.allowed(source) {
+		return false, 0
+	}
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	for _, f := range []*failures{l.get(l.users, username, now), l.get(l.sources, source, now)} {
+		if f == nil {
+			continue
+		}
+		if now.Before(f.locked) {
+			l.counts.Refused++
+			return true, f.locked.Sub(now)
+		}
+		if f.count == 0 {
+			continue
+		}
+		if w := f.last.Add(l.delay(f.count)).Sub(now); w > wait {
+			wait = w
+		}
+	}
+	if wait > 0 {
+		l.counts.Refused++
+	}
+	return false, wait
+}
+
+// delay returns the wait after count failures
+func (l *lockout) delay(count int) time.Duration {
+	delay := l.Delay
+	for i := 1; i < count && delay < l.MaxDelay; i++ {
+		delay *= 2
+	}
+	if delay > l.MaxDelay {
+		delay = l.MaxDelay
+	}
+	return delay
+}
+
+/*
+ * failed counts a failure for username from source, returning which, if
+ * either, are now locked out
+ */
+func (l *lockout) failed(username string, source string, now time.Time) (userLocked bool, sourceLocked bool) {
+	if l.allowed(source) {
+		return false, false
+	}
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	l.counts.Failures++
+	if username != "" {
+		userLocked = l.fail(l.users, username, l.MaxFailures, now)
+	}
+	if source != "" {
+		sourceLocked = l.fail(l.sources, source, l.MaxSourceFailures, now)
+	}
+	return userLocked, sourceLocked
+}
+
+// fail counts a failure for key, locking it out if it has had max
+func (l *lockout) fail(m map[string]*failures, key string, max int, now time.Time) (locked bool) {
+	f := l.get(m, key, now)
+	if f == nil {
+		if len(m) >= maxTracked {
+			l.prune(m, now)
+		}
+		f = &failures{}
+		m[key] = f
+	}
+	f.count++
+	f.last = now
+	if max > 0 && f.count >= max {
+		f.count = 0
+		f.locked = now.Add(l.LockoutTime)
+		l.counts.Lockouts++
+		return true
+	}
+	return false
+}
+
+// prune forgets failures that have expired
+func (l *lockout) prune(m map[string]*failures, now time.Time) {
+	for key := range m {
+		l.get(m, key, now)
+	}
+}
+
+// succeeded forgets the failures for username, but not those of its source,
+// so that guesses can't be hidden among successful logins
+func (l *lockout) succeeded(username string) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	delete(l.users, username)
+}
+
+func (l *lockout) report(now time.Time) LockoutCounts {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	counts := l.counts
+	counts.Users, counts.Sources = []string{}, []string{}
+	for username, f := range l.users {
+		if now.Before(f.locked) {
+			counts.Users = append(counts.Users, username)
+		}
+	}
+	for source, f := range l.sources {
+		if now.Before(f.locked) {
+			counts.Sources = append(counts.Sources, source)
+		}
+	}
+	sort.Strings(counts.Users)
+	sort.Strings(counts.Sources)
+	return counts
+}
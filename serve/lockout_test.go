@@ -0,0 +1,148 @@
+package serve
+
+import (
+	"github.com/gomqtt/packet"
+	"github.com/trafero/tstack/audit"
+	"github.com/trafero/tstack/auth/authtest"
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestParseAllowList(t *testing.T) {
+	allow, err := ParseAllowList("10.0.0.0/8, 192.168.1.5,::1")
+	if err != nil || len(allow) != 3 {
+		t.Fatal("Error parsing allow list", allow, err)
+	}
+	l := newLockout(Lockout{Allow: allow})
+	for source, allowed := range map[string]bool{"10.1.2.3": true, "192.168.1.5": true, "192.168.1.6": false, "::1": true, "": false} {
+		if l.allowed(source) != allowed {
+			t.Errorf("Expected %q allowed to be %v", source, allowed)
+		}
+	}
+	if _, err := ParseAllowList("10.0.0"); err == nil {
+		t.Error("Expected error parsing bad address")
+	}
+}
+
+func TestLockout(t *testing.T) {
+	now := time.Now()
+	l := newLockout(Lockout{
+		MaxFailures:       3,
+		MaxSourceFailures: 5,
+		LockoutTime:       time.Minute,
+		Delay:             time.Second,
+		MaxDelay:          3 * time.Second,
+	})
+
+	// Attempts are refused for a wait after each failure, doubling up to
+	// the most
+	for i, want := range []time.Duration{time.Second, 2 * time.Second} {
+		if locked, _ := l.failed("ABC-123", "10.0.0.1", now); locked {
+			t.Fatal("Expected no lockout after", i+1, "failures")
+		}
+		if locked, wait := l.check("ABC-123", "10.0.0.2", now); locked || wait != want {
+			t.Errorf("Expected wait of %v, got %v, %v", want, wait, locked)
+		}
+		if locked, wait := l.check("ABC-123", "10.0.0.2", now.Add(want)); locked || wait != 0 {
+			t.Errorf("Expected no wait after %v, got %v, %v", want, wait, locked)
+		}
+	}
+	if locked, _ := l.failed("ABC-123", "10.0.0.1", now); !locked {
+		t.Fatal("Expected username to be locked out")
+	}
+	if locked, wait := l.check("ABC-123", "10.0.0.2", now); !locked || wait != time.Minute {
+		t.Errorf("Expected username to be locked out from any address for a minute, got %v, %v", wait, locked)
+	}
+	if locked, wait := l.check("XYZ-789", "10.0.0.1", now); locked || wait != 3*time.Second {
+		t.Errorf("Expected address to wait after its failures, got %v, %v", wait, locked)
+	}
+	if locked, wait := l.check("ABC-123", "10.0.0.2", now.Add(2*time.Minute)); locked || wait != 0 {
+		t.Errorf("Expected lockout and failures to be forgotten, got %v, %v", wait, locked)
+	}
+
+	// Guessing many usernames locks out the address
+	for _, username := range []string{"a", "b"} {
+		l.failed(username, "10.0.0.1", now)
+	}
+	if locked, _ := l.check("c", "10.0.0.1", now); !locked {
+		t.Error("Expected address to be locked out")
+	}
+	counts := l.report(now)
+	if counts.Failures != 5 || counts.Lockouts != 2 || counts.Refused != 5 || len(counts.Users) != 0 || len(counts.Sources) != 1 {
+		t.Errorf("Unexpected counts %+v", counts)
+	}
+}
+
+// events keeps audit events for checking
+type events struct {
+	sync.Mutex
+	events []audit.Event
+}
+
+func (e *events) Audit(event audit.Event) {
+	e.Lock()
+	defer e.Unlock()
+	e.events = append(e.events, event)
+}
+
+func TestConnectLockout(t *testing.T) {
+	a := authtest.NewUser("device", "secret", "device/#")
+	b := NewBroker()
+	sink := &events{}
+	b.SetAudit(sink)
+	b.SetLockout(Lockout{MaxFailures: 2, LockoutTime: time.Minute, Delay: 20 * time.Millisecond, MaxDelay: 20 * time.Millisecond})
+	remote := &net.TCPAddr{IP: net.ParseIP("10.0.0.1"), Port: 1234}
+
+	connect := func(password string) error {
+		c := packet.NewConnectPacket()
+		c.ClientID = "device"
+		c.Username = "device"
+		c.Password = password
+		c.CleanSession = true
+		s, err := Connect(Pipe(a, b, remote), c, time.Second)
+		if err == nil {
+			s.Close(true)
+		}
+		return err
+	}
+	if err := connect("wrong"); err != ErrRefused {
+		t.Errorf("Expected wrong password to be refused, got %v", err)
+	}
+	// Refused at once, rather than made to wait
+	start := time.Now()
+	if err := connect("secret"); err != ErrRefused || time.Since(start) > 10*time.Millisecond {
+		t.Errorf("Expected attempt too soon after a failure to be refused at once, got %v", err)
+	}
+	time.Sleep(30 * time.Millisecond)
+	if err := connect("secret"); err != nil {
+		t.Errorf("Expected right password to connect after the wait, got %v", err)
+	}
+	connect("wrong")
+	time.Sleep(30 * time.Millisecond)
+	connect("wrong")
+	if err := connect("secret"); err != ErrRefused {
+		t.Errorf("Expected locked out user to be refused, got %v", err)
+	}
+
+	// Refusals are recorded after they are sent
+	time.Sleep(50 * time.Millisecond)
+	sink.Lock()
+	defer sink.Unlock()
+	lockouts, refused, soon := 0, 0, 0
+	for _, e := range sink.events {
+		if e.Action == audit.Lockout && e.Username == "device" {
+			lockouts++
+		}
+		switch e.Reason {
+		case "locked out":
+			refused++
+		case "too soon after failure":
+			soon++
+		}
+	}
+	if lockouts != 1 || refused != 1 || soon != 1 {
+		t.Errorf("Expected lockout to be audited, got %+v", sink.events)
+	}
+}
@@ -0,0 +1,29 @@
+package serve
+
+import (
+	"github.com/trafero/tstack/auth"
+	"net"
+)
+
+// pipeConn is the broker's end of an in-process connection. It reports the
+// address of the gateway's client, rather than the pipe, so that log lines
+// and audit events show where the client really is
+type pipeConn struct {
+	net.Conn
+	remote net.Addr
+}
+
+func (p *pipeConn) RemoteAddr() net.Addr {
+	return p.remote
+}
+
+// Pipe connects an in-process MQTT client, such as a protocol gateway, to
+// the broker. The returned connection speaks MQTT 3.1.1, exactly as a
+// network client would, and remote is the address used for logging and
+// auditing the client.
+func Pipe(a auth.Auth, b *Broker, remote net.Addr) net.Conn {
+	gateway, broker := net.Pipe()
+	c := NewClient(a, b, &pipeConn{Conn: broker, remote: remote})
+	go c.HandleConnection()
+	return gateway
+}
@@ -0,0 +1,196 @@
+package serve
+
+import (
+	"errors"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// RewriteRule maps topics matching Pattern to Target. Each "+" and "#" in
+// the pattern captures the topic level(s) it matches, and $1, $2... in the
+// target are replaced with the captures, in order. e.g. a pattern of
+// "sensors/+/t" with a target of "$1/temperature" rewrites "sensors/ABC/t"
+// to "ABC/temperature".
+type RewriteRule struct {
+	Pattern string
+	Target  string
+	inverse *RewriteRule // Maps rewritten topics back. nil if not reversible
+}
+
+var captureRef = regexp.MustCompile(`\$([0-9]+)`)
+
+// NewRewriteRule checks the pattern and target are valid
+func NewRewriteRule(pattern string, target string) (r *RewriteRule, err error) {
+	if pattern == "" || target == "" {
+		return nil, errors.New("Rewrite pattern and target cannot be empty")
+	}
+	levels := strings.Split(pattern, "/")
+	captures := 0
+	for i, l := range levels {
+		switch {
+		case l == "+":
+			captures++
+		case l == "#" && i == len(levels)-1:
+			captures++
+		case strings.ContainsAny(l, "+#"):
+			return nil, errors.New("Invalid wildcard in rewrite pattern " + pattern)
+		}
+	}
+	for _, ref := range captureRef.FindAllStringSubmatch(target, -1) {
+		if n, _ := strconv.Atoi(ref[1]); n < 1 || n > captures {
+			return nil, errors.New("Rewrite target " + target + " refers to " + ref[0] + " but pattern " + pattern + " only has " + strconv.Itoa(captures) + " captures")
+		}
+	}
+	r = &RewriteRule{Pattern: pattern, Target: target}
+	r.inverse = r.invert()
+	return r, nil
+}
+
+/*
+ * ParseRewriteRules reads rules in the form "pattern=target,pattern=target",
+ * e.g. "sensors/+/t=$1/temperature,legacy/#=$1"
+ */
+func ParseRewriteRules(s string) (rules []*RewriteRule, err error) {
+	if s == "" {
+		return rules, nil
+	}
+	for _, r := range strings.Split(s, ",") {
+		parts := strings.SplitN(r, "=", 2)
+		if len(parts) != 2 {
+			return nil, errors.New("Rewrite rule must be in the form pattern=target: " + r)
+		}
+		rule, err := NewRewriteRule(parts[0], parts[1])
+		if err != nil {
+			return nil, err
+		}
+		rules = append(rules, rule)
+	}
+	return rules, nil
+}
+
+/*
+ * match returns the topic levels captured by each wildcard in the pattern,
+ * if the topic matches
+ */
+func (r *RewriteRule) match(topic string) (captures []string, ok bool) {
+	pattern := strings.Split(r.Pattern, "/")
+	levels := strings.Split(topic, "/")
+
+	// MQTT-4.7.2-1 topics begining with $ should not match on wildcard
+	if strings.HasPrefix(topic, "$") && (pattern[0] == "+" || pattern[0] == "#") {
+		return nil, false
+	}
+
+	for i, p := range pattern {
+		switch {
+		case p == "#":
+			if i >= len(levels) {
+				return nil, false
+			}
+			return append(captures, strings.Join(levels[i:], "/")), true
+		case i >= len(levels):
+			return nil, false
+		case p == "+":
+			captures = append(captures, levels[i])
+		case p != levels[i]:
+			return nil, false
+		}
+	}
+	return captures, len(levels) == len(pattern)
+}
+
+// apply rewrites the topic if it matches the rule's pattern
+func (r *RewriteRule) apply(topic string) (string, bool) {
+	captures, ok := r.match(topic)
+	if !ok {
+		return topic, false
+	}
+	return captureRef.ReplaceAllStringFunc(r.Target, func(ref string) string {
+		n, _ := strconv.Atoi(ref[1:])
+		return captures[n-1]
+	}), true
+}
+
+/*
+ * invert builds the rule that maps rewritten topics back to the original.
+ * This is only possible when every capture is used exactly once in the
+ * target, as a whole topic level, and the target has no other wildcards
+ */
+func (r *RewriteRule) invert() *RewriteRule {
+	var kinds []string // "+" or "#" for each capture in the pattern
+	for _, l := range strings.Split(r.Pattern, "/") {
+		if l == "+" || l == "#" {
+			kinds = append(kinds, l)
+		}
+	}
+
+	target := strings.Split(r.Target, "/")
+	order := make(map[int]int) // Capture number in pattern -> position in target
+	for i, l := range target {
+		if strings.ContainsAny(l, "+#") {
+			return nil
+		}
+		refs := captureRef.FindAllString(l, -1)
+		if len(refs) == 0 {
+			continue
+		}
+		n, _ := strconv.Atoi(l[1:])
+		if len(refs) > 1 || refs[0] != l || order[n] != 0 {
+			return nil
+		}
+		// "#" can only be inverted from the last level
+		if kinds[n-1] == "#" && i != len(target)-1 {
+			return nil
+		}
+		order[n] = len(order) + 1
+		target[i] = kinds[n-1]
+	}
+	if len(order) != len(kinds) {
+		return nil
+	}
+
+	pattern := strings.Split(r.Pattern, "/")
+	n := 0
+	for i, l := range pattern {
+		if l == "+" || l == "#" {
+			n++
+			pattern[i] = "$" + strconv.Itoa(order[n])
+		}
+	}
+	return &RewriteRule{
+		Pattern: strings.Join(target, "/"),
+		Target:  strings.Join(pattern, "/"),
+	}
+}
+
+// SetRewrites sets the topic rewrite rules, in the order they are checked
+func (b *Broker) SetRewrites(rules []*RewriteRule) {
+	b.Lock()
+	b.rewrites = rules
+	b.Unlock()
+}
+
+/*
+ * rewrite applies the first matching rewrite rule to a topic or topic
+ * filter. The $delayed and $scheduled prefixes are kept, with the rules
+ * applied to the rest of the topic
+ */
+func (b *Broker) rewrite(topic string) (string, *RewriteRule) {
+	prefix := ""
+	if strings.HasPrefix(topic, DelayedPrefix) || strings.HasPrefix(topic, ScheduledPrefix) {
+		if parts := strings.SplitN(topic, "/", 3); len(parts) == 3 {
+			prefix = parts[0] + "/" + parts[1] + "/"
+			topic = parts[2]
+		}
+	}
+
+	b.RLock()
+	defer b.RUnlock()
+	for _, r := range b.rewrites {
+		if rewritten, ok := r.apply(topic); ok {
+			return prefix + rewritten, r
+		}
+	}
+	return prefix + topic, nil
+}
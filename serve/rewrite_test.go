@@ -0,0 +1,61 @@
+package serve
+
+import (
+	"testing"
+)
+
+func TestRewriteRule(t *testing.T) {
+	rules, err := ParseRewriteRules("sensors/+/t=$1/temperature,legacy/+/#=$1/$2")
+	if err != nil {
+		t.Fatal("Error parsing rewrite rules", err)
+	}
+	b := &Broker{}
+	b.SetRewrites(rules)
+
+	tests := []struct{ topic, want string }{
+		{"sensors/ABC-123/t", "ABC-123/temperature"},
+		{"legacy/ABC-123/analog/0", "ABC-123/analog/0"},
+		{"sensors/ABC-123/h", "sensors/ABC-123/h"},
+		{"sensors/ABC-123/t/extra", "sensors/ABC-123/t/extra"},
+		{"legacy/ABC-123", "legacy/ABC-123"},
+		{"$delayed/60/sensors/ABC-123/t", "$delayed/60/ABC-123/temperature"},
+		// Subscriptions with wildcards are rewritten level by level
+		{"sensors/+/t", "+/temperature"},
+	}
+	for _, test := range tests {
+		if got, _ := b.rewrite(test.topic); got != test.want {
+			t.Errorf("Expected %s to be rewritten to %s, got %s", test.topic, test.want, got)
+		}
+	}
+
+	// Delivered topics are mapped back for rewritten subscriptions
+	if got, ok := rules[0].inverse.apply("ABC-123/temperature"); !ok || got != "sensors/ABC-123/t" {
+		t.Error("Expected inverse rewrite, got", got)
+	}
+	if got, ok := rules[1].inverse.apply("ABC-123/analog/0"); !ok || got != "legacy/ABC-123/analog/0" {
+		t.Error("Expected inverse rewrite, got", got)
+	}
+}
+
+func TestRewriteRuleInvalid(t *testing.T) {
+	for _, bad := range []string{
+		"sensors/+/t",          // No target
+		"sensors/#/t=$1",       // # not last
+		"sensors/a+/t=$1",      // Partial wildcard
+		"sensors/+/t=$2/t",     // Too few captures
+		"=ABC-123/temperature", // No pattern
+	} {
+		if _, err := ParseRewriteRules(bad); err == nil {
+			t.Error("Expected error parsing rewrite rule", bad)
+		}
+	}
+
+	// Valid, but cannot be mapped back
+	r, err := NewRewriteRule("sensors/+/+", "$1-$2")
+	if err != nil {
+		t.Fatal("Error creating rewrite rule", err)
+	}
+	if r.inverse != nil {
+		t.Error("Expected rule not to be reversible")
+	}
+}
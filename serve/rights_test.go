@@ -0,0 +1,136 @@
+package serve
+
+import (
+	"github.com/gomqtt/packet"
+	"github.com/trafero/tstack/auth"
+	"github.com/trafero/tstack/auth/authtest"
+	"net"
+	"testing"
+	"time"
+)
+
+func gatewayClient(t *testing.T, a *authtest.Auth, b *Broker, username string, password string) *GatewayClient {
+	connect := packet.NewConnectPacket()
+	connect.ClientID = username
+	connect.Username = username
+	connect.Password = password
+	connect.CleanSession = true
+	s, err := Connect(Pipe(a, b, &net.IPAddr{}), connect, time.Second)
+	if err != nil {
+		t.Fatal("Error connecting:", err)
+	}
+	return NewGatewayClient(s)
+}
+
+func TestRightsChanged(t *testing.T) {
+	a := authtest.NewUser("device", "secret", "device/#")
+	a.AddOrUpdateUser("backend", "secret")
+	a.SetRights("backend", "#")
+	b := NewBroker()
+
+	device := gatewayClient(t, a, b, "device", "secret")
+	defer device.Close()
+	backend := gatewayClient(t, a, b, "backend", "secret")
+	defer backend.Close()
+	codes, _, err := device.Subscribe([]packet.Subscription{{Topic: "device/a/#"}, {Topic: "device/b/#"}}, time.Second)
+	if err != nil || len(codes) != 2 || codes[0] != 0 || codes[1] != 0 {
+		t.Fatalf("Expected both subscriptions granted, got %v, %v", codes, err)
+	}
+
+	// Narrowed rights drop the subscription to device/b/#
+	a.SetRights("device", "device/a/#")
+	b.UserChanged("device")
+	backend.Publish(packet.Message{Topic: "device/b/x", QOS: 1}, time.Second)
+	backend.Publish(packet.Message{Topic: "device/a/x", QOS: 1}, time.Second)
+	select {
+	case msg := <-device.Messages:
+		if msg.Topic != "device/a/x" {
+			t.Errorf("Expected only device/a/x to be delivered, got %s", msg.Topic)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Timed out waiting for message")
+	}
+
+	// And the device can no longer publish there
+	if err := device.Publish(packet.Message{Topic: "device/b/x", QOS: 1}, time.Second); err != ErrClosed {
+		t.Errorf("Expected publish without rights to close the connection, got %v", err)
+	}
+}
+
+func TestPasswordChanged(t *testing.T) {
+	a := authtest.NewUser("device", "secret", "device/#")
+	b := NewBroker()
+	b.SetDisconnectChanged(true)
+
+	device := gatewayClient(t, a, b, "device", "secret")
+	defer device.Close()
+
+	// Other users' changes make no difference
+	b.UserChanged("other")
+	b.UserChanged("device")
+	select {
+	case <-device.Done:
+		t.Fatal("Expected client to stay connected while its user is unchanged")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	a.AddOrUpdateUser("device", "changed")
+	b.UserChanged("")
+	select {
+	case <-device.Done:
+	case <-time.After(time.Second):
+		t.Error("Expected client to be disconnected after password change")
+	}
+}
+
+// tokenAuth gives sessions for the password "token", expiring after ttl
+type tokenAuth struct {
+	*authtest.Auth
+	ttl time.Duration
+}
+
+func (a *tokenAuth) AuthenticateSession(username string, password string) (s auth.Session, ok bool) {
+	if password != "token" {
+		return s, false
+	}
+	return auth.Session{Username: "device", Rights: "device/#", Expires: time.Now().Add(a.ttl)}, true
+}
+
+func TestTokenExpiry(t *testing.T) {
+	a := &tokenAuth{Auth: authtest.NewUser("device", "secret", "#"), ttl: 100 * time.Millisecond}
+	b := NewBroker()
+
+	// The username and rights come from the token, not the password
+	if _, err := Connect(Pipe(a, b, &net.IPAddr{}), packet.NewConnectPacket(), time.Second); err == nil {
+		t.Error("Expected connecting without a token to fail")
+	}
+	connect := packet.NewConnectPacket()
+	connect.Password = "token"
+	connect.CleanSession = true
+	s, err := Connect(Pipe(a, b, &net.IPAddr{}), connect, time.Second)
+	if err != nil {
+		t.Fatal("Error connecting:", err)
+	}
+	device := NewGatewayClient(s)
+	defer device.Close()
+	codes, _, err := device.Subscribe([]packet.Subscription{{Topic: "device/#"}}, time.Second)
+	if err != nil || len(codes) != 1 || codes[0] != 0 {
+		t.Fatalf("Expected subscription granted, got %v, %v", codes, err)
+	}
+
+	// Changes to users don't apply, as the rights came with the token
+	b.UserChanged("")
+	b.RLock()
+	for _, c := range b.clients {
+		if c.rights != "device/#" {
+			t.Errorf("Expected rights from the token to be kept, got %q", c.rights)
+		}
+	}
+	b.RUnlock()
+
+	select {
+	case <-device.Done:
+	case <-time.After(time.Second):
+		t.Error("Expected client to be disconnected when its token expired")
+	}
+}
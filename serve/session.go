@@ -0,0 +1,232 @@
+package serve
+
+import (
+	"errors"
+	"github.com/gomqtt/packet"
+	"net"
+	"sync"
+	"time"
+)
+
+var (
+	ErrRefused = errors.New("Connection refused by broker")
+	ErrTimeout = errors.New("Timed out waiting for broker")
+	ErrClosed  = errors.New("Connection to broker closed")
+)
+
+// Session is an MQTT 3.1.1 client session on the broker, made by a gateway
+// on behalf of one of its clients, usually over a connection from Pipe.
+// Writes may be made from any goroutine, but only one may Read.
+type Session struct {
+	conn    net.Conn
+	encoder *packet.Encoder
+	decoder *packet.Decoder
+	mutex   sync.Mutex // Guards writes
+}
+
+/*
+ * Connect sends connect on conn and waits for the broker to accept it.
+ * Returns ErrRefused if the broker refuses the connection, for example
+ * because the credentials are wrong. conn is closed on error.
+ */
+func Connect(conn net.Conn, connect *packet.ConnectPacket, timeout time.Duration) (s *Session, err error) {
+	s = &Session{
+		conn:    conn,
+		encoder: packet.NewEncoder(conn),
+		decoder: packet.NewDecoder(conn),
+	}
+	connect.Version = packet.Version311
+	if err = s.Write(connect); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	conn.SetReadDeadline(time.Now().Add(timeout))
+	pkt, err := s.decoder.Read()
+	conn.SetReadDeadline(time.Time{})
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	if connack, ok := pkt.(*packet.ConnackPacket); !ok || connack.ReturnCode != packet.ConnectionAccepted {
+		conn.Close()
+		return nil, ErrRefused
+	}
+	return s, nil
+}
+
+func (s *Session) Write(p packet.Packet) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if err := s.encoder.Write(p); err != nil {
+		return err
+	}
+	return s.encoder.Flush()
+}
+
+func (s *Session) Read() (packet.Packet, error) {
+	return s.decoder.Read()
+}
+
+// Close ends the session. With disconnect set, the broker is told the
+// client disconnected cleanly, so any will is discarded
+func (s *Session) Close(disconnect bool) {
+	if disconnect {
+		s.Write(packet.NewDisconnectPacket())
+	}
+	s.conn.Close()
+}
+
+// GatewayClient reads from a Session for gateways that only publish and
+// subscribe. Messages from the broker are acknowledged and passed on
+// Messages.
+type GatewayClient struct {
+	*Session
+	Messages chan *packet.Message
+	Done     chan struct{} // Closed when the connection ends
+
+	mutex    sync.Mutex
+	packetID uint16
+	pubacks  map[uint16]chan struct{}
+	suback   chan []byte
+	quit     chan struct{} // Closed by Close
+}
+
+func NewGatewayClient(s *Session) *GatewayClient {
+	c := &GatewayClient{
+		Session:  s,
+		Messages: make(chan *packet.Message),
+		Done:     make(chan struct{}),
+		pubacks:  make(map[uint16]chan struct{}),
+		suback:   make(chan []byte, 1),
+		quit:     make(chan struct{}),
+	}
+	go c.read()
+	return c
+}
+
+func (c *GatewayClient) nextPacketID() uint16 {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.packetID++
+	if c.packetID == 0 {
+		c.packetID++
+	}
+	return c.packetID
+}
+
+/*
+ * Publish sends a message. At QoS 1 it waits for the broker to acknowledge
+ * it. The broker closes the connection instead if the user does not have
+ * rights to the topic, so ErrClosed is returned. QoS 2 is not supported
+ */
+func (c *GatewayClient) Publish(msg packet.Message, timeout time.Duration) error {
+	p := packet.NewPublishPacket()
+	p.Message = msg
+	if msg.QOS == packet.QOSAtMostOnce {
+		return c.Write(p)
+	}
+	p.Message.QOS = packet.QOSAtLeastOnce
+	p.PacketID = c.nextPacketID()
+	ack := make(chan struct{})
+	c.mutex.Lock()
+	c.pubacks[p.PacketID] = ack
+	c.mutex.Unlock()
+	defer func() {
+		c.mutex.Lock()
+		delete(c.pubacks, p.PacketID)
+		c.mutex.Unlock()
+	}()
+
+	if err := c.Write(p); err != nil {
+		return err
+	}
+	select {
+	case <-ack:
+		return nil
+	case <-c.Done:
+		return ErrClosed
+	case <-time.After(timeout):
+		return ErrTimeout
+	}
+}
+
+/*
+ * Subscribe subscribes to filters, returning the SUBACK return codes and
+ * any messages that arrive before the SUBACK (i.e. retained messages).
+ * Only one Subscribe may be in progress at once
+ */
+func (c *GatewayClient) Subscribe(subscriptions []packet.Subscription, timeout time.Duration) (codes []byte, pending []*packet.Message, err error) {
+	p := packet.NewSubscribePacket()
+	p.PacketID = c.nextPacketID()
+	p.Subscriptions = subscriptions
+	if err := c.Write(p); err != nil {
+		return nil, nil, err
+	}
+	expired := time.After(timeout)
+	for {
+		select {
+		case msg := <-c.Messages:
+			pending = append(pending, msg)
+		case codes = <-c.suback:
+			return codes, pending, nil
+		case <-c.Done:
+			return nil, nil, ErrClosed
+		case <-expired:
+			return nil, nil, ErrTimeout
+		}
+	}
+}
+
+// read handles packets from the broker, acknowledging messages
+func (c *GatewayClient) read() {
+	defer close(c.Done)
+	for {
+		pkt, err := c.Read()
+		if err != nil {
+			return
+		}
+		switch pkt := pkt.(type) {
+		case *packet.PubackPacket:
+			c.mutex.Lock()
+			if ack, ok := c.pubacks[pkt.PacketID]; ok {
+				close(ack)
+				delete(c.pubacks, pkt.PacketID)
+			}
+			c.mutex.Unlock()
+		case *packet.SubackPacket:
+			select {
+			case c.suback <- pkt.ReturnCodes:
+			default:
+			}
+		case *packet.PublishPacket:
+			switch pkt.Message.QOS {
+			case packet.QOSAtLeastOnce:
+				c.Write(&packet.PubackPacket{PacketID: pkt.PacketID})
+			case packet.QOSExactlyOnce:
+				c.Write(&packet.PubrecPacket{PacketID: pkt.PacketID})
+			}
+			msg := pkt.Message
+			select {
+			case c.Messages <- &msg:
+			case <-c.quit:
+				return
+			}
+		case *packet.PubrelPacket:
+			c.Write(&packet.PubcompPacket{PacketID: pkt.PacketID})
+		}
+	}
+}
+
+// Close disconnects from the broker. It is safe to call more than once
+func (c *GatewayClient) Close() {
+	c.mutex.Lock()
+	select {
+	case <-c.quit:
+		c.mutex.Unlock()
+		return
+	default:
+		close(c.quit)
+	}
+	c.mutex.Unlock()
+	c.Session.Close(true)
+}
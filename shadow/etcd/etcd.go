@@ -0,0 +1,80 @@
+package etcd
+
+import (
+	"encoding/json"
+	"github.com/coreos/etcd/client"
+	"github.com/trafero/tstack/shadow"
+	"golang.org/x/net/context"
+	"time"
+)
+
+// Shadow documents are kept under /shadow/<id>
+const prefix = "/shadow/"
+
+// Etcd stores shadow documents in etcd
+type Etcd struct {
+	etcdApi client.KeysAPI
+}
+
+// New returns a store using the given etcd endpoints
+func New(endpoints []string) (s *Etcd, err error) {
+	c, err := client.New(client.Config{
+		Endpoints:               endpoints,
+		Transport:               client.DefaultTransport,
+		HeaderTimeoutPerRequest: time.Second,
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &Etcd{etcdApi: client.NewKeysAPI(c)}, nil
+}
+
+// Get returns a device's document, or nil if it has none
+func (s *Etcd) Get(id string) (doc *shadow.Document, err error) {
+	doc, _, err = s.get(id)
+	return doc, err
+}
+
+// get returns a device's document and its JSON, as saved
+func (s *Etcd) get(id string) (doc *shadow.Document, value string, err error) {
+	resp, err := s.etcdApi.Get(context.Background(), prefix+id, nil)
+	if client.IsKeyNotFound(err) {
+		return nil, "", nil
+	} else if err != nil {
+		return nil, "", err
+	}
+	doc = &shadow.Document{}
+	if err := json.Unmarshal([]byte(resp.Node.Value), doc); err != nil {
+		return nil, "", err
+	}
+	return doc, resp.Node.Value, nil
+}
+
+/*
+ * Put saves a device's document, returning shadow.ErrConflict unless the
+ * saved document is at the version before doc's. The document is only
+ * replaced if unchanged since it was checked, so that concurrent updates
+ * from more than one service are not lost
+ */
+func (s *Etcd) Put(id string, doc *shadow.Document) error {
+	value, err := json.Marshal(doc)
+	if err != nil {
+		return err
+	}
+	opts := &client.SetOptions{PrevExist: client.PrevNoExist}
+	if doc.Version > 1 {
+		saved, prevValue, err := s.get(id)
+		if err != nil {
+			return err
+		}
+		if saved == nil || saved.Version != doc.Version-1 {
+			return shadow.ErrConflict
+		}
+		opts = &client.SetOptions{PrevValue: prevValue}
+	}
+	_, err = s.etcdApi.Set(context.Background(), prefix+id, string(value), opts)
+	if e, ok := err.(client.Error); ok && (e.Code == client.ErrorCodeTestFailed || e.Code == client.ErrorCodeNodeExist) {
+		return shadow.ErrConflict
+	}
+	return err
+}
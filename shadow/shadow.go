@@ -0,0 +1,314 @@
+/*
+ * Package shadow keeps a JSON document for each device, holding the state
+ * the device last reported and the state it is desired to be in, so that
+ * back ends can change a device's state while it is offline, and devices
+ * can catch up when they connect.
+ *
+ * Devices (or back ends) publish partial updates to <id>/shadow/update:
+ *
+ *   {"state": {"reported": {"valve": "closed"}}}
+ *   {"state": {"desired": {"valve": "open"}}, "version": 7}
+ *
+ * Updates are merged into the document. A null value removes a key, and a
+ * null "desired" or "reported" removes all of it. If "version" is given,
+ * the update is only applied if it is the document's current version. The
+ * difference between desired and reported state is published to
+ * <id>/shadow/delta after each update that leaves one, and the document,
+ * with its delta, is sent in answer to requests (see client/mqtt Request)
+ * to <id>/shadow/get. Updates can also be sent as requests to
+ * <id>/shadow/update, to be answered with the new document.
+ */
+package shadow
+
+import (
+	"encoding/json"
+	"errors"
+	"github.com/trafero/tstack/client/mqtt"
+	"github.com/trafero/tstack/logging"
+	"reflect"
+	"strings"
+	"time"
+)
+
+var logger = logging.New("shadow")
+
+// Levels after the device ID in shadow topics
+const (
+	UpdateTopic = "shadow/update"
+	DeltaTopic  = "shadow/delta"
+	GetTopic    = "shadow/get"
+)
+
+var (
+	ErrConflict        = errors.New("Shadow changed while being updated")
+	ErrVersionMismatch = errors.New("Version does not match the shadow's current version")
+	ErrBadUpdate       = errors.New("Update must be a JSON object with a state of reported and/or desired objects")
+)
+
+// Times to try an update again after ErrConflict
+const conflictRetries = 5
+
+// Document is a device's shadow
+type Document struct {
+	State     State    `json:"state"`
+	Metadata  Metadata `json:"metadata"`
+	Version   int      `json:"version"`   // Incremented by each update
+	Timestamp int64    `json:"timestamp"` // Unix time of the last update
+}
+
+type State struct {
+	Reported map[string]interface{} `json:"reported,omitempty"`
+	Desired  map[string]interface{} `json:"desired,omitempty"`
+	Delta    map[string]interface{} `json:"delta,omitempty"` // Only in answers to get
+}
+
+// Metadata mirrors State, with {"timestamp": <unix time>} in place of each
+// value, giving when it was last updated
+type Metadata struct {
+	Reported map[string]interface{} `json:"reported,omitempty"`
+	Desired  map[string]interface{} `json:"desired,omitempty"`
+}
+
+// update is a message published to <id>/shadow/update
+type update struct {
+	State   map[string]json.RawMessage `json:"state"`
+	Version int                        `json:"version"` // Optional
+}
+
+// Store saves shadow documents
+type Store interface {
+	// Get returns a device's document, or nil if it has none
+	Get(id string) (doc *Document, err error)
+
+	// Put saves a device's document. It returns ErrConflict unless the
+	// saved document is at the version before doc's, or doc is at version 1
+	// and there is no saved document
+	Put(id string, doc *Document) error
+}
+
+// Service answers shadow updates and gets for all devices
+type Service struct {
+	client *mqtt.MQTT
+	store  Store
+}
+
+// New returns a shadow service using the given client, which needs rights
+// to publish and subscribe to the shadow topics of all devices
+func New(client *mqtt.MQTT, store Store) *Service {
+	return &Service{client: client, store: store}
+}
+
+// Start subscribes to the shadow topics of all devices
+func (s *Service) Start() error {
+	err := s.client.SubscribeFunc("+/"+UpdateTopic, 1, s.updateHandler)
+	if err != nil {
+		return err
+	}
+	err = s.client.HandleRequests("+/"+UpdateTopic, func(req mqtt.Message) (string, error) {
+		doc, err := s.Update(deviceID(req.Topic), req.Payload)
+		if err != nil {
+			return "", err
+		}
+		return encode(doc)
+	})
+	if err != nil {
+		return err
+	}
+	return s.client.HandleRequests("+/"+GetTopic, func(req mqtt.Message) (string, error) {
+		doc, err := s.Get(deviceID(req.Topic))
+		if err != nil {
+			return "", err
+		}
+		return encode(doc)
+	})
+}
+
+func (s *Service) updateHandler(msg mqtt.Message) {
+	id := deviceID(msg.Topic)
+	if _, err := s.Update(id, msg.Payload); err != nil {
+		logger.Warn("Could not update shadow", "id", id, "error", err)
+	}
+}
+
+/*
+ * Get returns a device's document, with its delta. Devices without a
+ * document get an empty one, at version 0
+ */
+func (s *Service) Get(id string) (doc *Document, err error) {
+	doc, err = s.store.Get(id)
+	if err != nil {
+		return nil, err
+	}
+	if doc == nil {
+		doc = &Document{}
+	}
+	doc.State.Delta = Delta(doc.State.Desired, doc.State.Reported)
+	return doc, nil
+}
+
+/*
+ * Update merges an update into a device's document, saving it and
+ * publishing the delta if there is one. Returns the new document, with its
+ * delta
+ */
+func (s *Service) Update(id string, payload []byte) (doc *Document, err error) {
+	var u update
+	if err := json.Unmarshal(payload, &u); err != nil || u.State == nil {
+		return nil, ErrBadUpdate
+	}
+	for attempt := 0; ; attempt++ {
+		doc, err = s.update(id, &u, time.Now())
+		if err != ErrConflict || attempt == conflictRetries {
+			break
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+	logger.Debug("Shadow updated", "id", id, "version", doc.Version)
+
+	doc.State.Delta = Delta(doc.State.Desired, doc.State.Reported)
+	if len(doc.State.Delta) > 0 {
+		// Not waited for, as updates come from message handlers, which
+		// can't wait for the broker to acknowledge a publish
+		go s.publishDelta(id, doc)
+	}
+	return doc, nil
+}
+
+func (s *Service) update(id string, u *update, now time.Time) (doc *Document, err error) {
+	doc, err = s.store.Get(id)
+	if err != nil {
+		return nil, err
+	}
+	if doc == nil {
+		doc = &Document{}
+	}
+	if u.Version != 0 && u.Version != doc.Version {
+		return nil, ErrVersionMismatch
+	}
+	for key, raw := range u.State {
+		var state, metadata *map[string]interface{}
+		switch key {
+		case "reported":
+			state, metadata = &doc.State.Reported, &doc.Metadata.Reported
+		case "desired":
+			state, metadata = &doc.State.Desired, &doc.Metadata.Desired
+		default:
+			return nil, ErrBadUpdate
+		}
+		var values map[string]interface{}
+		if err := json.Unmarshal(raw, &values); err != nil {
+			return nil, ErrBadUpdate
+		}
+		if values == nil {
+			// null removes everything
+			*state, *metadata = nil, nil
+			continue
+		}
+		if *state == nil {
+			*state = make(map[string]interface{})
+		}
+		if *metadata == nil {
+			*metadata = make(map[string]interface{})
+		}
+		merge(*state, *metadata, values, now.Unix())
+	}
+	doc.State.Delta = nil
+	doc.Version++
+	doc.Timestamp = now.Unix()
+	if err := s.store.Put(id, doc); err != nil {
+		return nil, err
+	}
+	return doc, nil
+}
+
+func (s *Service) publishDelta(id string, doc *Document) {
+	payload, err := json.Marshal(struct {
+		State     map[string]interface{} `json:"state"`
+		Version   int                    `json:"version"`
+		Timestamp int64                  `json:"timestamp"`
+	}{doc.State.Delta, doc.Version, doc.Timestamp})
+	if err != nil {
+		logger.Error("Could not encode shadow delta", "id", id, "error", err)
+		return
+	}
+	if err := s.client.PublishBytes(id+"/"+DeltaTopic, payload, 1, false); err != nil {
+		logger.Error("Could not publish shadow delta", "id", id, "error", err)
+	}
+}
+
+/*
+ * merge sets each value in update in state, recording when in metadata.
+ * Objects are merged key by key, null values remove keys, and anything else
+ * (including arrays) replaces the existing value
+ */
+func merge(state map[string]interface{}, metadata map[string]interface{}, update map[string]interface{}, now int64) {
+	for key, value := range update {
+		if value == nil {
+			delete(state, key)
+			delete(metadata, key)
+			continue
+		}
+		values, isObject := value.(map[string]interface{})
+		existing, wasObject := state[key].(map[string]interface{})
+		if isObject && wasObject {
+			m, ok := metadata[key].(map[string]interface{})
+			if !ok {
+				m = make(map[string]interface{})
+				metadata[key] = m
+			}
+			merge(existing, m, values, now)
+			continue
+		}
+		if isObject {
+			// Nulls have nothing to remove in a new object
+			existing = make(map[string]interface{})
+			m := make(map[string]interface{})
+			merge(existing, m, values, now)
+			state[key], metadata[key] = existing, m
+			continue
+		}
+		state[key] = value
+		metadata[key] = map[string]interface{}{"timestamp": now}
+	}
+}
+
+/*
+ * Delta returns the desired values that differ from the reported ones,
+ * comparing objects key by key. Returns nil if there are none
+ */
+func Delta(desired map[string]interface{}, reported map[string]interface{}) map[string]interface{} {
+	var delta map[string]interface{}
+	for key, want := range desired {
+		got, ok := reported[key]
+		wantObject, isObject := want.(map[string]interface{})
+		gotObject, wasObject := got.(map[string]interface{})
+		var diff interface{}
+		switch {
+		case isObject && wasObject:
+			if d := Delta(wantObject, gotObject); d != nil {
+				diff = d
+			}
+		case !ok || !reflect.DeepEqual(want, got):
+			diff = want
+		}
+		if diff != nil {
+			if delta == nil {
+				delta = make(map[string]interface{})
+			}
+			delta[key] = diff
+		}
+	}
+	return delta
+}
+
+// deviceID returns the device ID at the start of a shadow topic
+func deviceID(topic string) string {
+	return strings.SplitN(topic, "/", 2)[0]
+}
+
+func encode(doc *Document) (string, error) {
+	data, err := json.Marshal(doc)
+	return string(data), err
+}
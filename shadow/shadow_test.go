@@ -0,0 +1,219 @@
+package shadow
+
+import (
+	"context"
+	"encoding/json"
+	"github.com/trafero/tstack/auth/authtest"
+	"github.com/trafero/tstack/client/mqtt"
+	"github.com/trafero/tstack/client/settings"
+	"github.com/trafero/tstack/serve"
+	"net"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+)
+
+// memStore keeps documents in memory, as JSON so that callers can't change
+// them once saved
+type memStore struct {
+	mutex sync.Mutex
+	docs  map[string][]byte
+}
+
+func (s *memStore) Get(id string) (doc *Document, err error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	data, ok := s.docs[id]
+	if !ok {
+		return nil, nil
+	}
+	doc = &Document{}
+	err = json.Unmarshal(data, doc)
+	return doc, err
+}
+
+func (s *memStore) Put(id string, doc *Document) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	version := 0
+	if data, ok := s.docs[id]; ok {
+		var saved Document
+		json.Unmarshal(data, &saved)
+		version = saved.Version
+	}
+	if version != doc.Version-1 {
+		return ErrConflict
+	}
+	data, err := json.Marshal(doc)
+	s.docs[id] = data
+	return err
+}
+
+func decode(t *testing.T, s string) map[string]interface{} {
+	var m map[string]interface{}
+	if err := json.Unmarshal([]byte(s), &m); err != nil {
+		t.Fatal("Error decoding", s, err)
+	}
+	return m
+}
+
+func TestMerge(t *testing.T) {
+	state := decode(t, `{"a": 1, "b": {"c": 2, "d": 3}, "e": [1, 2], "f": "x"}`)
+	metadata := make(map[string]interface{})
+	merge(state, metadata, decode(t, `{"a": null, "b": {"c": 4}, "e": [3], "g": {"h": null, "i": true}}`), 100)
+
+	want := decode(t, `{"b": {"c": 4, "d": 3}, "e": [3], "f": "x", "g": {"i": true}}`)
+	if !reflect.DeepEqual(state, want) {
+		t.Errorf("Expected state %v, got %v", want, state)
+	}
+	stamp := map[string]interface{}{"timestamp": int64(100)}
+	wantMetadata := map[string]interface{}{
+		"b": map[string]interface{}{"c": stamp},
+		"e": stamp,
+		"g": map[string]interface{}{"i": stamp},
+	}
+	if !reflect.DeepEqual(metadata, wantMetadata) {
+		t.Errorf("Expected metadata %v, got %v", wantMetadata, metadata)
+	}
+}
+
+func TestDelta(t *testing.T) {
+	tests := []struct {
+		desired  string
+		reported string
+		delta    string
+	}{
+		{`{"a": 1}`, `{"a": 1}`, `null`},
+		{`{"a": 1}`, `{"a": 2, "b": 3}`, `{"a": 1}`},
+		{`{"a": 1}`, `{}`, `{"a": 1}`},
+		{`{"a": {"b": 1, "c": 2}}`, `{"a": {"b": 1, "c": 3}}`, `{"a": {"c": 2}}`},
+		{`{"a": {"b": 1}}`, `{"a": 1}`, `{"a": {"b": 1}}`},
+		{`{"a": [1, 2]}`, `{"a": [1, 2]}`, `null`},
+		{`{}`, `{"a": 1}`, `null`},
+	}
+	for _, test := range tests {
+		delta := Delta(decode(t, test.desired), decode(t, test.reported))
+		var want map[string]interface{}
+		json.Unmarshal([]byte(test.delta), &want)
+		if !reflect.DeepEqual(delta, want) {
+			t.Errorf("Desired %s, reported %s: expected delta %v, got %v", test.desired, test.reported, want, delta)
+		}
+	}
+}
+
+func client(t *testing.T, broker string, username string) *mqtt.MQTT {
+	m, err := mqtt.NewInsecure(&settings.Settings{Username: username, Password: "secret", Broker: broker, QoS: 1})
+	if err != nil {
+		t.Fatal("Error initiating mqtt client", err)
+	}
+	return m
+}
+
+// listen sets up a broker on a local port, with users "device" (rights to
+// its own topics), "backend" (rights to all) and "shadow", returning its URL
+func listen(t *testing.T) string {
+	a := authtest.NewUser("device", "secret", "device/#")
+	a.AddOrUpdateUser("backend", "secret")
+	a.SetRights("backend", "#")
+	a.AddOrUpdateUser("shadow", "secret")
+	a.SetRights("shadow", "+/shadow/#")
+	b := serve.NewBroker()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal("Error setting up listener:", err)
+	}
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go serve.NewClient(a, b, c).HandleConnection()
+		}
+	}()
+	return "tcp://" + l.Addr().String()
+}
+
+func TestService(t *testing.T) {
+	broker := listen(t)
+	store := &memStore{docs: make(map[string][]byte)}
+	if err := New(client(t, broker, "shadow"), store).Start(); err != nil {
+		t.Fatal("Error starting shadow service:", err)
+	}
+	device := client(t, broker, "device")
+	backend := client(t, broker, "backend")
+
+	deltas := make(chan map[string]interface{}, 10)
+	if err := device.HandleDelta(func(delta map[string]interface{}, version int) { deltas <- delta }); err != nil {
+		t.Fatal("Error handling deltas:", err)
+	}
+	expect := func(want string) {
+		select {
+		case got := <-deltas:
+			if !reflect.DeepEqual(got, decode(t, want)) {
+				t.Errorf("Expected delta %s, got %v", want, got)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("Timed out waiting for delta %s", want)
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	if err := device.ReportState(decode(t, `{"valve": "closed", "temperature": 21.5}`)); err != nil {
+		t.Fatal("Error reporting state:", err)
+	}
+	if err := backend.SetDesiredState("device", decode(t, `{"valve": "open"}`)); err != nil {
+		t.Fatal("Error setting desired state:", err)
+	}
+	expect(`{"valve": "open"}`)
+
+	// The device catches up, leaving no delta
+	device.ReportState(decode(t, `{"valve": "open"}`))
+	for {
+		s, err := backend.GetShadow(ctx, "device")
+		if err != nil {
+			t.Fatal("Error getting shadow:", err)
+		}
+		if s.Version == 3 {
+			if s.Delta != nil {
+				t.Errorf("Expected no delta, got %v", s.Delta)
+			}
+			want := decode(t, `{"valve": "open", "temperature": 21.5}`)
+			if !reflect.DeepEqual(s.Reported, want) {
+				t.Errorf("Expected reported %v, got %v", want, s.Reported)
+			}
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// Devices can't see or change other devices' shadows
+	refusedCtx, cancelRefused := context.WithTimeout(context.Background(), time.Second)
+	defer cancelRefused()
+	if _, err := device.GetShadow(refusedCtx, "other"); err == nil {
+		t.Error("Expected device to be refused another device's shadow")
+	}
+}
+
+func TestUpdateVersion(t *testing.T) {
+	s := &Service{store: &memStore{docs: make(map[string][]byte)}}
+	doc, err := s.Update("device", []byte(`{"state": {"reported": {"a": 1}}}`))
+	if err != nil || doc.Version != 1 {
+		t.Fatalf("Expected version 1, got %v, %v", doc, err)
+	}
+	if _, err := s.Update("device", []byte(`{"state": {"reported": {"a": 2}}, "version": 3}`)); err != ErrVersionMismatch {
+		t.Errorf("Expected version mismatch, got %v", err)
+	}
+	doc, err = s.Update("device", []byte(`{"state": {"reported": null}, "version": 1}`))
+	if err != nil || doc.Version != 2 || doc.State.Reported != nil {
+		t.Errorf("Expected reported state removed at version 2, got %v, %v", doc, err)
+	}
+	for _, bad := range []string{`x`, `{}`, `{"state": {"other": {}}}`, `{"state": {"reported": 1}}`} {
+		if _, err := s.Update("device", []byte(bad)); err != ErrBadUpdate {
+			t.Errorf("Expected bad update for %s, got %v", bad, err)
+		}
+	}
+}
@@ -3,16 +3,18 @@ package tls
 import (
 	"crypto/tls"
 	"crypto/x509"
+	"github.com/trafero/tstack/logging"
 	"io/ioutil"
-	"log"
 )
 
+var logger = logging.New("tls")
+
 func TLSClientConfig(cacrt string) (*tls.Config, error) {
 	// Import trusted certificates from CAfile.pem.
 	// Alternatively, manually add CA certificates to
 	// default openssl CA bundle.
 	certpool := x509.NewCertPool()
-	log.Printf("Using certificate %s\n", cacrt)
+	logger.Info("Using certificate", "file", cacrt)
 	certbytes, err := ioutil.ReadFile(cacrt)
 	if err != nil {
 		return nil, err
@@ -46,7 +48,7 @@ func TLSConfig(cacrt string, clientcrt string, clientkey string) (*tls.Config, e
 	// Alternatively, manually add CA certificates to
 	// default openssl CA bundle.
 	certpool := x509.NewCertPool()
-	log.Printf("Using certificate %s\n", cacrt)
+	logger.Info("Using certificate", "file", cacrt)
 	certbytes, err := ioutil.ReadFile(cacrt)
 	if err != nil {
 		return nil, err
@@ -1,8 +1,7 @@
 package tstackutil
 
 import (
-	"errors"
-	"log"
+	"github.com/trafero/tstack/logging"
 	"net"
 	"net/url"
 	"os"
@@ -10,6 +9,8 @@ import (
 	"time"
 )
 
+var logger = logging.New("tstackutil")
+
 var defaultports = map[string]int{
 	"http":  80,
 	"https": 443,
@@ -20,29 +21,29 @@ var defaultports = map[string]int{
 // This is especially useful for situations where the start order of various
 // services cannot be easily determined (such as docker-compose)
 func WaitForFile(filename string) {
-	log.Printf("Waiting for file (%s) to exist", filename)
+	logger.Info("Waiting for file to exist", "file", filename)
 	for {
 		_, err := os.Stat(filename)
 		if err == nil {
-			log.Printf("%s exists", filename)
+			logger.Info("File exists", "file", filename)
 			break
 		}
-		log.Println(err)
+		logger.Debug("File not available", "error", err)
 		time.Sleep(1000 * time.Millisecond)
 	}
 }
 
 // WaitForTcp waits for a TCP port to be available before coninuing
 func WaitForTcp(hostname string, port int) {
-	log.Printf("Waiting for service (%s:%d) to be available.", hostname, port)
+	logger.Info("Waiting for service to be available", "host", hostname, "port", port)
 	for {
 		conn, err := net.Dial("tcp", hostname+":"+strconv.Itoa(port))
 		if err == nil {
 			conn.Close()
-			log.Printf("%s:%d is ready", hostname, port)
+			logger.Info("Service is ready", "host", hostname, "port", port)
 			break
 		}
-		log.Println(err)
+		logger.Debug("Service not available", "error", err)
 		time.Sleep(1000 * time.Millisecond)
 	}
 }
@@ -54,7 +55,7 @@ func WaitForUrl(urlstring string) {
 
 	u, err := url.Parse(urlstring)
 	if err != nil {
-		log.Fatal(err)
+		logger.Fatal(err.Error())
 	}
 
 	// Requires go >= 1.8
@@ -67,11 +68,11 @@ func WaitForUrl(urlstring string) {
 	} else {
 		port, err = strconv.Atoi(portstring)
 		if err != nil {
-			log.Fatal(err)
+			logger.Fatal(err.Error())
 		}
 	}
 	if port == 0 {
-		log.Fatal(errors.New("Port not known for URL " + urlstring))
+		logger.Fatal("Port not known for URL", "url", urlstring)
 	}
 
 	WaitForTcp(host, port)